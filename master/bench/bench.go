@@ -0,0 +1,184 @@
+// Package bench benchmarks a master rendering a fixed camera path through a scene, and reports the results in a machine-readable form.
+package bench
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"encoding/json"
+	"sync"
+	"time"
+	"math"
+	"io"
+)
+
+// Config controls a benchmark.
+type Config struct {
+	Frames uint				// The number of frames rendered along the camera path.
+	MinWorkers uint			// The number of workers which must join before the benchmark starts.
+	WorkerWait uint			// How long (in milliseconds) to wait for workers to join.
+	Engine engine.Options	// The options of the benchmarked engine (its canvas is replaced by the benchmark's).
+}
+
+// Stages holds the mean time (in milliseconds) each stage of rendering took per frame.
+type Stages struct {
+	Encode float64	`json:"encodeMs"`
+	Assign float64	`json:"assignMs"`
+	Queue float64	`json:"queueMs"`
+	Trace float64	`json:"traceMs"`
+	Draw float64	`json:"drawMs"`
+	Total float64	`json:"totalMs"`
+}
+
+// Worker summarizes the work done by a single worker during a benchmark.
+type Worker struct {
+	Address string			`json:"address"`
+	Tasks uint				`json:"tasks"`
+	SuccessRate float64		`json:"successRate"`
+	Disagreements uint		`json:"disagreements"`
+	Pixels uint64			`json:"pixels"`
+	RaysPerSecond float64	`json:"raysPerSecond"`
+	MeanLatency float64		`json:"meanLatencyMs"`
+	P95Latency float64		`json:"p95LatencyMs"`
+	BytesSent uint64		`json:"bytesSent"`
+	BytesReceived uint64	`json:"bytesReceived"`
+}
+
+// Report summarizes the outcome of a benchmark.
+// Rays are counted as primary rays, one for each sample of each pixel traced.
+type Report struct {
+	Width uint				`json:"width"`
+	Height uint				`json:"height"`
+	Samples uint			`json:"samplesPerPixel"`
+	Frames uint				`json:"frames"`
+	FramesSkipped uint		`json:"framesSkipped"`
+	Seconds float64			`json:"seconds"`
+	FramesPerSecond float64	`json:"framesPerSecond"`
+	Pixels uint64			`json:"pixels"`
+	RaysPerSecond float64	`json:"raysPerSecond"`
+	MeanStages Stages		`json:"meanStages"`
+	Workers []Worker		`json:"workers"`
+}
+
+// WriteJSON writes a report to w in the JSON format.
+func (r Report) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// milliseconds converts a duration to a (fractional) number of milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Run benchmarks an engine rendering a scene.
+// The camera path starts at the scene's camera, and turns one full circle over the course of the benchmark.
+func Run(scene state.Environment, cfg Config) (Report, error) {
+	// Collect the statistics of every frame.
+	var mu sync.Mutex
+	var frames []engine.FrameStats
+	opts := cfg.Engine
+	opts.Canvas = engine.NullCanvas{}
+	opts.FrameDone = func(stats engine.FrameStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		
+		frames = append(frames, stats)
+	}
+	
+	// Set up the engine.
+	eng, err := engine.New(scene, opts)
+	if err != nil {
+		return Report{}, err
+	}
+	defer eng.Close()
+	
+	// Wait for enough workers to join.
+	if err := eng.WaitForWorkers(cfg.MinWorkers, cfg.WorkerWait); err != nil {
+		return Report{}, err
+	}
+	
+	// Render the frames along the camera path.
+	cam := scene.Mutable().Cam
+	start := time.Now()
+	for f := uint(0); f < cfg.Frames; f++ {
+		if err := eng.RenderFrame(cam); err != nil {
+			return Report{}, err
+		}
+		cam.Yaw(2.0 * math.Pi / float64(cfg.Frames))
+	}
+	eng.Wait()
+	duration := time.Since(start)
+	
+	// Summarize the frames.
+	mu.Lock()
+	defer mu.Unlock()
+	
+	// Each pixel is traced with the engine's samples, or else the scene's (or one).
+	samples := state.Limits{Samples: opts.Samples}.Or(scene.Limits()).Samples
+	if samples == 0 {
+		samples = 1
+	}
+	
+	report := Report{
+		Width: opts.Width,
+		Height: opts.Height,
+		Samples: samples,
+		Frames: uint(len(frames)),
+		Seconds: duration.Seconds(),
+	}
+	var stages engine.FrameStats
+	for _, stats := range frames {
+		if stats.Skipped {
+			report.FramesSkipped += 1
+		}
+		report.Pixels += stats.Pixels
+		
+		stages.Encode += stats.Encode
+		stages.Assign += stats.Assign
+		stages.Queue += stats.Queue
+		stages.Trace += stats.Trace
+		stages.Draw += stats.Draw
+		stages.Total += stats.Total
+	}
+	if len(frames) > 0 {
+		n := time.Duration(len(frames))
+		report.MeanStages = Stages{
+			Encode: milliseconds(stages.Encode / n),
+			Assign: milliseconds(stages.Assign / n),
+			Queue: milliseconds(stages.Queue / n),
+			Trace: milliseconds(stages.Trace / n),
+			Draw: milliseconds(stages.Draw / n),
+			Total: milliseconds(stages.Total / n),
+		}
+	}
+	if report.Seconds > 0 {
+		report.FramesPerSecond = float64(report.Frames - report.FramesSkipped) / report.Seconds
+		report.RaysPerSecond = float64(report.Pixels * uint64(samples)) / report.Seconds
+	}
+	
+	// Summarize the workers.
+	for _, ws := range eng.WorkerStats() {
+		w := Worker{
+			Address: ws.Address,
+			Tasks: ws.Succeeded,
+			SuccessRate: ws.SuccessRate,
+			Disagreements: ws.Disagreements,
+			Pixels: ws.Pixels,
+			MeanLatency: milliseconds(ws.MeanLatency),
+			P95Latency: milliseconds(ws.P95Latency),
+			BytesSent: ws.BytesSent,
+			BytesReceived: ws.BytesReceived,
+		}
+		if report.Seconds > 0 {
+			w.RaysPerSecond = float64(ws.Pixels * uint64(samples)) / report.Seconds
+		}
+		report.Workers = append(report.Workers, w)
+	}
+	
+	return report, nil
+}
\ No newline at end of file
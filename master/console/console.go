@@ -0,0 +1,360 @@
+// Package console provides a command line for a running master, so that it can be tweaked without restarting it.
+package console
+
+import (
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"github.com/mwindels/distributed-raytracer/master/output"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"encoding/json"
+	"path/filepath"
+	"text/tabwriter"
+	"strconv"
+	"strings"
+	"bufio"
+	"time"
+	"net"
+	"fmt"
+	"io"
+)
+
+// Prompt is written before each command read by a console.
+const Prompt string = "> "
+
+// command is something a console can be told to do.
+type command struct {
+	name string		// The words which start the command.
+	args string		// How the command's arguments are written (optional arguments in square brackets).
+	help string		// What the command does.
+	redraw bool		// Whether the current frame must be drawn again once the command has been carried out.
+	run func(c *Console, args []string, out io.Writer) error
+}
+
+// commands are the commands a console understands, besides "help".
+var commands []command = []command{
+	{name: "list workers", help: "lists the workers in the pool, along with how they have performed", run: listWorkers},
+	{name: "show camera", help: "shows the camera in the form bookmarks are stored in", run: showCamera},
+	{name: "set redundancy", args: "<workers>", help: "sets the number of workers assigned to each partition of each frame", run: setRedundancy},
+	{name: "set time", args: "<hour>", help: "moves the scene's sun to where it is at some hour (from 0 to 24)", redraw: true, run: setTime},
+	{name: "set passes", args: "<passes>", help: "sets the passes combined to draw each frame, and their weights (e.g. \"diffuse=1,occlusion=0.5\")", redraw: true, run: setPasses},
+	{name: "switch light", args: "<number> <on|off>", help: "switches a light (counting from one) on or off", redraw: true, run: switchLight},
+	{name: "move light", args: "<number> <x> <y> <z>", help: "moves a light (counting from one) to a new position, retracing the whole screen", redraw: true, run: moveLight},
+	{name: "move object", args: "<id> <x> <y> <z>", help: "moves an object (by its id, counting from one in the order of the scene's objects) to a new position, retracing only the part of the screen it covers", redraw: true, run: moveObject},
+	{name: "load scene", args: "<name>", help: "replaces the scene with one read from a file in the scene directory, sending it to every worker again", redraw: true, run: loadScene},
+	{name: "toggle fxaa", help: "turns anti-aliasing on or off", redraw: true, run: toggleFXAA},
+	{name: "save screenshot", args: "[name]", help: "writes the current frame to a file in the screenshot directory (named after the time, if no name is given)", run: saveScreenshot},
+}
+
+// Options controls where a console reads and writes files, and who it tells about new scenes.
+type Options struct {
+	ScreenshotDir string	// The directory screenshots are written to (and the only one console clients may write to).
+	SceneDir string			// The directory scenes are loaded from (and the only one console clients may read from).
+	SceneLoaded func(env state.Environment)	// Called with each newly loaded scene, once the engine is rendering it (nothing is called, if nil).
+}
+
+// Console carries out commands on a running engine, one line at a time.
+type Console struct {
+	engine *engine.Engine
+	opts Options
+}
+
+// New creates a console which carries out commands on an engine.
+func New(eng *engine.Engine, opts Options) *Console {
+	return &Console{engine: eng, opts: opts}
+}
+
+// match finds whether a line of words is a command, returning the command's arguments if it is.
+func (cmd command) match(fields []string) ([]string, bool) {
+	name := strings.Fields(cmd.name)
+	if len(fields) < len(name) {
+		return nil, false
+	}
+	for i, word := range name {
+		if !strings.EqualFold(fields[i], word) {
+			return nil, false
+		}
+	}
+	return fields[len(name):], true
+}
+
+// Execute carries out a single command, writing its output to out.
+// Commands which change how frames look draw the current frame again once they have been carried out.
+func (c *Console) Execute(line string, out io.Writer) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	
+	// List the commands (if necessary).
+	if len(fields) == 1 && strings.EqualFold(fields[0], "help") {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "%s\t%s\n", strings.TrimSpace(cmd.name + " " + cmd.args), cmd.help)
+		}
+		fmt.Fprintf(w, "help\tlists these commands\n")
+		return w.Flush()
+	}
+	
+	// Find and carry out the command.
+	for _, cmd := range commands {
+		if args, matched := cmd.match(fields); matched {
+			if err := cmd.run(c, args, out); err != nil {
+				return err
+			}
+			if cmd.redraw {
+				return c.engine.RenderFrame(c.engine.Camera())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown command \"%s\" (try \"help\").", strings.Join(fields, " "))
+}
+
+// Serve reads commands from in (one per line) until it runs out, writing a prompt before each command and the output of each (including any errors) to out.
+func (c *Console) Serve(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, Prompt); scanner.Scan(); fmt.Fprint(out, Prompt) {
+		if err := c.Execute(scanner.Text(), out); err != nil {
+			fmt.Fprintf(out, "%v\n", err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Accept serves every connection accepted by listener (see Serve), until the listener fails (such as by being closed).
+func (c *Console) Accept(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			
+			c.Serve(conn, conn)
+		}()
+	}
+}
+
+// expectArgs makes sure that a command was given between min and max arguments.
+func expectArgs(args []string, min, max int) error {
+	if len(args) >= min && len(args) <= max {
+		return nil
+	}else if min == max {
+		return fmt.Errorf("Expected %d arguments, but got %d.", min, len(args))
+	}
+	return fmt.Errorf("Expected %d to %d arguments, but got %d.", min, max, len(args))
+}
+
+// listWorkers lists the workers in the pool, along with how they have performed.
+func listWorkers(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 0, 0); err != nil {
+		return err
+	}
+	
+	stats := c.engine.WorkerStats()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "address\tgeneration\ttasks\tsucceeded\tdisagreements\tmean latency\testimated latency\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d of %d\t%d\t%v\t%v\n", s.Address, s.Generation, s.Tasks, s.Succeeded, s.Assigned, s.Disagreements, s.MeanLatency, s.EstimatedLatency)
+	}
+	fmt.Fprintf(w, "%d workers.\n", len(stats))
+	return w.Flush()
+}
+
+// showCamera shows the camera in the form bookmarks are stored in.
+func showCamera(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 0, 0); err != nil {
+		return err
+	}
+	
+	stored, err := json.Marshal(c.engine.Camera().Stored())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", stored)
+	return err
+}
+
+// setRedundancy sets the number of workers assigned to each partition of each frame.
+func setRedundancy(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 1, 1); err != nil {
+		return err
+	}
+	
+	redundancy, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Could not parse redundancy \"%s\": %v.", args[0], err)
+	}
+	return c.engine.SetRedundancy(uint(redundancy))
+}
+
+// setTime moves the scene's sun to where it is at some hour.
+func setTime(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 1, 1); err != nil {
+		return err
+	}
+	
+	hour, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return fmt.Errorf("Could not parse hour \"%s\": %v.", args[0], err)
+	}
+	return c.engine.SetTimeOfDay(hour)
+}
+
+// setPasses sets the passes combined to draw each frame.
+func setPasses(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 1, 1); err != nil {
+		return err
+	}
+	
+	comp, err := engine.ParseComposition(args[0])
+	if err != nil {
+		return err
+	}
+	c.engine.SetComposition(comp)
+	_, err = fmt.Fprintf(out, "Showing passes: %v.\n", comp)
+	return err
+}
+
+// switchLight switches a light on or off.
+func switchLight(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 2, 2); err != nil {
+		return err
+	}
+	
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse light number \"%s\": %v.", args[0], err)
+	}
+	var on bool
+	switch strings.ToLower(args[1]) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		return fmt.Errorf("Lights can only be switched \"on\" or \"off\", not \"%s\".", args[1])
+	}
+	return c.engine.SwitchLight(number - 1, on)
+}
+
+// parsePosition parses the three coordinates of a position.
+func parsePosition(args []string) (geom.Vector, error) {
+	var coords [3]float64
+	for i := range coords {
+		var err error
+		if coords[i], err = strconv.ParseFloat(args[i], 64); err != nil {
+			return geom.Vector{}, fmt.Errorf("Could not parse coordinate \"%s\": %v.", args[i], err)
+		}
+	}
+	return geom.Vector{X: coords[0], Y: coords[1], Z: coords[2]}, nil
+}
+
+// moveLight moves a light to a new position.
+func moveLight(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 4, 4); err != nil {
+		return err
+	}
+	
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse light number \"%s\": %v.", args[0], err)
+	}
+	pos, err := parsePosition(args[1:])
+	if err != nil {
+		return err
+	}
+	return c.engine.MoveLight(number - 1, pos)
+}
+
+// moveObject moves an object to a new position.
+func moveObject(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 4, 4); err != nil {
+		return err
+	}
+	
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Could not parse object id \"%s\": %v.", args[0], err)
+	}
+	pos, err := parsePosition(args[1:])
+	if err != nil {
+		return err
+	}
+	return c.engine.MoveObject(uint(id), pos)
+}
+
+// loadScene replaces the scene with one read from a file.
+func loadScene(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 1, 1); err != nil {
+		return err
+	}
+	
+	path, err := within(c.opts.SceneDir, args[0])
+	if err != nil {
+		return fmt.Errorf("Scenes can only be loaded from within the scene directory (\"%s\").", c.opts.SceneDir)
+	}
+	env, err := state.EnvironmentFromFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not load scene \"%s\": %v.", args[0], err)
+	}
+	if err := c.engine.LoadScene(env); err != nil {
+		return err
+	}
+	if c.opts.SceneLoaded != nil {
+		c.opts.SceneLoaded(env)
+	}
+	_, err = fmt.Fprintf(out, "Loaded scene \"%s\".\n", args[0])
+	return err
+}
+
+// toggleFXAA turns anti-aliasing on or off.
+func toggleFXAA(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 0, 0); err != nil {
+		return err
+	}
+	
+	var err error
+	if c.engine.ToggleFXAA() {
+		_, err = fmt.Fprintf(out, "Turned FXAA on.\n")
+	}else{
+		_, err = fmt.Fprintf(out, "Turned FXAA off.\n")
+	}
+	return err
+}
+
+// saveScreenshot writes the current frame to a file.
+func saveScreenshot(c *Console, args []string, out io.Writer) error {
+	if err := expectArgs(args, 0, 1); err != nil {
+		return err
+	}
+	
+	name := fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405.000"))
+	if len(args) > 0 {
+		name = args[0]
+	}
+	path, err := within(c.opts.ScreenshotDir, name)
+	if err != nil {
+		return fmt.Errorf("Screenshots can only be written within the screenshot directory (\"%s\").", c.opts.ScreenshotDir)
+	}
+	frame, err := c.engine.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := output.WriteFile(path, frame); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Screenshot written to \"%s\".\n", path)
+	return err
+}
+
+// within returns the path of the file with some name within a directory, failing if the name leads outside of it.
+// Anyone who can reach the console can give it names, so they mustn't be able to reach files anywhere else.
+func within(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, path); filepath.IsAbs(name) || err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("\"%s\" is not within \"%s\".", name, dir)
+	}
+	return path, nil
+}
\ No newline at end of file
@@ -0,0 +1,123 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"sync"
+	"time"
+	"net"
+	"fmt"
+)
+
+// admission decides which workers may register with an engine.
+// This keeps a misbehaving worker (or script) which registers over and over from tying up the master.
+type admission struct {
+	allow []*net.IPNet	// The networks workers may register from (any network if empty).
+	deny []*net.IPNet	// The networks workers may never register from, even if they are allowed.
+	rate float64		// The number of registrations allowed from each host per minute (unlimited if zero).
+	
+	mu sync.Mutex				// Used to protect the registration buckets.
+	buckets map[string]*registrationBucket	// Maps each source (usually a host) to the registrations it has left.
+	lastSweep time.Time			// When full buckets were last thrown away.
+}
+
+// registrationBucket is a token bucket which limits the rate at which a single host registers.
+type registrationBucket struct {
+	tokens float64	// The number of registrations the host can make right now.
+	last time.Time	// When the tokens were last topped up.
+}
+
+// parseNetworks parses a list of IP addresses and CIDR ranges into networks.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if _, network, err := net.ParseCIDR(s); err == nil {
+			networks = append(networks, network)
+		}else if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}else{
+			return nil, fmt.Errorf("\"%s\" is not an IP address or CIDR range.", s)
+		}
+	}
+	return networks, nil
+}
+
+// contains returns whether any of some networks contains ip.
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAdmission creates an admission policy from an engine's options.
+func newAdmission(opts Options) (*admission, error) {
+	allow, err := parseNetworks(opts.AllowWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse allowed workers: %v.", err)
+	}
+	deny, err := parseNetworks(opts.DenyWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse denied workers: %v.", err)
+	}
+	
+	return &admission{allow: allow, deny: deny, rate: float64(opts.RegistrationRate), buckets: make(map[string]*registrationBucket), lastSweep: time.Now()}, nil
+}
+
+// permitted returns whether a worker at host may register at all, or be reached at host.
+// Host names (rather than IP addresses) are only permitted when there are no allow or deny lists to check them against.
+func (a *admission) permitted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if contains(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || contains(a.allow, ip)
+}
+
+// take uses up one of the registrations of a source (usually a host), returning false if it has none left.
+// Each source can register up to one minute's worth of times at once, after which its registrations are topped up at a steady rate.
+func (a *admission) take(source string) bool {
+	if a.rate <= 0.0 {
+		return true
+	}
+	
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	
+	// Top up every bucket, throwing away the full ones, every so often so that hosts which have stopped registering don't pile up.
+	now := time.Now()
+	if now.Sub(a.lastSweep) > time.Minute {
+		for h, b := range a.buckets {
+			if b.tokens + now.Sub(b.last).Minutes() * a.rate >= a.rate {
+				delete(a.buckets, h)
+			}
+		}
+		a.lastSweep = now
+	}
+	
+	// Top up the source's bucket, then take a registration from it (if there is one).
+	b, exists := a.buckets[source]
+	if !exists {
+		b = &registrationBucket{tokens: a.rate, last: now}
+		a.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * a.rate
+	if b.tokens > a.rate {
+		b.tokens = a.rate
+	}
+	b.last = now
+	
+	if b.tokens < 1.0 {
+		return false
+	}
+	b.tokens -= 1.0
+	return true
+}
\ No newline at end of file
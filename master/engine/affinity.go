@@ -0,0 +1,75 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import "github.com/mwindels/distributed-raytracer/shared/comms"
+
+// tile identifies a rectangular region of the screen, or a set of its rows if it is interleaved.
+type tile struct {
+	x, y uint32
+	width, height uint32
+	interleave uint32	// Which rows of the region the tile covers (see comms.WorkOrder), or zero if it covers them all.
+}
+
+// tileOf finds the region of the screen covered by a work order.
+func tileOf(order *comms.WorkOrder) tile {
+	return tile{x: order.GetX(), y: order.GetY(), width: order.GetWidth(), height: order.GetHeight(), interleave: order.GetInterleave()}
+}
+
+// contains returns whether a tile's region covers the pixel (x, y).
+func (t tile) contains(x, y uint32) bool {
+	return x >= t.x && x < t.x + t.width && y >= t.y && y < t.y + t.height
+}
+
+// overlaps returns whether two tiles cover any of the same pixels.
+// Tiles with different sets of interleaved rows are counted as separate, even if their regions overlap.
+func (t tile) overlaps(o tile) bool {
+	if t.interleave != o.interleave && t.interleave != 0 && o.interleave != 0 {
+		return false
+	}
+	return t.x < o.x + o.width && o.x < t.x + t.width && t.y < o.y + o.height && o.y < t.y + t.height
+}
+
+// preferredWorker returns the address of the worker which most recently drew a tile, or an empty string if no worker has.
+// If the screen was partitioned differently then (such as by cost, or around a changed area), the worker which drew the middle of the tile is preferred instead.
+// Assigning a tile to the same worker across frames keeps that worker's caches warm and its latency predictable.
+func (e *Engine) preferredWorker(t tile) string {
+	e.affinityMu.Lock()
+	defer e.affinityMu.Unlock()
+	
+	if address, exists := e.affinity[t]; exists {
+		return address
+	}
+	x, y := t.x + t.width / 2, t.y + t.height / 2
+	for drawn, address := range e.affinity {
+		if drawn.interleave == t.interleave && drawn.contains(x, y) {
+			return address
+		}
+	}
+	return ""
+}
+
+// rememberWorker records that the worker at address drew a tile, forgetting any tiles drawn before it which it overlaps.
+// So the tiles remembered never overlap, and there are never more of them than fit on the screen, however its partitions change.
+func (e *Engine) rememberWorker(t tile, address string) {
+	e.affinityMu.Lock()
+	defer e.affinityMu.Unlock()
+	
+	for drawn := range e.affinity {
+		if drawn.overlaps(t) {
+			delete(e.affinity, drawn)
+		}
+	}
+	e.affinity[t] = address
+}
+
+// forgetDepartedWorkers forgets the tiles drawn by workers which have since left the pool.
+func (e *Engine) forgetDepartedWorkers() {
+	e.affinityMu.Lock()
+	defer e.affinityMu.Unlock()
+	
+	for drawn, address := range e.affinity {
+		if !e.workers.Has(address) {
+			delete(e.affinity, drawn)
+		}
+	}
+}
\ No newline at end of file
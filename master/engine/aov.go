@@ -0,0 +1,27 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"strings"
+	"fmt"
+)
+
+// ParseAOVs converts a comma-separated list of AOV names (e.g. "depth,normal") into a bit mask of comms.AOV values.
+func ParseAOVs(list string) (uint32, error) {
+	var aovs uint32
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		
+		aov, exists := comms.AOV_value[strings.ToUpper(name)]
+		if !exists || aov == int32(comms.AOV_NONE) {
+			return 0, fmt.Errorf("Unknown AOV \"%s\".", name)
+		}
+		aovs |= uint32(aov)
+	}
+	
+	return aovs, nil
+}
\ No newline at end of file
@@ -0,0 +1,173 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"math"
+	"fmt"
+)
+
+// DefaultBloomThreshold is the brightness above which pixels glow, for blooms which are set from the command line without one.
+const DefaultBloomThreshold float64 = 0.8
+
+// DefaultBloomRadius is how far (in pixels) the glow around bright pixels spreads, for blooms which do not specify it.
+const DefaultBloomRadius uint = 8
+
+// Bloom is a post-processor which adds a glow around the bright pixels of each frame.
+type Bloom struct {
+	Threshold float64	// The brightness (in the range [0, 1]) above which pixels glow.
+	Intensity float64	// How strongly the glow is added to the frame (no glow if zero).
+	Radius uint			// How far (in pixels) the glow spreads (DefaultBloomRadius if zero).
+}
+
+// validate returns an error if a bloom's settings are out of range.
+func (b Bloom) validate() error {
+	if b.Threshold < 0.0 || b.Threshold > 1.0 {
+		return fmt.Errorf("The bloom threshold %g is outside of the range [0, 1].", b.Threshold)
+	}
+	if b.Intensity < 0.0 {
+		return fmt.Errorf("The bloom intensity %g is negative.", b.Intensity)
+	}
+	return nil
+}
+
+// enabled returns whether a bloom adds any glow.
+func (b Bloom) enabled() bool {
+	return b.Intensity > 0.0
+}
+
+// luminance returns the brightness of a colour, as perceived by the eye.
+func luminance(r, g, b float64) float64 {
+	return 0.2126 * r + 0.7152 * g + 0.0722 * b
+}
+
+// gaussianKernel returns the weights (summing to one) of a Gaussian blur reaching radius pixels either side of its centre.
+func gaussianKernel(radius int) []float64 {
+	sigma := math.Max(float64(radius) / 2.0, 0.5)
+	kernel := make([]float64, 2 * radius + 1, 2 * radius + 1)
+	sum := 0.0
+	for i := range kernel {
+		offset := float64(i - radius)
+		kernel[i] = math.Exp(-offset * offset / (2.0 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// blur blurs a layer of colours (held as three values per pixel, in row-major order) along one axis of a width by height frame, treating pixels off the edge as black.
+func blur(layer []float64, width, height int, kernel []float64, horizontal bool) []float64 {
+	radius := len(kernel) / 2
+	blurred := make([]float64, len(layer), len(layer))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			idx := 3 * (y * width + x)
+			for k, weight := range kernel {
+				i, j := x, y
+				if horizontal {
+					i += k - radius
+				}else{
+					j += k - radius
+				}
+				if i < 0 || i >= width || j < 0 || j >= height {
+					continue
+				}
+				src := 3 * (j * width + i)
+				blurred[idx] += weight * layer[src]
+				blurred[idx + 1] += weight * layer[src + 1]
+				blurred[idx + 2] += weight * layer[src + 2]
+			}
+		}
+	}
+	return blurred
+}
+
+// glare works out the glow around the bright pixels of a frame.
+// The parts of each pixel brighter than the bloom's threshold are picked out, then blurred over the bloom's radius.
+func (b Bloom) glare(f Frame) []float64 {
+	size := f.Width * f.Height
+	radius := b.Radius
+	if radius == 0 {
+		radius = DefaultBloomRadius
+	}
+	
+	// Pick out the bright parts of each pixel.
+	layer := make([]float64, 3 * size, 3 * size)
+	if b.Threshold < 1.0 {
+		for idx := 0; idx < size; idx++ {
+			r, g, bl := f.Colours[idx].Floats()
+			if l := luminance(r, g, bl); l > b.Threshold {
+				excess := (l - b.Threshold) / (1.0 - b.Threshold)
+				layer[3 * idx], layer[3 * idx + 1], layer[3 * idx + 2] = excess * r, excess * g, excess * bl
+			}
+		}
+	}
+	
+	// Since a Gaussian blur is separable, blur across then down.
+	kernel := gaussianKernel(int(radius))
+	return blur(blur(layer, f.Width, f.Height, kernel, true), f.Width, f.Height, kernel, false)
+}
+
+// Process adds the glow around a frame's bright pixels to the frame.
+func (b Bloom) Process(f Frame) []colour.RGB {
+	processed := make([]colour.RGB, len(f.Colours), len(f.Colours))
+	if !b.enabled() {
+		copy(processed, f.Colours)
+		return processed
+	}
+	
+	glow := b.glare(f)
+	for idx := range processed {
+		r, g, bl := f.Colours[idx].Floats()
+		processed[idx] = colour.NewRGBFromFloats(float32(r + b.Intensity * glow[3 * idx]), float32(g + b.Intensity * glow[3 * idx + 1]), float32(bl + b.Intensity * glow[3 * idx + 2]))
+	}
+	return processed
+}
+
+// SetBloom changes the settings of the bloom in the chain of post-processors applied to each frame.
+// Because the glow is worked out from a whole frame, the next frame is retraced in full.
+func (e *Engine) SetBloom(b Bloom) error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	if b.Radius == 0 {
+		b.Radius = DefaultBloomRadius
+	}
+	
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	// Frames already in flight hold the old chain, so it is replaced rather than changed in place.
+	chain := append(PostChain(nil), e.post...)
+	found := false
+	for i, p := range chain {
+		if _, isBloom := p.(Bloom); isBloom {
+			chain[i] = b
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("There is no bloom among the post-processors.")
+	}
+	
+	e.post = chain
+	e.version += 1
+	e.allDirty = true
+	return nil
+}
+
+// Bloom returns the settings of the bloom in the chain of post-processors applied to each frame.
+// The second return value is false if there is no bloom in the chain.
+func (e *Engine) Bloom() (Bloom, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	for _, p := range e.post {
+		if b, isBloom := p.(Bloom); isBloom {
+			return b, true
+		}
+	}
+	return Bloom{}, false
+}
\ No newline at end of file
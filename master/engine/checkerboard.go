@@ -0,0 +1,108 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"math"
+)
+
+// checkerboardParity returns the parity of the checkerboard traced in some frame (see tracer.Checkered).
+// The parity alternates between frames, so that each frame traces the pixels the frame before it left out.
+func checkerboardParity(frame uint) uint32 {
+	return uint32(frame % 2 + 1)
+}
+
+// neighbourhood finds the range and average of the colours of the pixels directly above, below, left, and right of the pixel (x, y) of a frame buffer, each step pixels away.
+// This function returns the darkest and brightest values of each channel, the average colour, and the index of one of the pixels (or -1 if none of them are on the screen).
+func (fb *frameBuffer) neighbourhood(x, y, step int) (colour.RGB, colour.RGB, colour.RGB, int) {
+	minR, minG, minB := math.Inf(1), math.Inf(1), math.Inf(1)
+	maxR, maxG, maxB := math.Inf(-1), math.Inf(-1), math.Inf(-1)
+	var sumR, sumG, sumB float64
+	count, any := 0, -1
+	for _, offset := range [4][2]int{{-step, 0}, {step, 0}, {0, -step}, {0, step}} {
+		nx, ny := x + offset[0], y + offset[1]
+		if nx < 0 || nx >= fb.width || ny < 0 || ny >= fb.height {
+			continue
+		}
+		
+		idx := fb.index(nx, ny)
+		r, g, b := fb.pixels[idx].Floats()
+		minR, minG, minB = math.Min(minR, r), math.Min(minG, g), math.Min(minB, b)
+		maxR, maxG, maxB = math.Max(maxR, r), math.Max(maxG, g), math.Max(maxB, b)
+		sumR, sumG, sumB = sumR + r, sumG + g, sumB + b
+		count, any = count + 1, idx
+	}
+	
+	if count == 0 {
+		return colour.RGB{}, colour.RGB{}, colour.RGB{}, -1
+	}
+	n := float64(count)
+	low := colour.NewRGBFromFloats(float32(minR), float32(minG), float32(minB))
+	high := colour.NewRGBFromFloats(float32(maxR), float32(maxG), float32(maxB))
+	mean := colour.NewRGBFromFloats(float32(sumR / n), float32(sumG / n), float32(sumB / n))
+	return low, high, mean, any
+}
+
+// clampColour restricts each channel of a colour to the range between two other colours.
+func clampColour(c, low, high colour.RGB) colour.RGB {
+	r, g, b := c.Floats()
+	lr, lg, lb := low.Floats()
+	hr, hg, hb := high.Floats()
+	return colour.NewRGBFromFloats(float32(math.Max(lr, math.Min(r, hr))), float32(math.Max(lg, math.Min(g, hg))), float32(math.Max(lb, math.Min(b, hb))))
+}
+
+// drawReconstructed draws the pixels of a work order which were left out of its checkerboard onto the canvas and into a frame buffer.
+// Each pixel is reprojected from the previous frame (which traced the other half of the checkerboard), then clamped to the range of the colours around it in this frame, so that anything which has moved doesn't leave a trail behind it.
+// Pixels which can't be reprojected are filled with the average of the colours around them.
+// If the previous frame's depths are known, sources and depths hold the previous frame splatted onto this one (see frameBuffer.splat).
+// This function assumes that the pixels which were traced have already been drawn into the frame buffer.
+func (e *Engine) drawReconstructed(order *comms.WorkOrder, fb *frameBuffer, sources []int, depths []float64) {
+	xInit, yInit := int(order.GetX()), int(order.GetY())
+	width, height := int(order.GetWidth()), int(order.GetHeight())
+	parity := uint(order.GetCheckerboard())
+	scale := int(order.GetScale())
+	if scale < 1 {
+		scale = 1
+	}
+	
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			x, y := xInit + i, yInit + j
+			if tracer.Checkered(x / scale, y / scale, parity) {
+				continue
+			}
+			
+			// The neighbouring pixels (or blocks) were all traced, since they're on the other half of the checkerboard.
+			idx := fb.index(x, y)
+			low, high, mean, neighbour := fb.neighbourhood(x, y, scale)
+			
+			// Try to reproject the pixel from the previous frame.
+			reprojected := false
+			if e.previous != nil {
+				if sources != nil && sources[idx] >= 0 {
+					fb.copyPixel(idx, e.previous, sources[idx])
+					if fb.depth != nil {
+						fb.depth[idx] = depths[idx]
+					}
+					reprojected = true
+				}else if src, visible := e.previous.reproject(x, y, fb.cam); visible {
+					fb.copyPixel(idx, e.previous, src)
+					reprojected = true
+				}
+			}
+			
+			// Keep the pixel's colour close to its neighbours', or fill it in from them.
+			if reprojected && neighbour >= 0 {
+				fb.pixels[idx] = clampColour(fb.pixels[idx], low, high)
+			}else if neighbour >= 0 {
+				fb.copyPixel(idx, fb, neighbour)
+				fb.pixels[idx] = mean
+			}else if !reprojected {
+				continue
+			}
+			e.opts.Canvas.Set(x, y, fb.displayed(idx))
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,215 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"strconv"
+	"strings"
+	"fmt"
+)
+
+// depthFalloff is the distance (in scene units) at which the depth pass is drawn at half brightness.
+const depthFalloff float64 = 10.0
+
+// Pass identifies one of the images which can be combined to draw a frame.
+type Pass uint8
+
+// These constants are the possible passes.
+const (
+	PassBeauty Pass = iota	// The shaded colour of each pixel.
+	PassAmbient				// The ambient component of each pixel's colour.
+	PassDiffuse				// The diffuse component of each pixel's colour.
+	PassSpecular			// The specular component of each pixel's colour.
+	PassShadow				// How much of each pixel's light is blocked (white if every light is blocked).
+	PassOcclusion			// How open the hemisphere above each pixel is (white if nothing occludes it).
+	PassDepth				// How near each pixel is (white if it is at the camera, black if nothing was hit).
+	PassNormal				// Each pixel's normal vector, with each axis mapped to a colour channel.
+	PassAlbedo				// The diffuse colour of each pixel's material.
+	PassObjectID			// Each object in its own colour.
+	NumPasses
+)
+
+// passNames holds the name of each pass.
+var passNames = [NumPasses]string{"beauty", "ambient", "diffuse", "specular", "shadow", "occlusion", "depth", "normal", "albedo", "object_id"}
+
+// passAOVs holds the AOV which must be traced to draw each pass.
+var passAOVs = [NumPasses]comms.AOV{
+	comms.AOV_NONE,
+	comms.AOV_AMBIENT,
+	comms.AOV_DIFFUSE,
+	comms.AOV_SPECULAR,
+	comms.AOV_SHADOW,
+	comms.AOV_OCCLUSION,
+	comms.AOV_DEPTH,
+	comms.AOV_NORMAL,
+	comms.AOV_ALBEDO,
+	comms.AOV_OBJECT_ID,
+}
+
+// String returns the name of a pass.
+func (p Pass) String() string {
+	if p < NumPasses {
+		return passNames[p]
+	}
+	return fmt.Sprintf("Pass(%d)", uint8(p))
+}
+
+// PassByName finds the pass with some name (ignoring case).
+func PassByName(name string) (Pass, error) {
+	for p := Pass(0); p < NumPasses; p++ {
+		if strings.EqualFold(name, passNames[p]) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown pass \"%s\".", name)
+}
+
+// Composition holds the weight of each pass in a frame, so that a frame is drawn as the weighted sum of its passes.
+type Composition [NumPasses]float64
+
+// DefaultComposition draws each frame's beauty pass alone.
+var DefaultComposition Composition = Solo(PassBeauty)
+
+// Solo returns a composition which draws a single pass alone.
+func Solo(p Pass) Composition {
+	var c Composition
+	c[p] = 1.0
+	return c
+}
+
+// ParseComposition converts a comma-separated list of passes and their weights (e.g. "diffuse=1,occlusion=0.5") into a composition.
+// A pass without a weight has a weight of one.
+func ParseComposition(list string) (Composition, error) {
+	var c Composition
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		
+		// Split the entry into a name and a weight.
+		name, weight := entry, 1.0
+		if eq := strings.Index(entry, "="); eq >= 0 {
+			var err error
+			name = strings.TrimSpace(entry[:eq])
+			if weight, err = strconv.ParseFloat(strings.TrimSpace(entry[eq + 1:]), 64); err != nil {
+				return Composition{}, fmt.Errorf("Could not parse the weight of pass \"%s\": %v.", name, err)
+			}
+		}
+		
+		p, err := PassByName(name)
+		if err != nil {
+			return Composition{}, err
+		}
+		c[p] = weight
+	}
+	
+	return c, nil
+}
+
+// String describes a composition in the form accepted by ParseComposition.
+func (c Composition) String() string {
+	var entries []string
+	for p := Pass(0); p < NumPasses; p++ {
+		if c[p] != 0.0 {
+			entries = append(entries, fmt.Sprintf("%s=%g", passNames[p], c[p]))
+		}
+	}
+	
+	if len(entries) == 0 {
+		return "none"
+	}
+	return strings.Join(entries, ",")
+}
+
+// aovs returns the AOVs (as a bit mask of comms.AOV values) which must be traced to draw a composition.
+func (c Composition) aovs() uint32 {
+	var aovs uint32
+	for p := Pass(0); p < NumPasses; p++ {
+		if c[p] != 0.0 {
+			aovs |= uint32(passAOVs[p])
+		}
+	}
+	return aovs
+}
+
+// grey returns a shade of grey with some brightness in the range [0, 1].
+func grey(v float64) colour.RGB {
+	return colour.NewRGBFromFloats(float32(v), float32(v), float32(v))
+}
+
+// objectColour returns a distinct colour for an object id, or black if there is no object.
+func objectColour(id uint) colour.RGB {
+	if id == 0 {
+		return colour.RGB{}
+	}
+	
+	// Scatter the ids around the colour cube, so that neighbouring ids look different.
+	h := uint32(id) * 2654435761
+	return colour.NewRGB(uint8(h >> 24), uint8(h >> 16), uint8(h >> 8))
+}
+
+// passColour returns the colour of pixel idx of a frame buffer in some pass, or black if the frame buffer doesn't hold that pass.
+func passColour(fb *frameBuffer, p Pass, idx int) colour.RGB {
+	switch {
+	case p == PassBeauty:
+		return fb.pixels[idx]
+	case p == PassAmbient && fb.ambient != nil:
+		return fb.ambient[idx]
+	case p == PassDiffuse && fb.diffuse != nil:
+		return fb.diffuse[idx]
+	case p == PassSpecular && fb.specular != nil:
+		return fb.specular[idx]
+	case p == PassShadow && fb.shadow != nil:
+		return grey(fb.shadow[idx])
+	case p == PassOcclusion && fb.occlusion != nil:
+		return grey(fb.occlusion[idx])
+	case p == PassDepth && fb.depth != nil:
+		return grey(depthFalloff / (depthFalloff + fb.depth[idx]))
+	case p == PassNormal && fb.normals != nil:
+		n := fb.normals[idx]
+		return colour.NewRGBFromFloats(float32((n.X + 1.0) / 2.0), float32((n.Y + 1.0) / 2.0), float32((n.Z + 1.0) / 2.0))
+	case p == PassAlbedo && fb.albedo != nil:
+		return fb.albedo[idx]
+	case p == PassObjectID && fb.objectIDs != nil:
+		return objectColour(fb.objectIDs[idx])
+	default:
+		return colour.RGB{}
+	}
+}
+
+// colourAt returns the colour of pixel idx of a frame buffer as the weighted sum of its passes.
+func (c Composition) colourAt(fb *frameBuffer, idx int) colour.RGB {
+	if c == DefaultComposition {
+		return fb.pixels[idx]
+	}
+	
+	var r, g, b float64
+	for p := Pass(0); p < NumPasses; p++ {
+		if c[p] != 0.0 {
+			pr, pg, pb := passColour(fb, p, idx).Floats()
+			r, g, b = r + c[p] * pr, g + c[p] * pg, b + c[p] * pb
+		}
+	}
+	return colour.NewRGBFromFloats(float32(r), float32(g), float32(b))
+}
+
+// SetComposition changes how the passes of each frame are combined.
+// Because the new composition might need passes which haven't been traced, the next frame is retraced in full.
+func (e *Engine) SetComposition(c Composition) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	e.composition = c
+	e.version += 1
+	e.allDirty = true
+}
+
+// Composition returns how the passes of each frame are currently combined.
+func (e *Engine) Composition() Composition {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.composition
+}
\ No newline at end of file
@@ -0,0 +1,159 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/master/output"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"context"
+	"bytes"
+)
+
+// Controller implements the comms.ControlServer interface.
+type Controller struct {
+	engine *Engine
+}
+
+// vectorFromComms converts a protocol vector into a geom.Vector.
+func vectorFromComms(v *comms.Vector) geom.Vector {
+	return geom.Vector{v.GetX(), v.GetY(), v.GetZ()}
+}
+
+// vectorToComms converts a geom.Vector into a protocol vector.
+func vectorToComms(v geom.Vector) *comms.Vector {
+	return &comms.Vector{X: v.X, Y: v.Y, Z: v.Z}
+}
+
+// cameraState describes a camera using the protocol's messages.
+func cameraState(cam state.Camera) *comms.CameraState {
+	return &comms.CameraState{
+		Position: vectorToComms(cam.Pos),
+		Direction: vectorToComms(cam.Forward()),
+		Fov: cam.Fov,
+	}
+}
+
+// SetCamera moves the engine's camera, and renders a frame from its new position.
+func (c *Controller) SetCamera(ctx context.Context, req *comms.CameraUpdate) (*comms.CameraState, error) {
+	cam := c.engine.Camera()
+	
+	if req.GetRelative() {
+		// Offset and turn the camera.
+		cam.Pos = cam.Pos.Add(vectorFromComms(req.GetPosition()))
+		cam.Yaw(req.GetYaw())
+		cam.Pitch(req.GetPitch())
+	}else{
+		// Replace the camera's position and direction.
+		dir := cam.Forward()
+		if req.GetDirection() != nil && !vectorFromComms(req.GetDirection()).Zero() {
+			dir = vectorFromComms(req.GetDirection())
+		}
+		
+		// The clipping distances (and the scene's up vector) carry over to the new camera.
+		near, far := cam.Near, cam.Far
+		var err error
+		if cam, err = state.NewCameraWithUp(vectorFromComms(req.GetPosition()), dir, cam.WorldUp(), cam.Fov); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		cam.Near, cam.Far = near, far
+	}
+	
+	// Replace the camera's field of view (if necessary).
+	if req.GetFov() > 0 {
+		cam.Fov = req.GetFov()
+	}
+	
+	if err := c.engine.RenderFrame(cam); err != nil {
+		return nil, err
+	}
+	
+	return cameraState(cam), nil
+}
+
+// GetCamera describes the engine's camera.
+func (c *Controller) GetCamera(ctx context.Context, req *empty.Empty) (*comms.CameraState, error) {
+	return cameraState(c.engine.Camera()), nil
+}
+
+// CaptureFrame returns the most recently drawn frame.
+func (c *Controller) CaptureFrame(ctx context.Context, req *empty.Empty) (*comms.CapturedFrame, error) {
+	frame, err := c.engine.Snapshot()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	
+	writer := bytes.Buffer{}
+	if err := output.Encode(&writer, frame, output.FormatPNG); err != nil {
+		return nil, err
+	}
+	
+	return &comms.CapturedFrame{
+		Width: uint32(frame.Bounds().Dx()),
+		Height: uint32(frame.Bounds().Dy()),
+		Png: writer.Bytes(),
+	}, nil
+}
+
+// PickObject returns the id of the object visible at a pixel in the most recently drawn frame.
+func (c *Controller) PickObject(ctx context.Context, req *comms.Pixel) (*comms.PickedObject, error) {
+	id, err := c.engine.ObjectAt(int(req.GetX()), int(req.GetY()))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	
+	return &comms.PickedObject{Id: uint32(id)}, nil
+}
+
+// SetPasses changes how the engine combines the passes of each frame, and redraws the current frame with the new combination.
+func (c *Controller) SetPasses(ctx context.Context, req *comms.PassWeights) (*comms.PassWeights, error) {
+	var comp Composition
+	for name, weight := range req.GetWeights() {
+		p, err := PassByName(name)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		comp[p] = weight
+	}
+	
+	c.engine.SetComposition(comp)
+	if err := c.engine.RenderFrame(c.engine.Camera()); err != nil {
+		return nil, err
+	}
+	
+	// Describe the new combination.
+	weights := make(map[string]float64)
+	for p := Pass(0); p < NumPasses; p++ {
+		if comp[p] != 0.0 {
+			weights[p.String()] = comp[p]
+		}
+	}
+	return &comms.PassWeights{Weights: weights}, nil
+}
+
+// SwitchLight switches one of the engine's lights on or off, and renders a frame with the new lighting.
+func (c *Controller) SwitchLight(ctx context.Context, req *comms.LightSwitch) (*comms.LightSwitch, error) {
+	if err := c.engine.SwitchLight(int(req.GetIndex()), req.GetOn()); err != nil {
+		return nil, status.Errorf(codes.NotFound, "%v", err)
+	}
+	if err := c.engine.RenderFrame(c.engine.Camera()); err != nil {
+		return nil, err
+	}
+	
+	return &comms.LightSwitch{Index: req.GetIndex(), On: req.GetOn()}, nil
+}
+// SetBloom changes the glow the engine adds around the bright pixels of each frame, and redraws the current frame with the new glow.
+func (c *Controller) SetBloom(ctx context.Context, req *comms.BloomSettings) (*comms.BloomSettings, error) {
+	if err := c.engine.SetBloom(Bloom{Threshold: req.GetThreshold(), Intensity: req.GetIntensity(), Radius: uint(req.GetRadius())}); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	if err := c.engine.RenderFrame(c.engine.Camera()); err != nil {
+		return nil, err
+	}
+	
+	bloom, _ := c.engine.Bloom()
+	return &comms.BloomSettings{Threshold: bloom.Threshold, Intensity: bloom.Intensity, Radius: uint32(bloom.Radius)}, nil
+}
\ No newline at end of file
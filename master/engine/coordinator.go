@@ -0,0 +1,422 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"github.com/golang/protobuf/proto"
+	"time"
+	"log"
+	"fmt"
+)
+
+// partitionRetries controls how many times a partition is reassigned within a frame after every worker assigned to it has failed.
+const partitionRetries uint = 2
+
+// tileResult is a worker's response to one of a frame's partitions, as collected by the frame's coordinator.
+type tileResult struct {
+	tile int						// The index of the partition the results are for.
+	address string					// The address of the worker which traced the partition.
+	results *comms.TraceResults		// The worker's results (nil if the worker failed).
+	latency time.Duration			// How long the worker took to respond, from when it was assigned the partition.
+}
+
+// resultsFit returns an error if some trace results don't cover exactly the blocks of a work order, laid out consistently.
+// Results which don't fit can't be drawn, so they are treated as though the worker failed.
+func resultsFit(order *comms.WorkOrder, results *comms.TraceResults) error {
+	scale := order.GetScale()
+	if scale < 1 {
+		scale = 1
+	}
+	left, top, width, height := tracer.Blocks(int(order.GetX()), int(order.GetY()), int(order.GetWidth()), int(order.GetHeight()), int(scale))
+	if results.GetX() != uint32(left) || results.GetY() != uint32(top) || results.GetWidth() != uint32(width) || results.GetHeight() != uint32(height) {
+		return fmt.Errorf("The results cover %dx%d blocks at (%d, %d), rather than %dx%d blocks at (%d, %d).", results.GetWidth(), results.GetHeight(), results.GetX(), results.GetY(), width, height, left, top)
+	}
+	depth := order.GetBitDepth()
+	if depth == 0 {
+		depth = comms.DefaultBitDepth
+	}
+	if results.ChannelBits() != depth {
+		return fmt.Errorf("The results have %d bits per channel, rather than %d.", results.ChannelBits(), depth)
+	}
+	if results.GetScale() != scale || results.GetCheckerboard() != order.GetCheckerboard() {
+		return fmt.Errorf("The results were traced at scale %d with checkerboard %d, rather than scale %d with checkerboard %d.", results.GetScale(), results.GetCheckerboard(), scale, order.GetCheckerboard())
+	}
+	if comms.InterleaveStride(results.GetInterleave()) != comms.InterleaveStride(order.GetInterleave()) {
+		return fmt.Errorf("The results were interleaved every %d rows, rather than every %d rows.", comms.InterleaveStride(results.GetInterleave()), comms.InterleaveStride(order.GetInterleave()))
+	}
+	return results.CheckLayout()
+}
+
+// drawResults draws the results of a work order onto the canvas and into a frame buffer.
+// If the work order was traced at a reduced resolution, each block's results are stretched over every pixel in the block, with the colours blended between blocks by the engine's filter.
+// If the work order was traced in a checkerboard, the pixels left out of the checkerboard are left alone (see drawReconstructed).
+// This function assumes that the results fit the work order (see resultsFit).
+func (e *Engine) drawResults(order *comms.WorkOrder, results *comms.TraceResults, fb *frameBuffer) {
+	xInit, yInit := int(order.GetX()), int(order.GetY())
+	width, height := int(order.GetWidth()), int(order.GetHeight())
+	scale := int(results.GetScale())
+	
+	// Blocks are only blended with others in the same results, so the colours aren't blended across partitions.
+	filtered := scale > 1 && e.opts.Filter != FilterNearest
+	block := func(bi, bj int) (colour.RGB, bool) {
+		if result, traced := results.Index(bi, bj); traced {
+			return results.Colour(result), true
+		}
+		return colour.RGB{}, false
+	}
+	
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			// Blocks left out of the checkerboard (or the interleaved rows) have no results.
+			result, traced := results.Index((xInit + i) / scale, (yInit + j) / scale)
+			if !traced {
+				continue
+			}
+			
+			idx := fb.index(xInit + i, yInit + j)
+			fb.setResults(idx, results, result)
+			if filtered {
+				// Find where the centre of the pixel lies among the blocks, where each block is centred on its coordinates.
+				u := (float64(xInit + i) + 0.5) / float64(scale) - 0.5
+				v := (float64(yInit + j) + 0.5) / float64(scale) - 0.5
+				if col, blended := e.opts.Filter.sampleAt(block, u, v); blended {
+					fb.pixels[idx] = col
+				}
+			}
+			e.opts.Canvas.Set(xInit + i, yInit + j, fb.displayed(idx))
+		}
+	}
+}
+
+// drawReprojected draws the area of a work order onto the canvas and into a frame buffer by reprojecting the previous frame's pixels.
+// If the previous frame's depths are known, sources and depths hold the previous frame splatted onto this one (see frameBuffer.splat).
+// Pixels which could not be splatted are reprojected using the change in the camera's orientation alone.
+// Only the rows an interleaved work order covers are drawn, since the rest belong to other work orders.
+// This function assumes that the engine has a previous frame.
+func (e *Engine) drawReprojected(order *comms.WorkOrder, fb *frameBuffer, sources []int, depths []float64) {
+	xInit, yInit := int(order.GetX()), int(order.GetY())
+	width, height := int(order.GetWidth()), int(order.GetHeight())
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			if !coversRow(order, yInit + j) {
+				continue
+			}
+			
+			idx := fb.index(xInit + i, yInit + j)
+			if sources != nil && sources[idx] >= 0 {
+				fb.copyPixel(idx, e.previous, sources[idx])
+				if fb.depth != nil {
+					fb.depth[idx] = depths[idx]
+				}
+			}else if src, visible := e.previous.reproject(xInit + i, yInit + j, fb.cam); visible {
+				fb.copyPixel(idx, e.previous, src)
+			}else{
+				continue
+			}
+			e.opts.Canvas.Set(xInit + i, yInit + j, fb.displayed(idx))
+		}
+	}
+}
+
+// drawPostProcessed applies a frame buffer's post-processors to the whole frame, and redraws the whole canvas with the results.
+func (e *Engine) drawPostProcessed(fb *frameBuffer) {
+	fb.postProcess()
+	for x := 0; x < fb.width; x++ {
+		for y := 0; y < fb.height; y++ {
+			e.opts.Canvas.Set(x, y, fb.displayed(fb.index(x, y)))
+		}
+	}
+}
+
+// coordinate coordinates the drawing of a new frame of the scene as seen by cam, with its passes combined by comp and post-processed by post, and each partition assigned to redundancy workers.
+// The coordinator waits on in before drawing, and signals out once it has drawn (or skipped) the frame.
+// Only the given area of the screen is traced; the rest of the frame is kept from the previous one.
+// Each partition is drawn as soon as its results arrive, and partitions which no worker could fill are reprojected from the previous frame.
+// The frame's statistics are filled in as it is drawn, and reported once it is finished.
+func (e *Engine) coordinate(diff []byte, cam state.Camera, comp Composition, post PostChain, redundancy uint, area comms.WorkOrder, stats FrameStats, requested time.Time, in <-chan struct{}, out chan<- struct{}) {
+	frame := stats.Frame
+	defer e.reportFrame(&stats, requested)
+	
+	// Find the number of workers.
+	// This number might change while assigning tasks, so this is just a heuristic for partitioning.
+	numWorkers := e.workers.Size()
+	
+	if numWorkers > 0 {
+		// Partition the screen, then coarsen the partitions away from the focus point (if necessary).
+		// Frames are numbered by the pool in work orders, since other sessions may be sending frames to the same workers.
+		area.Diff = diff
+		area.Frame = e.workers.NewFrame()
+		if stats.Foveated && numWorkers < minFoveatedWorkers {
+			numWorkers = minFoveatedWorkers
+		}
+		var partitions []comms.WorkOrder
+		if e.opts.Partitioning == PartitionInterleaved && area.GetCheckerboard() == 0 && !stats.Foveated {
+			partitions = interleave(&area, numWorkers / redundancy)
+		}else{
+			split := halve
+			if e.opts.Partitioning == PartitionCost {
+				split = e.costs.split
+			}
+			partitions, _ = partition(&area, numWorkers, redundancy, 0, uint32(e.opts.PartitionWidth), uint32(e.opts.PartitionHeight), split)
+		}
+		if stats.Foveated {
+			e.foveate(partitions)
+		}
+		e.orderPartitions(partitions)
+		
+		// Assign the partitions to workers, preferring those which drew them last (unless they have left).
+		// Every worker's response is forwarded onto a single channel, tagged with the partition it is for, until the frame is finished with.
+		assignStart := time.Now()
+		e.forgetDepartedWorkers()
+		merged := make(chan tileResult)
+		done := make(chan struct{})
+		defer close(done)
+		orderMap := make(map[*comms.WorkOrder]*comms.TraceResults)
+		outstanding := make(map[*comms.WorkOrder]uint)		// The number of workers still tracing each partition.
+		failed := make(map[*comms.WorkOrder][]string)		// The addresses of the workers which have failed to trace each partition.
+		retries := make(map[*comms.WorkOrder]uint)			// The number of times each partition has been reassigned.
+		candidates := make(map[*comms.WorkOrder][]candidate)	// The results received for each partition, when they are cross-checked.
+		drawnBy := make(map[*comms.WorkOrder]string)		// The address of the worker whose results filled each partition.
+		tiles := make(map[*comms.WorkOrder]TileStats)		// How each filled partition was filled.
+		
+		// assign assigns worker(s) to a partition, preferring one worker and avoiding others (if possible).
+		// Each partition is assigned to different workers, so that their results can be cross-checked.
+		assign := func(tile int, preferred string, excluded []string) error {
+			var err error
+			order := &partitions[tile]
+			excluded = append([]string(nil), excluded...)
+			for j := uint(0); j < redundancy; j++ {
+				var resultCh <-chan *comms.TraceResults
+				var address string
+				if resultCh, address, err = e.workers.AssignAt(e.opts.Priority, order, e.opts.TraceTimeout, preferred, excluded...); err == nil {
+					outstanding[order] += 1
+					preferred = ""
+					excluded = append(excluded, address)
+					go func(response tileResult, resultCh <-chan *comms.TraceResults, assigned time.Time) {
+						// The pool always closes the channel, so this doesn't wait forever.
+						response.results = <-resultCh
+						response.latency = time.Since(assigned)
+						select{
+						case merged <- response:
+						case <-done:
+						}
+					}(tileResult{tile: tile, address: address}, resultCh, time.Now())
+				}
+			}
+			if outstanding[order] == 0 {
+				return err
+			}
+			return nil
+		}
+		
+		for i := 0; i < len(partitions); i++ {
+			// Assign worker(s) to the current partition.
+			// The first worker assigned prefers whichever worker drew this partition last.
+			// If no workers could be assigned to this partition, it can't be filled.
+			if err := assign(i, e.preferredWorker(tileOf(&partitions[i])), nil); err != nil {
+				log.Printf("Frame %d could not draw part of screen: %v.\n", frame, err)
+				orderMap[&partitions[i]] = nil
+			}
+		}
+		
+		stats.Assign = time.Since(assignStart)
+		stats.Partitions = len(partitions)
+		
+		// Wait for our turn to draw.
+		queueStart := time.Now()
+		<-in
+		stats.Queue = time.Since(queueStart)
+		traceStart := time.Now()
+		
+		// Start the frame from the previous one, so that the frame buffer matches what is on the canvas.
+		current := newFrameBuffer(int(e.opts.Width), int(e.opts.Height), cam, area.GetAovs())
+		current.comp = comp
+		current.post = post
+		current.deep = area.GetBitDepth() > 8
+		if e.previous != nil {
+			current.copyFrom(e.previous)
+		}
+		
+		// Accumulate results, drawing each partition as soon as it is filled.
+		for len(orderMap) < len(partitions) {
+			// Wait for a worker to respond.
+			response := <-merged
+			result, success := response.results, response.results != nil
+			order := &partitions[response.tile]
+			outstanding[order] -= 1
+			if success {
+				stats.Bytes += uint64(proto.Size(result))
+			}
+			
+			// Update the order map with the new results.
+			// A partition which has already been filled is left alone.
+			// If results are cross-checked, the partition is only filled once every worker assigned to it has responded.
+			filled := false
+			filledBy := response.address
+			if _, exists := orderMap[order]; !exists {
+				if success {
+					if err := resultsFit(order, result); err != nil {
+						log.Printf("Frame %d received malformed results from worker \"%s\": %v.\n", frame, response.address, err)
+						success = false
+					}
+				}
+				if !success {
+					failed[order] = append(failed[order], response.address)
+				}else if redundancy < 2 {
+					orderMap[order] = result
+					filled = true
+				}else{
+					candidates[order] = append(candidates[order], candidate{results: result, address: response.address})
+				}
+			}
+			
+			// Once every worker assigned to a partition has responded, fill it with the results most of them agree on.
+			if _, exists := orderMap[order]; !exists && outstanding[order] == 0 && len(candidates[order]) > 0 {
+				chosen := e.crossCheck(frame, order, candidates[order])
+				result, filledBy = chosen.results, chosen.address
+				orderMap[order] = result
+				filled = true
+			}
+			
+			// If every worker assigned to a partition has failed, reassign it to other workers while there's still time.
+			// Once its retries run out, the partition can't be filled.
+			if _, exists := orderMap[order]; !exists && outstanding[order] == 0 {
+				retried := false
+				if retries[order] < partitionRetries && (area.GetDeadline() == 0 || time.Now().UnixNano() < area.GetDeadline()) {
+					retries[order] += 1
+					if err := assign(response.tile, "", failed[order]); err == nil {
+						stats.Retries += 1
+						retried = true
+					}
+				}
+				if !retried {
+					orderMap[order] = nil
+				}
+			}
+			
+			// If the partition was just filled, draw it.
+			if filled {
+				drawStart := time.Now()
+				e.rememberWorker(tileOf(order), filledBy)
+				e.costs.record(order, result)
+				drawnBy[order] = filledBy
+				tiles[order] = TileStats{Filled: true, Worker: filledBy, Latency: response.latency, Bytes: proto.Size(result)}
+				e.drawResults(order, result, current)
+				e.opts.Canvas.Update()
+				stats.Draw += time.Since(drawStart)
+				stats.Pixels += uint64(result.Count())
+			}
+		}
+		
+		stats.Trace = time.Since(traceStart) - stats.Draw
+		
+		// Record how each partition was filled (if it was).
+		stats.Tiles = make([]TileStats, len(partitions), len(partitions))
+		for i := range partitions {
+			order := &partitions[i]
+			stats.Tiles[i] = tiles[order]
+			stats.Tiles[i].X, stats.Tiles[i].Y, stats.Tiles[i].Width, stats.Tiles[i].Height = order.GetX(), order.GetY(), order.GetWidth(), order.GetHeight()
+			stats.Tiles[i].Retries = retries[order]
+		}
+		
+		// Count the partitions which could not be filled.
+		unfilled := 0
+		for _, r := range orderMap {
+			if r == nil {
+				unfilled += 1
+			}
+		}
+		stats.Unfilled = unfilled
+		
+		// If none of the partitions could be filled, skip the frame.
+		if unfilled == len(partitions) {
+			stats.Skipped = true
+			stats.SkipReason = "no partition could be filled"
+			log.Printf("Frame %d skipped, could not draw part of the screen.", frame)
+			e.redraw(frame)
+			out <- struct{}{}
+			return
+		}
+		
+		// Find where the previous frame's pixels land in this one (if its depths are known), for filling in the pixels which weren't traced.
+		// This accounts for the camera's movement as well as its rotation.
+		var sources []int
+		var depths []float64
+		checkerboard := area.GetCheckerboard() != 0
+		if e.previous != nil && e.previous.depth != nil && (checkerboard || unfilled > 0) {
+			drawStart := time.Now()
+			sources, depths = e.previous.splat(cam)
+			stats.Draw += time.Since(drawStart)
+		}
+		
+		// Fill in the pixels which were left out of each filled partition's checkerboard.
+		if checkerboard {
+			drawStart := time.Now()
+			for i := 0; i < len(partitions); i++ {
+				if orderMap[&partitions[i]] != nil {
+					e.drawReconstructed(&partitions[i], current, sources, depths)
+				}
+			}
+			e.opts.Canvas.Update()
+			stats.Draw += time.Since(drawStart)
+		}
+		
+		// If only part of the screen was traced over an incomplete frame, this frame is incomplete too.
+		// Frames traced at a reduced resolution, in a checkerboard, or foveated are also incomplete, so that they are traced again in full.
+		whole := area.GetWidth() == uint32(e.opts.Width) && area.GetHeight() == uint32(e.opts.Height)
+		complete := unfilled == 0 && (whole || e.previousComplete) && area.GetScale() <= 1 && !checkerboard && !stats.Foveated
+		if !complete {
+			e.redraw(frame)
+		}
+		
+		// Fill in the remaining partitions by reprojecting the previous frame (if there is one).
+		if unfilled > 0 {
+			if e.previous != nil {
+				drawStart := time.Now()
+				for i := 0; i < len(partitions); i++ {
+					if orderMap[&partitions[i]] == nil {
+						e.drawReprojected(&partitions[i], current, sources, depths)
+					}
+				}
+				stats.Draw += time.Since(drawStart)
+				log.Printf("Frame %d reprojected %d of %d partitions from the previous frame.\n", frame, unfilled, len(partitions))
+			}else{
+				log.Printf("Frame %d could not draw %d of %d partitions.\n", frame, unfilled, len(partitions))
+			}
+		}
+		
+		// Apply the post-processors to the whole frame, then draw it again as it should be displayed (if necessary).
+		if len(post) > 0 {
+			drawStart := time.Now()
+			e.drawPostProcessed(current)
+			stats.Draw += time.Since(drawStart)
+		}
+		
+		// Finish the frame.
+		e.opts.Canvas.Present()
+		e.previous = current
+		e.previousComplete = complete
+		e.present(current)
+		out <- struct{}{}
+		
+		// Spot check some of the workers' results (if necessary).
+		// This happens once the next frame can draw, so that it doesn't hold up the next frame's drawing.
+		e.mu.RLock()
+		checker := e.checker
+		e.mu.RUnlock()
+		if checker != nil {
+			stats.SpotChecks, stats.SpotCheckFailures = e.spotCheck(checker, frame, partitions, orderMap, drawnBy)
+		}
+	}else{
+		// If there are no workers available, skip the frame.
+		stats.Skipped = true
+		stats.SkipReason = "no workers"
+		<-in
+		log.Printf("Frame %d skipped, no workers in pool.\n", frame)
+		e.redraw(frame)
+		out <- struct{}{}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,152 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"sync"
+)
+
+// costCellSize is the width and height (in pixels) of each cell of a cost map.
+const costCellSize uint32 = 16
+
+// costBlend is how much each new measurement of a cell's cost counts for, against the cell's previous estimate.
+const costBlend float64 = 0.5
+
+// costMap estimates how long each region of the screen takes to trace, from how long workers took to trace previous frames.
+type costMap struct {
+	mu sync.Mutex
+	columns, rows uint32
+	costs []float64		// The estimated time (in nanoseconds) each pixel in each cell takes to trace, or a negative number if it hasn't been measured.
+}
+
+// newCostMap creates a cost map for a width by height screen, with no estimates yet.
+func newCostMap(width, height uint) *costMap {
+	columns := (uint32(width) + costCellSize - 1) / costCellSize
+	rows := (uint32(height) + costCellSize - 1) / costCellSize
+	costs := make([]float64, columns * rows)
+	for i := range costs {
+		costs[i] = -1.0
+	}
+	return &costMap{columns: columns, rows: rows, costs: costs}
+}
+
+// record updates the estimated cost of the cells covered by a work order, from how long the worker took to trace it.
+// The time is shared evenly between the blocks which were traced, so that the estimate is the cost of a pixel at full resolution.
+func (m *costMap) record(order *comms.WorkOrder, results *comms.TraceResults) {
+	if results.GetTraceTime() <= 0 || results.Slots() == 0 {
+		return
+	}
+	cost := float64(results.GetTraceTime()) / float64(results.Slots())
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	// Blend the cost into every cell the work order overlaps.
+	left, top := order.GetX() / costCellSize, order.GetY() / costCellSize
+	right, bottom := (order.GetX() + order.GetWidth() - 1) / costCellSize, (order.GetY() + order.GetHeight() - 1) / costCellSize
+	for i := left; i <= right && i < m.columns; i++ {
+		for j := top; j <= bottom && j < m.rows; j++ {
+			idx := j * m.columns + i
+			if m.costs[idx] < 0.0 {
+				m.costs[idx] = cost
+			}else{
+				m.costs[idx] += costBlend * (cost - m.costs[idx])
+			}
+		}
+	}
+}
+
+// overlap returns the number of pixels from start (inclusive) to end (exclusive) within cell k.
+func overlap(k, start, end uint32) uint32 {
+	low, high := k * costCellSize, (k + 1) * costCellSize
+	if start > low {
+		low = start
+	}
+	if end < high {
+		high = end
+	}
+	if high <= low {
+		return 0
+	}
+	return high - low
+}
+
+// split finds where to split an area along some dimension (zero for a vertical split), so that fraction of the area's estimated cost lies before the split.
+// Cells which haven't been measured are assumed to cost as much as the average measured cell, and areas with no measurements are split in half.
+// This function is a splitter for partition.
+func (m *costMap) split(area *comms.WorkOrder, dimension uint, fraction float64) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	// Find the cost of the unmeasured cells.
+	var measured float64
+	var count int
+	for _, cost := range m.costs {
+		if cost >= 0.0 {
+			measured, count = measured + cost, count + 1
+		}
+	}
+	if count == 0 {
+		return halve(area, dimension, fraction)
+	}
+	unmeasured := measured / float64(count)
+	cellCost := func(i, j uint32) float64 {
+		if i >= m.columns || j >= m.rows || m.costs[j * m.columns + i] < 0.0 {
+			return unmeasured
+		}
+		return m.costs[j * m.columns + i]
+	}
+	
+	// Find the cost of each line of pixels across the split dimension, from the cells the line passes through.
+	start, size := area.GetX(), area.GetWidth()
+	across, span := area.GetY(), area.GetHeight()
+	if dimension % 2 != 0 {
+		start, size, across, span = across, span, start, size
+	}
+	lines := make([]float64, size)
+	var total float64
+	for offset := uint32(0); offset < size; offset++ {
+		k := (start + offset) / costCellSize
+		for c := across / costCellSize; c * costCellSize < across + span; c++ {
+			cost := cellCost(k, c)
+			if dimension % 2 != 0 {
+				cost = cellCost(c, k)
+			}
+			lines[offset] += cost * float64(overlap(c, across, across + span))
+		}
+		total += lines[offset]
+	}
+	if total <= 0.0 {
+		return halve(area, dimension, fraction)
+	}
+	
+	// Split after the line which takes the running cost past the fraction, leaving at least one line on each side.
+	var running float64
+	for offset := uint32(0); offset + 1 < size; offset++ {
+		running += lines[offset]
+		if running >= fraction * total {
+			return offset + 1
+		}
+	}
+	return size - 1
+}
+
+// snapshot returns a copy of a cost map's estimates, row by row.
+func (m *costMap) snapshot() []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	return append([]float64(nil), m.costs...)
+}
+
+// restore replaces a cost map's estimates with a snapshot of another cost map of the same size, returning false (and leaving the estimates alone) if the sizes differ.
+func (m *costMap) restore(costs []float64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	if len(costs) != len(m.costs) {
+		return false
+	}
+	copy(m.costs, costs)
+	return true
+}
\ No newline at end of file
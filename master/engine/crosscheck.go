@@ -0,0 +1,73 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"math"
+	"log"
+)
+
+// crossCheckTolerance is the largest mean difference (in colour levels, out of 255) between the channels of two workers' results for the same partition for them to agree.
+// Workers trace the same rays with the same random numbers, so results which agree should be nearly identical.
+const crossCheckTolerance float64 = 1.0
+
+// candidate is one worker's results for a partition, waiting to be cross-checked against the others.
+type candidate struct {
+	results *comms.TraceResults
+	address string	// The address of the worker which traced the results.
+}
+
+// agree returns whether two sets of trace results are close enough to have been traced correctly by both workers.
+func agree(a, b *comms.TraceResults) bool {
+	if a.Count() != b.Count() {
+		return false
+	}
+	if a.Count() == 0 {
+		return true
+	}
+	
+	// Find the mean difference (in colour levels, out of 255) between the channels of each pixel.
+	var sum float64
+	for i := 0; i < a.Count(); i++ {
+		ar, ag, ab := a.Colour(i).Floats()
+		br, bg, bb := b.Colour(i).Floats()
+		sum += 255.0 * (math.Abs(ar - br) + math.Abs(ag - bg) + math.Abs(ab - bb))
+	}
+	return sum / float64(3 * a.Count()) <= crossCheckTolerance
+}
+
+// crossCheck picks the results for a partition which the most workers agree on, from those traced by every worker that responded.
+// Ties go to whichever results arrived first.
+// Every worker whose results disagree with the chosen results is flagged in the pool's statistics.
+func (e *Engine) crossCheck(frame uint, order *comms.WorkOrder, candidates []candidate) candidate {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	
+	// Count how many other workers agree with each worker.
+	agreements := make([]int, len(candidates), len(candidates))
+	for i := range candidates {
+		for j := i + 1; j < len(candidates); j++ {
+			if agree(candidates[i].results, candidates[j].results) {
+				agreements[i] += 1
+				agreements[j] += 1
+			}
+		}
+	}
+	best := 0
+	for i := range candidates {
+		if agreements[i] > agreements[best] {
+			best = i
+		}
+	}
+	
+	// Flag the workers which disagree.
+	for i := range candidates {
+		if i != best && !agree(candidates[best].results, candidates[i].results) {
+			log.Printf("Frame %d found worker \"%s\" disagreeing with worker \"%s\" over partition (%d, %d).\n", frame, candidates[i].address, candidates[best].address, order.GetX(), order.GetY())
+			e.workers.Flag(candidates[i].address)
+		}
+	}
+	
+	return candidates[best]
+}
\ No newline at end of file
@@ -0,0 +1,175 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"fmt"
+	"math"
+)
+
+// dirtyMargin is the number of pixels added to each side of a dirty region, to cover rounding in the projection.
+const dirtyMargin int = 1
+
+// MoveObject moves the object with some id to a new position.
+// If the camera doesn't move before the next frame, only the part of the screen covered by the object (before and after the move) is retraced.
+// Note that shadows cast by the object outside of that part of the screen are not updated until the whole screen is retraced.
+func (e *Engine) MoveObject(id uint, pos geom.Vector) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	before, after, exists := e.scene.Mutable().MoveObject(id, pos)
+	if !exists {
+		return fmt.Errorf("No object with id %d.", id)
+	}
+	
+	e.version += 1
+	e.dirty = append(e.dirty, before, after)
+	return nil
+}
+
+// MoveLight moves the light with some index to a new position.
+// Because a light can affect any part of the screen, the whole screen is retraced in the next frame.
+func (e *Engine) MoveLight(index int, pos geom.Vector) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if !e.scene.Mutable().MoveLight(index, pos) {
+		return fmt.Errorf("No light with index %d.", index)
+	}
+	
+	e.version += 1
+	e.allDirty = true
+	return nil
+}
+
+// SwitchLight switches the light with some index on or off.
+// Because a light can affect any part of the screen, the whole screen is retraced in the next frame.
+func (e *Engine) SwitchLight(index int, on bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if !e.scene.Mutable().SwitchLight(index, on) {
+		return fmt.Errorf("No light with index %d.", index)
+	}
+	
+	e.version += 1
+	e.allDirty = true
+	return nil
+}
+
+// ToggleLight switches the light with some index on if it's off, or off if it's on.
+// The first return value is whether the light is now on.
+func (e *Engine) ToggleLight(index int) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	lights := e.scene.Mutable().Lights
+	if index < 0 || index >= len(lights) {
+		return false, fmt.Errorf("No light with index %d.", index)
+	}
+	on := lights[index].Off
+	e.scene.Mutable().SwitchLight(index, on)
+	
+	e.version += 1
+	e.allDirty = true
+	return on, nil
+}
+
+// SetTimeOfDay moves the scene's sun to where it is at some hour.
+// Because the sun can light any part of the screen, the whole screen is retraced in the next frame.
+func (e *Engine) SetTimeOfDay(hour float64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if !e.scene.Mutable().SetTimeOfDay(hour) {
+		return fmt.Errorf("The scene has no sun.")
+	}
+	
+	e.version += 1
+	e.allDirty = true
+	return nil
+}
+
+// RenderArea starts rendering a new frame of the scene as seen by cam, retracing only the width by height area of the screen with its top left corner at (x, y).
+// The rest of the frame is kept from the previous one, even if the camera has moved, so this is meant for rendering a frame a piece at a time.
+// Like RenderFrame, this function does not wait for the frame to be drawn.
+func (e *Engine) RenderArea(cam state.Camera, x, y, width, height uint) error {
+	if width == 0 || height == 0 || x + width > e.opts.Width || y + height > e.opts.Height {
+		return fmt.Errorf("The %dx%d area at (%d, %d) is not within the %dx%d screen.", width, height, x, y, e.opts.Width, e.opts.Height)
+	}
+	
+	e.mu.Lock()
+	e.forced = &comms.WorkOrder{X: uint32(x), Y: uint32(y), Width: uint32(width), Height: uint32(height)}
+	e.version += 1
+	e.mu.Unlock()
+	
+	return e.RenderFrame(cam)
+}
+
+// dirtyArea finds the area of the screen which must be retraced for a new frame as seen by cam, and resets the dirty state.
+// The second return value is false if none of the screen needs to be retraced.
+// This function assumes the caller holds the engine's lock.
+func (e *Engine) dirtyArea(cam state.Camera) (comms.WorkOrder, bool) {
+	whole := comms.WorkOrder{X: 0, Y: 0, Width: uint32(e.opts.Width), Height: uint32(e.opts.Height)}
+	boxes, allDirty, forced := e.dirty, e.allDirty, e.forced
+	e.dirty, e.allDirty, e.forced = nil, false, nil
+	
+	// If an area was asked for outright, only that area is retraced.
+	if forced != nil {
+		return *forced, true
+	}
+	
+	// If the camera has moved (or the last frame was incomplete), the whole screen must be retraced.
+	if allDirty || e.lastKey == nil || e.lastKey.cam != cam {
+		return whole, true
+	}
+	
+	// Otherwise, find the smallest area of the screen containing the projection of every dirty box.
+	width, height := int(e.opts.Width), int(e.opts.Height)
+	xMin, yMin := math.Inf(1), math.Inf(1)
+	xMax, yMax := math.Inf(-1), math.Inf(-1)
+	for _, box := range boxes {
+		for corner := 0; corner < 8; corner++ {
+			// Pick the corner's coordinate along each axis.
+			var p [3]float64
+			for axis := 0; axis < 3; axis++ {
+				p[axis] = box.PointCoord(axis)
+				if corner & (1 << uint(axis)) != 0 {
+					p[axis] += box.LengthsCoord(axis)
+				}
+			}
+			
+			// If any corner is behind the camera, the box's projection could cover the whole screen.
+			x, y, visible := cam.PointToPixel(geom.Vector{p[0], p[1], p[2]}, width, height)
+			if !visible {
+				return whole, true
+			}
+			
+			xMin, xMax = math.Min(xMin, x), math.Max(xMax, x)
+			yMin, yMax = math.Min(yMin, y), math.Max(yMax, y)
+		}
+	}
+	
+	// Clamp the area to the screen.
+	left := clampInt(int(math.Floor(xMin)) - dirtyMargin, 0, width)
+	right := clampInt(int(math.Ceil(xMax)) + dirtyMargin + 1, 0, width)
+	top := clampInt(int(math.Floor(yMin)) - dirtyMargin, 0, height)
+	bottom := clampInt(int(math.Ceil(yMax)) + dirtyMargin + 1, 0, height)
+	if len(boxes) == 0 || left >= right || top >= bottom {
+		return comms.WorkOrder{}, false
+	}
+	
+	return comms.WorkOrder{X: uint32(left), Y: uint32(top), Width: uint32(right - left), Height: uint32(bottom - top)}, true
+}
+
+// clampInt restricts an integer to the range [min, max].
+func clampInt(value, min, max int) int {
+	if value < min {
+		return min
+	}else if value > max {
+		return max
+	}
+	return value
+}
\ No newline at end of file
@@ -0,0 +1,833 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/chaos"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/throttle"
+	"github.com/mwindels/distributed-raytracer/shared/bind"
+	"github.com/mwindels/distributed-raytracer/master/pool"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"github.com/mwindels/distributed-raytracer/worker/serve"
+	"github.com/mwindels/rtreego"
+	"google.golang.org/grpc"
+	"encoding/gob"
+	"context"
+	"image"
+	"bytes"
+	"sync"
+	"time"
+	"net"
+	"log"
+	"fmt"
+)
+
+// DefaultTraceTimeout is the trace timeout used by engines whose options do not specify one.
+const DefaultTraceTimeout uint = 2000
+
+// workerPollFrequency controls how often (in milliseconds) the pool is checked while waiting for workers to join.
+const workerPollFrequency uint = 100
+
+// Canvas represents a surface onto which an engine draws its frames.
+// Calls to a canvas are made by one frame at a time, in the order the frames were requested.
+// Frames are drawn over the top of one another, so pixels which are not set keep their colour from the previous frame.
+type Canvas interface {
+	// Set colours the pixel (x, y) of the canvas.
+	Set(x, y int, c colour.RGB)
+	
+	// Update displays everything drawn so far, while a frame is still being drawn.
+	Update()
+	
+	// Present displays a frame once it has been completely drawn.
+	Present()
+}
+
+// NullCanvas implements the Canvas interface without drawing anything, for engines which run without a display.
+// Frames drawn onto a null canvas can still be captured using Snapshot.
+type NullCanvas struct{}
+
+// Set does nothing.
+func (c NullCanvas) Set(x, y int, col colour.RGB) {}
+
+// Update does nothing.
+func (c NullCanvas) Update() {}
+
+// Present does nothing.
+func (c NullCanvas) Present() {}
+
+// Options controls the behaviour of an engine.
+type Options struct {
+	Width, Height uint		// The dimensions (in pixels) of every frame.
+	RegistrationPort uint	// The port on which workers register with the engine.
+	Bind string				// The address, network interface, or Unix domain socket on which workers register (every interface if empty, see bind.Host).
+	AllowWorkers []string	// The IP addresses and CIDR ranges workers may register from (anywhere if empty).
+	DenyWorkers []string	// The IP addresses and CIDR ranges workers may never register from, even if they are allowed.
+	MaxWorkers uint			// The maximum number of workers (including local workers) in the pool at once, beyond which registrations are refused (unlimited if zero).
+	RegistrationRate uint	// The most times per minute a worker's host can register, beyond which registrations are refused (unlimited if zero).
+	TraceTimeout uint		// How long (in milliseconds) the engine waits before rejecting a BulkTrace call, until a worker's latencies are known.
+	FixedTimeout bool		// Whether every BulkTrace call waits TraceTimeout, rather than a timeout derived from the worker's latency and the partition's area.
+	SpotChecks uint			// The number of pixels of each frame the engine traces again itself, to check its workers' results (none if zero).
+	Redundancy uint			// The number of workers assigned to each partition, whose results are cross-checked if there are several (DefaultRedundancy if zero).
+	MaxWorkerTasks uint		// The maximum number of partitions a worker can be tracing at once (unlimited if zero).
+	MaxFramesInFlight uint	// The maximum number of frames that can be rendering at once (unlimited if zero).
+	LatestOnly bool			// Whether frames requested while the pipeline is full are coalesced, rendering only the newest of them once there is room (see RenderFrame).
+	FrameBudget uint		// How long (in milliseconds) each frame should take, beyond which frames are traced at a reduced resolution (never reduced if zero).
+	MaxScale uint			// The most the resolution of each frame is divided by when reducing it (DefaultMaxScale if zero).
+	FoveaRadius uint		// The radius (in pixels) around the focus point (the mouse cursor, or wherever SetFocus last put it) traced at the frame's own resolution, beyond which the resolution falls off (no foveation if zero).
+	PeripheryScale uint		// The most the resolution at the edge of the screen is divided by when foveating (DefaultPeripheryScale if zero).
+	Filter Filter			// How partitions traced at a reduced resolution are stretched over the screen.
+	BitDepth uint			// The number of bits per channel of the colours traced by workers (8, 10, or 16; 8 if zero), above which snapshots have 16 bits per channel.
+	Checkerboard bool		// Whether each frame only traces half its pixels, in a checkerboard which alternates between frames, filling in the rest from the frame before it.
+	FrameDeadline uint		// How long (in milliseconds) after a frame is requested its partitions are abandoned, by the engine and its workers (no deadline if zero).
+	TileOrder TileOrder		// The order in which the partitions of each frame are dispatched.
+	Partitioning Partitioning	// How the area of each frame is split between workers.
+	PartitionWidth uint		// The largest width (in pixels) the smallest partitions of each frame can be, when there are enough workers to split frames that finely (DefaultPartitionWidth if zero).
+	PartitionHeight uint	// The largest height (in pixels) the smallest partitions of each frame can be (DefaultPartitionHeight if zero); with a width as wide as the frame, frames are split into strips of rows.
+	LocalWorkers uint		// The number of workers to run inside the engine's own process.
+	Chaos *chaos.Monkey		// Injects faults into the engine's RPCs and kills its workers (no faults if nil).
+	FrameDone func(FrameStats)	// Called with each frame's statistics once it has been drawn or skipped (if not nil).
+	RemoteControl bool		// Whether external programs can move the camera through the registration port.
+	ResultRate uint			// The most bytes per second received from each remote worker (unlimited if zero).
+	AssetRate uint			// The most bytes per second of scene data sent to each registering worker (unlimited if zero).
+	AOVs uint32				// A bit mask of the comms.AOV buffers traced alongside each frame (depth makes reprojection account for camera movement).
+	Composition Composition	// How the passes of each frame are combined (the beauty pass alone if zero).
+	PostChain PostChain		// The post-processors applied, in order, to each frame before it is displayed (none if empty).
+	Samples uint			// The number of rays traced through each pixel (the scene's, or else one, if zero).
+	MirrorDepth uint		// The most reflections and refractions a ray goes through when using Phong shading (the scene's, or else tracer.DefaultMirrorDepth, if zero).
+	PathDepth uint			// The most surfaces a path bounces off of when path tracing (the scene's, or else tracer.DefaultPathDepth, if zero).
+	AreaLightSamples uint	// The number of points on the scene's emitters which light each point when using Phong shading (the scene's, or else tracer.DefaultAreaLightSamples, if zero).
+	Pattern tracer.Pattern	// Where within each pixel the rays are traced.
+	Integrator tracer.Integrator	// How the colour of each ray is found.
+	ProfileDir string		// The directory holding a tuning profile for each scene, which is applied when the engine is created and saved when it is closed (no profiles if empty).
+	StatsOut string			// The file to which each frame's statistics are written, as CSV if it ends in ".csv" and as JSON lines otherwise (none if empty).
+	Priority int			// How urgently the engine's work orders are traced, when it shares its workers with other sessions (see NewSession); workers trace the orders of higher priorities first.
+	Canvas Canvas			// The canvas onto which frames are drawn.
+}
+
+// pendingFrame is a frame which was requested while the pipeline was full, waiting for room to render.
+type pendingFrame struct {
+	cam state.Camera
+	requested time.Time
+	dropped uint	// The number of frames requested before this one which it replaced.
+}
+
+// frameKey identifies the contents of a frame.
+// Two frames with the same key would look identical.
+type frameKey struct {
+	version uint
+	cam state.Camera
+}
+
+// Engine coordinates a pool of workers to render frames of a scene.
+type Engine struct {
+	mu sync.RWMutex	// Used to protect the scene's state, the frame counter, and the coordinator chain.
+	scene state.Environment
+	version uint		// Incremented whenever the scene (other than its camera) changes.
+	frame uint
+	lastKey *frameKey	// The key of the most recently requested frame, or nil if that frame needs to be redrawn.
+	dirty []*rtreego.Rect	// The bounding boxes of everything which has changed since the last frame was requested.
+	allDirty bool			// Whether something has changed since the last frame which could affect the whole screen.
+	forced *comms.WorkOrder	// The area of the screen the next frame must retrace, whatever else has changed (nil if none was asked for, see RenderArea).
+	focusX, focusY int	// The point on the screen (usually the cursor, starting at the centre) which partitions are dispatched around (when using OrderFocus), and foveated frames are traced in full around.
+	composition Composition	// How the passes of each frame are combined.
+	post PostChain			// The post-processors applied to each frame (replaced, rather than changed, so that frames in flight can hold on to it).
+	redundancy uint			// The number of workers assigned to each partition of each frame (see SetRedundancy).
+	scale uint				// How much the resolution of the next frame is divided by (one at full resolution).
+	refining bool			// Whether the next frame is traced in full, whatever the scale, checkerboard, and foveation.
+	reduced bool			// Whether the most recently finished frame was traced at a reduced resolution, in a checkerboard, or foveated.
+	coordinatorIn chan struct{}	// Recieves a value once the most recently requested frame has been drawn.
+	inFlight chan struct{}		// Holds a value for every frame currently rendering (nil if the number of frames is unlimited, or if only the latest frame is kept).
+	
+	pendingMu sync.Mutex		// Used to protect the pending frame and the number of frames rendering (when only the latest frame is kept).
+	pendingIdle *sync.Cond		// Signalled whenever there is no pending frame, and none is being dispatched.
+	pending *pendingFrame		// The newest frame waiting for room in the pipeline (nil if there is none).
+	rendering uint				// The number of frames currently rendering.
+	dispatching uint			// The number of pending frames which have left the queue but haven't started rendering.
+	droppedFrames uint			// The number of frames which were replaced before they could render.
+	
+	workers *pool.Pool		// The workers which render the engine's frames (shared with the engine's owner, if it has one).
+	owner *Engine			// The engine whose workers and registrar this engine shares (nil if this engine has its own, see NewSession).
+	checker *serve.Tracer	// Traces pixels again to spot check the workers' results (nil if there are no spot checks, replaced along with the scene).
+	registrar *grpc.Server
+	admission *admission	// Decides which workers may register.
+	sceneHash string		// A hash of the scene's immutable parts, so that workers which have cached the scene needn't be sent it (replaced along with the scene).
+	neverIdle map[string]bool	// The addresses of the registered workers which never idle, and so never register again on their own (protected by mu).
+	loading bool			// Whether a new scene is being loaded, during which no frames are rendered and no workers register (see LoadScene).
+	opts Options
+	given Options			// The options as they were given, before the scene's limits were filled in (so that they can be filled in again from a new scene).
+	stopChaos chan struct{}	// Closed when the engine closes, to stop killing workers.
+	
+	previous *frameBuffer	// The most recently drawn frame (only used by the coordinator whose turn it is to draw).
+	previousComplete bool	// Whether every pixel of the previous frame was traced for its own scene.
+	presented *frameBuffer	// The most recently drawn frame, which is never modified (protected by mu).
+	
+	affinityMu sync.Mutex		// Used to protect the affinity map.
+	affinity map[tile]string	// Maps each tile to the address of the worker which most recently drew it (the tiles never overlap, see rememberWorker).
+	costs *costMap				// Estimates how long each region of the screen takes to trace.
+	statsOut *statsWriter		// Writes each frame's statistics to a file (nil if they aren't written).
+	reports sync.WaitGroup		// Counts the frames whose statistics haven't been reported yet, so that they're all written before the engine is closed.
+}
+
+// withDefaults returns a copy of some options with every unset value replaced by its default, or by the scene's own limits.
+func (opts Options) withDefaults(scene state.Environment) (Options, error) {
+	if opts.Canvas == nil {
+		return opts, fmt.Errorf("No canvas to draw frames onto.")
+	}
+	if opts.TraceTimeout == 0 {
+		opts.TraceTimeout = DefaultTraceTimeout
+	}
+	if opts.Composition == (Composition{}) {
+		opts.Composition = DefaultComposition
+	}
+	if opts.Redundancy == 0 {
+		opts.Redundancy = DefaultRedundancy
+	}
+	if opts.MaxScale == 0 {
+		opts.MaxScale = DefaultMaxScale
+	}
+	if opts.PeripheryScale == 0 {
+		opts.PeripheryScale = DefaultPeripheryScale
+	}
+	if opts.PartitionWidth == 0 {
+		opts.PartitionWidth = DefaultPartitionWidth
+	}
+	if opts.PartitionHeight == 0 {
+		opts.PartitionHeight = DefaultPartitionHeight
+	}
+	
+	// Take the scene's limits on how much work is done for each pixel, wherever none were given.
+	limits := state.Limits{Samples: opts.Samples, MirrorDepth: opts.MirrorDepth, PathDepth: opts.PathDepth, AreaLightSamples: opts.AreaLightSamples}.Or(scene.Limits())
+	opts.Samples, opts.MirrorDepth, opts.PathDepth, opts.AreaLightSamples = limits.Samples, limits.MirrorDepth, limits.PathDepth, limits.AreaLightSamples
+	
+	if !comms.ValidBitDepth(uint32(opts.BitDepth)) {
+		return opts, fmt.Errorf("Colours can't be traced with %d bits per channel.", opts.BitDepth)
+	}
+	return opts, nil
+}
+
+// newEngine sets up an engine which renders scene using a pool of workers, without accepting registrations or starting any workers.
+// The options are assumed to have their defaults filled in.
+func newEngine(scene state.Environment, sceneHash string, workers *pool.Pool, opts Options) *Engine {
+	e := &Engine{
+		scene: scene,
+		coordinatorIn: make(chan struct{}, 1),
+		workers: workers,
+		sceneHash: sceneHash,
+		opts: opts,
+		composition: opts.Composition,
+		redundancy: opts.Redundancy,
+		post: append(PostChain(nil), opts.PostChain...),
+		focusX: int(opts.Width / 2),
+		focusY: int(opts.Height / 2),
+		scale: 1,
+		stopChaos: make(chan struct{}),
+		affinity: make(map[tile]string),
+		neverIdle: make(map[string]bool),
+		costs: newCostMap(opts.Width, opts.Height),
+	}
+	e.pendingIdle = sync.NewCond(&e.pendingMu)
+	
+	// Start from what earlier sessions learned about the scene (if possible).
+	if opts.ProfileDir != "" {
+		if err := e.loadProfile(); err != nil {
+			log.Printf("Could not load the scene's profile: %v.\n", err)
+		}
+	}
+	
+	// Set up a tracer of our own to spot check the workers (if necessary).
+	if opts.SpotChecks > 0 {
+		e.checker = serve.NewTracer(scene, opts.Width, opts.Height, serve.Options{})
+	}
+	
+	// Get the initial coordinator channel ready.
+	e.coordinatorIn <- struct{}{}
+	
+	// Limit the number of frames in flight (if necessary).
+	// If only the latest frame is kept, the frames in flight are counted instead, so that requests needn't block.
+	if opts.MaxFramesInFlight > 0 && !opts.LatestOnly {
+		e.inFlight = make(chan struct{}, opts.MaxFramesInFlight)
+	}
+	
+	return e
+}
+
+// New creates an engine which renders scene, and starts accepting worker registrations.
+func New(scene state.Environment, opts Options) (*Engine, error) {
+	given := opts
+	opts, err := opts.withDefaults(scene)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Hash the scene, so that workers can tell whether they've cached it.
+	sceneHash, err := scene.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("Could not hash the scene: %v.", err)
+	}
+	
+	// Work out which workers may register.
+	admission, err := newAdmission(opts)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Create a listener for the workers.
+	listenAddr, err := bind.Address(opts.Bind, opts.RegistrationPort)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := bind.Listen(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Limit the rate at which registering workers are sent the scene.
+	listener = throttle.NewListener(listener, 0, opts.AssetRate)
+	
+	// Inject faults into calls to the workers (if necessary).
+	poolOpts := pool.Options{MaxTasks: opts.MaxWorkerTasks, MaxWorkers: opts.MaxWorkers, FixedTimeouts: opts.FixedTimeout}
+	if opts.Chaos != nil {
+		poolOpts.DialOptions = append(poolOpts.DialOptions, grpc.WithUnaryInterceptor(opts.Chaos.UnaryClientInterceptor()))
+	}
+	
+	// Limit the rate at which results are received from each worker (if necessary).
+	// Local workers use their own dialers, so they are never limited.
+	if opts.ResultRate > 0 {
+		poolOpts.DialOptions = append(poolOpts.DialOptions, grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			conn, err := bind.Dial(ctx, address)
+			if err != nil {
+				return nil, err
+			}
+			return throttle.NewConn(conn, opts.ResultRate, 0), nil
+		}))
+	}
+	
+	// Set up the engine.
+	workers := pool.NewPool(8, poolOpts)
+	e := newEngine(scene, sceneHash, &workers, opts)
+	e.given = given
+	e.registrar = grpc.NewServer()
+	e.admission = admission
+	
+	// Spin up the local workers (if any).
+	if err := e.startLocalWorkers(opts.LocalWorkers); err != nil {
+		listener.Close()
+		e.workers.Destroy()
+		return nil, fmt.Errorf("Could not start local workers: %v.", err)
+	}
+	
+	// Open the file to which each frame's statistics are written (if necessary).
+	if opts.StatsOut != "" {
+		if e.statsOut, err = newStatsWriter(opts.StatsOut); err != nil {
+			listener.Close()
+			e.workers.Destroy()
+			return nil, fmt.Errorf("Could not open the statistics file: %v.", err)
+		}
+	}
+	
+	// Spin off a goroutine which kills workers on a schedule (if necessary).
+	if opts.Chaos != nil && opts.Chaos.KillFrequency() > 0 {
+		go e.killWorkers()
+	}
+	
+	// Spin off the registration server.
+	comms.RegisterRegistrationServer(e.registrar, &Registrar{engine: e})
+	if opts.RemoteControl {
+		comms.RegisterControlServer(e.registrar, &Controller{engine: e})
+	}
+	go func() {
+		if err := e.registrar.Serve(listener); err != nil {
+			log.Printf("Registrar interrupted: %v.\n", err)
+		}
+	}()
+	
+	return e, nil
+}
+
+// NewSession creates another engine which renders the same scene as e, using e's workers, alongside e's own frames.
+// The session starts from the scene as e sees it now, but has its own copy of it, so that it can move the camera (or anything else) without affecting e.
+// Each session has its own options, such as its own resolution, quality, canvas, and priority (see Options), except that the options which control workers (their registration, pool, and local workers, as well as fault injection and tuning profiles) are left to e.
+// A session must be closed before e is, since closing e disconnects from the workers.
+func (e *Engine) NewSession(opts Options) (*Engine, error) {
+	// Sessions of sessions share the same workers.
+	owner := e
+	if e.owner != nil {
+		owner = e.owner
+	}
+	
+	// Leave the workers to the engine which owns them.
+	opts.RegistrationPort, opts.Bind, opts.AllowWorkers, opts.DenyWorkers = 0, "", nil, nil
+	opts.MaxWorkers, opts.RegistrationRate, opts.MaxWorkerTasks, opts.FixedTimeout, opts.LocalWorkers = 0, 0, 0, false, 0
+	opts.Chaos, opts.RemoteControl, opts.ResultRate, opts.AssetRate, opts.ProfileDir = nil, false, 0, 0, ""
+	
+	e.mu.RLock()
+	scene, err := e.scene.Copy()
+	e.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("Could not copy the scene: %v.", err)
+	}
+	if opts, err = opts.withDefaults(scene); err != nil {
+		return nil, err
+	}
+	
+	// Set up the session.
+	s := newEngine(scene, owner.sceneHash, owner.workers, opts)
+	s.owner = owner
+	
+	// Open the file to which each frame's statistics are written (if necessary).
+	if opts.StatsOut != "" {
+		if s.statsOut, err = newStatsWriter(opts.StatsOut); err != nil {
+			return nil, fmt.Errorf("Could not open the statistics file: %v.", err)
+		}
+	}
+	
+	return s, nil
+}
+
+// RenderFrame starts rendering a new frame of the scene as seen by cam.
+// This function does not wait for the frame to be drawn; frames are drawn onto the engine's canvas in the order they were requested.
+// However, if the engine already has its maximum number of frames in flight, this function blocks until one of them is drawn.
+// If the engine only keeps the latest frame, it doesn't block; instead the frame waits until there is room, replacing (and dropping) any frame already waiting.
+// If the new frame would be identical to the last frame requested, and that frame was (or is being) completely drawn, nothing is rendered.
+// If only parts of the scene have changed since the last frame, and the camera hasn't moved, only the affected area of the screen is retraced.
+func (e *Engine) RenderFrame(cam state.Camera) error {
+	requested := time.Now()
+	
+	// If nothing has changed since the last frame, don't bother rendering.
+	key := frameKey{cam: cam}
+	if e.unchanged(&key) {
+		return nil
+	}
+	
+	// Wait for room in the pipeline.
+	// We don't hold the lock here, so that registrations aren't blocked while waiting.
+	if e.opts.LatestOnly {
+		if !e.admit(cam, requested) {
+			return nil
+		}
+	}else if e.inFlight != nil {
+		e.inFlight <- struct{}{}
+	}
+	
+	return e.render(key, requested, 0)
+}
+
+// admit finds whether a frame can start rendering straight away, when only the latest frame is kept.
+// If the pipeline is full, the frame becomes the pending frame instead, dropping the frame that was pending before it.
+func (e *Engine) admit(cam state.Camera, requested time.Time) bool {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	
+	limit := e.opts.MaxFramesInFlight
+	if limit == 0 {
+		limit = 1
+	}
+	if e.rendering < limit {
+		e.rendering += 1
+		return true
+	}
+	
+	// Replace the pending frame (if there is one).
+	var dropped uint
+	if e.pending != nil {
+		dropped = e.pending.dropped + 1
+		e.droppedFrames += 1
+	}
+	e.pending = &pendingFrame{cam: cam, requested: requested, dropped: dropped}
+	return false
+}
+
+// dispatch renders a pending frame, using the room in the pipeline left by the frame before it.
+// This function should be spun off as a goroutine.
+func (e *Engine) dispatch(p *pendingFrame) {
+	defer func() {
+		e.pendingMu.Lock()
+		defer e.pendingMu.Unlock()
+		
+		e.dispatching -= 1
+		if e.pending == nil && e.dispatching == 0 {
+			e.pendingIdle.Broadcast()
+		}
+	}()
+	
+	// The scene might have changed back while the frame was waiting.
+	key := frameKey{cam: p.cam}
+	if e.unchanged(&key) {
+		e.frameDone()
+		return
+	}
+	
+	if err := e.render(key, p.requested, p.dropped); err != nil {
+		log.Printf("Could not render a pending frame: %v.\n", err)
+	}
+}
+
+// render renders a frame which has room in the pipeline, having dropped some frames requested before it.
+func (e *Engine) render(key frameKey, requested time.Time, dropped uint) error {
+	cam := key.cam
+	
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	// Frames requested while a new scene is loaded are dropped, since the workers are being replaced.
+	if e.loading {
+		e.frameDone()
+		return nil
+	}
+	
+	// Find the area of the screen which needs to be retraced.
+	key.version = e.version
+	area, dirty := e.dirtyArea(cam)
+	e.lastKey = &key
+	if !dirty {
+		e.frameDone()
+		return nil
+	}
+	
+	frame := e.frame
+	e.frame += 1
+	
+	// Move the scene's camera.
+	scene := e.scene.Mutable()
+	scene.Cam = cam
+	
+	// Trace whichever AOVs are needed, both by the engine and by the current composition.
+	comp, post, redundancy := e.composition, e.post, e.redundancy
+	area.Aovs = e.opts.AOVs | comp.aovs()
+	area.Samples = uint32(e.opts.Samples)
+	area.MirrorDepth = uint32(e.opts.MirrorDepth)
+	area.PathDepth = uint32(e.opts.PathDepth)
+	area.AreaLightSamples = uint32(e.opts.AreaLightSamples)
+	area.Pattern = comms.SamplingPattern(e.opts.Pattern)
+	area.Integrator = comms.Integrator(e.opts.Integrator)
+	area.Scale = uint32(e.scale)
+	area.BitDepth = uint32(e.opts.BitDepth)
+	area.ScreenWidth, area.ScreenHeight = uint32(e.opts.Width), uint32(e.opts.Height)
+	if e.opts.Checkerboard {
+		area.Checkerboard = checkerboardParity(frame)
+	}
+	if e.refining {
+		area.Scale = 1
+		area.Checkerboard = 0
+	}
+	if e.opts.FrameDeadline > 0 {
+		area.Deadline = requested.Add(time.Millisecond * time.Duration(e.opts.FrameDeadline)).UnixNano()
+	}
+	
+	// Encode the current state of the scene.
+	stats := FrameStats{Frame: frame, Dropped: dropped, Scale: uint(area.Scale), Checkerboard: area.Checkerboard != 0, Requested: requested}
+	stats.Foveated = e.opts.FoveaRadius > 0 && !e.refining
+	encodeStart := time.Now()
+	writer := bytes.Buffer{}
+	if err := gob.NewEncoder(&writer).Encode(scene); err != nil {
+		e.lastKey = nil
+		e.frameDone()
+		return fmt.Errorf("Could not encode frame %d's scene: %v.", frame, err)
+	}
+	stats.Encode = time.Since(encodeStart)
+	
+	// Spin off a coordinator for the new frame.
+	coordinatorIn, coordinatorOut := e.coordinatorIn, make(chan struct{}, 1)
+	e.reports.Add(1)
+	go func() {
+		e.coordinate(writer.Bytes(), cam, comp, post, redundancy, area, stats, requested, coordinatorIn, coordinatorOut)
+		e.frameDone()
+	}()
+	e.coordinatorIn = coordinatorOut
+	
+	return nil
+}
+
+// Camera returns the camera of the most recently requested frame.
+func (e *Engine) Camera() state.Camera {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.scene.Mutable().Cam
+}
+
+// present records a frame buffer as the most recently drawn frame.
+func (e *Engine) present(fb *frameBuffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	e.presented = fb
+}
+
+// unchanged returns whether a frame with some key would be identical to the last frame requested.
+// The key's version is filled in with the scene's current version.
+func (e *Engine) unchanged(key *frameKey) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	key.version = e.version
+	return e.lastKey != nil && *e.lastKey == *key
+}
+
+// redraw marks a frame as incomplete, so that if it is the last frame requested, an identical frame will be rendered again.
+func (e *Engine) redraw(frame uint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if frame + 1 == e.frame {
+		e.lastKey = nil
+	}
+}
+
+// killWorkers removes a random worker from the pool on the schedule set by the engine's fault injection, until the engine closes.
+// Remote workers which are killed must register again to rejoin the pool, while local workers are gone for good.
+func (e *Engine) killWorkers() {
+	ticker := time.NewTicker(e.opts.Chaos.KillFrequency())
+	defer ticker.Stop()
+	
+	for {
+		select{
+		case <-ticker.C:
+			if workers := e.workers.Stats(); len(workers) > 0 {
+				victim := workers[e.opts.Chaos.Intn(len(workers))].Address
+				log.Printf("Killing worker \"%s\" by fault injection.\n", victim)
+				e.workers.Remove(victim)
+			}
+		case <-e.stopChaos:
+			return
+		}
+	}
+}
+
+// frameDone makes room in the pipeline for another frame.
+// If only the latest frame is kept and a frame is pending, the room is handed straight to the pending frame.
+func (e *Engine) frameDone() {
+	if e.opts.LatestOnly {
+		e.pendingMu.Lock()
+		defer e.pendingMu.Unlock()
+		
+		if e.pending == nil {
+			e.rendering -= 1
+			return
+		}
+		
+		// Dispatch the pending frame without blocking, since the engine's lock may be held.
+		p := e.pending
+		e.pending = nil
+		e.dispatching += 1
+		go e.dispatch(p)
+		return
+	}
+	
+	if e.inFlight != nil {
+		<-e.inFlight
+	}
+}
+
+// DroppedFrames returns the number of frames which were replaced by newer frames before they could render.
+// Frames are only dropped when the engine keeps only the latest frame.
+func (e *Engine) DroppedFrames() uint {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	
+	return e.droppedFrames
+}
+
+// Frames returns the number of frames that have been requested from the engine.
+func (e *Engine) Frames() uint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.frame
+}
+
+// AddWorker adds a worker to the engine's pool without it having to register.
+// Any dial options are used when connecting to the worker.
+func (e *Engine) AddWorker(address string, opts ...grpc.DialOption) error {
+	return e.workers.Add(address, opts...)
+}
+
+// LoadScene replaces the engine's scene with another (such as one read from a different file).
+// The engine's options are kept, except that the limits on how much work is done for each pixel are taken from the new scene wherever none were given.
+// Workers only hold the scene they were sent when they registered, so every worker is dropped from the pool: local workers are started again with the new scene straight away, while remote workers register again (and are sent the new scene) once their idle timeout lapses.
+// Workers which never idle would never register again, so no scene is loaded while any are registered.
+// No frames are rendered, and no workers register, until the new scene has replaced the old one.
+// Sessions (see NewSession) can't load scenes, and should be closed before their owner loads one, since they share its workers.
+func (e *Engine) LoadScene(scene state.Environment) error {
+	if e.owner != nil {
+		return fmt.Errorf("Sessions can't load scenes, since they share their owner's workers.")
+	}
+	sceneHash, err := scene.Hash()
+	if err != nil {
+		return fmt.Errorf("Could not hash the scene: %v.", err)
+	}
+	opts, err := e.given.withDefaults(scene)
+	if err != nil {
+		return err
+	}
+	
+	// Stop rendering frames until the new scene is in place, unless some worker would never pick it up.
+	err = func() error {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		
+		if e.loading {
+			return fmt.Errorf("Another scene is already being loaded.")
+		}
+		for _, w := range e.workers.Stats() {
+			if e.neverIdle[w.Address] {
+				return fmt.Errorf("The worker at \"%s\" never idles, so it would never register again to be sent the new scene.", w.Address)
+			}
+		}
+		e.loading = true
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		
+		e.loading = false
+	}()
+	
+	// Let the frames of the old scene finish, and keep what was learned about it.
+	e.Wait()
+	if e.opts.ProfileDir != "" {
+		if err := e.saveProfile(); err != nil {
+			log.Printf("Could not save the scene's profile: %v.\n", err)
+		}
+	}
+	
+	// Swap in the new scene, which has to be traced in full, and start learning about it afresh.
+	func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		
+		e.scene, e.sceneHash = scene, sceneHash
+		e.opts.Samples, e.opts.MirrorDepth, e.opts.PathDepth, e.opts.AreaLightSamples = opts.Samples, opts.MirrorDepth, opts.PathDepth, opts.AreaLightSamples
+		e.version += 1
+		e.allDirty = true
+		e.dirty = nil
+		e.lastKey = nil
+		e.neverIdle = make(map[string]bool)
+		if e.opts.SpotChecks > 0 {
+			e.checker = serve.NewTracer(scene, e.opts.Width, e.opts.Height, serve.Options{})
+		}
+	}()
+	e.costs.restore(newCostMap(e.opts.Width, e.opts.Height).snapshot())
+	if e.opts.ProfileDir != "" {
+		if err := e.loadProfile(); err != nil {
+			log.Printf("Could not load the scene's profile: %v.\n", err)
+		}
+	}
+	
+	// Drop the workers holding the old scene, and start the local workers again.
+	for _, w := range e.workers.Stats() {
+		e.workers.Remove(w.Address)
+	}
+	return e.startLocalWorkers(e.opts.LocalWorkers)
+}
+
+// Snapshot returns the most recently drawn frame.
+func (e *Engine) Snapshot() (image.Image, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	if e.presented == nil {
+		return nil, fmt.Errorf("No frames have been drawn.")
+	}
+	return e.presented, nil
+}
+
+// ObjectAt returns the id of the object visible at the pixel (x, y) in the most recently drawn frame (zero if there is no object there).
+// This requires the engine to trace the comms.AOV_OBJECT_ID buffer.
+func (e *Engine) ObjectAt(x, y int) (uint, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	if e.presented == nil {
+		return 0, fmt.Errorf("No frames have been drawn.")
+	}
+	if e.presented.objectIDs == nil {
+		return 0, fmt.Errorf("Object ids are not being traced.")
+	}
+	if x < 0 || x >= e.presented.width || y < 0 || y >= e.presented.height {
+		return 0, fmt.Errorf("Pixel (%d, %d) is off the screen.", x, y)
+	}
+	return e.presented.objectIDs[y * e.presented.width + x], nil
+}
+
+// Clearance returns how far a ray from some position in some (normalized) direction travels before hitting any of the scene's objects, up to far.
+// This lets the camera be kept from moving through the scene.
+func (e *Engine) Clearance(from, dir geom.Vector, far float64) float64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.scene.Mutable().Clearance(from, dir, far)
+}
+
+// WaitForWorkers blocks until at least n workers are in the engine's pool, or until timeout (in milliseconds) has passed.
+func (e *Engine) WaitForWorkers(n uint, timeout uint) error {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(timeout))
+	for e.workers.Size() < n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Only %d of %d workers joined.", e.workers.Size(), n)
+		}
+		time.Sleep(time.Millisecond * time.Duration(workerPollFrequency))
+	}
+	
+	return nil
+}
+
+// WorkerStats returns statistics about every worker currently registered with the engine.
+func (e *Engine) WorkerStats() []pool.WorkerStats {
+	return e.workers.Stats()
+}
+
+// WorkerEvents subscribes to the events of the engine's pool, such as workers joining and leaving (see pool.Pool.Subscribe).
+// Sessions share their events with the engine which owns their workers.
+func (e *Engine) WorkerEvents(buffer uint) (<-chan pool.Event, func()) {
+	return e.workers.Subscribe(buffer)
+}
+
+// Wait blocks until every frame requested so far has been drawn, skipped, or dropped.
+func (e *Engine) Wait() {
+	// Wait for the pending frame (if any) to start rendering.
+	e.pendingMu.Lock()
+	for e.pending != nil || e.dispatching > 0 {
+		e.pendingIdle.Wait()
+	}
+	e.pendingMu.Unlock()
+	
+	e.mu.RLock()
+	coordinatorIn := e.coordinatorIn
+	e.mu.RUnlock()
+	
+	// Take the token from the last coordinator, then hand it back for the next one.
+	<-coordinatorIn
+	coordinatorIn <- struct{}{}
+}
+
+// Close waits for any outstanding frames, then stops accepting registrations and disconnects from all workers.
+// Sessions (see NewSession) only wait for their own frames, leaving the workers to the engine which owns them.
+func (e *Engine) Close() {
+	e.Wait()
+	e.reports.Wait()
+	if e.opts.ProfileDir != "" {
+		if err := e.saveProfile(); err != nil {
+			log.Printf("Could not save the scene's profile: %v.\n", err)
+		}
+	}
+	if e.statsOut != nil {
+		if err := e.statsOut.close(); err != nil {
+			log.Printf("Could not close the statistics file: %v.\n", err)
+		}
+	}
+	close(e.stopChaos)
+	
+	// Sessions leave the workers to the engine which owns them.
+	if e.owner == nil {
+		e.registrar.GracefulStop()
+		e.workers.Destroy()
+	}
+}
\ No newline at end of file
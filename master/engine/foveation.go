@@ -0,0 +1,40 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"math"
+)
+
+// DefaultPeripheryScale is the most the resolution at the edge of the screen is divided by when foveating, for engines whose options do not specify it.
+const DefaultPeripheryScale uint = 4
+
+// minFoveatedWorkers is the smallest number of workers the screen is partitioned for when foveating.
+// Foveation sets a scale for each partition, so the screen is split finely enough for the fovea to be a small part of it, however few workers there are.
+const minFoveatedWorkers uint = 16
+
+// foveate sets the scale of each partition from its distance to the engine's focus point (see focus).
+// Partitions which overlap the fovea keep the frame's own scale, while the scale of the rest grows by one for every fovea radius further out, up to the periphery scale.
+func (e *Engine) foveate(partitions []comms.WorkOrder) {
+	x, y := e.focus()
+	radius := float64(e.opts.FoveaRadius)
+	for i := range partitions {
+		p := &partitions[i]
+		
+		// Find the distance from the focus point to the nearest point of the partition.
+		left, top := float64(p.GetX()), float64(p.GetY())
+		right, bottom := left + float64(p.GetWidth()), top + float64(p.GetHeight())
+		dx := math.Max(math.Max(left - float64(x), float64(x) - right), 0.0)
+		dy := math.Max(math.Max(top - float64(y), float64(y) - bottom), 0.0)
+		distance := math.Sqrt(dx * dx + dy * dy)
+		
+		// Coarsen the partition's scale, but never refine it.
+		scale := uint(math.Ceil(distance / radius)) + 1
+		if scale > e.opts.PeripheryScale {
+			scale = e.opts.PeripheryScale
+		}
+		if scale > uint(p.GetScale()) {
+			p.Scale = uint32(scale)
+		}
+	}
+}
\ No newline at end of file
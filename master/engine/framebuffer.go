@@ -0,0 +1,302 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"image/color"
+	"image"
+	"math"
+)
+
+// frameBuffer holds a copy of a frame drawn onto a canvas, along with the camera it was rendered from and the composition it was drawn with.
+// A frame buffer also holds whichever AOVs were traced for the frame (the slices of the rest are nil).
+// Every slice holds one value per pixel, in row-major order.
+type frameBuffer struct {
+	width, height int
+	pixels []colour.RGB
+	cam state.Camera
+	comp Composition
+	post PostChain	// The post-processors applied to the frame before it is displayed.
+	display []colour.RGB	// The colour of each pixel as displayed, once the post-processors have been applied to the whole frame (nil until then).
+	deep bool	// Whether the frame's colours have more than 8 bits per channel, so that it is seen as a 16 bit image.
+	
+	depth []float64			// The distance along each pixel's ray to the nearest object (infinite if nothing was hit).
+	normals []geom.Vector	// The normal vector of the nearest object along each pixel's ray.
+	albedo []colour.RGB		// The diffuse colour of the nearest object along each pixel's ray.
+	objectIDs []uint		// The id of the nearest object along each pixel's ray (zero if nothing was hit).
+	ambient []colour.RGB	// The ambient component of each pixel's colour.
+	diffuse []colour.RGB	// The diffuse component of each pixel's colour.
+	specular []colour.RGB	// The specular component of each pixel's colour.
+	shadow []float64		// The fraction of lights blocked from the nearest object along each pixel's ray.
+	occlusion []float64		// The fraction of the hemisphere above the nearest object along each pixel's ray which is open.
+}
+
+// newFrameBuffer creates an empty width by height frame buffer for a frame rendered from cam, with room for some AOVs (a bit mask of comms.AOV values).
+// The frame buffer shows its pixels as they are, until it is given a composition.
+func newFrameBuffer(width, height int, cam state.Camera, aovs uint32) *frameBuffer {
+	size := width * height
+	fb := &frameBuffer{
+		width: width,
+		height: height,
+		pixels: make([]colour.RGB, size, size),
+		cam: cam,
+		comp: DefaultComposition,
+	}
+	if aovs & uint32(comms.AOV_DEPTH) != 0 {
+		fb.depth = make([]float64, size, size)
+		for i := range fb.depth {
+			fb.depth[i] = math.Inf(1)
+		}
+	}
+	if aovs & uint32(comms.AOV_NORMAL) != 0 {
+		fb.normals = make([]geom.Vector, size, size)
+	}
+	if aovs & uint32(comms.AOV_ALBEDO) != 0 {
+		fb.albedo = make([]colour.RGB, size, size)
+	}
+	if aovs & uint32(comms.AOV_OBJECT_ID) != 0 {
+		fb.objectIDs = make([]uint, size, size)
+	}
+	if aovs & uint32(comms.AOV_AMBIENT) != 0 {
+		fb.ambient = make([]colour.RGB, size, size)
+	}
+	if aovs & uint32(comms.AOV_DIFFUSE) != 0 {
+		fb.diffuse = make([]colour.RGB, size, size)
+	}
+	if aovs & uint32(comms.AOV_SPECULAR) != 0 {
+		fb.specular = make([]colour.RGB, size, size)
+	}
+	if aovs & uint32(comms.AOV_SHADOW) != 0 {
+		fb.shadow = make([]float64, size, size)
+	}
+	if aovs & uint32(comms.AOV_OCCLUSION) != 0 {
+		fb.occlusion = make([]float64, size, size)
+	}
+	
+	return fb
+}
+
+// copyFrom copies the contents of another frame buffer (with the same dimensions) into a frame buffer.
+// Only the AOVs both frame buffers hold are copied.
+func (fb *frameBuffer) copyFrom(other *frameBuffer) {
+	copy(fb.pixels, other.pixels)
+	if fb.depth != nil && other.depth != nil {
+		copy(fb.depth, other.depth)
+	}
+	if fb.normals != nil && other.normals != nil {
+		copy(fb.normals, other.normals)
+	}
+	if fb.albedo != nil && other.albedo != nil {
+		copy(fb.albedo, other.albedo)
+	}
+	if fb.objectIDs != nil && other.objectIDs != nil {
+		copy(fb.objectIDs, other.objectIDs)
+	}
+	if fb.ambient != nil && other.ambient != nil {
+		copy(fb.ambient, other.ambient)
+	}
+	if fb.diffuse != nil && other.diffuse != nil {
+		copy(fb.diffuse, other.diffuse)
+	}
+	if fb.specular != nil && other.specular != nil {
+		copy(fb.specular, other.specular)
+	}
+	if fb.shadow != nil && other.shadow != nil {
+		copy(fb.shadow, other.shadow)
+	}
+	if fb.occlusion != nil && other.occlusion != nil {
+		copy(fb.occlusion, other.occlusion)
+	}
+}
+
+// copyPixel copies pixel src of another frame buffer into pixel dst of a frame buffer.
+// Only the AOVs both frame buffers hold are copied.
+func (fb *frameBuffer) copyPixel(dst int, other *frameBuffer, src int) {
+	fb.pixels[dst] = other.pixels[src]
+	if fb.depth != nil && other.depth != nil {
+		fb.depth[dst] = other.depth[src]
+	}
+	if fb.normals != nil && other.normals != nil {
+		fb.normals[dst] = other.normals[src]
+	}
+	if fb.albedo != nil && other.albedo != nil {
+		fb.albedo[dst] = other.albedo[src]
+	}
+	if fb.objectIDs != nil && other.objectIDs != nil {
+		fb.objectIDs[dst] = other.objectIDs[src]
+	}
+	if fb.ambient != nil && other.ambient != nil {
+		fb.ambient[dst] = other.ambient[src]
+	}
+	if fb.diffuse != nil && other.diffuse != nil {
+		fb.diffuse[dst] = other.diffuse[src]
+	}
+	if fb.specular != nil && other.specular != nil {
+		fb.specular[dst] = other.specular[src]
+	}
+	if fb.shadow != nil && other.shadow != nil {
+		fb.shadow[dst] = other.shadow[src]
+	}
+	if fb.occlusion != nil && other.occlusion != nil {
+		fb.occlusion[dst] = other.occlusion[src]
+	}
+}
+
+// index returns the index of the pixel (x, y) in each of a frame buffer's slices.
+func (fb *frameBuffer) index(x, y int) int {
+	return y * fb.width + x
+}
+
+// colourFromFloats converts three AOV values, starting at index 3 * i, into a colour.
+func colourFromFloats(values []float32, i int) colour.RGB {
+	return colour.NewRGBFromFloats(values[3 * i], values[3 * i + 1], values[3 * i + 2])
+}
+
+// setResults fills in the colour and AOVs of pixel idx of a frame buffer, using the results at index i of some trace results.
+// AOVs which the frame buffer doesn't hold, or which the results don't contain, are left alone.
+func (fb *frameBuffer) setResults(idx int, results *comms.TraceResults, i int) {
+	fb.pixels[idx] = results.Colour(i)
+	
+	if depth := results.GetDepth(); fb.depth != nil && i < len(depth) {
+		fb.depth[idx] = float64(depth[i])
+	}
+	if normal := results.GetNormal(); fb.normals != nil && 3 * i + 2 < len(normal) {
+		fb.normals[idx] = geom.Vector{float64(normal[3 * i]), float64(normal[3 * i + 1]), float64(normal[3 * i + 2])}
+	}
+	if albedo := results.GetAlbedo(); fb.albedo != nil && 3 * i + 2 < len(albedo) {
+		fb.albedo[idx] = colourFromFloats(albedo, i)
+	}
+	if ids := results.GetObjectId(); fb.objectIDs != nil && i < len(ids) {
+		fb.objectIDs[idx] = uint(ids[i])
+	}
+	if ambient := results.GetAmbient(); fb.ambient != nil && 3 * i + 2 < len(ambient) {
+		fb.ambient[idx] = colourFromFloats(ambient, i)
+	}
+	if diffuse := results.GetDiffuse(); fb.diffuse != nil && 3 * i + 2 < len(diffuse) {
+		fb.diffuse[idx] = colourFromFloats(diffuse, i)
+	}
+	if specular := results.GetSpecular(); fb.specular != nil && 3 * i + 2 < len(specular) {
+		fb.specular[idx] = colourFromFloats(specular, i)
+	}
+	if shadow := results.GetShadow(); fb.shadow != nil && i < len(shadow) {
+		fb.shadow[idx] = float64(shadow[i])
+	}
+	if occlusion := results.GetOcclusion(); fb.occlusion != nil && i < len(occlusion) {
+		fb.occlusion[idx] = float64(occlusion[i])
+	}
+}
+
+// composite returns the colour of pixel idx of a frame buffer, as seen through its composition.
+func (fb *frameBuffer) composite(idx int) colour.RGB {
+	return fb.comp.colourAt(fb, idx)
+}
+
+// displayed returns the colour of pixel idx of a frame buffer as it is displayed.
+// Until the post-processors have been applied to the whole frame, only those which work on each pixel alone are applied (see PostChain.preview).
+func (fb *frameBuffer) displayed(idx int) colour.RGB {
+	if fb.display != nil {
+		return fb.display[idx]
+	}
+	return fb.post.preview(idx % fb.width, idx / fb.width, fb.width, fb.height, fb.composite(idx))
+}
+
+// frame describes a frame buffer, as seen through its composition, to a post-processor.
+func (fb *frameBuffer) frame() Frame {
+	colours := make([]colour.RGB, len(fb.pixels), len(fb.pixels))
+	for idx := range colours {
+		colours[idx] = fb.composite(idx)
+	}
+	return Frame{Width: fb.width, Height: fb.height, Colours: colours, Depth: fb.depth, Normals: fb.normals, Albedo: fb.albedo, ObjectIDs: fb.objectIDs}
+}
+
+// postProcess applies a frame buffer's post-processors to the whole frame.
+func (fb *frameBuffer) postProcess() {
+	fb.display = fb.post.Apply(fb.frame())
+}
+
+// ColorModel returns the colour model of a frame buffer, so that it can be used as an image.Image.
+// Frames with deep colours use a 16 bit colour model, so that they are saved (e.g. as PNGs) without losing precision.
+func (fb *frameBuffer) ColorModel() color.Model {
+	if fb.deep {
+		return color.RGBA64Model
+	}
+	return color.RGBAModel
+}
+
+// Bounds returns the area covered by a frame buffer, so that it can be used as an image.Image.
+func (fb *frameBuffer) Bounds() image.Rectangle {
+	return image.Rect(0, 0, fb.width, fb.height)
+}
+
+// At returns the colour of the pixel (x, y) of a frame buffer as it is displayed, so that it can be used as an image.Image.
+func (fb *frameBuffer) At(x, y int) color.Color {
+	return fb.displayed(fb.index(x, y))
+}
+
+// reproject finds the pixel of the frame buffer which the pixel (x, y) as seen by cam would have appeared as.
+// Because the depth of the pixel is unknown, every point is assumed to be infinitely far away, so only the change in the camera's orientation is accounted for.
+// This function returns the index of the pixel in the frame buffer, or false if the pixel was not visible in the frame buffer.
+func (fb *frameBuffer) reproject(x, y int, cam state.Camera) (int, bool) {
+	// Find the direction of the ray through (x, y), then find where a ray in the same direction would have appeared.
+	dir := cam.PixelToPoint(x, y, fb.width, fb.height).Sub(cam.Pos)
+	i, j, visible := fb.cam.PointToPixel(fb.cam.Pos.Add(dir), fb.width, fb.height)
+	if !visible {
+		return 0, false
+	}
+	
+	// Use the nearest pixel, as long as it's on the screen.
+	xPrev, yPrev := int(math.Floor(i + 0.5)), int(math.Floor(j + 0.5))
+	if xPrev < 0 || xPrev >= fb.width || yPrev < 0 || yPrev >= fb.height {
+		return 0, false
+	}
+	return fb.index(xPrev, yPrev), true
+}
+
+// splat reprojects every pixel of a frame buffer onto a new frame as seen by cam, using each pixel's depth.
+// Where several pixels land on the same spot, the nearest one wins.
+// This function returns, for each pixel of the new frame, the index of the pixel of the frame buffer which landed there (or -1 if none did), along with its depth as seen by cam.
+// This function assumes that the frame buffer holds depths.
+func (fb *frameBuffer) splat(cam state.Camera) ([]int, []float64) {
+	sources := make([]int, fb.width * fb.height, fb.width * fb.height)
+	depths := make([]float64, fb.width * fb.height, fb.width * fb.height)
+	for i := range sources {
+		sources[i] = -1
+	}
+	
+	for x := 0; x < fb.width; x++ {
+		for y := 0; y < fb.height; y++ {
+			// Find where the pixel's point (or direction, if it's infinitely far away) appears to the new camera.
+			dir := fb.cam.PixelToPoint(x, y, fb.width, fb.height).Sub(fb.cam.Pos).Norm()
+			depth := fb.depth[fb.index(x, y)]
+			var i, j, newDepth float64
+			var visible bool
+			if math.IsInf(depth, 1) {
+				i, j, visible = cam.PointToPixel(cam.Pos.Add(dir), fb.width, fb.height)
+				newDepth = depth
+			}else{
+				point := fb.cam.Pos.Add(dir.Scale(depth))
+				i, j, visible = cam.PointToPixel(point, fb.width, fb.height)
+				newDepth = point.Sub(cam.Pos).Len()
+			}
+			if !visible {
+				continue
+			}
+			
+			// Keep the pixel if it lands on the screen, and is nearer than anything already there.
+			xNew, yNew := int(math.Floor(i + 0.5)), int(math.Floor(j + 0.5))
+			if xNew < 0 || xNew >= fb.width || yNew < 0 || yNew >= fb.height {
+				continue
+			}
+			idx := fb.index(xNew, yNew)
+			if sources[idx] < 0 || newDepth < depths[idx] {
+				sources[idx] = fb.index(x, y)
+				depths[idx] = newDepth
+			}
+		}
+	}
+	
+	return sources, depths
+}
\ No newline at end of file
@@ -0,0 +1,159 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"math"
+)
+
+// These constants are the default settings of FXAA, for FXAA which doesn't set its own.
+const (
+	DefaultFXAAEdgeThreshold float64 = 0.125	// The contrast (relative to the brightest nearby pixel) below which pixels aren't smoothed.
+	DefaultFXAASubpixel float64 = 0.75			// How strongly details smaller than a pixel are smoothed.
+)
+
+// fxaaMinContrast is the contrast below which pixels are never smoothed, however dark they are.
+const fxaaMinContrast float64 = 0.0312
+
+// fxaaSearchSteps is the furthest (in pixels) along an edge FXAA looks for the edge's ends.
+const fxaaSearchSteps int = 12
+
+// FXAA is a post-processor which smooths jagged edges (as a cheap alternative to tracing several rays through each pixel), at the cost of slightly blurring the frame.
+// Each pixel on an edge is blended with its neighbour across the edge, by how near the pixel is to the end of the edge, and by how much it stands out from its neighbours.
+type FXAA struct {
+	EdgeThreshold float64	// The contrast (relative to the brightest nearby pixel) below which pixels aren't smoothed (DefaultFXAAEdgeThreshold if zero).
+	Subpixel float64		// How strongly details smaller than a pixel are smoothed, in the range [0, 1].
+}
+
+// lumas returns the brightness of each pixel of a frame.
+func lumas(f Frame) []float64 {
+	l := make([]float64, len(f.Colours), len(f.Colours))
+	for idx, col := range f.Colours {
+		l[idx] = luminance(col.Floats())
+	}
+	return l
+}
+
+// clampedIndex returns the index of the pixel (x, y) of a frame, or of the nearest pixel on the frame if (x, y) is off of it.
+func (f Frame) clampedIndex(x, y int) int {
+	x = int(math.Max(0, math.Min(float64(x), float64(f.Width - 1))))
+	y = int(math.Max(0, math.Min(float64(y), float64(f.Height - 1))))
+	return f.Index(x, y)
+}
+
+// Process smooths the edges of a frame.
+func (a FXAA) Process(f Frame) []colour.RGB {
+	threshold := a.EdgeThreshold
+	if threshold == 0.0 {
+		threshold = DefaultFXAAEdgeThreshold
+	}
+	
+	l := lumas(f)
+	luma := func(x, y int) float64 {
+		return l[f.clampedIndex(x, y)]
+	}
+	
+	processed := make([]colour.RGB, len(f.Colours), len(f.Colours))
+	copy(processed, f.Colours)
+	for x := 0; x < f.Width; x++ {
+		for y := 0; y < f.Height; y++ {
+			// Skip pixels which don't contrast with their neighbours.
+			centre := luma(x, y)
+			north, south, east, west := luma(x, y - 1), luma(x, y + 1), luma(x + 1, y), luma(x - 1, y)
+			lMin := math.Min(centre, math.Min(math.Min(north, south), math.Min(east, west)))
+			lMax := math.Max(centre, math.Max(math.Max(north, south), math.Max(east, west)))
+			contrast := lMax - lMin
+			if contrast < math.Max(fxaaMinContrast, threshold * lMax) {
+				continue
+			}
+			
+			// Find whether the edge runs horizontally or vertically.
+			northEast, northWest, southEast, southWest := luma(x + 1, y - 1), luma(x - 1, y - 1), luma(x + 1, y + 1), luma(x - 1, y + 1)
+			horizontal := 2.0 * math.Abs(north + south - 2.0 * centre) + math.Abs(northEast + southEast - 2.0 * east) + math.Abs(northWest + southWest - 2.0 * west)
+			vertical := 2.0 * math.Abs(east + west - 2.0 * centre) + math.Abs(northEast + northWest - 2.0 * north) + math.Abs(southEast + southWest - 2.0 * south)
+			isHorizontal := horizontal >= vertical
+			
+			// Find the neighbour across the edge, on whichever side the brightness changes most.
+			// The edge is followed in steps of (stepX, stepY), and lies between the pixel and the pixel (x + normalX, y + normalY).
+			before, after := west, east
+			normalX, normalY, stepX, stepY := -1, 0, 0, 1
+			if isHorizontal {
+				before, after = north, south
+				normalX, normalY, stepX, stepY = 0, -1, 1, 0
+			}
+			across := before
+			if math.Abs(after - centre) > math.Abs(before - centre) {
+				across = after
+				normalX, normalY = -normalX, -normalY
+			}
+			
+			// Follow the edge both ways until the brightness along it changes, to find its nearest end.
+			edgeLuma := (centre + across) / 2.0
+			gradient := math.Abs(across - centre) / 4.0
+			along := func(step int) float64 {
+				i, j := x + step * stepX, y + step * stepY
+				return (luma(i, j) + luma(i + normalX, j + normalY)) / 2.0 - edgeLuma
+			}
+			forward, backward := fxaaSearchSteps, fxaaSearchSteps
+			var forwardEnd, backwardEnd float64
+			for s := 1; s <= fxaaSearchSteps; s++ {
+				if forwardEnd = along(s); math.Abs(forwardEnd) >= gradient {
+					forward = s
+					break
+				}
+			}
+			for s := 1; s <= fxaaSearchSteps; s++ {
+				if backwardEnd = along(-s); math.Abs(backwardEnd) >= gradient {
+					backward = s
+					break
+				}
+			}
+			
+			// Pixels nearer the end of the edge are blended more, as long as the edge ends the way the pixel's side of it suggests.
+			nearest, nearestEnd := forward, forwardEnd
+			if backward < forward {
+				nearest, nearestEnd = backward, backwardEnd
+			}
+			blend := 0.0
+			if (nearestEnd < 0.0) != (centre < edgeLuma) {
+				blend = 0.5 - float64(nearest) / float64(forward + backward)
+			}
+			
+			// Details smaller than a pixel are blended by how much the pixel stands out from its neighbours.
+			average := (2.0 * (north + south + east + west) + northEast + northWest + southEast + southWest) / 12.0
+			subpixel := math.Min(math.Abs(average - centre) / contrast, 1.0)
+			subpixel = subpixel * subpixel * (3.0 - 2.0 * subpixel)
+			blend = math.Max(blend, subpixel * subpixel * a.Subpixel)
+			
+			// Blend the pixel with its neighbour across the edge.
+			r, g, b := f.Colours[f.Index(x, y)].Floats()
+			rn, gn, bn := f.Colours[f.clampedIndex(x + normalX, y + normalY)].Floats()
+			processed[f.Index(x, y)] = colour.NewRGBFromFloats(float32(r + blend * (rn - r)), float32(g + blend * (gn - g)), float32(b + blend * (bn - b)))
+		}
+	}
+	return processed
+}
+
+// ToggleFXAA adds FXAA (with its default settings) to the end of the chain of post-processors applied to each frame, or removes it if it's already there.
+// The return value is whether FXAA is now applied.
+func (e *Engine) ToggleFXAA() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	// Frames already in flight hold the old chain, so it is replaced rather than changed in place.
+	chain := make(PostChain, 0, len(e.post) + 1)
+	for _, p := range e.post {
+		if _, isFXAA := p.(FXAA); !isFXAA {
+			chain = append(chain, p)
+		}
+	}
+	on := len(chain) == len(e.post)
+	if on {
+		chain = append(chain, FXAA{EdgeThreshold: DefaultFXAAEdgeThreshold, Subpixel: DefaultFXAASubpixel})
+	}
+	
+	e.post = chain
+	e.version += 1
+	e.allDirty = true
+	return on
+}
\ No newline at end of file
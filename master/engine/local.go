@@ -0,0 +1,45 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/worker/serve"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/grpc"
+	"context"
+	"net"
+	"fmt"
+	"log"
+)
+
+// localBufferSize is the size (in bytes) of the in-memory buffer between the engine and each of its local workers.
+const localBufferSize int = 1 << 20
+
+// startLocalWorkers spins up n workers inside the engine's process, and adds them to the engine's pool.
+// Local workers are connected to the pool using in-memory connections rather than the network.
+func (e *Engine) startLocalWorkers(n uint) error {
+	for i := uint(0); i < n; i++ {
+		address := fmt.Sprintf("local-%d", i)
+		listener := bufconn.Listen(localBufferSize)
+		
+		// Serve the worker's work orders.
+		// The pool's heartbeats keep the worker from timing out until the pool is destroyed (or drops the worker).
+		e.mu.RLock()
+		t := serve.NewTracer(e.scene, e.opts.Width, e.opts.Height, serve.Options{})
+		e.mu.RUnlock()
+		go func() {
+			if err := t.Serve(listener); err != nil {
+				log.Printf("Local worker \"%s\" interrupted: %v.\n", address, err)
+			}
+		}()
+		
+		// Add the worker to the pool.
+		dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		})
+		if err := e.AddWorker(address, dialer); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
\ No newline at end of file
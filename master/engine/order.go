@@ -0,0 +1,133 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"strings"
+	"sort"
+	"fmt"
+)
+
+// curveBits is the number of bits of each coordinate used to place a partition along a space-filling curve, so that the curve passes through a 2^curveBits by 2^curveBits grid over the screen.
+const curveBits uint = 10
+
+// TileOrder controls the order in which the partitions of a frame are dispatched to workers (and so, roughly, the order in which they are drawn).
+type TileOrder uint8
+
+// These constants are the possible tile orders.
+const (
+	OrderPartition TileOrder = iota	// Partitions are dispatched in the order the screen was partitioned.
+	OrderCentre						// Partitions are dispatched from the centre of the screen outwards.
+	OrderFocus						// Partitions are dispatched outwards from the engine's focus point (see SetFocus).
+	OrderHilbert					// Partitions are dispatched along a Hilbert curve, so that each partition is next to the one before it.
+	OrderMorton						// Partitions are dispatched along a Morton (Z-order) curve, which keeps nearby partitions together more cheaply than a Hilbert curve, but with jumps between quadrants.
+	numTileOrders
+)
+
+// tileOrderNames holds the name of each tile order.
+var tileOrderNames = [numTileOrders]string{"partition", "centre", "focus", "hilbert", "morton"}
+
+// String returns the name of a tile order.
+func (o TileOrder) String() string {
+	if o < numTileOrders {
+		return tileOrderNames[o]
+	}
+	return fmt.Sprintf("TileOrder(%d)", uint8(o))
+}
+
+// ParseTileOrder finds the tile order with some name (ignoring case).
+func ParseTileOrder(name string) (TileOrder, error) {
+	for o := TileOrder(0); o < numTileOrders; o++ {
+		if strings.EqualFold(name, tileOrderNames[o]) {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown tile order \"%s\".", name)
+}
+
+// mortonIndex returns the distance along a Morton curve of the point (x, y), by interleaving the bits of its coordinates.
+func mortonIndex(x, y uint32) uint64 {
+	var index uint64
+	for bit := uint(0); bit < curveBits; bit++ {
+		index |= uint64((x >> bit) & 1) << (2 * bit)
+		index |= uint64((y >> bit) & 1) << (2 * bit + 1)
+	}
+	return index
+}
+
+// hilbertIndex returns the distance along a Hilbert curve of the point (x, y).
+// Each step down the curve's quadrants rotates (and flips) the point into the quadrant's own orientation.
+func hilbertIndex(x, y uint32) uint64 {
+	var index uint64
+	for s := uint32(1) << (curveBits - 1); s > 0; s /= 2 {
+		var rx, ry uint32
+		if x & s != 0 {
+			rx = 1
+		}
+		if y & s != 0 {
+			ry = 1
+		}
+		index += uint64(s) * uint64(s) * uint64((3 * rx) ^ ry)
+		
+		// Rotate the quadrant.
+		if ry == 0 {
+			if rx == 1 {
+				x, y = s - 1 - x % s, s - 1 - y % s
+			}
+			x, y = y, x
+		}
+	}
+	return index
+}
+
+// curveIndex returns the distance along a space-filling curve (OrderHilbert or OrderMorton) of the centre of a partition, with the curve stretched over the screen.
+func (e *Engine) curveIndex(order *comms.WorkOrder) uint64 {
+	// Scale the partition's centre onto the curve's grid.
+	cells := uint64(1) << curveBits
+	x := uint32((2 * uint64(order.GetX()) + uint64(order.GetWidth())) * cells / (2 * uint64(e.opts.Width)))
+	y := uint32((2 * uint64(order.GetY()) + uint64(order.GetHeight())) * cells / (2 * uint64(e.opts.Height)))
+	if e.opts.TileOrder == OrderMorton {
+		return mortonIndex(x, y)
+	}
+	return hilbertIndex(x, y)
+}
+
+// SetFocus sets the point on the screen (usually the cursor) which partitions are dispatched around when using OrderFocus, and which foveated frames are traced in full around.
+// The point starts at the centre of the screen, and is measured in the pixels of the engine's frames.
+func (e *Engine) SetFocus(x, y int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	e.focusX, e.focusY = x, y
+}
+
+// focus returns the engine's focus point (see SetFocus).
+func (e *Engine) focus() (int, int) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.focusX, e.focusY
+}
+
+// orderPartitions sorts partitions by the engine's tile order, so that the most important partitions are dispatched first.
+func (e *Engine) orderPartitions(partitions []comms.WorkOrder) {
+	switch e.opts.TileOrder {
+	case OrderPartition:
+		return
+	case OrderHilbert, OrderMorton:
+		sort.SliceStable(partitions, func(i, j int) bool {return e.curveIndex(&partitions[i]) < e.curveIndex(&partitions[j])})
+		return
+	}
+	
+	// Sort the partitions by the (squared) distance between their centres and the centre of the screen (or the focus point).
+	x, y := int(e.opts.Width / 2), int(e.opts.Height / 2)
+	if e.opts.TileOrder == OrderFocus {
+		x, y = e.focus()
+	}
+	distance := func(order *comms.WorkOrder) int {
+		dx := 2 * x - (2 * int(order.GetX()) + int(order.GetWidth()))
+		dy := 2 * y - (2 * int(order.GetY()) + int(order.GetHeight()))
+		return dx * dx + dy * dy
+	}
+	sort.SliceStable(partitions, func(i, j int) bool {return distance(&partitions[i]) < distance(&partitions[j])})
+}
\ No newline at end of file
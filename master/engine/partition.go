@@ -0,0 +1,199 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"strings"
+	"fmt"
+)
+
+// DefaultPartitionWidth and DefaultPartitionHeight both inform the recursion depth of the screen partitioning function, for engines whose options do not specify their own.
+// If there are sufficient workers, these values represent the largest width and height a minimal partition piece can be.
+const (
+	DefaultPartitionWidth uint = 50
+	DefaultPartitionHeight uint = 50
+)
+
+// Partitioning controls how the area of each frame is split between workers.
+type Partitioning uint8
+
+// These constants are the possible partitioning strategies.
+const (
+	PartitionRectangles Partitioning = iota	// The area is split in half, alternating between vertical and horizontal splits, until there is a rectangle for every worker (see Options.PartitionWidth and Options.PartitionHeight).
+	PartitionInterleaved					// Every worker is given an interleaved set of the area's rows, which balances the work better when some parts of the scene are much slower to trace than others.
+	PartitionCost							// The area is split like PartitionRectangles, but each split divides the area's estimated cost (from how long previous frames took to trace) rather than its size.
+	numPartitionings
+)
+
+// partitioningNames holds the name of each partitioning strategy.
+var partitioningNames = [numPartitionings]string{"rectangles", "interleaved", "cost"}
+
+// String returns the name of a partitioning strategy.
+func (p Partitioning) String() string {
+	if p < numPartitionings {
+		return partitioningNames[p]
+	}
+	return fmt.Sprintf("Partitioning(%d)", uint8(p))
+}
+
+// ParsePartitioning finds the partitioning strategy with some name (ignoring case).
+func ParsePartitioning(name string) (Partitioning, error) {
+	for p := Partitioning(0); p < numPartitionings; p++ {
+		if strings.EqualFold(name, partitioningNames[p]) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown partitioning \"%s\".", name)
+}
+
+// DefaultRedundancy is the number of workers assigned to each partition of the screen, for engines whose options do not specify it.
+const DefaultRedundancy uint = 1
+
+// SetRedundancy changes the number of workers assigned to each partition of the screen, starting with the next frame.
+// Frames already in flight keep the redundancy they were requested with.
+func (e *Engine) SetRedundancy(redundancy uint) error {
+	if redundancy == 0 {
+		return fmt.Errorf("Each partition must be assigned to at least one worker.")
+	}
+	
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	e.redundancy = redundancy
+	return nil
+}
+
+// Redundancy returns the number of workers currently assigned to each partition of the screen.
+func (e *Engine) Redundancy() uint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return e.redundancy
+}
+
+// subOrder creates a work order for part of an area, which is traced in the same way as the rest of the area.
+func subOrder(area *comms.WorkOrder, x, y, width, height uint32) *comms.WorkOrder {
+	return &comms.WorkOrder{
+		X: x,
+		Y: y,
+		Width: width,
+		Height: height,
+		Diff: area.GetDiff(),
+		Frame: area.GetFrame(),
+		ScreenWidth: area.GetScreenWidth(),
+		ScreenHeight: area.GetScreenHeight(),
+		Aovs: area.GetAovs(),
+		Samples: area.GetSamples(),
+		Pattern: area.GetPattern(),
+		Integrator: area.GetIntegrator(),
+		Deadline: area.GetDeadline(),
+		Scale: area.GetScale(),
+		Checkerboard: area.GetCheckerboard(),
+		BitDepth: area.GetBitDepth(),
+		MirrorDepth: area.GetMirrorDepth(),
+		PathDepth: area.GetPathDepth(),
+		AreaLightSamples: area.GetAreaLightSamples(),
+	}
+}
+
+// splitter finds where to split an area along some dimension (zero for a vertical split), returning the width (or height) of the part before the split.
+// Fraction is the share of the area's workers given to the part before the split.
+type splitter func(area *comms.WorkOrder, dimension uint, fraction float64) uint32
+
+// halve splits an area in half, whatever the share of its workers on each side.
+func halve(area *comms.WorkOrder, dimension uint, fraction float64) uint32 {
+	if dimension % 2 == 0 {
+		return area.GetWidth() / 2
+	}
+	return area.GetHeight() / 2
+}
+
+// partition recursively creates a list of work orders by partitioning an area, to be shared between some workers with redundancy workers assigned to each partition.
+// Areas no wider than kernelWidth aren't split vertically, and areas no taller than kernelHeight aren't split horizontally, so a kernel as wide as the area splits it into strips of rows.
+// Each split is placed by split (see halve and costMap.split).
+// The first return value is a slice of the original area's partitioned sub-areas.
+// The second return value is the number of leftover workers.
+func partition(area *comms.WorkOrder, workers, redundancy, dimension uint, kernelWidth, kernelHeight uint32, split splitter) ([]comms.WorkOrder, uint) {
+	// If there aren't enough workers left to split the area in half, return.
+	if workers / redundancy < 2 {
+		if workers > redundancy {
+			return []comms.WorkOrder{*area}, workers % redundancy
+		}else{
+			return []comms.WorkOrder{*area}, 0
+		}
+	}
+	
+	x, y := area.GetX(), area.GetY()
+	width, height := area.GetWidth(), area.GetHeight()
+	if width <= kernelWidth && height <= kernelHeight {
+		// If the area can't be partitioned any more, return.
+		return []comms.WorkOrder{*area}, workers - redundancy
+	}else if width <= kernelWidth {
+		// If the area can't be split vertically, split horizontally.
+		dimension = 1
+	}else if height <= kernelHeight {
+		// If the area can't be split horizontally, split vertically.
+		dimension = 0
+	}
+	
+	// Compute the left and right areas.
+	leftWorkers := workers / 2 + workers % 2
+	offset := split(area, dimension, float64(leftWorkers) / float64(workers))
+	var leftOrder, rightOrder *comms.WorkOrder
+	if dimension % 2 == 0 {
+		leftOrder = subOrder(area, x, y, offset, height)
+		rightOrder = subOrder(area, x + offset, y, width - offset, height)
+	}else{
+		leftOrder = subOrder(area, x, y, width, offset)
+		rightOrder = subOrder(area, x, y + offset, width, height - offset)
+	}
+	
+	// Find the partitions within the left and right areas.
+	left, remainder := partition(leftOrder, leftWorkers, redundancy, (dimension + 1) % 2, kernelWidth, kernelHeight, split)
+	right, remainder := partition(rightOrder, workers / 2 + remainder, redundancy, (dimension + 1) % 2, kernelWidth, kernelHeight, split)
+	return append(left, right...), remainder
+}
+
+// interleave splits an area into (at most) sets work orders, each covering every sets-th row (of blocks) of the area, starting from a different row.
+// Each set spans the area's full width, so neighbouring rows are traced by different workers, and slow parts of the scene are shared between all of them.
+// Since every set covers the whole area, interleaved work orders can't be foveated, and aren't used for checkerboards.
+func interleave(area *comms.WorkOrder, sets uint) []comms.WorkOrder {
+	// Find the area's rows of blocks, and don't make more sets than there are rows.
+	scale := area.GetScale()
+	if scale < 1 {
+		scale = 1
+	}
+	_, _, _, rows := tracer.Blocks(int(area.GetX()), int(area.GetY()), int(area.GetWidth()), int(area.GetHeight()), int(scale))
+	if sets > uint(rows) {
+		sets = uint(rows)
+	}
+	if sets < 2 {
+		return []comms.WorkOrder{*area}
+	}
+	
+	// Start each set one row of blocks further down, trimming its area so that its first row is the one it starts from.
+	// The first row of blocks can start partway through a block, so the rest of the sets start from the block boundaries after it.
+	orders := make([]comms.WorkOrder, sets)
+	top := area.GetY() / scale * scale
+	for k := uint32(0); k < uint32(sets); k++ {
+		y := area.GetY()
+		if k > 0 {
+			y = top + k * scale
+		}
+		orders[k] = *subOrder(area, area.GetX(), y, area.GetWidth(), area.GetY() + area.GetHeight() - y)
+		orders[k].Interleave = uint32(sets)
+	}
+	return orders
+}
+
+// coversRow returns whether a work order covers the row y (in pixels) of the screen, which is always true unless the work order is interleaved.
+// The row should be within the work order's area.
+func coversRow(order *comms.WorkOrder, y int) bool {
+	scale := int(order.GetScale())
+	if scale < 1 {
+		scale = 1
+	}
+	step := int(comms.InterleaveStride(order.GetInterleave()))
+	return (y / scale - int(order.GetY()) / scale) % step == 0
+}
\ No newline at end of file
@@ -0,0 +1,185 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"strings"
+	"math"
+	"fmt"
+)
+
+// DefaultExposure is how strongly the tone map compresses bright colours, for tone maps which are set from the command line without one.
+const DefaultExposure float64 = 2.0
+
+// DefaultVignetteStrength is how much a vignette darkens the corners of each frame, for vignettes which are set from the command line without one.
+const DefaultVignetteStrength float64 = 0.5
+
+// Frame is a frame handed to a post-processor, holding the colour of each pixel along with whichever AOVs were traced for it (the slices of the rest are nil).
+// Every slice holds one value per pixel, in row-major order, and none of them may be modified by post-processors.
+type Frame struct {
+	Width, Height int
+	Colours []colour.RGB	// The colour of each pixel, with the frame's passes combined and every earlier post-processor applied.
+	Depth []float64			// The distance along each pixel's ray to the nearest object (infinite if nothing was hit).
+	Normals []geom.Vector	// The normal vector of the nearest object along each pixel's ray.
+	Albedo []colour.RGB		// The diffuse colour of the nearest object along each pixel's ray.
+	ObjectIDs []uint		// The id of the nearest object along each pixel's ray (zero if nothing was hit).
+}
+
+// Index returns the index of the pixel (x, y) in each of a frame's slices.
+func (f Frame) Index(x, y int) int {
+	return y * f.Width + x
+}
+
+// PostProcessor is an image-space effect applied to each frame once it has been drawn, before it is displayed.
+type PostProcessor interface {
+	// Process returns the colour of each pixel of a frame once the effect is applied, in a new slice.
+	Process(f Frame) []colour.RGB
+}
+
+// PixelProcessor is a post-processor whose effect on each pixel depends on nothing but the pixel itself.
+// Unlike other post-processors, pixel processors are applied to each pixel as soon as it is drawn, rather than waiting for the whole frame.
+type PixelProcessor interface {
+	PostProcessor
+	
+	// ProcessPixel returns the colour of the pixel (x, y) of a width by height frame once the effect is applied.
+	ProcessPixel(x, y, width, height int, col colour.RGB) colour.RGB
+}
+
+// processPixels applies a pixel processor to every pixel of a frame.
+func processPixels(p PixelProcessor, f Frame) []colour.RGB {
+	processed := make([]colour.RGB, len(f.Colours), len(f.Colours))
+	for x := 0; x < f.Width; x++ {
+		for y := 0; y < f.Height; y++ {
+			idx := f.Index(x, y)
+			processed[idx] = p.ProcessPixel(x, y, f.Width, f.Height, f.Colours[idx])
+		}
+	}
+	return processed
+}
+
+// PostChain is an ordered list of post-processors, each of which is applied to the output of the one before it.
+type PostChain []PostProcessor
+
+// Apply applies every post-processor in a chain to a frame, returning the colour of each pixel as it should be displayed.
+func (c PostChain) Apply(f Frame) []colour.RGB {
+	for _, p := range c {
+		f.Colours = p.Process(f)
+	}
+	return f.Colours
+}
+
+// preview applies every pixel processor in a chain to a pixel of a width by height frame, skipping the post-processors which need the whole frame.
+// This is how each pixel is displayed while its frame is still being drawn.
+func (c PostChain) preview(x, y, width, height int, col colour.RGB) colour.RGB {
+	for _, p := range c {
+		if pixel, isPixel := p.(PixelProcessor); isPixel {
+			col = pixel.ProcessPixel(x, y, width, height, col)
+		}
+	}
+	return col
+}
+
+// ToneMap compresses the colours of each frame along an exponential curve, brightening the darker colours while leaving black and white alone.
+type ToneMap struct {
+	Exposure float64	// How strongly the colours are compressed (not at all if zero).
+}
+
+// ProcessPixel tone maps a single pixel.
+func (t ToneMap) ProcessPixel(x, y, width, height int, col colour.RGB) colour.RGB {
+	if t.Exposure <= 0.0 {
+		return col
+	}
+	
+	r, g, b := col.Floats()
+	scale := 1.0 - math.Exp(-t.Exposure)
+	curve := func(v float64) float32 {
+		return float32((1.0 - math.Exp(-t.Exposure * v)) / scale)
+	}
+	return colour.NewRGBFromFloats(curve(r), curve(g), curve(b))
+}
+
+// Process tone maps a frame.
+func (t ToneMap) Process(f Frame) []colour.RGB {
+	return processPixels(t, f)
+}
+
+// Vignette darkens each frame towards its corners.
+type Vignette struct {
+	Strength float64	// How much the corners are darkened (in the range [0, 1], where one leaves them black).
+}
+
+// ProcessPixel darkens a single pixel by its distance from the centre of the frame.
+func (v Vignette) ProcessPixel(x, y, width, height int, col colour.RGB) colour.RGB {
+	// Measure the distance so that it is one at the corners, whatever the frame's aspect ratio.
+	dx := (float64(x) + 0.5) / float64(width) - 0.5
+	dy := (float64(y) + 0.5) / float64(height) - 0.5
+	return col.Scale(1.0 - v.Strength * 2.0 * (dx * dx + dy * dy))
+}
+
+// Process darkens a frame towards its corners.
+func (v Vignette) Process(f Frame) []colour.RGB {
+	return processPixels(v, f)
+}
+
+// PostSettings holds the settings of each of the built-in post-processors, so that chains of them can be built by name.
+type PostSettings struct {
+	ToneMap ToneMap
+	Bloom Bloom
+	Vignette Vignette
+	FXAA FXAA
+}
+
+// Chain builds a chain from a comma-separated list of the names of built-in post-processors (tonemap, bloom, fxaa, or vignette), in the order they're applied.
+// The chain is empty if the list is empty or "none".
+func (s PostSettings) Chain(list string) (PostChain, error) {
+	var chain PostChain
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "none":
+			continue
+		case "tonemap":
+			chain = append(chain, s.ToneMap)
+		case "bloom":
+			if err := s.Bloom.validate(); err != nil {
+				return nil, err
+			}
+			if s.Bloom.Radius == 0 {
+				s.Bloom.Radius = DefaultBloomRadius
+			}
+			chain = append(chain, s.Bloom)
+		case "fxaa":
+			if s.FXAA.EdgeThreshold < 0.0 || s.FXAA.Subpixel < 0.0 || s.FXAA.Subpixel > 1.0 {
+				return nil, fmt.Errorf("The FXAA edge threshold %g is negative, or its subpixel smoothing %g is outside of the range [0, 1].", s.FXAA.EdgeThreshold, s.FXAA.Subpixel)
+			}
+			chain = append(chain, s.FXAA)
+		case "vignette":
+			if s.Vignette.Strength < 0.0 || s.Vignette.Strength > 1.0 {
+				return nil, fmt.Errorf("The vignette strength %g is outside of the range [0, 1].", s.Vignette.Strength)
+			}
+			chain = append(chain, s.Vignette)
+		default:
+			return nil, fmt.Errorf("Unknown post-processor \"%s\".", strings.TrimSpace(name))
+		}
+	}
+	return chain, nil
+}
+
+// SetPostChain changes the post-processors applied to each frame.
+// Because the post-processors work on whole frames, the next frame is retraced in full.
+func (e *Engine) SetPostChain(c PostChain) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	e.post = append(PostChain(nil), c...)
+	e.version += 1
+	e.allDirty = true
+}
+
+// PostChain returns a copy of the post-processors currently applied to each frame.
+func (e *Engine) PostChain() PostChain {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	return append(PostChain(nil), e.post...)
+}
\ No newline at end of file
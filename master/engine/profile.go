@@ -0,0 +1,119 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"path/filepath"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+	"fmt"
+	"os"
+)
+
+// Profile holds what an engine has learned about rendering a scene, so that later sessions rendering the same scene start from it rather than learning it all again.
+type Profile struct {
+	SceneHash string					`json:"sceneHash"`
+	Width uint							`json:"width"`
+	Height uint							`json:"height"`
+	Scale uint							`json:"scale"`		// The resolution divisor frames settled on to meet the frame budget.
+	Costs []float64						`json:"costs"`		// The estimated cost of each cell of the screen (see costMap), row by row.
+	Workers map[string]time.Duration	`json:"workers"`	// The estimated task latency of each worker, by address.
+}
+
+// profilePath returns the path of the file holding the profile of the scene with some hash, within a directory.
+func profilePath(dir, sceneHash string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.json", sceneHash))
+}
+
+// ReadProfile reads a profile from a file.
+func ReadProfile(path string) (Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Profile{}, err
+	}
+	
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Profile{}, fmt.Errorf("Could not parse profile \"%s\": %v.", path, err)
+	}
+	return p, nil
+}
+
+// Write writes a profile to a file, replacing the file all at once so that it is never left half written.
+func (p Profile) Write(path string) error {
+	data, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return err
+	}
+	
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Profile returns what the engine has learned about rendering its scene so far.
+func (e *Engine) Profile() Profile {
+	p := Profile{
+		SceneHash: e.sceneHash,
+		Width: e.opts.Width,
+		Height: e.opts.Height,
+		Costs: e.costs.snapshot(),
+		Workers: make(map[string]time.Duration),
+	}
+	for _, ws := range e.workers.Stats() {
+		if ws.EstimatedLatency > 0 {
+			p.Workers[ws.Address] = ws.EstimatedLatency
+		}
+	}
+	
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	
+	p.Scale = e.scale
+	return p
+}
+
+// ApplyProfile starts the engine from what an earlier session learned about rendering its scene.
+// The profile must be for the same scene, drawn at the same size.
+func (e *Engine) ApplyProfile(p Profile) error {
+	if p.SceneHash != e.sceneHash {
+		return fmt.Errorf("The profile is for a different scene.")
+	}
+	if p.Width != e.opts.Width || p.Height != e.opts.Height {
+		return fmt.Errorf("The profile is for %dx%d frames, rather than %dx%d frames.", p.Width, p.Height, e.opts.Width, e.opts.Height)
+	}
+	if p.Costs != nil && !e.costs.restore(p.Costs) {
+		return fmt.Errorf("The profile has %d cost estimates, rather than %d.", len(p.Costs), len(e.costs.costs))
+	}
+	e.workers.Seed(p.Workers)
+	
+	// Only start from the profile's scale if frames are still reduced to meet a budget.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if e.opts.FrameBudget > 0 && p.Scale >= 1 && p.Scale <= e.opts.MaxScale {
+		e.scale = p.Scale
+	}
+	return nil
+}
+
+// loadProfile applies the profile kept for the engine's scene in the engine's profile directory, if there is one.
+func (e *Engine) loadProfile() error {
+	p, err := ReadProfile(profilePath(e.opts.ProfileDir, e.sceneHash))
+	if os.IsNotExist(err) {
+		return nil
+	}else if err != nil {
+		return err
+	}
+	return e.ApplyProfile(p)
+}
+
+// saveProfile writes what the engine has learned about its scene to the engine's profile directory.
+func (e *Engine) saveProfile() error {
+	if err := os.MkdirAll(e.opts.ProfileDir, 0755); err != nil {
+		return err
+	}
+	return e.Profile().Write(profilePath(e.opts.ProfileDir, e.sceneHash))
+}
\ No newline at end of file
@@ -0,0 +1,190 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/bind"
+	"github.com/mwindels/distributed-raytracer/master/pool"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/peer"
+	"encoding/gob"
+	"context"
+	"strconv"
+	"strings"
+	"bytes"
+	"net"
+	"fmt"
+)
+
+// Registrar implements the comms.RegistrationServer interface.
+type Registrar struct {
+	engine *Engine
+}
+
+// These constants are the longest host name, and host name label, a worker can give as its address.
+const (
+	maxHostLength int = 253
+	maxLabelLength int = 63
+)
+
+// parseHost checks whether a host given by a worker is an IP address (optionally in brackets) or a well formed host name, returning it without brackets.
+// Hosts including a port are rejected, since the port is given separately.
+func parseHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1:len(host) - 1]
+	}
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	if len(host) > maxHostLength {
+		return "", fmt.Errorf("The host \"%.16s...\" is too long.", host)
+	}
+	
+	// Check each label of the host name.
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > maxLabelLength || label[0] == '-' || label[len(label) - 1] == '-' {
+			return "", fmt.Errorf("The host \"%s\" is not a valid host name.", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("The host \"%s\" is not a valid host name.", host)
+			}
+		}
+	}
+	return host, nil
+}
+
+// Register registers a worker with the master.
+func (r *Registrar) Register(ctx context.Context, req *comms.WorkerLink) (*comms.MasterState, error) {
+	var err error = nil
+	
+	// Get a writer and encoder ready for processing state.
+	writer := bytes.Buffer{}
+	encoder := gob.NewEncoder(&writer)
+	
+	// Get the worker's sending address.
+	worker, exists := peer.FromContext(ctx)
+	if !exists {
+		return nil, fmt.Errorf("Could not derive worker's address.")
+	}
+	
+	// Turn the worker away if it isn't allowed to register, or has registered too often.
+	// This happens before the scene is encoded, so that rejected workers cost as little as possible.
+	// Workers which register through a Unix domain socket are on the same machine, so they aren't checked against the allow and deny lists.
+	// They have no host to tell them apart, so each is limited by the socket it's reached through instead, and replicas on the same machine don't use up each other's registrations.
+	var host, source string
+	if worker.Addr.Network() == "unix" {
+		source = "unix:" + req.GetHost()
+	}else{
+		if host, _, err = net.SplitHostPort(worker.Addr.String()); err != nil {
+			host = worker.Addr.String()
+		}
+		if !r.engine.admission.permitted(host) {
+			return nil, status.Errorf(codes.PermissionDenied, "Workers may not register from %s.", host)
+		}
+		source = host
+	}
+	if !r.engine.admission.take(source) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many registrations from %s.", source)
+	}
+	
+	// Compute the worker's recieving address, from the host it gave us or else the host it registered from.
+	// Workers can only be reached through Unix domain sockets if they registered through one, and so are on the same machine.
+	var addr string
+	if bind.IsUnix(req.GetHost()) {
+		if worker.Addr.Network() != "unix" {
+			return nil, status.Errorf(codes.InvalidArgument, "Workers must register through a Unix domain socket to be reached through one.")
+		}
+		addr = req.GetHost()
+	}else{
+		if req.GetHost() != "" {
+			if host, err = parseHost(req.GetHost()); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+			
+			// The host the master reaches the worker at must be allowed too, so that allowed workers can't point the master at anywhere else.
+			// Host names can't be checked against the allow and deny lists, so they're only accepted when there are no lists.
+			if !r.engine.admission.permitted(host) {
+				return nil, status.Errorf(codes.PermissionDenied, "Workers may not be reached at %s.", host)
+			}
+		}
+		addr = net.JoinHostPort(host, strconv.FormatUint(uint64(req.GetPort()), 10))
+	}
+	
+	// Check whether the worker has already cached the scene, and encode the scene state if it hasn't.
+	// The scene and its hash are read together, since the scene may be replaced (see Engine.LoadScene).
+	cached := false
+	var sceneHash string
+	func() {
+		r.engine.mu.RLock()
+		defer r.engine.mu.RUnlock()
+		
+		sceneHash = r.engine.sceneHash
+		for _, hash := range req.GetCachedScenes() {
+			if hash == sceneHash {
+				cached = true
+			}
+		}
+		if !cached {
+			err = encoder.Encode(r.engine.scene)
+		}
+	}()
+	
+	// If there was an error while encoding, return it.
+	if err != nil {
+		return nil, err
+	}
+	
+	// Add the worker to the workers map, replacing any old registration of the worker.
+	if err = r.engine.workers.AddSession(addr, req.GetSession()); err == pool.ErrFull {
+		return nil, status.Errorf(codes.ResourceExhausted, "%v", err)
+	}else if err != nil {
+		return nil, err
+	}
+	
+	// Remember whether the worker ever registers again on its own.
+	// Workers which registered while a new scene was loaded may hold the old scene, so they're turned away to register again.
+	loading := func() bool {
+		r.engine.mu.Lock()
+		defer r.engine.mu.Unlock()
+		
+		if r.engine.loading {
+			return true
+		}
+		if req.GetNeverIdle() {
+			r.engine.neverIdle[addr] = true
+		}else{
+			delete(r.engine.neverIdle, addr)
+		}
+		return false
+	}()
+	if loading {
+		r.engine.workers.Remove(addr)
+		return nil, status.Errorf(codes.Unavailable, "A new scene is being loaded.")
+	}
+	
+	// Build up the repsonse.
+	stateData := comms.MasterState{
+		ScreenWidth: uint32(r.engine.opts.Width),
+		ScreenHeight: uint32(r.engine.opts.Height),
+		SceneHash: sceneHash,
+	}
+	if !cached {
+		stateData.State = writer.Bytes()
+	}
+	
+	return &stateData, nil
+}
+
+// FetchMesh sends one of the scene's meshes to a worker which evicted it.
+func (r *Registrar) FetchMesh(ctx context.Context, req *comms.MeshKey) (*comms.MeshData, error) {
+	r.engine.mu.RLock()
+	defer r.engine.mu.RUnlock()
+	
+	data, err := r.engine.scene.EncodeMesh(req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	return &comms.MeshData{Mesh: data}, nil
+}
\ No newline at end of file
@@ -0,0 +1,65 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import "math"
+
+// DefaultMaxScale is the most the resolution of each frame is divided by, for engines whose options do not specify it.
+const DefaultMaxScale uint = 4
+
+// scaleHeadroom controls how far under budget a frame is expected to be at a finer resolution before the resolution is raised.
+// This keeps the resolution from flickering between two scales when frames are close to the budget.
+const scaleHeadroom float64 = 0.8
+
+// adjustScale picks the scale of the next frame from how long a frame took, given the scale it was traced at.
+// Since the number of pixels traced falls with the square of the scale, a frame's time is assumed to do the same.
+// The scale is raised as far as is needed to meet the budget at once, but only lowered one step at a time, so that a single fast frame can't undo it all at once.
+func (e *Engine) adjustScale(stats *FrameStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	
+	if stats.Skipped {
+		return
+	}
+	e.reduced = stats.Scale > 1 || stats.Checkerboard || stats.Foveated
+	if e.opts.FrameBudget == 0 || stats.Scale == 0 {
+		return
+	}
+	
+	// Find the finest scale at which the frame would have met the budget.
+	budget := float64(e.opts.FrameBudget) * 1e6
+	took := float64(stats.Total)
+	target := e.opts.MaxScale
+	for s := uint(1); s < e.opts.MaxScale; s++ {
+		if took * math.Pow(float64(stats.Scale) / float64(s), 2.0) <= scaleHeadroom * budget {
+			target = s
+			break
+		}
+	}
+	
+	// Only raise the scale if the frame actually missed the budget.
+	if target > e.scale && took > budget {
+		e.scale = target
+	}else if target < e.scale {
+		e.scale -= 1
+	}
+}
+
+// Refine traces the most recently requested frame again in full, if it was traced at a reduced resolution, in a checkerboard, or foveated.
+// This is meant to be called while the camera is still, so that the scene sharpens once there is time to trace it properly.
+func (e *Engine) Refine() error {
+	e.mu.Lock()
+	if !e.reduced {
+		e.mu.Unlock()
+		return nil
+	}
+	e.refining = true
+	e.mu.Unlock()
+	
+	err := e.RenderFrame(e.Camera())
+	
+	e.mu.Lock()
+	e.refining = false
+	e.mu.Unlock()
+	
+	return err
+}
\ No newline at end of file
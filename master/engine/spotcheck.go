@@ -0,0 +1,96 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/worker/serve"
+	"math/rand"
+	"context"
+	"math"
+	"log"
+)
+
+// spotCheckTolerance is the largest difference (in colour levels, out of 255) between any channel of a worker's pixel and the engine's own tracing of it for them to agree.
+const spotCheckTolerance float64 = 2.0
+
+// coloursAgree returns whether the colours of two traced pixels (at index i of a and index j of b) are within the spot check tolerance of each other.
+func coloursAgree(a *comms.TraceResults, i int, b *comms.TraceResults, j int) bool {
+	within := func(x, y float64) bool {
+		return math.Abs(x - y) * 255.0 <= spotCheckTolerance
+	}
+	ar, ag, ab := a.Colour(i).Floats()
+	br, bg, bb := b.Colour(j).Floats()
+	return within(ar, br) && within(ag, bg) && within(ab, bb)
+}
+
+// spotCheck traces some randomly chosen pixels of a frame's filled partitions again with checker, and compares them against the results of the workers which drew them.
+// Workers whose pixels disagree are flagged in the pool's statistics.
+// This function returns the number of pixels checked, and the number which disagreed.
+func (e *Engine) spotCheck(checker *serve.Tracer, frame uint, partitions []comms.WorkOrder, orderMap map[*comms.WorkOrder]*comms.TraceResults, drawnBy map[*comms.WorkOrder]string) (int, int) {
+	// Count the results of every filled partition, so that each result is equally likely to be checked.
+	total := 0
+	for i := range partitions {
+		total += orderMap[&partitions[i]].Count()
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	
+	checked, failures := 0, 0
+	for n := uint(0); n < e.opts.SpotChecks; n++ {
+		// Pick a result, then find its partition and block.
+		k := rand.Intn(total)
+		var order *comms.WorkOrder
+		for i := range partitions {
+			count := orderMap[&partitions[i]].Count()
+			if k < count {
+				order = &partitions[i]
+				break
+			}
+			k -= count
+		}
+		x, y, exists := orderMap[order].Block(k)
+		if !exists {
+			continue
+		}
+		
+		// Trace the block again, just as the worker was asked to.
+		scale := order.GetScale()
+		if scale < 1 {
+			scale = 1
+		}
+		check := comms.WorkOrder{
+			X: uint32(x) * scale,
+			Y: uint32(y) * scale,
+			Width: 1,
+			Height: 1,
+			Diff: order.GetDiff(),
+			Aovs: order.GetAovs(),
+			Samples: order.GetSamples(),
+			Pattern: order.GetPattern(),
+			Integrator: order.GetIntegrator(),
+			Scale: order.GetScale(),
+			BitDepth: order.GetBitDepth(),
+			MirrorDepth: order.GetMirrorDepth(),
+			PathDepth: order.GetPathDepth(),
+			AreaLightSamples: order.GetAreaLightSamples(),
+			ScreenWidth: order.GetScreenWidth(),
+			ScreenHeight: order.GetScreenHeight(),
+		}
+		results, err := checker.TraceOrder(context.Background(), &check)
+		if err != nil || results.Count() != 1 {
+			log.Printf("Frame %d could not spot check pixel (%d, %d): %v.\n", frame, check.X, check.Y, err)
+			continue
+		}
+		
+		// Compare the worker's pixel with our own.
+		checked += 1
+		if !coloursAgree(orderMap[order], k, results, 0) {
+			failures += 1
+			log.Printf("Frame %d found worker \"%s\" miscomputing pixel (%d, %d).\n", frame, drawnBy[order], check.X, check.Y)
+			e.workers.Flag(drawnBy[order])
+		}
+	}
+	
+	return checked, failures
+}
\ No newline at end of file
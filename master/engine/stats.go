@@ -0,0 +1,60 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"time"
+	"log"
+)
+
+// FrameStats describes how a single frame was rendered, and how long each stage of rendering it took.
+type FrameStats struct {
+	Frame uint				// The frame's number.
+	Partitions int			// The number of partitions the frame's area was split into.
+	Unfilled int			// The number of partitions which no worker filled.
+	SpotChecks int			// The number of pixels traced again by the engine to check the workers' results.
+	SpotCheckFailures int	// The number of spot checked pixels which disagreed with the workers' results.
+	Retries int				// The number of times partitions were reassigned after every worker assigned to them failed.
+	Pixels uint64			// The number of pixels traced by workers.
+	Skipped bool			// Whether the frame was skipped entirely.
+	Scale uint				// How much the frame's resolution was divided by (one at full resolution).
+	Checkerboard bool		// Whether only half of the frame's pixels were traced, in a checkerboard.
+	Foveated bool			// Whether the frame was traced at a reduced resolution away from the focus point.
+	Dropped uint			// The number of frames requested before this one which were dropped in its favour (see Options.LatestOnly).
+	SkipReason string		// Why the frame was skipped (empty unless it was).
+	Bytes uint64			// The number of bytes of results received from workers.
+	Tiles []TileStats		// How each of the frame's partitions was filled (if it was).
+	
+	Requested time.Time		// When the frame was requested.
+	Encode time.Duration	// How long it took to encode the frame's scene.
+	Assign time.Duration	// How long it took to assign the frame's partitions to workers.
+	Queue time.Duration		// How long the frame waited for the frames before it to be drawn.
+	Trace time.Duration		// How long the frame waited for results after its turn to draw began.
+	Draw time.Duration		// How long it took to draw (or reproject) the frame's pixels.
+	Total time.Duration		// How long it took from requesting the frame to finishing it.
+}
+
+// TileStats describes how a single partition of a frame was filled.
+type TileStats struct {
+	X, Y, Width, Height uint32	// The area (in pixels) of the screen the partition covers.
+	Filled bool					// Whether any worker filled the partition.
+	Worker string				// The address of the worker whose results filled the partition (empty if it wasn't filled).
+	Latency time.Duration		// How long the worker whose results filled the partition took to return them, from when it was assigned the partition.
+	Bytes int					// The size (in bytes) of the results which filled the partition.
+	Retries uint				// The number of times the partition was reassigned after every worker assigned to it failed.
+}
+
+// reportFrame reports a frame's statistics (if the engine's options ask for them).
+func (e *Engine) reportFrame(stats *FrameStats, requested time.Time) {
+	defer e.reports.Done()
+	
+	stats.Total = time.Since(requested)
+	e.adjustScale(stats)
+	if e.statsOut != nil {
+		if err := e.statsOut.write(*stats); err != nil {
+			log.Printf("Could not write frame %d's statistics: %v.\n", stats.Frame, err)
+		}
+	}
+	if e.opts.FrameDone != nil {
+		e.opts.FrameDone(*stats)
+	}
+}
\ No newline at end of file
@@ -0,0 +1,168 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"path/filepath"
+	"encoding/json"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+	"sync"
+	"os"
+)
+
+// statsColumns are the columns of a statistics file written as CSV, which has a row for each partition of each frame.
+// Frames with no partitions (such as those skipped for want of workers) have a single row, with the partition's columns left empty.
+var statsColumns []string = []string{
+	"frame", "requested", "skipped", "skipReason", "partitions", "unfilled", "retries", "pixels", "bytes", "scale", "dropped",
+	"encodeMs", "assignMs", "queueMs", "traceMs", "drawMs", "totalMs",
+	"tileX", "tileY", "tileWidth", "tileHeight", "tileFilled", "tileWorker", "tileLatencyMs", "tileBytes", "tileRetries",
+}
+
+// tileRecord is how a partition's statistics are written to a statistics file as JSON.
+type tileRecord struct {
+	X uint32			`json:"x"`
+	Y uint32			`json:"y"`
+	Width uint32		`json:"width"`
+	Height uint32		`json:"height"`
+	Filled bool			`json:"filled"`
+	Worker string		`json:"worker,omitempty"`
+	Latency float64		`json:"latencyMs"`
+	Bytes int			`json:"bytes"`
+	Retries uint		`json:"retries"`
+}
+
+// frameRecord is how a frame's statistics are written to a statistics file as JSON, one frame per line.
+type frameRecord struct {
+	Frame uint				`json:"frame"`
+	Requested time.Time		`json:"requested"`
+	Skipped bool			`json:"skipped"`
+	SkipReason string		`json:"skipReason,omitempty"`
+	Partitions int			`json:"partitions"`
+	Unfilled int			`json:"unfilled"`
+	Retries int				`json:"retries"`
+	Pixels uint64			`json:"pixels"`
+	Bytes uint64			`json:"bytes"`
+	Scale uint				`json:"scale"`
+	Dropped uint			`json:"dropped"`
+	Encode float64			`json:"encodeMs"`
+	Assign float64			`json:"assignMs"`
+	Queue float64			`json:"queueMs"`
+	Trace float64			`json:"traceMs"`
+	Draw float64			`json:"drawMs"`
+	Total float64			`json:"totalMs"`
+	Tiles []tileRecord		`json:"tiles"`
+}
+
+// milliseconds converts a duration to a (fractional) number of milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statsWriter writes the statistics of every frame to a file, for analysing offline.
+// Files ending in ".csv" are written as CSV (see statsColumns), and the rest as JSON, with one frame per line.
+type statsWriter struct {
+	mu sync.Mutex
+	file *os.File
+	csv *csv.Writer		// Writes the file as CSV (nil if it is written as JSON).
+}
+
+// newStatsWriter creates (or truncates) a statistics file.
+func newStatsWriter(path string) (*statsWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	
+	w := &statsWriter{file: file}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w.csv = csv.NewWriter(file)
+		if err := w.csv.Write(statsColumns); err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.csv.Flush()
+	}
+	return w, nil
+}
+
+// record converts a frame's statistics into the form written to a statistics file.
+func record(stats FrameStats) frameRecord {
+	r := frameRecord{
+		Frame: stats.Frame,
+		Requested: stats.Requested,
+		Skipped: stats.Skipped,
+		SkipReason: stats.SkipReason,
+		Partitions: stats.Partitions,
+		Unfilled: stats.Unfilled,
+		Retries: stats.Retries,
+		Pixels: stats.Pixels,
+		Bytes: stats.Bytes,
+		Scale: stats.Scale,
+		Dropped: stats.Dropped,
+		Encode: milliseconds(stats.Encode),
+		Assign: milliseconds(stats.Assign),
+		Queue: milliseconds(stats.Queue),
+		Trace: milliseconds(stats.Trace),
+		Draw: milliseconds(stats.Draw),
+		Total: milliseconds(stats.Total),
+		Tiles: make([]tileRecord, len(stats.Tiles), len(stats.Tiles)),
+	}
+	for i, t := range stats.Tiles {
+		r.Tiles[i] = tileRecord{X: t.X, Y: t.Y, Width: t.Width, Height: t.Height, Filled: t.Filled, Worker: t.Worker, Latency: milliseconds(t.Latency), Bytes: t.Bytes, Retries: t.Retries}
+	}
+	return r
+}
+
+// write writes a frame's statistics to a statistics file.
+// Each frame is written out straight away, so that the file is useful even if the engine never closes it.
+func (w *statsWriter) write(stats FrameStats) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	r := record(stats)
+	if w.csv == nil {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.file.Write(append(data, '\n'))
+		return err
+	}
+	
+	// Write a row for each partition, starting with the frame's own columns.
+	ms := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	frame := []string{
+		strconv.FormatUint(uint64(r.Frame), 10), r.Requested.Format(time.RFC3339Nano), strconv.FormatBool(r.Skipped), r.SkipReason,
+		strconv.Itoa(r.Partitions), strconv.Itoa(r.Unfilled), strconv.Itoa(r.Retries), strconv.FormatUint(r.Pixels, 10), strconv.FormatUint(r.Bytes, 10),
+		strconv.FormatUint(uint64(r.Scale), 10), strconv.FormatUint(uint64(r.Dropped), 10),
+		ms(r.Encode), ms(r.Assign), ms(r.Queue), ms(r.Trace), ms(r.Draw), ms(r.Total),
+	}
+	if len(r.Tiles) == 0 {
+		if err := w.csv.Write(append(frame, make([]string, len(statsColumns) - len(frame))...)); err != nil {
+			return err
+		}
+	}
+	for _, t := range r.Tiles {
+		row := append(append([]string(nil), frame...),
+			strconv.FormatUint(uint64(t.X), 10), strconv.FormatUint(uint64(t.Y), 10), strconv.FormatUint(uint64(t.Width), 10), strconv.FormatUint(uint64(t.Height), 10),
+			strconv.FormatBool(t.Filled), t.Worker, ms(t.Latency), strconv.Itoa(t.Bytes), strconv.FormatUint(uint64(t.Retries), 10),
+		)
+		if err := w.csv.Write(row); err != nil {
+			return err
+		}
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// close closes a statistics file.
+func (w *statsWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	return w.file.Close()
+}
\ No newline at end of file
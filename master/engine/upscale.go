@@ -0,0 +1,187 @@
+// Package engine provides the master's distributed rendering logic, so that other programs can embed it.
+package engine
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"strings"
+	"image"
+	"math"
+	"fmt"
+)
+
+// lanczosLobes is the number of lobes either side of the centre of the Lanczos filter, so that it blends the nearest 2 * lanczosLobes samples along each axis.
+const lanczosLobes int = 2
+
+// Filter selects how an image is stretched over more pixels than it has samples.
+type Filter uint8
+
+// These constants are the possible filters.
+const (
+	FilterNearest Filter = iota	// Each pixel takes the colour of the nearest sample, leaving the image blocky.
+	FilterBilinear				// Each pixel blends the four nearest samples, smoothing the image.
+	FilterLanczos				// Each pixel blends the nearest 4 by 4 samples, keeping the image sharper than bilinear filtering.
+	numFilters
+)
+
+// filterNames holds the name of each filter.
+var filterNames = [numFilters]string{"nearest", "bilinear", "lanczos"}
+
+// String returns the name of a filter.
+func (f Filter) String() string {
+	if f < numFilters {
+		return filterNames[f]
+	}
+	return fmt.Sprintf("Filter(%d)", uint8(f))
+}
+
+// ParseFilter finds the filter with some name (ignoring case).
+func ParseFilter(name string) (Filter, error) {
+	for f := Filter(0); f < numFilters; f++ {
+		if strings.EqualFold(name, filterNames[f]) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown filter \"%s\".", name)
+}
+
+// lanczos returns the weight of the Lanczos filter at some distance (in samples) from its centre.
+func lanczos(d float64) float64 {
+	if d == 0.0 {
+		return 1.0
+	}
+	if math.Abs(d) >= float64(lanczosLobes) {
+		return 0.0
+	}
+	a := float64(lanczosLobes)
+	return a * math.Sin(math.Pi * d) * math.Sin(math.Pi * d / a) / (math.Pi * math.Pi * d * d)
+}
+
+// taps returns the first sample along one axis which a filter blends to find the value at position u, along with the weight of each sample it blends.
+// Sample i lies at position i.
+func (f Filter) taps(u float64) (int, []float64) {
+	switch f {
+	case FilterBilinear:
+		first := int(math.Floor(u))
+		t := u - float64(first)
+		return first, []float64{1.0 - t, t}
+	case FilterLanczos:
+		first := int(math.Floor(u)) - lanczosLobes + 1
+		weights := make([]float64, 2 * lanczosLobes, 2 * lanczosLobes)
+		for k := range weights {
+			weights[k] = lanczos(u - float64(first + k))
+		}
+		return first, weights
+	default:
+		return int(math.Floor(u + 0.5)), []float64{1.0}
+	}
+}
+
+// sampleAt returns the colour at the position (u, v) of a grid of samples, blended by a filter, where sample (i, j) lies at position (i, j).
+// Samples which get reports as missing (e.g. off the edge of the grid) are left out of the blend.
+// The second return value is false if none of the samples could be blended.
+func (f Filter) sampleAt(get func(i, j int) (colour.RGB, bool), u, v float64) (colour.RGB, bool) {
+	firstI, weightsI := f.taps(u)
+	firstJ, weightsJ := f.taps(v)
+	
+	var r, g, b, total float64
+	for k, wi := range weightsI {
+		for l, wj := range weightsJ {
+			if wi * wj == 0.0 {
+				continue
+			}
+			col, exists := get(firstI + k, firstJ + l)
+			if !exists {
+				continue
+			}
+			cr, cg, cb := col.Floats()
+			r, g, b, total = r + wi * wj * cr, g + wi * wj * cg, b + wi * wj * cb, total + wi * wj
+		}
+	}
+	
+	// If the blend can't be normalized (because every sample with any weight is missing), fall back to the nearest sample.
+	if total <= 0.0 {
+		if f == FilterNearest {
+			return colour.RGB{}, false
+		}
+		return FilterNearest.sampleAt(get, u, v)
+	}
+	return colour.NewRGBFromFloats(float32(r / total), float32(g / total), float32(b / total)), true
+}
+
+// ScaledCanvas implements the Canvas interface by stretching each frame over another canvas of a different size, using a filter.
+// This lets frames be traced at a lower resolution than they are displayed at.
+type ScaledCanvas struct {
+	canvas Canvas
+	width, height int					// The dimensions (in pixels) of each frame.
+	displayWidth, displayHeight int		// The dimensions (in pixels) of the canvas frames are stretched over.
+	filter Filter
+	pixels []colour.RGB		// The colour of each pixel of the frame, in row-major order.
+	dirty image.Rectangle	// The area of the frame which has been drawn since the canvas was last updated.
+}
+
+// NewScaledCanvas creates a canvas which stretches width by height frames over a displayWidth by displayHeight canvas, using a filter.
+func NewScaledCanvas(canvas Canvas, width, height, displayWidth, displayHeight int, filter Filter) *ScaledCanvas {
+	return &ScaledCanvas{
+		canvas: canvas,
+		width: width,
+		height: height,
+		displayWidth: displayWidth,
+		displayHeight: displayHeight,
+		filter: filter,
+		pixels: make([]colour.RGB, width * height, width * height),
+	}
+}
+
+// Set colours the pixel (x, y) of the frame, which is stretched over the canvas once it is updated.
+func (c *ScaledCanvas) Set(x, y int, col colour.RGB) {
+	c.pixels[y * c.width + x] = col
+	c.dirty = c.dirty.Union(image.Rect(x, y, x + 1, y + 1))
+}
+
+// Update stretches the parts of the frame drawn so far over the canvas, then displays them.
+func (c *ScaledCanvas) Update() {
+	c.flush()
+	c.canvas.Update()
+}
+
+// Present stretches the rest of the frame over the canvas, then displays it.
+func (c *ScaledCanvas) Present() {
+	c.flush()
+	c.canvas.Present()
+}
+
+// flush draws every pixel of the canvas which could be affected by the parts of the frame drawn since the last flush.
+func (c *ScaledCanvas) flush() {
+	if c.dirty.Empty() {
+		return
+	}
+	
+	// Every pixel of the frame affects the pixels of the canvas within the filter's reach of it.
+	reach := 1
+	if c.filter == FilterLanczos {
+		reach = lanczosLobes
+	}
+	area := c.dirty.Inset(-reach).Intersect(image.Rect(0, 0, c.width, c.height))
+	c.dirty = image.Rectangle{}
+	
+	scaleX, scaleY := float64(c.displayWidth) / float64(c.width), float64(c.displayHeight) / float64(c.height)
+	xMin, xMax := int(math.Floor(float64(area.Min.X) * scaleX)), int(math.Ceil(float64(area.Max.X) * scaleX))
+	yMin, yMax := int(math.Floor(float64(area.Min.Y) * scaleY)), int(math.Ceil(float64(area.Max.Y) * scaleY))
+	
+	get := func(i, j int) (colour.RGB, bool) {
+		if i < 0 || j < 0 || i >= c.width || j >= c.height {
+			return colour.RGB{}, false
+		}
+		return c.pixels[j * c.width + i], true
+	}
+	for x := xMin; x < xMax && x < c.displayWidth; x++ {
+		for y := yMin; y < yMax && y < c.displayHeight; y++ {
+			// Find where the centre of the canvas's pixel lies in the frame, where each of the frame's pixels is centred on its coordinates.
+			u := (float64(x) + 0.5) / scaleX - 0.5
+			v := (float64(y) + 0.5) / scaleY - 0.5
+			if col, exists := c.filter.sampleAt(get, u, v); exists {
+				c.canvas.Set(x, y, col)
+			}
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,351 @@
+// Package job renders offline jobs (high resolution stills, or sequences of frames) a tile at a time, checkpointing each finished tile to disk so that an interrupted job can be resumed.
+package job
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"github.com/mwindels/distributed-raytracer/master/output"
+	"path/filepath"
+	"encoding/json"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"image"
+	"math"
+	"sync"
+	"log"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultTileSize is the width and height (in pixels) of each tile, for jobs which don't set their own.
+const DefaultTileSize uint = 256
+
+// tileRetries controls how many times a tile is traced again when part of it could not be filled, before the job gives up.
+const tileRetries uint = 3
+
+// jobFile is the name of the file (within a job's directory) which describes the job.
+const jobFile string = "job.json"
+
+// tileDir is the name of the directory (within a job's directory) finished tiles are checkpointed to.
+const tileDir string = "tiles"
+
+// Frame describes a single frame of a job.
+type Frame struct {
+	Cam state.StoredCamera	`json:"cam"`
+	TimeOfDay *float64		`json:"timeOfDay,omitempty"`	// The hour the scene's sun is at (wherever the scene puts it if missing).
+}
+
+// Job describes an offline render, as stored in its directory.
+// Its frames can be written by hand (e.g. to render an animation), as long as they are never changed once the job has started.
+type Job struct {
+	SceneHash string		`json:"sceneHash"`	// The hash of the scene's immutable parts, so that a job isn't resumed with a different scene.
+	Width uint				`json:"width"`
+	Height uint				`json:"height"`
+	TileSize uint			`json:"tileSize"`
+	Frames []Frame			`json:"frames"`
+}
+
+// Config controls an offline job.
+type Config struct {
+	Dir string				// The directory the job is stored in, which is resumed if it holds a job already.
+	Frames uint				// The number of frames of a new job, over which the camera turns one full circle (one if zero).
+	TileSize uint			// The width and height (in pixels) of each tile of a new job (DefaultTileSize if zero).
+	MinWorkers uint			// The number of workers which must join before the job starts.
+	WorkerWait uint			// How long (in milliseconds) to wait for workers to join.
+	Engine engine.Options	// The options of the engine rendering the job (its canvas is replaced by the job's, and its post-processors are applied to each finished frame instead).
+	Owner *engine.Engine	// An engine whose workers the job shares, rendering in a session of it (see engine.NewSession) rather than starting its own engine (nil if the job starts its own).
+}
+
+// tileCanvas implements the engine.Canvas interface by copying whatever is drawn within a single tile into an image.
+type tileCanvas struct {
+	mu sync.Mutex
+	tile image.Rectangle
+	img draw.Image	// The tile's pixels, with the tile's top left corner at (0, 0).
+}
+
+// Set colours the pixel (x, y) of the tile's image, if it's within the tile.
+func (c *tileCanvas) Set(x, y int, col colour.RGB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	if image.Pt(x, y).In(c.tile) {
+		c.img.Set(x - c.tile.Min.X, y - c.tile.Min.Y, col)
+	}
+}
+
+// Update does nothing.
+func (c *tileCanvas) Update() {}
+
+// Present does nothing.
+func (c *tileCanvas) Present() {}
+
+// start gets the canvas ready to copy a new tile, returning the tile's image.
+func (c *tileCanvas) start(tile image.Rectangle, deep bool) draw.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	c.tile = tile
+	if deep {
+		c.img = image.NewRGBA64(image.Rect(0, 0, tile.Dx(), tile.Dy()))
+	}else{
+		c.img = image.NewRGBA(image.Rect(0, 0, tile.Dx(), tile.Dy()))
+	}
+	return c.img
+}
+
+// newJob creates a job for a scene, whose frames turn the scene's camera one full circle.
+func newJob(scene state.Environment, sceneHash string, cfg Config) Job {
+	j := Job{SceneHash: sceneHash, Width: cfg.Engine.Width, Height: cfg.Engine.Height, TileSize: cfg.TileSize}
+	if j.TileSize == 0 {
+		j.TileSize = DefaultTileSize
+	}
+	frames := cfg.Frames
+	if frames == 0 {
+		frames = 1
+	}
+	
+	cam := scene.Mutable().Cam
+	for f := uint(0); f < frames; f++ {
+		j.Frames = append(j.Frames, Frame{Cam: cam.Stored()})
+		cam.Yaw(2.0 * math.Pi / float64(frames))
+	}
+	return j
+}
+
+// load reads a job from its directory, or creates (and saves) a new one if the directory holds no job.
+func load(scene state.Environment, cfg Config) (Job, error) {
+	sceneHash, err := scene.Hash()
+	if err != nil {
+		return Job{}, err
+	}
+	
+	path := filepath.Join(cfg.Dir, jobFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Start a new job.
+		j := newJob(scene, sceneHash, cfg)
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, tileDir), 0755); err != nil {
+			return Job{}, err
+		}
+		data, err := json.MarshalIndent(j, "", "\t")
+		if err != nil {
+			return Job{}, err
+		}
+		if err := writeAtomically(path, func(w io.Writer) error {
+			_, err := w.Write(append(data, '\n'))
+			return err
+		}); err != nil {
+			return Job{}, err
+		}
+		log.Printf("Started job \"%s\" with %d frames.\n", cfg.Dir, len(j.Frames))
+		return j, nil
+	}else if err != nil {
+		return Job{}, err
+	}
+	
+	// Resume the existing job, as long as it renders the same scene at the same size.
+	var j Job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return Job{}, fmt.Errorf("Could not parse job \"%s\": %v.", path, err)
+	}
+	if j.SceneHash != sceneHash {
+		return Job{}, fmt.Errorf("Job \"%s\" was started with a different scene.", path)
+	}
+	if j.Width != cfg.Engine.Width || j.Height != cfg.Engine.Height {
+		return Job{}, fmt.Errorf("Job \"%s\" renders %dx%d frames, rather than %dx%d.", path, j.Width, j.Height, cfg.Engine.Width, cfg.Engine.Height)
+	}
+	if j.TileSize == 0 {
+		return Job{}, fmt.Errorf("Job \"%s\" has no tile size.", path)
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, tileDir), 0755); err != nil {
+		return Job{}, err
+	}
+	log.Printf("Resuming job \"%s\" with %d frames.\n", cfg.Dir, len(j.Frames))
+	return j, nil
+}
+
+// tiles splits a job's frames into tiles, in row-major order.
+func (j Job) tiles() []image.Rectangle {
+	var tiles []image.Rectangle
+	size := int(j.TileSize)
+	for y := 0; y < int(j.Height); y += size {
+		for x := 0; x < int(j.Width); x += size {
+			tiles = append(tiles, image.Rect(x, y, x + size, y + size).Intersect(image.Rect(0, 0, int(j.Width), int(j.Height))))
+		}
+	}
+	return tiles
+}
+
+// writeAtomically writes a file using write, so that the file either appears in full or not at all, even if the process is killed.
+func writeAtomically(path string, write func(w io.Writer) error) error {
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// exists returns whether a file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Run renders (or resumes) an offline job of a scene, writing each finished frame to its own PNG file in the job's directory.
+// Each finished tile is checkpointed before the next is traced, so if the job is interrupted, running it again only traces the tiles which weren't finished.
+func Run(scene state.Environment, cfg Config) error {
+	j, err := load(scene, cfg)
+	if err != nil {
+		return err
+	}
+	tiles := j.tiles()
+	deep := cfg.Engine.BitDepth > 8
+	
+	// Report each frame's statistics, so that tiles which weren't filled can be traced again.
+	canvas := &tileCanvas{}
+	done := make(chan engine.FrameStats, 1)
+	opts := cfg.Engine
+	opts.Canvas = canvas
+	opts.PostChain = nil
+	opts.FrameDone = func(stats engine.FrameStats) {
+		done <- stats
+	}
+	
+	// Set up the engine (or a session of the engine which owns the workers), then wait for enough workers to join.
+	var eng *engine.Engine
+	if cfg.Owner != nil {
+		eng, err = cfg.Owner.NewSession(opts)
+	}else{
+		eng, err = engine.New(scene, opts)
+	}
+	if err != nil {
+		return err
+	}
+	defer eng.Close()
+	if err := eng.WaitForWorkers(cfg.MinWorkers, cfg.WorkerWait); err != nil {
+		return err
+	}
+	
+	for f, frame := range j.Frames {
+		// Skip the frames which are already finished.
+		framePath := filepath.Join(cfg.Dir, fmt.Sprintf("frame-%04d.png", f))
+		if exists(framePath) {
+			continue
+		}
+		
+		// Set the scene up as the frame sees it.
+		cam, err := frame.Cam.CameraWithUp(eng.Camera().WorldUp())
+		if err != nil {
+			return fmt.Errorf("Frame %d has an invalid camera: %v.", f, err)
+		}
+		if frame.TimeOfDay != nil {
+			if err := eng.SetTimeOfDay(*frame.TimeOfDay); err != nil {
+				return fmt.Errorf("Frame %d could not set the time of day: %v.", f, err)
+			}
+		}
+		
+		// Trace and checkpoint each of the frame's unfinished tiles.
+		for t, tile := range tiles {
+			tilePath := filepath.Join(cfg.Dir, tileDir, fmt.Sprintf("frame-%04d-tile-%04d.png", f, t))
+			if exists(tilePath) {
+				continue
+			}
+			
+			img := canvas.start(tile, deep)
+			filled := false
+			for attempt := uint(0); attempt <= tileRetries && !filled; attempt++ {
+				if err := eng.RenderArea(cam, uint(tile.Min.X), uint(tile.Min.Y), uint(tile.Dx()), uint(tile.Dy())); err != nil {
+					return err
+				}
+				stats := <-done
+				filled = !stats.Skipped && stats.Unfilled == 0
+			}
+			if !filled {
+				return fmt.Errorf("Frame %d could not fill tile %d after %d attempts; run the job again to resume it.", f, t, tileRetries + 1)
+			}
+			
+			if err := writeAtomically(tilePath, func(w io.Writer) error {return png.Encode(w, img)}); err != nil {
+				return err
+			}
+			log.Printf("Frame %d finished tile %d of %d.\n", f, t + 1, len(tiles))
+		}
+		
+		// Put the frame together from its tiles.
+		if err := assemble(j, tiles, f, framePath, deep, cfg); err != nil {
+			return err
+		}
+		log.Printf("Frame %d written to \"%s\".\n", f, framePath)
+	}
+	
+	return nil
+}
+
+// assemble puts a frame together from its checkpointed tiles, applies the engine's post-processors to it, and writes it to path.
+// Once the frame has been written, its tiles are removed.
+func assemble(j Job, tiles []image.Rectangle, f int, path string, deep bool, cfg Config) error {
+	var frame draw.Image
+	bounds := image.Rect(0, 0, int(j.Width), int(j.Height))
+	if deep {
+		frame = image.NewRGBA64(bounds)
+	}else{
+		frame = image.NewRGBA(bounds)
+	}
+	
+	tilePaths := make([]string, len(tiles), len(tiles))
+	for t, tile := range tiles {
+		tilePaths[t] = filepath.Join(cfg.Dir, tileDir, fmt.Sprintf("frame-%04d-tile-%04d.png", f, t))
+		file, err := os.Open(tilePaths[t])
+		if err != nil {
+			return err
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Could not read tile \"%s\": %v.", tilePaths[t], err)
+		}
+		draw.Draw(frame, tile, img, image.Point{}, draw.Src)
+	}
+	
+	// Apply the post-processors to the whole frame (if necessary).
+	if len(cfg.Engine.PostChain) > 0 {
+		colours := make([]colour.RGB, 0, bounds.Dx() * bounds.Dy())
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b, _ := frame.At(x, y).RGBA()
+				colours = append(colours, colour.NewRGBFromLevels(uint16(r), uint16(g), uint16(b), 16))
+			}
+		}
+		colours = cfg.Engine.PostChain.Apply(engine.Frame{Width: bounds.Dx(), Height: bounds.Dy(), Colours: colours})
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				frame.Set(x, y, colours[y * bounds.Dx() + x])
+			}
+		}
+	}
+	
+	if err := writeAtomically(path, func(w io.Writer) error {return output.Encode(w, frame, output.FormatPNG)}); err != nil {
+		return err
+	}
+	for _, tilePath := range tilePaths {
+		os.Remove(tilePath)
+	}
+	return nil
+}
\ No newline at end of file
@@ -2,193 +2,181 @@ package main
 
 import (
 	"github.com/veandco/go-sdl2/sdl"
-	"github.com/mwindels/distributed-raytracer/shared/comms"
 	"github.com/mwindels/distributed-raytracer/shared/colour"
 	"github.com/mwindels/distributed-raytracer/shared/state"
 	"github.com/mwindels/distributed-raytracer/shared/screen"
 	"github.com/mwindels/distributed-raytracer/shared/input"
-	"github.com/mwindels/distributed-raytracer/master/pool"
-	"google.golang.org/grpc"
-	"encoding/gob"
+	"github.com/mwindels/distributed-raytracer/shared/app"
+	"github.com/mwindels/distributed-raytracer/shared/profiling"
+	"github.com/mwindels/distributed-raytracer/shared/chaos"
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"github.com/mwindels/distributed-raytracer/master/console"
+	"github.com/mwindels/distributed-raytracer/master/bench"
+	"github.com/mwindels/distributed-raytracer/master/job"
+	"github.com/mwindels/distributed-raytracer/master/output"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"image/color"
+	"path/filepath"
 	"strconv"
-	"reflect"
-	"bytes"
-	"sync"
+	"strings"
+	"flag"
 	"math"
+	"net"
+	"fmt"
 	"sort"
 	"log"
 	"os"
 )
 
-// widthKernel and heightKernel both inform the recursion depth of the screen partitioning function.
-// If there are sufficient workers, these values represent the largest width and height a minimal partition piece can be.
-const (
-	widthKernel uint32 = 50
-	heightKernel uint32 = 50
-)
-
-// workerRedundancy controls how many workers are assigned to each partition of the screen.
-const workerRedundancy uint = 1
-
-// traceTimeout controls how long the master waits before rejecting a BulkTrace call.
-// This is a variable because the master may want to dynamically change it.
-var traceTimeout uint = 2000
-
 // these variables are used to calculate the number of frames per second.
 var (
 	frameStartTimes []uint32 = nil
 	frameEndTimes []uint32 = nil
 )
 
-// system represents the whole distributed system as the master sees it.
-type system struct {
-	mu sync.RWMutex	// Used to protect the scene's state.
-	scene state.Environment
-	
-	workers pool.Pool
+// sdlCanvas implements the engine.Canvas interface using an SDL window.
+type sdlCanvas struct {
+	window *sdl.Window
+	surface *sdl.Surface
+	dither bool	// Whether colours are dithered down to the surface's 8 bits per channel, rather than truncated.
 }
 
-// partition recursively creates a list of work orders by partitioning an area.
-// The first return value is a slice of the original area's partitioned sub-areas.
-// The second return value is the number of leftover workers.
-func partition(area *comms.WorkOrder, workers uint, dimension uint) ([]comms.WorkOrder, uint) {
-	// If there aren't enough workers left to split the area in half, return.
-	if workers / workerRedundancy < 2 {
-		if workers > workerRedundancy {
-			return []comms.WorkOrder{*area}, workers % workerRedundancy
-		}else{
-			return []comms.WorkOrder{*area}, 0
-		}
+// Set colours the pixel (x, y) of the window's surface.
+func (c sdlCanvas) Set(x, y int, col colour.RGB) {
+	if c.dither {
+		r, g, b := col.Dither(x, y)
+		c.surface.Set(x, y, color.RGBA{R: r, G: g, B: b, A: 0xFF})
+	}else{
+		c.surface.Set(x, y, col)
+	}
+}
+
+// Update updates the window with part of a frame.
+func (c sdlCanvas) Update() {
+	c.window.UpdateSurface()
+}
+
+// Present updates the window with a complete frame, and records the time at which the frame was drawn.
+func (c sdlCanvas) Present() {
+	c.window.UpdateSurface()
+	frameEndTimes = append(frameEndTimes, sdl.GetTicks())
+	frameStartTimes = append(frameStartTimes, sdl.GetTicks())
+}
+
+// splitList splits a comma-separated list, returning nil if the list is empty.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
 	}
 	
-	x, y := area.GetX(), area.GetY()
-	width, height := area.GetWidth(), area.GetHeight()
-	if width <= widthKernel && height <= heightKernel {
-		// If the area can't be partitioned any more, return.
-		return []comms.WorkOrder{*area}, workers - workerRedundancy
-	}else if width <= widthKernel {
-		// If the area can't be split vertically, split horizontally.
-		dimension = 1
-	}else if height <= heightKernel {
-		// If the area can't be split horizontally, split vertically.
-		dimension = 0
-	}
-	
-	// Compute the left and right areas.
-	var leftOrder, rightOrder *comms.WorkOrder
-	if dimension % 2 == 0 {
-		leftOrder = &comms.WorkOrder{X: x, Y: y, Width: width / 2, Height: height, Diff: area.GetDiff()}
-		rightOrder = &comms.WorkOrder{X: x + width / 2, Y: y, Width: width / 2 + width % 2, Height: height, Diff: area.GetDiff()}
-	}else{
-		leftOrder = &comms.WorkOrder{X: x, Y: y, Width: width, Height: height / 2, Diff: area.GetDiff()}
-		rightOrder = &comms.WorkOrder{X: x, Y: y + height / 2, Width: width, Height: height / 2 + height % 2, Diff: area.GetDiff()}
+	items := strings.Split(list, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// screenshot writes the most recently drawn frame to the file at path.
+func screenshot(eng *engine.Engine, path string) error {
+	frame, err := eng.Snapshot()
+	if err != nil {
+		return err
 	}
 	
-	// Find the partitions within the left and right areas.
-	left, remainder := partition(leftOrder, workers / 2 + workers % 2, (dimension + 1) % 2)
-	right, remainder := partition(rightOrder, workers / 2 + remainder, (dimension + 1) % 2)
-	return append(left, right...), remainder
+	return output.WriteFile(path, frame)
 }
 
-// newCoordinator coordinates the drawing of a new frame.
-func newCoordinator(sys *system, diff []byte, frame uint, window *sdl.Window, surface *sdl.Surface, in <-chan struct{}, out chan<- struct{}) {
-	// Find the number of workers.
-	// This number might change while assigning tasks, so this is just a heuristic for partitioning.
-	numWorkers := sys.workers.Size()
-	
-	if numWorkers > 0 {
-		// Partition the screen.
-		partitions, _ := partition(&comms.WorkOrder{X: 0, Y: 0, Width: uint32(surface.W), Height: uint32(surface.H), Diff: diff}, numWorkers, 0)
-		
-		// Assign the partitions to workers.
-		resultMap := make(map[<-chan *comms.TraceResults]*comms.WorkOrder)
-		resultChs := make([]reflect.SelectCase, 0, workerRedundancy * uint(len(partitions)))
-		for i := 0; i < len(partitions); i++ {
-			var err error
-			assigned := false
-			
-			// Assign worker(s) to the current partition.
-			for j := uint(0); j < workerRedundancy; j++ {
-				if resultCh, err := sys.workers.Assign(&partitions[i], traceTimeout); err == nil {
-					resultMap[resultCh] = &partitions[i]
-					resultChs = append(resultChs, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(resultCh)})
-					assigned = true
-				}
-			}
-			
-			// If no workers could be assigned to this partition, skip the frame.
-			if !assigned {
-				<-in
-				log.Printf("Frame %d skipped, could not draw part of screen: %v.\n", frame, err)
-				out <- struct{}{}
-				return
-			}
-		}
-		
-		// Accumulate results.
-		orderMap := make(map[*comms.WorkOrder]*comms.TraceResults)
-		for len(orderMap) < len(partitions) {
-			// Wait for a worker to respond.
-			idx, value, success := reflect.Select(resultChs)
-			result := value.Interface().(*comms.TraceResults)
-			order := resultMap[resultChs[idx].Chan.Interface().(<-chan *comms.TraceResults)]
-			
-			// Update the order map with the new results.
-			if status, exists := orderMap[order]; exists {
-				if success && status == nil {
-					orderMap[order] = result
-				}
-			}else{
-				if success {
-					orderMap[order] = result
-				}else{
-					orderMap[order] = nil
-				}
-			}
-			
-			// Remove the worker from the working list.
-			resultChs = append(resultChs[:idx], resultChs[idx + 1:]...)
-		}
-		
-		// If any of the partitions could not be filled, skip the frame.
-		for _, r := range orderMap {
-			if r == nil {
-				<-in
-				log.Printf("Frame %d skipped, could not draw part of the screen.", frame)
-				out <- struct{}{}
-				return
-			}
-		}
-		
-		// Draw the frame.
-		<-in
-		surface.FillRect(nil, 0)
-		for o, r := range orderMap {
-			pixels := r.GetResults()
-			xInit, yInit := int(o.GetX()), int(o.GetY())
-			width, height := int(o.GetWidth()), int(o.GetHeight())
-			for i := 0; i < width; i++ {
-				for j := 0; j < height; j++ {
-					pixel := pixels[i * height + j]
-					surface.Set(xInit + i, yInit + j, colour.NewRGB(uint8(pixel.GetR()), uint8(pixel.GetG()), uint8(pixel.GetB())))
-				}
-			}
-		}
-		window.UpdateSurface()
-		frameEndTimes = append(frameEndTimes, sdl.GetTicks())
-		frameStartTimes = append(frameStartTimes, sdl.GetTicks())
-		out <- struct{}{}
-	}else{
-		// If there are no workers available, skip the frame.
-		<-in
-		log.Printf("Frame %d skipped, no workers in pool.\n", frame)
-		out <- struct{}{}
+// renderHeadless renders a single frame of a scene without a window, then writes it to the file at path.
+// Before rendering, this function waits (for at most workerWait milliseconds) for minWorkers workers to join.
+func renderHeadless(env state.Environment, opts engine.Options, minWorkers, workerWait uint, path string) error {
+	eng, err := engine.New(env, opts)
+	if err != nil {
+		return err
+	}
+	defer eng.Close()
+	
+	if err := eng.WaitForWorkers(minWorkers, workerWait); err != nil {
+		return err
+	}
+	if err := eng.RenderFrame(eng.Camera()); err != nil {
+		return err
 	}
+	eng.Wait()
+	
+	return screenshot(eng, path)
 }
 
 func main() {
+	// Parse the command line options.
+	localWorkers := flag.Uint("local-workers", 0, "the number of workers to run inside the master's process")
+	chaosOpts := chaos.AddFlags(flag.CommandLine)
+	profileOpts := profiling.AddFlags(flag.CommandLine)
+	benchFrames := flag.Uint("bench", 0, "render this many frames along a fixed camera path without a window, then print a JSON report")
+	headlessPath := flag.String("headless", "", "render one frame without a window, write it to this file (.png), then exit")
+	jobDir := flag.String("job", "", "render an offline job without a window, a tile at a time, checkpointing each finished tile to this directory (resuming the job already there, if any), then exit")
+	backgroundJob := flag.String("background-job", "", "render an offline job (as with -job) into this directory in the background of the window, sharing its workers, whose work orders are traced whenever the window's aren't (none if empty)")
+	backgroundPriority := flag.Int("background-priority", -1, "the priority of the background job's work orders, which are traced after the window's (at priority zero) if it is lower")
+	jobFrames := flag.Uint("job-frames", 1, "the number of frames of a new offline job, over which the camera turns one full circle")
+	tileSize := flag.Uint("tile-size", job.DefaultTileSize, "the width and height (in pixels) of each tile of a new offline job")
+	minWorkers := flag.Uint("min-workers", 1, "the number of workers which must join before a benchmark, headless render, or offline job starts")
+	workerWait := flag.Uint("worker-wait", 10000, "how long (in milliseconds) a benchmark, headless render, or offline job waits for workers to join")
+	glideFrames := flag.Uint("glide-frames", 0, "the number of frames over which the camera glides to a recalled bookmark, rather than jumping straight there (no glide if zero)")
+	collide := flag.Bool("collide", false, "keep the camera from moving through the scene's objects, stopping it just short of them")
+	moveSpeed := flag.Float64("move-speed", 0.0, "how fast (in metres per second) the camera moves while a movement key is held, which can be turned up and down with the plus and minus keys (scaled to the size of the scene if zero)")
+	screenshotDir := flag.String("screenshot-dir", ".", "the directory screenshots (taken with F12) are written to")
+	sceneDir := flag.String("scene-dir", "", "the directory the console loads scenes from (the directory of the scene given on the command line if empty)")
+	recordPath := flag.String("record", "", "record the input stream to this file")
+	replayPath := flag.String("replay", "", "replay the input stream recorded in this file instead of using live input")
+	resultRate := flag.Uint("result-rate", 0, "the most bytes per second received from each remote worker (unlimited if zero)")
+	assetRate := flag.Uint("asset-rate", 0, "the most bytes per second of scene data sent to each registering worker (unlimited if zero)")
+	remoteControl := flag.Bool("remote-control", false, "let external programs move the camera through the registration port")
+	consoleAddr := flag.String("console", "", "read commands (such as \"set redundancy 2\" or \"list workers\", see \"help\") from standard input if \"-\", or else from connections to this address (e.g. localhost:4000) while the window is open (no console if empty)")
+	aovList := flag.String("aovs", "", "a comma-separated list of auxiliary buffers (depth, normal, albedo, object_id) to trace alongside each frame")
+	passList := flag.String("passes", "beauty", "a comma-separated list of passes and their weights (e.g. \"diffuse=1,occlusion=0.5\") combined to draw each frame (F1 cycles through each pass alone)")
+	samples := flag.Uint("samples", 0, "the number of rays traced through each pixel (the scene's, or else one, if zero)")
+	mirrorDepth := flag.Uint("mirror-depth", 0, fmt.Sprintf("the most reflections and refractions a ray goes through when using Phong shading (the scene's, or else %d, if zero)", tracer.DefaultMirrorDepth))
+	pathDepth := flag.Uint("path-depth", 0, fmt.Sprintf("the most surfaces a path bounces off of when path tracing (the scene's, or else %d, if zero)", tracer.DefaultPathDepth))
+	areaLightSamples := flag.Uint("area-light-samples", 0, fmt.Sprintf("the number of points on the scene's emitters which light each point when using Phong shading (the scene's, or else %d, if zero)", tracer.DefaultAreaLightSamples))
+	patternName := flag.String("pattern", "grid", "where within each pixel rays are traced (grid, jittered, halton, sobol, or blue-noise)")
+	integratorName := flag.String("integrator", "phong", "how the colour of each ray is found (phong, or path for path tracing)")
+	frameBudget := flag.Uint("frame-budget", 0, "how long (in milliseconds) each frame should take, beyond which frames are traced at a reduced resolution while the camera moves (never reduced if zero)")
+	maxScale := flag.Uint("max-scale", engine.DefaultMaxScale, "the most the resolution of each frame is divided by when it is reduced")
+	foveaRadius := flag.Uint("fovea-radius", 0, "the radius (in pixels) around the mouse cursor traced at full resolution while the camera moves, beyond which the resolution falls off (no foveation if zero)")
+	peripheryScale := flag.Uint("periphery-scale", engine.DefaultPeripheryScale, "the most the resolution at the edge of the screen is divided by when foveating")
+	checkerboard := flag.Bool("checkerboard", false, "trace half of each frame's pixels in a checkerboard while the camera moves, filling in the rest from the previous frame")
+	maxFramesInFlight := flag.Uint("max-frames-in-flight", 0, "the most frames rendering at once, beyond which input waits for a frame to finish (or, with -latest-only, only the newest frame waits; unlimited if zero, or one with -latest-only)")
+	latestOnly := flag.Bool("latest-only", false, "when input arrives faster than frames are drawn, only render the newest camera, dropping the frames in between")
+	spotChecks := flag.Uint("spot-checks", 0, "the number of pixels of each frame the master traces again itself, to check the workers' results")
+	maxWorkerTasks := flag.Uint("max-worker-tasks", 0, "the most partitions each worker can be tracing at once, beyond which partitions go to other workers (unlimited if zero)")
+	redundancy := flag.Uint("redundancy", engine.DefaultRedundancy, "the number of workers each partition is assigned to, whose results are cross-checked if there are several")
+	frameDeadline := flag.Uint("frame-deadline", 0, "how long (in milliseconds) after a frame is requested its unfinished partitions are abandoned (no deadline if zero)")
+	bindAddr := flag.String("bind", "", "the address, network interface (e.g. \"eth0\"), or Unix domain socket (e.g. \"unix:///tmp/master.sock\", ignoring the port) on which workers register (every interface if empty)")
+	allowWorkers := flag.String("allow-workers", "", "a comma-separated list of IP addresses and CIDR ranges workers may register from (anywhere if empty)")
+	denyWorkers := flag.String("deny-workers", "", "a comma-separated list of IP addresses and CIDR ranges workers may never register from")
+	maxWorkers := flag.Uint("max-workers", 0, "the most workers (including local workers) in the pool at once, beyond which registrations are refused (unlimited if zero)")
+	registrationRate := flag.Uint("registration-rate", 0, "the most times per minute a worker's host can register, beyond which registrations are refused (unlimited if zero)")
+	timeOfDay := flag.Float64("time-of-day", -1.0, "the hour (from 0 to 24) the scene's sun starts at (the scene's time if negative)")
+	dayLength := flag.Float64("day-length", -1.0, "how long (in seconds) a whole day takes to pass for the scene's sun, which stands still if zero (the scene's day length if negative)")
+	postList := flag.String("post", "bloom", "a comma-separated list of post-processing effects (tonemap, bloom, fxaa, or vignette) applied in order to each frame before it is displayed")
+	exposure := flag.Float64("exposure", engine.DefaultExposure, "how strongly the tone map compresses bright colours")
+	vignetteStrength := flag.Float64("vignette", engine.DefaultVignetteStrength, "how much the vignette darkens the corners of each frame (from 0 to 1)")
+	bloomIntensity := flag.Float64("bloom-intensity", 0.0, "how strongly the bloom adds a glow around the bright pixels of each frame (no glow if zero)")
+	bloomThreshold := flag.Float64("bloom-threshold", engine.DefaultBloomThreshold, "the brightness (from 0 to 1) above which pixels glow")
+	bloomRadius := flag.Uint("bloom-radius", engine.DefaultBloomRadius, "how far (in pixels) the glow around bright pixels spreads")
+	tileOrderName := flag.String("tile-order", "centre", "the order in which the partitions of each frame are dispatched to workers (partition, centre, focus around the mouse cursor, hilbert, or morton)")
+	profileDir := flag.String("profile-dir", "", "the directory holding what earlier sessions learned about tracing each scene (region costs, worker latencies, and the budgeted resolution), loaded on start and saved on exit (none if empty)")
+	statsOut := flag.String("stats-out", "", "a file to which each frame's statistics (when it was requested, its partitions and their latencies, why it was skipped, and the bytes received) are written, as CSV if it ends in .csv and as JSON lines otherwise (none if empty)")
+	partitioningName := flag.String("partitioning", "rectangles", "how each frame is split between workers (rectangles; interleaved rows, which balance the work better when parts of the scene are much slower to trace; or cost, which sizes rectangles by how long previous frames took to trace)")
+	partitionWidth := flag.Uint("partition-width", engine.DefaultPartitionWidth, "the largest width (in pixels) the smallest partitions of each frame can be, when there are enough workers to split frames that finely")
+	partitionHeight := flag.Uint("partition-height", engine.DefaultPartitionHeight, "the largest height (in pixels) the smallest partitions of each frame can be (use the window's width and a small height to split frames into scanlines)")
+	renderScale := flag.Uint("render-scale", 1, "the number the window's width and height are divided by to find the resolution frames are traced at, before they are stretched over the window")
+	filterName := flag.String("upscale-filter", "nearest", "how frames (or parts of frames) traced at a lower resolution than the window are stretched over it (nearest, bilinear, or lanczos)")
+	bitDepth := flag.Uint("bit-depth", 8, "the number of bits per channel of the colours traced by workers (8, 10, or 16), above which colours are dithered on screen and saved as 16 bit PNGs")
+	flag.Parse()
+	args := flag.Args()
+	
 	// Make sure we have enough parameters.
-	if len(os.Args) != 5 {
+	if len(args) != 4 {
 		log.Fatalln("Improper parameters.  This program requires the parameters:"+
 			"\n\t(1) environment file path"+
 			"\n\t(2) window width"+
@@ -196,27 +184,184 @@ func main() {
 			"\n\t(4) worker registration port")
 	}
 	
+	// Serve profiles (if necessary), before loading the scene so that loading can be profiled too.
+	if profileOpts.Enabled() {
+		if err := profiling.Start(*profileOpts); err != nil {
+			log.Fatalf("Could not serve profiles: %v.\n", err)
+		}
+	}
+	
 	// Parse the command line parameters.
-	env, err := state.EnvironmentFromFile(os.Args[1])
+	env, err := state.EnvironmentFromFile(args[0])
 	if err != nil {
-		log.Fatalf("Could not read in environment \"%s\": %v.\n", os.Args[1], err)
+		log.Fatalf("Could not read in environment \"%s\": %v.\n", args[0], err)
 	}
-	width, err := strconv.ParseUint(os.Args[2], 10, 64)
+	width, err := strconv.ParseUint(args[1], 10, 64)
 	if err != nil {
-		log.Fatalf("Could not parse window width \"%s\": %v.\n", os.Args[2], err)
+		log.Fatalf("Could not parse window width \"%s\": %v.\n", args[1], err)
 	}
-	height, err := strconv.ParseUint(os.Args[3], 10, 64)
+	height, err := strconv.ParseUint(args[2], 10, 64)
 	if err != nil {
-		log.Fatalf("Could not parse window height \"%s\": %v.\n", os.Args[3], err)
+		log.Fatalf("Could not parse window height \"%s\": %v.\n", args[2], err)
 	}
-	registrationPort, err := strconv.ParseUint(os.Args[4], 10, 32)
+	registrationPort, err := strconv.ParseUint(args[3], 10, 32)
 	if err != nil {
-		log.Fatalf("Could not parse port number \"%s\": %v.\n", os.Args[4], err)
+		log.Fatalf("Could not parse port number \"%s\": %v.\n", args[3], err)
 	}
 	
-	// Set up the system's state.
-	sys := system{scene: env, workers: pool.NewPool(8)}
-	defer sys.workers.Destroy()
+	// Move the scene's sun (if necessary) before anything is rendered.
+	sun, hasSun := env.Mutable().Sun()
+	if *timeOfDay >= 0.0 {
+		if !env.Mutable().SetTimeOfDay(*timeOfDay) {
+			log.Fatalf("Could not set the time of day: the scene has no sun.\n")
+		}
+		sun.Time = *timeOfDay
+	}
+	if *dayLength >= 0.0 {
+		if !hasSun {
+			log.Fatalf("Could not set the length of the day: the scene has no sun.\n")
+		}
+		sun.DayLength = *dayLength
+	}
+	
+	aovs, err := engine.ParseAOVs(*aovList)
+	if err != nil {
+		log.Fatalf("Could not parse AOVs \"%s\": %v.\n", *aovList, err)
+	}
+	
+	composition, err := engine.ParseComposition(*passList)
+	if err != nil {
+		log.Fatalf("Could not parse passes \"%s\": %v.\n", *passList, err)
+	}
+	
+	postChain, err := engine.PostSettings{
+		ToneMap: engine.ToneMap{Exposure: *exposure},
+		Bloom: engine.Bloom{Threshold: *bloomThreshold, Intensity: *bloomIntensity, Radius: *bloomRadius},
+		Vignette: engine.Vignette{Strength: *vignetteStrength},
+		FXAA: engine.FXAA{EdgeThreshold: engine.DefaultFXAAEdgeThreshold, Subpixel: engine.DefaultFXAASubpixel},
+	}.Chain(*postList)
+	if err != nil {
+		log.Fatalf("Could not parse post-processors \"%s\": %v.\n", *postList, err)
+	}
+	
+	partitioning, err := engine.ParsePartitioning(*partitioningName)
+	if err != nil {
+		log.Fatalf("Could not parse partitioning: %v.\n", err)
+	}
+	
+	tileOrder, err := engine.ParseTileOrder(*tileOrderName)
+	if err != nil {
+		log.Fatalf("Could not parse tile order: %v.\n", err)
+	}
+	
+	filter, err := engine.ParseFilter(*filterName)
+	if err != nil {
+		log.Fatalf("Could not parse upscaling filter: %v.\n", err)
+	}
+	if *renderScale == 0 {
+		log.Fatalf("The render scale must be at least one.\n")
+	}
+	
+	pattern, err := tracer.ParsePattern(*patternName)
+	if err != nil {
+		log.Fatalf("Could not parse sampling pattern: %v.\n", err)
+	}
+	integrator, err := tracer.ParseIntegrator(*integratorName)
+	if err != nil {
+		log.Fatalf("Could not parse integrator: %v.\n", err)
+	}
+	
+	// Set up fault injection (if necessary).
+	var monkey *chaos.Monkey
+	if chaosOpts.Enabled() {
+		monkey = chaos.New(*chaosOpts)
+	}
+	
+	// Every mode shares the same engine options, apart from the few each mode sets for itself.
+	shared := engine.Options{
+		Width: uint(width),
+		Height: uint(height),
+		RegistrationPort: uint(registrationPort),
+		Bind: *bindAddr,
+		AllowWorkers: splitList(*allowWorkers),
+		DenyWorkers: splitList(*denyWorkers),
+		MaxWorkers: *maxWorkers,
+		RegistrationRate: *registrationRate,
+		TileOrder: tileOrder,
+		LocalWorkers: *localWorkers,
+		Chaos: monkey,
+		ResultRate: *resultRate,
+		AssetRate: *assetRate,
+		AOVs: aovs,
+		Composition: composition,
+		PostChain: postChain,
+		Filter: filter,
+		Samples: *samples,
+		MirrorDepth: *mirrorDepth,
+		PathDepth: *pathDepth,
+		AreaLightSamples: *areaLightSamples,
+		Pattern: pattern,
+		Integrator: integrator,
+		BitDepth: *bitDepth,
+		FrameDeadline: *frameDeadline,
+		Redundancy: *redundancy,
+		MaxWorkerTasks: *maxWorkerTasks,
+		MaxFramesInFlight: *maxFramesInFlight,
+		Partitioning: partitioning,
+		ProfileDir: *profileDir,
+		StatsOut: *statsOut,
+		PartitionWidth: *partitionWidth,
+		PartitionHeight: *partitionHeight,
+		SpotChecks: *spotChecks,
+	}
+	
+	// In benchmark mode, render without a window and report the results.
+	// Benchmarks don't load or save tuning profiles, so that their results don't depend on earlier sessions.
+	if *benchFrames > 0 {
+		benchOpts := shared
+		benchOpts.ProfileDir = ""
+		report, err := bench.Run(env, bench.Config{
+			Frames: *benchFrames,
+			MinWorkers: *minWorkers,
+			WorkerWait: *workerWait,
+			Engine: benchOpts,
+		})
+		if err != nil {
+			log.Fatalf("Benchmark failed: %v.\n", err)
+		}
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			log.Fatalf("Could not write benchmark report: %v.\n", err)
+		}
+		return
+	}
+	
+	// In headless mode, render a single frame without a window and write it to a file.
+	if *headlessPath != "" {
+		opts := shared
+		opts.Canvas = engine.NullCanvas{}
+		if err := renderHeadless(env, opts, *minWorkers, *workerWait, *headlessPath); err != nil {
+			log.Fatalf("Headless render failed: %v.\n", err)
+		}
+		return
+	}
+	
+	// Offline jobs are rendered in job mode, or in the background of the window (sharing its workers).
+	jobCfg := job.Config{
+		Frames: *jobFrames,
+		TileSize: *tileSize,
+		MinWorkers: *minWorkers,
+		WorkerWait: *workerWait,
+		Engine: shared,
+	}
+	
+	// In job mode, render an offline job (or resume one) without a window.
+	if *jobDir != "" {
+		jobCfg.Dir = *jobDir
+		if err := job.Run(env, jobCfg); err != nil {
+			log.Fatalf("Job failed: %v.\n", err)
+		}
+		return
+	}
 	
 	// Set up the screen.
 	window, surface, err := screen.StartScreen("Distributed Ray-Tracer", int(width), int(height))
@@ -225,66 +370,179 @@ func main() {
 	}
 	defer screen.StopScreen(window)
 	
-	// Spin off the registration server.
-	registrar := grpc.NewServer()
-	defer registrar.GracefulStop()
-	go newRegistrar(&sys, registrar, uint(surface.W), uint(surface.H), uint(registrationPort))
+	// Trace frames at a lower resolution than the window (if necessary), stretching them over it.
+	renderWidth, renderHeight := int(surface.W) / int(*renderScale), int(surface.H) / int(*renderScale)
+	if renderWidth < 1 || renderHeight < 1 {
+		log.Fatalf("The render scale %d leaves no pixels to trace.\n", *renderScale)
+	}
+	var canvas engine.Canvas = sdlCanvas{window: window, surface: surface, dither: *bitDepth > 8}
+	if renderWidth != int(surface.W) || renderHeight != int(surface.H) {
+		canvas = engine.NewScaledCanvas(canvas, renderWidth, renderHeight, int(surface.W), int(surface.H), filter)
+	}
+	
+	// Set up the engine, which also spins off the registration server.
+	// Only the window's frames follow a moving camera, so only they are reduced while it moves.
+	opts := shared
+	opts.Width, opts.Height = uint(renderWidth), uint(renderHeight)
+	opts.RemoteControl = *remoteControl
+	opts.LatestOnly = *latestOnly
+	opts.FrameBudget = *frameBudget
+	opts.MaxScale = *maxScale
+	opts.Checkerboard = *checkerboard
+	opts.FoveaRadius = *foveaRadius
+	opts.PeripheryScale = *peripheryScale
+	opts.Canvas = canvas
+	eng, err := engine.New(env, opts)
+	if err != nil {
+		log.Fatalf("Could not start engine: %v.\n", err)
+	}
+	defer eng.Close()
 	
-	// Get the initial coordinator channel ready.
-	coordinatorIn := make(chan struct{}, 1)
-	coordinatorIn <- struct{}{}
+	// Render an offline job in a session of the engine, at a lower priority than the window's own frames (if necessary).
+	// The job is given its own copy of the scene, so that it isn't moved around by the window.
+	// If the window is closed first, the job stops where it is, and picks up from there when it is run again.
+	if *backgroundJob != "" {
+		jobEnv, err := env.Copy()
+		if err != nil {
+			log.Fatalf("Could not copy the scene for the background job: %v.\n", err)
+		}
+		jobCfg.Dir = *backgroundJob
+		jobCfg.Owner = eng
+		jobCfg.Engine.Priority = *backgroundPriority
+		jobCfg.Engine.StatsOut = ""
+		go func() {
+			if err := job.Run(jobEnv, jobCfg); err != nil {
+				log.Printf("Background job failed: %v.\n", err)
+			}else{
+				log.Printf("Background job finished.\n")
+			}
+		}()
+	}
 	
-	// Parse user input and issue work orders.
-	var frame uint = 0
-	var prevUpdate, currentUpdate uint32
-	for running, moveDirs, yaw, pitch := true, uint8(0), 0.0, 0.0; running; {
-		prevUpdate = sdl.GetTicks()
-		
-		// Collect new inputs.
-		running, moveDirs, yaw, pitch = input.HandleInputs(moveDirs, int(surface.W), int(surface.H))
-		
-		if moveDirs != 0 || yaw != 0.0 || pitch != 0.0 {
-			func() {
-				sys.mu.Lock()
-				defer sys.mu.Unlock()
-				
-				scene := sys.scene.Mutable()
-				
-				// Move the camera.
-				scene.Cam.Move(0.1, moveDirs & input.MoveForward != 0, moveDirs & input.MoveBackward != 0, moveDirs & input.MoveLeftward != 0, moveDirs & input.MoveRightward != 0, moveDirs & input.MoveUpward != 0, moveDirs & input.MoveDownward != 0)
-				
-				// Rotate the camera.
-				scene.Cam.Yaw(yaw * scene.Cam.Fov / 2.0)
-				scene.Cam.Pitch(pitch * (float64(surface.H) / float64(surface.W)) * scene.Cam.Fov / 2.0)
-				
-				// Encode the current state of the scene.
-				writer := bytes.Buffer{}
-				if err := gob.NewEncoder(&writer).Encode(scene); err == nil {
-					// Spin off a coordinator for the new frame.
-					coordinatorOut := make(chan struct{}, 1)
-					go newCoordinator(&sys, writer.Bytes(), frame, window, surface, coordinatorIn, coordinatorOut)
-					coordinatorIn = coordinatorOut
-				}else{
-					log.Printf("Could not encode frame %d's scene: %v.\n", frame, err)
-				}
-			}()
-			
-			frame += 1
+	// Set up input recording and replay (if necessary).
+	var recorder *input.Recorder
+	if *recordPath != "" {
+		if recorder, err = input.NewRecorder(*recordPath); err != nil {
+			log.Fatalf("Could not record input to \"%s\": %v.\n", *recordPath, err)
+		}
+		defer recorder.Close()
+	}
+	var player *input.Player
+	if *replayPath != "" {
+		if player, err = input.NewPlayer(*replayPath); err != nil {
+			log.Fatalf("Could not replay input from \"%s\": %v.\n", *replayPath, err)
+		}
+	}
+	
+	// Work out the parts of the loop's configuration which come from a scene, with the speed and day length given on the command line.
+	sceneConfig := func(env state.Environment) app.Scene {
+		speed := app.DefaultMoveSpeed(env.Mutable())
+		if *moveSpeed > 0.0 {
+			speed = env.Mutable().Metres(*moveSpeed)
 		}
+		sun, hasSun := env.Mutable().Sun()
+		if *dayLength >= 0.0 {
+			sun.DayLength = *dayLength
+		}
+		return app.Scene{MoveSpeed: speed, CollisionMargin: env.Mutable().Metres(input.CollisionMargin), Bookmarks: env.Bookmarks(), Sun: sun, HasSun: hasSun}
+	}
+	
+	// Take commands from a console (if necessary), handing the scenes it loads on to the loop.
+	loadedScenes := make(chan app.Scene, 1)
+	consoleOpts := console.Options{
+		ScreenshotDir: *screenshotDir,
+		SceneDir: *sceneDir,
+		SceneLoaded: func(env state.Environment) {
+			loadedScenes <- sceneConfig(env)
+		},
+	}
+	if consoleOpts.SceneDir == "" {
+		consoleOpts.SceneDir = filepath.Dir(args[0])
+	}
+	if *consoleAddr == "-" {
+		go func() {
+			if err := console.New(eng, consoleOpts).Serve(os.Stdin, os.Stdout); err != nil {
+				log.Printf("Console failed: %v.\n", err)
+			}
+		}()
+	}else if *consoleAddr != "" {
+		listener, err := net.Listen("tcp", *consoleAddr)
+		if err != nil {
+			log.Fatalf("Could not listen for console connections on \"%s\": %v.\n", *consoleAddr, err)
+		}
+		defer listener.Close()
 		
-		// Wait for the next frame.
-		currentUpdate = sdl.GetTicks()
-		if currentUpdate - prevUpdate < screen.MsPerFrame {
-			sdl.Delay(screen.MsPerFrame - (currentUpdate - prevUpdate))
+		// The console has no authentication, so anyone who can reach it can (for instance) move the camera, load scenes, and take screenshots.
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			log.Printf("Warning: the console is listening on %s, which other hosts can reach, and anyone who connects can control the master.\n", addr)
 		}
+		go console.New(eng, consoleOpts).Accept(listener)
+	}
+	
+	// The passes can be viewed as composed on the command line, or one at a time.
+	views := []engine.Composition{eng.Composition()}
+	for p := engine.Pass(0); p < engine.NumPasses; p++ {
+		views = append(views, engine.Solo(p))
+	}
+	view := 0
+	
+	// Parse user input and issue work orders, starting with the environment's bookmarks (which can be saved over as the user looks around).
+	// The camera moves at the same physical speed (if set), whatever units the environment is written in, or else crosses the scene in the same time whatever its size.
+	// While the camera is still, any frame drawn at a reduced resolution (in a checkerboard, or foveated) is traced again in full.
+	initial := sceneConfig(env)
+	hooks := app.Hooks{
+		Camera: eng.Camera,
+		Render: eng.RenderFrame,
+		Refine: eng.Refine,
+		SetTimeOfDay: eng.SetTimeOfDay,
+		ToggleLight: eng.ToggleLight,
+		ToggleFXAA: eng.ToggleFXAA,
+		CyclePasses: func() string {
+			view = (view + 1) % len(views)
+			eng.SetComposition(views[view])
+			return views[view].String()
+		},
+		Screenshot: func(path string) error {
+			return screenshot(eng, path)
+		},
+		SetFocus: func(x, y int) {
+			eng.SetFocus(x * renderWidth / int(surface.W), y * renderHeight / int(surface.H))
+		},
+		SceneLoaded: func() (app.Scene, bool) {
+			select{
+			case scene := <-loadedScenes:
+				return scene, true
+			default:
+				return app.Scene{}, false
+			}
+		},
+	}
+	
+	// Keep the camera from moving through the scene (if necessary).
+	if *collide {
+		hooks.Clearance = eng.Clearance
 	}
+	app.Run(app.Config{
+		Width: int(surface.W),
+		Height: int(surface.H),
+		MoveSpeed: initial.MoveSpeed,
+		GlideFrames: *glideFrames,
+		CollisionMargin: initial.CollisionMargin,
+		Bookmarks: initial.Bookmarks,
+		Sun: sun,
+		HasSun: hasSun,
+		ScreenshotDir: *screenshotDir,
+		Recorder: recorder,
+		Player: player,
+		Hooks: hooks,
+	})
 	
-	// Wait for the remaining coordinators to complete.
-	<- coordinatorIn
+	// Wait for the remaining frames to be drawn.
+	eng.Wait()
 	
 	// Log the total number of frames and some FPS stats.
 	log.Printf("Total frames drawn: %d.\n", len(frameEndTimes))
-	log.Printf("Total frames: %d.\n", frame)
+	log.Printf("Total frames: %d.\n", eng.Frames())
 	usableFrames := len(frameEndTimes) - 1
 	if usableFrames > 0 {
 		frameEndTimes = frameEndTimes[1:]
@@ -0,0 +1,66 @@
+// Package output provides functionality for writing rendered frames to files.
+package output
+
+import (
+	"path/filepath"
+	"image/png"
+	"strings"
+	"image"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format represents a file format frames can be written in.
+type Format uint8
+
+// These constants are the formats frames can be written in.
+const (
+	FormatPNG Format = iota	// 8 bits per channel PNG.
+	FormatEXR				// Floating point OpenEXR.
+)
+
+// FormatOf chooses a format based on the extension of a file's path.
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return FormatPNG, nil
+	case ".exr":
+		return FormatEXR, nil
+	default:
+		return 0, fmt.Errorf("Unknown image format for \"%s\".", path)
+	}
+}
+
+// Encode writes a frame to w in some format.
+func Encode(w io.Writer, frame image.Image, format Format) error {
+	switch format {
+	case FormatPNG:
+		return png.Encode(w, frame)
+	case FormatEXR:
+		// Frames are clamped to 8 bits per channel until the renderer supports high dynamic range.
+		return fmt.Errorf("OpenEXR output needs high dynamic range frames, which are not supported yet.")
+	default:
+		return fmt.Errorf("Unknown image format %d.", format)
+	}
+}
+
+// WriteFile writes a frame to the file at path, in a format chosen by the path's extension.
+func WriteFile(path string, frame image.Image) error {
+	format, err := FormatOf(path)
+	if err != nil {
+		return err
+	}
+	
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	
+	if err := Encode(file, frame, format); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
\ No newline at end of file
@@ -0,0 +1,88 @@
+// Package pool provides a worker pool object for use by the master.
+package pool
+
+import (
+	"time"
+	"sync"
+	"fmt"
+)
+
+// EventKind identifies what happened to a pool.
+type EventKind uint8
+
+// These constants are the possible kinds of events.
+const (
+	EventJoined EventKind = iota	// A worker was added to the pool.
+	EventRemoved					// A worker was removed from the pool, whether by Remove, by Destroy, or after its heartbeats failed.
+	EventFailed						// A task failed, either on its worker or because no worker could be assigned it.
+	EventLatency					// A worker finished a task, updating its latency estimate.
+	numEventKinds
+)
+
+// eventKindNames holds the name of each kind of event.
+var eventKindNames = [numEventKinds]string{"joined", "removed", "failed", "latency"}
+
+// String returns the name of a kind of event.
+func (k EventKind) String() string {
+	if k < numEventKinds {
+		return eventKindNames[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", uint8(k))
+}
+
+// Event describes something which happened to a pool.
+type Event struct {
+	Kind EventKind
+	At time.Time
+	Address string			// The address of the worker the event happened to (empty if a task couldn't be assigned to any worker).
+	Generation uint64		// Which of the workers added at the address the event happened to (see WorkerStats.Generation).
+	Err error				// Why the task failed, or why the worker was removed (nil if it was removed on purpose).
+	Latency time.Duration	// How long the worker took to finish the task (EventLatency only).
+	Estimate time.Duration	// The worker's new latency estimate (EventLatency only).
+}
+
+// subscriptions holds the channels a pool's events are sent on.
+type subscriptions struct {
+	mu sync.Mutex
+	next int
+	channels map[int]chan Event
+}
+
+// Subscribe returns a channel on which the pool's events are sent, and a function which ends the subscription (closing the channel).
+// Events are sent without ever blocking the pool, so events which would overfill the channel's buffer (of some size) are dropped; subscribers should keep up with their channels.
+func (p *Pool) Subscribe(buffer uint) (<-chan Event, func()) {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	
+	if p.subs.channels == nil {
+		p.subs.channels = make(map[int]chan Event)
+	}
+	id, events := p.subs.next, make(chan Event, buffer)
+	p.subs.next += 1
+	p.subs.channels[id] = events
+	
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			p.subs.mu.Lock()
+			defer p.subs.mu.Unlock()
+			
+			delete(p.subs.channels, id)
+			close(events)
+		})
+	}
+}
+
+// emit sends an event to every subscriber with room for it.
+func (p *Pool) emit(e Event) {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	
+	e.At = time.Now()
+	for _, events := range p.subs.channels {
+		select{
+		case events <- e:
+		default:
+		}
+	}
+}
\ No newline at end of file
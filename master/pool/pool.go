@@ -4,10 +4,16 @@ package pool
 import (
 	"github.com/mwindels/distributed-raytracer/shared/comms"
 	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc"
+	"math/rand"
 	"context"
+	"errors"
 	"sync"
 	"time"
+	"math"
 	"log"
 	"fmt"
 )
@@ -18,14 +24,80 @@ const HeartbeatFrequency uint = 500
 // HeartbeatTimeout controls how long heartbeats are waited on before the associated worker is assumed to be disconnected.
 const HeartbeatTimeout uint = 2000
 
+// AffinityTolerance controls how much more loaded a preferred worker can be than the least loaded worker and still be assigned a task.
+const AffinityTolerance float64 = 1.5
+
+// These constants are the retry values used by pools whose options leave them unset.
+const (
+	DefaultRetries uint = 3			// How many times a failed heartbeat is retried before a worker is evicted.
+	DefaultRetryBackoff uint = 100	// How long (in milliseconds) to wait before the first retry; each further retry waits twice as long.
+)
+
+// ErrFull is returned when adding a worker to a pool which already has its maximum number of workers.
+var ErrFull = errors.New("The pool is full.")
+
+// ErrReregistered is the reason given for removing a worker which has registered again under a new session (see Pool.AddSession).
+var ErrReregistered = errors.New("The worker registered again.")
+
+// maxPreparedFrames is the most frames a pool remembers preparing on each worker, which should cover every frame in flight at once.
+const maxPreparedFrames int = 8
+
+// minLatencyEstimate is the smallest per-task latency assumed when estimating how long a worker will take to finish its tasks.
+// This keeps workers with no (or tiny) latency estimates ordered by their number of tasks.
+const minLatencyEstimate time.Duration = time.Millisecond
+
 // worker represents an entry in a pool.
 type worker struct {
+	address string
 	connection *grpc.ClientConn
-	stopHeartbeats chan struct{}
+	stopHeartbeats chan struct{}	// Closed once the worker leaves the pool.
 	closing bool
+	responded time.Time		// When the worker last answered a trace request, which spares it the next heartbeat (see Pool.heartbeat).
+	session uint64			// The session the worker registered under (zero if unknown, see Pool.AddSession).
+	generation uint64		// Which of the pool's additions this worker was, telling it apart from other workers added at the same address.
 	
 	tasks uint
+	ranks map[int]uint	// The number of tasks the worker has been assigned at each priority.
 	index uint
+	
+	stats workerStats
+	
+	frames map[uint64]*preparedFrame	// The frames sent (or being sent) to the worker ahead of their tasks, by frame.
+	prepared []uint64					// The frames sent to the worker, oldest first.
+	unprepared bool						// Whether the worker can't prepare frames, so that its tasks must carry their diffs.
+}
+
+// preparedFrame tracks the sending of a frame's diff to a worker (see Pool.prepare).
+type preparedFrame struct {
+	done chan struct{}	// Closed once the frame has been sent (or failed to send).
+	ok bool				// Whether the worker has the frame.
+}
+
+// outranked returns whether a worker has been assigned any tasks with a higher priority than some priority.
+// This function assumes that the pool has already been locked.
+func (w *worker) outranked(priority int) bool {
+	for rank, tasks := range w.ranks {
+		if rank > priority && tasks > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// load estimates how long a worker would take to finish all of its tasks if it were assigned one more.
+// Workers are ordered in a pool's heap by their load, so that a busy but fast worker can be preferred over an idle but slow one.
+func (w *worker) load() float64 {
+	return float64(w.tasks + 1) * math.Max(float64(w.stats.estimate), float64(minLatencyEstimate))
+}
+
+// Options controls the behaviour of a pool.
+type Options struct {
+	MaxTasks uint		// The maximum number of tasks a worker can be assigned at once (unlimited if zero).
+	MaxWorkers uint		// The maximum number of workers in the pool at once (unlimited if zero).
+	Retries uint		// How many times a failed heartbeat is retried before a worker is evicted (DefaultRetries if zero).
+	RetryBackoff uint	// How long (in milliseconds) to wait before the first retry (DefaultRetryBackoff if zero).
+	DialOptions []grpc.DialOption	// Extra options used when connecting to every worker.
+	FixedTimeouts bool	// Whether tasks are always given the timeout passed to Assign, rather than one derived from the assignee's recent latencies.
 }
 
 // Pool represents a threadsafe worker pool.
@@ -33,14 +105,30 @@ type Pool struct {
 	mu sync.RWMutex
 	heap []*worker
 	addresses map[string]*worker
+	seeds map[string]time.Duration	// Latency estimates for workers which haven't been added yet, by address.
+	released chan struct{}			// Closed (and replaced) whenever a task finishes, so that lower priority tasks waiting on it can check again.
+	subs subscriptions				// The channels the pool's events are sent on (see Subscribe).
+	lastFrame uint64				// The number given to the most recent frame (see NewFrame).
+	generations uint64				// The generation given to the most recently added worker.
+	
+	opts Options
 }
 
 // NewPool creates a new worker pool with a given initial capacity.
-func NewPool(c uint) Pool {
+func NewPool(c uint, opts Options) Pool {
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	
 	return Pool{
 		mu: sync.RWMutex{},
 		heap: make([]*worker, 0, c),
 		addresses: make(map[string]*worker),
+		released: make(chan struct{}),
+		opts: opts,
 	}
 }
 
@@ -51,7 +139,7 @@ func (p *Pool) Destroy() {
 	
 	// Close all the open connections.
 	for a, w := range p.addresses {
-		p.remove(a, w)
+		p.remove(a, w, nil)
 	}
 }
 
@@ -63,6 +151,15 @@ func (p *Pool) Size() uint {
 	return uint(len(p.heap))
 }
 
+// Has returns whether a worker at some address is in the pool.
+func (p *Pool) Has(address string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	_, exists := p.addresses[address]
+	return exists
+}
+
 // swap swaps two workers in the heap.
 // This function assumes that the heap has already been locked.
 func (p *Pool) swap(i, j uint) {
@@ -78,7 +175,7 @@ func (p *Pool) swap(i, j uint) {
 	}
 }
 
-// bubbleUp pushes a worker up the heap as long as it has fewer tasks than its parent.
+// bubbleUp pushes a worker up the heap as long as it has a lower load than its parent.
 // This function assumes that the heap has already been locked.
 func (p *Pool) bubbleUp(w *worker) {
 	if w != nil {
@@ -86,10 +183,10 @@ func (p *Pool) bubbleUp(w *worker) {
 			
 			// While the worker has a parent...
 			for i := w.index; i > 0; {
-				parent := i / 2
+				parent := (i - 1) / 2
 				
-				// If the worker has fewer tasks than its parent, bubble up.
-				if p.heap[i].tasks < p.heap[parent].tasks {
+				// If the worker has a lower load than its parent, bubble up.
+				if p.heap[i].load() < p.heap[parent].load() {
 					p.swap(i, parent)
 					i = parent
 				}else{
@@ -100,7 +197,7 @@ func (p *Pool) bubbleUp(w *worker) {
 	}
 }
 
-// bubbleDown pushes a worker down the heap as long as it has more tasks than one of its children.
+// bubbleDown pushes a worker down the heap as long as it has a higher load than one of its children.
 // This function assumes that the heap has already been locked.
 func (p *Pool) bubbleDown(w *worker) {
 	if w != nil {
@@ -112,18 +209,18 @@ func (p *Pool) bubbleDown(w *worker) {
 				if 2 * i + 2 < uint(len(p.heap)) {
 					right := 2 * i + 2
 					
-					// The worker has two children, so compare against the child with with fewer tasks.
-					if p.heap[left].tasks <= p.heap[right].tasks {
-						// If the worker has more tasks than its left child, bubble down.
-						if p.heap[i].tasks > p.heap[left].tasks {
+					// The worker has two children, so compare against the child with the lower load.
+					if p.heap[left].load() <= p.heap[right].load() {
+						// If the worker has a higher load than its left child, bubble down.
+						if p.heap[i].load() > p.heap[left].load() {
 							p.swap(i, left)
 							i = left
 						}else{
 							break
 						}
 					}else{
-						// If the worker has more tasks than its right child, bubble down.
-						if p.heap[i].tasks > p.heap[right].tasks {
+						// If the worker has a higher load than its right child, bubble down.
+						if p.heap[i].load() > p.heap[right].load() {
 							p.swap(i, right)
 							i = right
 						}else{
@@ -131,8 +228,8 @@ func (p *Pool) bubbleDown(w *worker) {
 						}
 					}
 				}else{
-					// If the worker has more tasks than its left child, bubble down.
-					if p.heap[i].tasks > p.heap[left].tasks {
+					// If the worker has a higher load than its left child, bubble down.
+					if p.heap[i].load() > p.heap[left].load() {
 						p.swap(i, left)
 						i = left
 					}else{
@@ -144,29 +241,186 @@ func (p *Pool) bubbleDown(w *worker) {
 	}
 }
 
-// Assign assigns a task to the worker who is the least busy.
-func (p *Pool) Assign(order *comms.WorkOrder, timeout uint) (<-chan *comms.TraceResults, error) {
+// full returns whether a worker has been assigned the maximum number of tasks.
+func (p *Pool) full(w *worker) bool {
+	return p.opts.MaxTasks > 0 && w.tasks >= p.opts.MaxTasks
+}
+
+// isExcluded returns whether an address is one of some excluded addresses.
+func isExcluded(address string, excluded []string) bool {
+	for _, e := range excluded {
+		if address == e {
+			return true
+		}
+	}
+	return false
+}
+
+// leastLoaded finds the worker with the lowest load that is not full (or excluded), or nil if there is no such worker.
+// This function assumes that the pool has already been locked.
+func (p *Pool) leastLoaded(excluded []string) *worker {
+	if len(p.heap) == 0 {
+		return nil
+	}else if !p.full(p.heap[0]) && !isExcluded(p.heap[0].address, excluded) {
+		return p.heap[0]
+	}
+	
+	// The top of the heap is full (or excluded), so search the rest of the heap instead.
+	var best *worker
+	for _, w := range p.heap[1:] {
+		if !p.full(w) && !isExcluded(w.address, excluded) && (best == nil || w.load() < best.load()) {
+			best = w
+		}
+	}
+	
+	return best
+}
+
+// NewFrame returns a new number identifying a frame, which no other frame sent through the pool has.
+// Frames are numbered from one, since zero means no frame, and are numbered by the pool so that several engines sharing it can't mix up their frames on the workers.
+func (p *Pool) NewFrame() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	p.lastFrame += 1
+	return p.lastFrame
+}
+
+// waitForTurn blocks until a worker has no tasks with a higher priority than some priority.
+// It gives up (returning false) if the task's work order has a deadline which passes first.
+func (p *Pool) waitForTurn(w *worker, priority int, order *comms.WorkOrder) bool {
+	var expired <-chan time.Time
+	if d := order.GetDeadline(); d != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, d)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	
+	for {
+		p.mu.Lock()
+		outranked, released := w.outranked(priority), p.released
+		p.mu.Unlock()
+		if !outranked {
+			return true
+		}
+		
+		select{
+		case <-released:
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// Assign assigns a task to the worker who is expected to finish it the soonest, at the default priority (zero).
+// See AssignAt.
+func (p *Pool) Assign(order *comms.WorkOrder, timeout uint, preferred string, excluded ...string) (<-chan *comms.TraceResults, string, error) {
+	return p.AssignAt(0, order, timeout, preferred, excluded...)
+}
+
+// AssignAt assigns a task with some priority to the worker who is expected to finish it the soonest.
+// If the worker at the preferred address is in the pool and not much more loaded than that worker, it is assigned the task instead.
+// If every worker already has the maximum number of tasks, the task is not assigned.
+// Workers at excluded addresses (such as those which have already failed the task) are only assigned the task if no other worker can be.
+// The task is given timeout milliseconds to finish, unless the pool derives its timeouts from the assignee's recent latencies (see Options).
+// If the task's work order has a deadline, the task is never given past its deadline to finish.
+// The task isn't sent to its worker until the worker has finished every task with a higher priority, so that tasks with higher priorities (such as those of an interactive session) are traced ahead of the rest.
+// Its timeout only starts once it has been sent, but it is abandoned if its work order's deadline passes while it waits.
+// This function returns a channel on which the task's results will be sent, and the address of the assigned worker.
+func (p *Pool) AssignAt(priority int, order *comms.WorkOrder, timeout uint, preferred string, excluded ...string) (<-chan *comms.TraceResults, string, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	
 	if len(p.heap) > 0 {
-		resultsCh := make(chan *comms.TraceResults)
-		assignee := p.heap[0]
+		assignee := p.leastLoaded(excluded)
+		if assignee == nil && len(excluded) > 0 {
+			assignee = p.leastLoaded(nil)
+		}
+		if assignee == nil {
+			err := fmt.Errorf("Every worker is at capacity, task %v cannot be assigned.", *order)
+			p.emit(Event{Kind: EventFailed, Err: err})
+			return nil, "", err
+		}
+		
+		// If there is a preferred worker that can handle the task (and isn't excluded), assign it instead.
+		if w, exists := p.addresses[preferred]; exists && w != assignee && !p.full(w) && w.load() <= AffinityTolerance * assignee.load() && !isExcluded(preferred, excluded) {
+			assignee = w
+		}
+		// The results channel is buffered, so that the task completes even if the results aren't collected straight away.
+		resultsCh := make(chan *comms.TraceResults, 1)
 		
 		// Assign the task and re-arrange the heap.
 		assignee.tasks += 1
+		assignee.ranks[priority] += 1
+		assignee.stats.assigned += 1
 		p.bubbleDown(assignee)
 		
+		// Find how long the task should be given, scaled by its area if the assignee's latencies are known.
+		// If the task is traced at a reduced resolution, only about one pixel is traced for each block of pixels.
+		// Likewise, only about half the pixels are traced in a checkerboard, and only some of the rows of an interleaved task.
+		pixels := uint64(order.GetWidth()) * uint64(order.GetHeight())
+		if scale := uint64(order.GetScale()); scale > 1 {
+			pixels = (pixels + scale * scale - 1) / (scale * scale)
+		}
+		if order.GetCheckerboard() != 0 {
+			pixels = (pixels + 1) / 2
+		}
+		if step := uint64(comms.InterleaveStride(order.GetInterleave())); step > 1 {
+			pixels = (pixels + step - 1) / step
+		}
+		deadline := time.Millisecond * time.Duration(timeout)
+		if !p.opts.FixedTimeouts {
+			deadline = assignee.stats.timeout(pixels, deadline)
+		}
+		
 		// Perform the task.
 		go func(out chan<- *comms.TraceResults, client comms.TraceClient){
 			defer close(out)
 			
-			// Create a timeout for the trace operation.
-			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * time.Duration(timeout))
+			// Wait for the assignee to finish its tasks with higher priorities.
+			if !p.waitForTurn(assignee, priority, order) {
+				err := fmt.Errorf("The task's deadline passed while it waited for higher priority tasks.")
+				log.Printf("Failed to trace: %v.\n", err)
+				func() {
+					p.mu.Lock()
+					defer p.mu.Unlock()
+					
+					p.finish(assignee, priority)
+					p.emit(Event{Kind: EventFailed, Address: assignee.address, Generation: assignee.generation, Err: err})
+				}()
+				return
+			}
+			
+			// Create a timeout for the trace operation, which is cut short by the work order's deadline (if it has one).
+			// The timeout is propagated to the worker, so that it stops tracing once nobody is waiting on its results.
+			ctx, cancel := context.WithTimeout(context.Background(), deadline)
 			defer cancel()
+			if d := order.GetDeadline(); d != 0 {
+				var cancelDeadline context.CancelFunc
+				ctx, cancelDeadline = context.WithDeadline(ctx, time.Unix(0, d))
+				defer cancelDeadline()
+			}
+			
+			// Send the task's frame ahead of it if the worker doesn't have it yet, so that the task needn't carry the frame's diff.
+			// If the worker has lost the frame since, the task is sent again with its diff.
+			start := time.Now()
+			sent := order
+			if p.prepare(ctx, assignee, client, order) {
+				stripped := *order
+				stripped.Diff = nil
+				sent = &stripped
+			}
 			
 			// Attempt to trace.
-			results, err := client.BulkTrace(ctx, order)
+			results, err := client.BulkTrace(ctx, sent)
+			if status.Code(err) == codes.FailedPrecondition && sent != order {
+				sent = order
+				results, err = client.BulkTrace(ctx, sent)
+			}
+			latency := time.Since(start)
+			if err == nil {
+				err = p.checkSession(assignee, results.GetSession())
+			}
 			if err == nil {
 				out <- results
 			}else{
@@ -177,29 +431,120 @@ func (p *Pool) Assign(order *comms.WorkOrder, timeout uint) (<-chan *comms.Trace
 				p.mu.Lock()
 				defer p.mu.Unlock()
 				
-				// Complete the task and re-arrange the heap (if the assignee is still in it).
-				assignee.tasks -= 1
-				if assignee.index < uint(len(p.heap)) && p.heap[assignee.index] == assignee {
-					p.bubbleUp(assignee)
-				}
-				
-				// If this is the worker's last task, close the connection.
-				if assignee.closing && assignee.tasks == 0 {
-					assignee.connection.Close()
+				assignee.stats.record(proto.Size(sent), proto.Size(results), pixels, latency, err == nil, ctx.Err() == context.DeadlineExceeded)
+				p.finish(assignee, priority)
+				if err == nil {
+					assignee.responded = time.Now()
+					p.emit(Event{Kind: EventLatency, Address: assignee.address, Generation: assignee.generation, Latency: latency, Estimate: assignee.stats.estimate})
+				}else{
+					p.emit(Event{Kind: EventFailed, Address: assignee.address, Generation: assignee.generation, Err: err})
 				}
 			}()
 		}(resultsCh, comms.NewTraceClient(assignee.connection))
 		
-		return resultsCh, nil
+		return resultsCh, assignee.address, nil
 	}else{
-		return nil, fmt.Errorf("No workers to which task %v can be assigned.", *order)
+		err := fmt.Errorf("No workers to which task %v can be assigned.", *order)
+		p.emit(Event{Kind: EventFailed, Err: err})
+		return nil, "", err
 	}
 }
 
-// remove removes a worker with some address from a pool.
+// finish completes one of a worker's tasks with some priority, and re-arranges the heap (if the worker is still in it).
+// Because the worker's latency estimate may have grown, it might need to move down instead of up.
+// This function assumes that the pool has already been locked.
+func (p *Pool) finish(w *worker, priority int) {
+	w.tasks -= 1
+	if w.ranks[priority] -= 1; w.ranks[priority] == 0 {
+		delete(w.ranks, priority)
+	}
+	if w.index < uint(len(p.heap)) && p.heap[w.index] == w {
+		p.bubbleUp(w)
+		p.bubbleDown(w)
+	}
+	
+	// Let any tasks waiting on this one check again.
+	close(p.released)
+	p.released = make(chan struct{})
+	
+	// If this is the worker's last task, close the connection.
+	if w.closing && w.tasks == 0 {
+		w.connection.Close()
+	}
+}
+
+// prepare makes sure a worker has been sent the diff of a task's frame, so that the task can refer to the frame rather than carry the diff.
+// Each frame is only sent to each worker once, however many of its tasks the worker is assigned; the rest of its tasks wait until it has been sent.
+// Workers which can't prepare frames (such as older workers) are left to receive their tasks' diffs instead.
+// The return value is whether the worker has the frame.
+func (p *Pool) prepare(ctx context.Context, w *worker, client comms.TraceClient, order *comms.WorkOrder) bool {
+	if order.GetFrame() == 0 || len(order.GetDiff()) == 0 {
+		return false
+	}
+	
+	// Find whether the frame has been sent to the worker, or start sending it.
+	p.mu.Lock()
+	if w.unprepared {
+		p.mu.Unlock()
+		return false
+	}
+	f, exists := w.frames[order.GetFrame()]
+	if !exists {
+		f = &preparedFrame{done: make(chan struct{})}
+		w.frames[order.GetFrame()] = f
+		w.prepared = append(w.prepared, order.GetFrame())
+		for len(w.prepared) > maxPreparedFrames {
+			delete(w.frames, w.prepared[0])
+			w.prepared = w.prepared[1:]
+		}
+	}
+	p.mu.Unlock()
+	
+	if exists {
+		select{
+		case <-f.done:
+			return f.ok
+		case <-ctx.Done():
+			return false
+		}
+	}
+	
+	// Send the frame.
+	_, err := client.PrepareFrame(ctx, &comms.FrameState{Frame: order.GetFrame(), Diff: order.GetDiff()})
+	if err != nil {
+		log.Printf("Failed to prepare frame %d: %v.\n", order.GetFrame(), err)
+		if status.Code(err) == codes.Unimplemented {
+			p.mu.Lock()
+			w.unprepared = true
+			p.mu.Unlock()
+		}
+	}
+	f.ok = err == nil
+	close(f.done)
+	
+	return f.ok
+}
+
+// Seed sets the latency estimates of workers (by address) from before they are added to the pool, such as from an earlier session.
+// Workers already in the pool keep their own estimates.
+func (p *Pool) Seed(estimates map[string]time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	if p.seeds == nil {
+		p.seeds = make(map[string]time.Duration)
+	}
+	for address, estimate := range estimates {
+		if estimate > 0 {
+			p.seeds[address] = estimate
+		}
+	}
+}
+
+// remove removes a worker with some address from a pool, for some reason (nil if it was removed on purpose).
 // This function assumes that the pool has already been locked.
 // This function also assumes that address refers to w, and that w is in the pool.
-func (p *Pool) remove(address string, w *worker) {
+func (p *Pool) remove(address string, w *worker, reason error) {
 	wIndex := w.index
 	
 	// Remove the worker from the pool.
@@ -211,6 +556,11 @@ func (p *Pool) remove(address string, w *worker) {
 	if wIndex < uint(len(p.heap)) {
 		p.bubbleDown(p.heap[wIndex])
 	}
+	p.emit(Event{Kind: EventRemoved, Address: address, Generation: w.generation, Err: reason})
+	
+	// Stop the worker from recieving heartbeats.
+	// This doesn't wait on the heartbeats, since they may themselves be waiting on the pool.
+	close(w.stopHeartbeats)
 	
 	// Close the worker and disconnect if there are no remaining tasks.
 	w.closing = true
@@ -219,66 +569,194 @@ func (p *Pool) remove(address string, w *worker) {
 	}
 }
 
+// backoff computes how long to wait before some retry (counting from zero).
+// The wait doubles with each retry, and is randomly jittered by up to half in either direction so that retries to many workers don't line up.
+func (p *Pool) backoff(retry uint) time.Duration {
+	wait := float64(p.opts.RetryBackoff) * float64(uint(1) << retry)
+	return time.Duration(wait * (0.5 + rand.Float64()) * float64(time.Millisecond))
+}
+
+// sendHeartbeat sends a single heartbeat message to a worker.
+func (p *Pool) sendHeartbeat(w *worker) error {
+	// Because ClientConn objects are threadsafe, we don't need to lock.
+	client := comms.NewTraceClient(w.connection)
+	
+	// Set up a timeout for the heartbeat.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * time.Duration(HeartbeatTimeout))
+	defer cancel()
+	
+	// Attempt to send a heartbeat.
+	reply, err := client.Heartbeat(ctx, &empty.Empty{})
+	if err != nil {
+		return err
+	}
+	return p.checkSession(w, reply.GetSession())
+}
+
+// owns returns whether a reply from a worker's session belongs to the worker's registration.
+// A session of zero (from a worker which never registered, or one added without a session) matches any other session.
+// This function assumes that the pool has already been locked.
+func (w *worker) owns(session uint64) bool {
+	return w.session == 0 || session == 0 || w.session == session
+}
+
+// checkSession makes sure that a reply from a worker came from the session the worker was added under.
+// Replies from another session (such as from a worker which has since restarted and registered again) aren't attributed to the worker, but fail instead.
+func (p *Pool) checkSession(w *worker, session uint64) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	if !w.owns(session) {
+		return fmt.Errorf("Worker \"%s\" replied from session %x rather than session %x.", w.address, session, w.session)
+	}
+	return nil
+}
+
+// respondedRecently returns whether a worker has answered a trace request within the last heartbeat period.
+func (p *Pool) respondedRecently(w *worker) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	return time.Since(w.responded) < time.Millisecond * time.Duration(HeartbeatFrequency)
+}
+
 // heartbeat periodically sends out heartbeat messages to a worker.
+// Failed heartbeats are retried with exponential backoff, and the worker is only removed from the pool once its retries run out.
+// Heartbeats are skipped while the worker is answering trace requests, since those already show that it's alive (and reset its idle timeout).
 // This function should be spun off as a goroutine.
 func (p *Pool) heartbeat(w *worker) {
-	for beat := true; beat; {
+	for beat, failures := true, uint(0); beat; {
+		// Wait until the next heartbeat is due, or until the next retry if the last heartbeat failed.
+		wait := time.Millisecond * time.Duration(HeartbeatFrequency)
+		if failures > 0 {
+			wait = p.backoff(failures - 1)
+		}
+		
 		select{
 		case <-w.stopHeartbeats:
 			beat = false
-		case <-time.After(time.Millisecond * time.Duration(HeartbeatFrequency)):
-			func() {
-				// Because ClientConn objects are threadsafe, we don't need to lock.
-				client := comms.NewTraceClient(w.connection)
-				
-				// Set up a timeout for the heartbeat.
-				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * time.Duration(HeartbeatTimeout))
-				defer cancel()
+		case <-time.After(wait):
+			if p.respondedRecently(w) {
+				failures = 0
+			}else if err := p.sendHeartbeat(w); err == nil {
+				failures = 0
+			}else if failures < p.opts.Retries {
+				failures += 1
+				log.Printf("Failed to send heartbeat, retrying (%d of %d): %v.\n", failures, p.opts.Retries, err)
+			}else{
+				log.Printf("Failed to send heartbeat: %v.\n", err)
 				
-				// Attempt to send a heartbeat.
-				if _, err := client.Heartbeat(ctx, &empty.Empty{}); err != nil {
-					log.Printf("Failed to send heartbeat: %v.\n", err)
+				func() {
+					p.mu.Lock()
+					defer p.mu.Unlock()
 					
-					func() {
-						p.mu.Lock()
-						defer p.mu.Unlock()
-						
-						// Find whether the worker is in the pool, then remove it if it is.
-						for a, wInternal := range p.addresses {
-							if w == wInternal {
-								p.remove(a, w)
-								break
-							}
+					// Find whether the worker is in the pool, then remove it if it is.
+					for a, wInternal := range p.addresses {
+						if w == wInternal {
+							p.remove(a, w, err)
+							break
 						}
-					}()
-					
-					beat = false
-				}
-			}()
+					}
+				}()
+				
+				beat = false
+			}
+		}
+	}
+}
+
+// dial sets up a connection to a worker using some extra dial options.
+// The connection is made in the background, since workers registering with a master only start listening once their registration has been answered.
+// So this only fails if the address or options are malformed, and unreachable workers are found (and retried) by their heartbeats instead.
+func (p *Pool) dial(address string, opts []grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(append([]grpc.DialOption{grpc.WithInsecure()}, p.opts.DialOptions...), opts...)
+	return grpc.Dial(address, opts...)
+}
+
+// meanEstimate computes the mean latency estimate of the workers in the pool which have one.
+// This function assumes that the pool has already been locked.
+func (p *Pool) meanEstimate() time.Duration {
+	var sum time.Duration
+	var count time.Duration
+	for _, w := range p.heap {
+		if w.stats.estimate > 0 {
+			sum += w.stats.estimate
+			count += 1
 		}
 	}
+	
+	if count == 0 {
+		return 0
+	}
+	return sum / count
 }
 
 // Add adds a new worker to the pool.
-func (p *Pool) Add(address string) error {
+// Any dial options are used when connecting to the worker, in addition to the pool's own.
+func (p *Pool) Add(address string, opts ...grpc.DialOption) error {
+	return p.AddSession(address, 0, opts...)
+}
+
+// AddSession adds a new worker, which registered under some session (see comms.WorkerLink), to the pool.
+// If a worker at the same address is already in the pool under another session, it must have registered again (such as after restarting), so it is replaced.
+// Tasks the old worker is still tracing stay attributed to it, and fail if they're answered by the new session.
+// A session of zero matches any other session.
+// Any dial options are used when connecting to the worker, in addition to the pool's own.
+func (p *Pool) AddSession(address string, session uint64, opts ...grpc.DialOption) error {
+	// Check whether the worker is already in the pool, or whether there's no room for it.
+	// Workers replacing their old registrations don't need any more room.
+	p.mu.Lock()
+	old, exists := p.addresses[address]
+	current := exists && old.owns(session)
+	if current && old.session == 0 {
+		old.session = session
+	}
+	full := !exists && p.opts.MaxWorkers > 0 && uint(len(p.heap)) >= p.opts.MaxWorkers
+	p.mu.Unlock()
+	if current {
+		return nil
+	}else if full {
+		return ErrFull
+	}
+	
+	// Connect to the worker.
+	// This ClientConn is threadsafe.
+	conn, err := p.dial(address, opts)
+	if err != nil {
+		return err
+	}
+	
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	
-	if _, exists := p.addresses[address]; !exists {
-		// Connect to the worker.
-		// This ClientConn is threadsafe.
-		conn, err := grpc.Dial(address, grpc.WithInsecure())
-		if err != nil {
-			return err
+	if old, exists := p.addresses[address]; exists && old.owns(session) {
+		// The worker was added while we were connecting, so this connection isn't needed.
+		conn.Close()
+	}else if !exists && p.opts.MaxWorkers > 0 && uint(len(p.heap)) >= p.opts.MaxWorkers {
+		// The pool filled up while we were connecting.
+		conn.Close()
+		return ErrFull
+	}else{
+		// Retire the worker's old registration (if necessary).
+		if exists {
+			p.remove(address, old, ErrReregistered)
 		}
 		
 		// Set up a new worker.
-		w := &worker{connection: conn, stopHeartbeats: make(chan struct{}), closing: false, tasks: 0, index: uint(len(p.heap))}
+		// Until it has completed a task, assume the new worker is as fast as it was seeded with, or else about as fast as the rest of the pool.
+		p.generations += 1
+		w := &worker{address: address, connection: conn, stopHeartbeats: make(chan struct{}), closing: false, session: session, generation: p.generations, tasks: 0, ranks: make(map[int]uint), index: uint(len(p.heap)), frames: make(map[uint64]*preparedFrame)}
+		if seed, exists := p.seeds[address]; exists {
+			w.stats.estimate = seed
+		}else{
+			w.stats.estimate = p.meanEstimate()
+		}
 		
 		// Add the worker to the pool.
 		p.addresses[address] = w
 		p.heap = append(p.heap, w)
 		p.bubbleUp(w)
+		p.emit(Event{Kind: EventJoined, Address: address, Generation: w.generation})
 		
 		// Spin off a goroutine to send the worker heartbeats.
 		go p.heartbeat(w)
@@ -287,15 +765,22 @@ func (p *Pool) Add(address string) error {
 	return nil
 }
 
+// Flag records that a worker's results for a task disagreed with other workers' results for the same task.
+func (p *Pool) Flag(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	if w, exists := p.addresses[address]; exists {
+		w.stats.disagreements += 1
+	}
+}
+
 // Remove removes a worker from the pool.
 func (p *Pool) Remove(address string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	
 	if w, exists := p.addresses[address]; exists {
-		// Stop the worker from recieving heartbeats.
-		w.stopHeartbeats <- struct{}{}
-		
-		p.remove(address, w)
+		p.remove(address, w, nil)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,237 @@
+// Package pool provides a worker pool object for use by the master.
+package pool
+
+import (
+	"sort"
+	"time"
+)
+
+// latencyWindow controls how many of a worker's most recent task latencies are used to compute its latency statistics.
+const latencyWindow int = 128
+
+// estimateWeight controls how heavily each new task latency is weighted in a worker's rolling latency estimate.
+const estimateWeight float64 = 0.2
+
+// These constants control how a worker's trace timeouts are derived from its recent latencies.
+const (
+	minTimeoutSamples int = 8				// How many successful tasks a worker must finish before its timeouts are derived from its latencies.
+	timeoutMargin float64 = 3.0				// How many times longer than its expected latency a task is given to finish.
+	maxTimeoutDoublings uint = 4			// How many times the margin can be doubled after consecutive timed out tasks.
+	minTimeout time.Duration = 50 * time.Millisecond	// The shortest timeout a task is ever given.
+	maxTimeoutScale float64 = 10.0			// How many times longer than the pool's fallback timeout a task can be given.
+)
+
+// rateWindow is the period over which a worker's current transfer rates are measured.
+const rateWindow time.Duration = 5 * time.Second
+
+// transfer records a number of bytes transferred at some time.
+type transfer struct {
+	at time.Time
+	bytes uint64
+}
+
+// meter measures a transfer rate over the most recent rate window.
+type meter struct {
+	transfers []transfer
+}
+
+// trim forgets transfers which happened before the most recent rate window.
+func (m *meter) trim(now time.Time) {
+	i := 0
+	for i < len(m.transfers) && now.Sub(m.transfers[i].at) > rateWindow {
+		i++
+	}
+	m.transfers = m.transfers[i:]
+}
+
+// add records a number of bytes transferred now.
+func (m *meter) add(bytes uint64) {
+	now := time.Now()
+	m.trim(now)
+	m.transfers = append(m.transfers, transfer{at: now, bytes: bytes})
+}
+
+// rate computes the mean transfer rate (in bytes per second) over the most recent rate window.
+// This doesn't modify the meter, so it is safe to call while only holding a read lock.
+func (m *meter) rate() float64 {
+	now := time.Now()
+	
+	var sum uint64
+	for _, t := range m.transfers {
+		if now.Sub(t.at) <= rateWindow {
+			sum += t.bytes
+		}
+	}
+	return float64(sum) / rateWindow.Seconds()
+}
+
+// workerStats accumulates statistics about the tasks a worker has been assigned.
+type workerStats struct {
+	assigned, succeeded uint
+	disagreements uint	// The number of tasks whose results disagreed with other workers' results for the same task.
+	bytesSent, bytesReceived uint64
+	pixels uint64	// The number of pixels the worker has successfully traced.
+	sendMeter, receiveMeter meter
+	
+	latencies []time.Duration	// A ring buffer of the worker's most recent successful task latencies.
+	pixelLatencies []float64	// A ring buffer of the latencies (in nanoseconds per pixel) of the same tasks as in latencies.
+	nextLatency int				// The index in latencies that the next latency will be written to.
+	timeouts uint				// The number of the worker's tasks in a row which have timed out.
+	estimate time.Duration		// An exponentially weighted moving average of the worker's task latencies.
+}
+
+// record records the outcome of a single task.
+// The number of bytes received, the number of pixels traced, and the latency are only recorded if the task succeeded.
+// Whether the task timed out is only relevant if it failed.
+func (ws *workerStats) record(sent, received int, pixels uint64, latency time.Duration, success, timedOut bool) {
+	ws.bytesSent += uint64(sent)
+	ws.sendMeter.add(uint64(sent))
+	if success {
+		ws.timeouts = 0
+		ws.succeeded += 1
+		ws.bytesReceived += uint64(received)
+		ws.receiveMeter.add(uint64(received))
+		ws.pixels += pixels
+		
+		// Add the latency, and the latency per pixel, to the ring buffers.
+		perPixel := float64(latency) / float64(pixels)
+		if pixels == 0 {
+			perPixel = 0.0
+		}
+		if len(ws.latencies) < latencyWindow {
+			ws.latencies = append(ws.latencies, latency)
+			ws.pixelLatencies = append(ws.pixelLatencies, perPixel)
+		}else{
+			ws.latencies[ws.nextLatency] = latency
+			ws.pixelLatencies[ws.nextLatency] = perPixel
+		}
+		ws.nextLatency = (ws.nextLatency + 1) % latencyWindow
+		
+		// Fold the latency into the rolling estimate.
+		if ws.estimate == 0 {
+			ws.estimate = latency
+		}else{
+			ws.estimate = time.Duration(estimateWeight * float64(latency) + (1.0 - estimateWeight) * float64(ws.estimate))
+		}
+	}else if timedOut {
+		ws.timeouts += 1
+	}
+}
+
+// meanLatency computes the mean of a worker's recent task latencies.
+func (ws *workerStats) meanLatency() time.Duration {
+	if len(ws.latencies) == 0 {
+		return 0
+	}
+	
+	var sum time.Duration
+	for _, l := range ws.latencies {
+		sum += l
+	}
+	return sum / time.Duration(len(ws.latencies))
+}
+
+// percentileLatency computes the pth percentile (in the range [0, 1]) of a worker's recent task latencies.
+func (ws *workerStats) percentileLatency(p float64) time.Duration {
+	if len(ws.latencies) == 0 {
+		return 0
+	}
+	
+	sorted := make([]time.Duration, len(ws.latencies))
+	copy(sorted, ws.latencies)
+	sort.Slice(sorted, func(i, j int) bool {return sorted[i] < sorted[j]})
+	return sorted[int(p * float64(len(sorted) - 1))]
+}
+
+// timeout computes how long a worker should be given to trace some number of pixels.
+// A task's expected latency is modelled as a fixed overhead (the worker's fastest recent task) plus a cost per pixel (the 95th percentile of the worker's recent costs per pixel).
+// Until the worker has finished enough tasks for this to be meaningful, the fallback timeout is used instead.
+// Each task in a row which has timed out doubles the margin, so that a worker which has slowed down isn't failed forever.
+func (ws *workerStats) timeout(pixels uint64, fallback time.Duration) time.Duration {
+	if len(ws.latencies) < minTimeoutSamples {
+		return fallback
+	}
+	
+	// Find the worker's overhead and cost per pixel.
+	overhead := ws.latencies[0]
+	for _, l := range ws.latencies[1:] {
+		if l < overhead {
+			overhead = l
+		}
+	}
+	sorted := make([]float64, len(ws.pixelLatencies))
+	copy(sorted, ws.pixelLatencies)
+	sort.Float64s(sorted)
+	perPixel := sorted[int(0.95 * float64(len(sorted) - 1))]
+	
+	// Scale the expected latency by the margin, then clamp it to a sane range.
+	doublings := ws.timeouts
+	if doublings > maxTimeoutDoublings {
+		doublings = maxTimeoutDoublings
+	}
+	margin := timeoutMargin * float64(uint(1) << doublings)
+	t := time.Duration(margin * (float64(overhead) + perPixel * float64(pixels)))
+	if t < minTimeout {
+		t = minTimeout
+	}
+	if max := time.Duration(maxTimeoutScale * float64(fallback)); t > max {
+		t = max
+	}
+	return t
+}
+
+// WorkerStats summarises the work done by a single worker in a pool.
+// Latencies are computed from the worker's most recent successful tasks.
+type WorkerStats struct {
+	Address string
+	Generation uint64			// Which of the pool's additions the worker was, so that a worker added again at the same address has a higher generation.
+	Tasks uint					// The number of tasks the worker is currently performing.
+	Assigned uint				// The number of tasks the worker has ever been assigned.
+	Succeeded uint				// The number of tasks the worker has completed successfully.
+	SuccessRate float64			// The fraction of the worker's finished tasks that succeeded.
+	Disagreements uint			// The number of tasks whose results disagreed with other workers' results for the same task.
+	MeanLatency time.Duration
+	P95Latency time.Duration
+	EstimatedLatency time.Duration	// The rolling latency estimate used to schedule tasks.
+	BytesSent uint64			// The number of bytes of work orders sent to the worker.
+	BytesReceived uint64		// The number of bytes of results received from the worker.
+	Pixels uint64				// The number of pixels the worker has successfully traced.
+	SendRate float64			// The recent rate (in bytes per second) at which work orders have been sent to the worker.
+	ReceiveRate float64			// The recent rate (in bytes per second) at which results have been received from the worker.
+}
+
+// Stats returns statistics about every worker in the pool, sorted by address.
+func (p *Pool) Stats() []WorkerStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	stats := make([]WorkerStats, 0, len(p.addresses))
+	for a, w := range p.addresses {
+		ws := WorkerStats{
+			Address: a,
+			Generation: w.generation,
+			Tasks: w.tasks,
+			Assigned: w.stats.assigned,
+			Succeeded: w.stats.succeeded,
+			Disagreements: w.stats.disagreements,
+			MeanLatency: w.stats.meanLatency(),
+			P95Latency: w.stats.percentileLatency(0.95),
+			EstimatedLatency: w.stats.estimate,
+			BytesSent: w.stats.bytesSent,
+			BytesReceived: w.stats.bytesReceived,
+			Pixels: w.stats.pixels,
+			SendRate: w.stats.sendMeter.rate(),
+			ReceiveRate: w.stats.receiveMeter.rate(),
+		}
+		
+		// Only count tasks which have finished towards the success rate.
+		if finished := w.stats.assigned - w.tasks; finished > 0 {
+			ws.SuccessRate = float64(w.stats.succeeded) / float64(finished)
+		}
+		
+		stats = append(stats, ws)
+	}
+	sort.Slice(stats, func(i, j int) bool {return stats[i].Address < stats[j].Address})
+	
+	return stats
+}
\ No newline at end of file
@@ -0,0 +1,310 @@
+// Package sim simulates a master rendering frames with many fake workers, so that the master's scheduling can be exercised without a cluster.
+package sim
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"github.com/mwindels/distributed-raytracer/master/pool"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/grpc"
+	"encoding/binary"
+	"math/rand"
+	"hash/fnv"
+	"context"
+	"sync"
+	"time"
+	"math"
+	"net"
+	"fmt"
+)
+
+// bufferSize is the size (in bytes) of the in-memory buffer between the engine and each fake worker.
+const bufferSize int = 1 << 20
+
+// WorkerProfile describes how a fake worker behaves.
+type WorkerProfile struct {
+	Latency time.Duration	// The mean amount of time the worker takes to fill a work order.
+	Jitter time.Duration	// The largest amount by which the worker's latency varies (uniformly) from its mean.
+	FailureRate float64		// The probability that the worker fails a work order.
+	HangRate float64		// The probability that the worker never responds to a work order.
+}
+
+// Clock tells the time for a simulation, and measures the time its fake workers take.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	
+	// After waits for some duration, then sends the time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock implements the Clock interface using the wall clock.
+type realClock struct{}
+
+// Now returns the wall clock's time.
+func (c realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for some duration of real time.
+func (c realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock implements the Clock interface without ever waiting.
+// Every wait is over straight away, and moves the clock on by its duration, so a simulation's duration is the total time its fake workers spent "tracing", however their work overlapped.
+// This makes the duration the same from one run of a simulation to the next, as long as the same work orders are filled.
+type FakeClock struct {
+	mu sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a fake clock which starts at some time.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the fake clock's time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	return c.now
+}
+
+// After moves the fake clock on by some duration, and sends the new time straight away.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Config controls a simulation.
+type Config struct {
+	Workers []WorkerProfile	// The fake workers which render the simulation's frames.
+	Frames uint				// The number of frames to render.
+	Seed int64				// Seeds the fake workers' behaviour, so that simulations can be repeated.
+	Clock Clock				// Tells the time, and measures the fake workers' latencies (the wall clock if nil; see FakeClock for repeatable durations).
+	Engine engine.Options	// The options of the simulated engine (its canvas is replaced by the simulation's).
+}
+
+// Report summarizes the outcome of a simulation.
+type Report struct {
+	Frames uint					// The number of frames requested.
+	Presented uint				// The number of frames which were drawn.
+	PixelsDrawn uint64			// The number of pixels set across every frame.
+	Retries uint				// The number of times partitions were reassigned after every worker assigned to them failed.
+	Unfilled uint				// The number of partitions, across every frame, which no worker filled.
+	Duration time.Duration		// How long the simulation took, by its clock.
+	Workers []pool.WorkerStats	// The statistics of each fake worker at the end of the simulation.
+}
+
+// countingCanvas implements the engine.Canvas interface by counting what is drawn onto it.
+type countingCanvas struct {
+	mu sync.Mutex
+	pixels uint64
+	presented uint
+}
+
+// Set counts a pixel being drawn.
+func (c *countingCanvas) Set(x, y int, col colour.RGB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	c.pixels += 1
+}
+
+// Update does nothing, since nothing is displayed.
+func (c *countingCanvas) Update() {}
+
+// Present counts a frame being drawn.
+func (c *countingCanvas) Present() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	c.presented += 1
+}
+
+// fakeWorker implements the comms.TraceServer interface without tracing anything.
+type fakeWorker struct {
+	seed int64
+	index uint		// Which of the simulation's workers this is, so that workers with the same profile don't all fail the same work orders.
+	profile WorkerProfile
+	clock Clock
+	col colour.RGB	// The colour this worker fills every pixel with.
+}
+
+// behaviour decides how long a work order takes, and whether it fails or hangs.
+// The decision is drawn from the simulation's seed, the worker's index, and the order itself (its frame and area), rather than from the order in which work orders arrive.
+// So however the engine's goroutines interleave, each worker always treats the same work order the same way, while another worker given the order (such as when it is retried) decides afresh.
+func (w *fakeWorker) behaviour(req *comms.WorkOrder) (time.Duration, bool, bool) {
+	h := fnv.New64a()
+	for _, v := range []uint64{uint64(w.seed), uint64(w.index), req.GetFrame(), uint64(req.GetX()), uint64(req.GetY()), uint64(req.GetWidth()), uint64(req.GetHeight())} {
+		binary.Write(h, binary.LittleEndian, v)
+	}
+	random := rand.New(rand.NewSource(int64(h.Sum64())))
+	
+	latency := w.profile.Latency
+	if w.profile.Jitter > 0 {
+		latency += time.Duration((random.Float64() * 2.0 - 1.0) * float64(w.profile.Jitter))
+	}
+	fails := random.Float64() < w.profile.FailureRate
+	hangs := random.Float64() < w.profile.HangRate
+	
+	return time.Duration(math.Max(float64(latency), 0.0)), fails, hangs
+}
+
+// BulkTrace pretends to trace a batch of rays.
+func (w *fakeWorker) BulkTrace(ctx context.Context, req *comms.WorkOrder) (*comms.TraceResults, error) {
+	latency, fails, hangs := w.behaviour(req)
+	
+	// Wait for the order to be "traced".
+	if hangs {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	select{
+	case <-w.clock.After(latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	
+	if fails {
+		return nil, fmt.Errorf("Simulated failure.")
+	}
+	
+	// Fill every pixel (or block) with the worker's colour, laid out just as a real worker would.
+	scale := int(req.GetScale())
+	if scale < 1 {
+		scale = 1
+	}
+	x, y, width, height := tracer.Blocks(int(req.GetX()), int(req.GetY()), int(req.GetWidth()), int(req.GetHeight()), scale)
+	results := &comms.TraceResults{}
+	results.SetLayout(x, y, width, height, scale, uint(req.GetCheckerboard()), uint(req.GetInterleave()))
+	results.BitDepth = req.GetBitDepth()
+	results.Colours = make([]byte, results.ColourSize() * results.Slots(), results.ColourSize() * results.Slots())
+	for i := 0; i < results.Slots(); i++ {
+		results.SetColour(i, w.col)
+	}
+	results.TraceTime = int64(latency)
+	
+	return results, nil
+}
+
+// PrepareFrame always succeeds, since the fake worker ignores the scene.
+func (w *fakeWorker) PrepareFrame(ctx context.Context, req *comms.FrameState) (*empty.Empty, error) {
+	return &empty.Empty{}, nil
+}
+
+// Heartbeat always succeeds, without giving a session (since the fake worker never registers).
+func (w *fakeWorker) Heartbeat(ctx context.Context, req *empty.Empty) (*comms.HeartbeatReply, error) {
+	return &comms.HeartbeatReply{}, nil
+}
+
+// Run runs a simulation, rendering frames with fake workers connected to a real engine over in-memory connections.
+// The camera turns slightly between frames, so that every frame must be rendered.
+func Run(cfg Config) (Report, error) {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	
+	// Set up an empty scene.
+	cam, err := state.NewCamera(geom.Vector{0, 0, 0}, geom.Vector{0, 0, 1}, math.Pi / 2.0)
+	if err != nil {
+		return Report{}, err
+	}
+	
+	// Set up the engine.
+	canvas := &countingCanvas{}
+	opts := cfg.Engine
+	opts.Canvas = canvas
+	opts.LocalWorkers = 0
+	
+	// Count the retried and unfilled partitions of every frame.
+	var statsMu sync.Mutex
+	var retries, unfilled uint
+	frameDone := opts.FrameDone
+	opts.FrameDone = func(stats engine.FrameStats) {
+		func() {
+			statsMu.Lock()
+			defer statsMu.Unlock()
+			
+			retries += uint(stats.Retries)
+			unfilled += uint(stats.Unfilled)
+		}()
+		if frameDone != nil {
+			frameDone(stats)
+		}
+	}
+	eng, err := engine.New(state.NewEnvironment(cam), opts)
+	if err != nil {
+		return Report{}, err
+	}
+	
+	// Spin up the fake workers.
+	servers := make([]*grpc.Server, 0, len(cfg.Workers))
+	defer func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	}()
+	for i, profile := range cfg.Workers {
+		listener := bufconn.Listen(bufferSize)
+		server := grpc.NewServer()
+		comms.RegisterTraceServer(server, &fakeWorker{
+			seed: cfg.Seed,
+			index: uint(i),
+			profile: profile,
+			clock: clock,
+			col: colour.NewRGB(uint8(i * 37 % 256), uint8(i * 91 % 256), uint8(i * 163 % 256)),
+		})
+		go server.Serve(listener)
+		servers = append(servers, server)
+		
+		dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		})
+		if err := eng.AddWorker(fmt.Sprintf("sim-%d", i), dialer); err != nil {
+			eng.Close()
+			return Report{}, err
+		}
+	}
+	
+	// Render the frames.
+	start := clock.Now()
+	for f := uint(0); f < cfg.Frames; f++ {
+		cam.Yaw(0.01)
+		if err := eng.RenderFrame(cam); err != nil {
+			eng.Close()
+			return Report{}, err
+		}
+	}
+	eng.Wait()
+	duration := clock.Now().Sub(start)
+	
+	// Collect the results before disconnecting from the workers, and the frames' statistics once every frame has been reported.
+	report := Report{
+		Frames: eng.Frames(),
+		Presented: canvas.presented,
+		PixelsDrawn: canvas.pixels,
+		Duration: duration,
+		Workers: eng.WorkerStats(),
+	}
+	eng.Close()
+	
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	
+	report.Retries, report.Unfilled = retries, unfilled
+	return report, nil
+}
\ No newline at end of file
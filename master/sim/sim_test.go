@@ -0,0 +1,187 @@
+package sim
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/master/engine"
+	"testing"
+	"time"
+)
+
+// testOptions returns the options of a small engine, which only listens for registrations on the loopback interface.
+// Frames are rendered one at a time, so that they are numbered in the order they are requested.
+// Work orders always wait the same (generous) timeout, since the latencies the engine observes don't follow the fake clock.
+func testOptions() engine.Options {
+	return engine.Options{
+		Width: 64,
+		Height: 48,
+		Bind: "127.0.0.1",
+		MaxFramesInFlight: 1,
+		FixedTimeout: true,
+	}
+}
+
+// TestRunDrawsEveryFrame checks that reliable workers fill every pixel of every frame.
+func TestRunDrawsEveryFrame(t *testing.T) {
+	profile := WorkerProfile{Latency: time.Millisecond, Jitter: time.Millisecond / 2}
+	report, err := Run(Config{
+		Workers: []WorkerProfile{profile, profile, profile, profile},
+		Frames: 5,
+		Seed: 1,
+		Clock: NewFakeClock(time.Unix(0, 0)),
+		Engine: testOptions(),
+	})
+	if err != nil {
+		t.Fatalf("Simulation failed: %v.", err)
+	}
+	
+	if report.Frames != 5 {
+		t.Errorf("Requested %d frames, expected 5.", report.Frames)
+	}
+	if report.Presented != 5 {
+		t.Errorf("Drew %d frames, expected 5.", report.Presented)
+	}
+	if minPixels := uint64(5 * 64 * 48); report.PixelsDrawn < minPixels {
+		t.Errorf("Drew %d pixels, expected at least %d.", report.PixelsDrawn, minPixels)
+	}
+	if report.Duration <= 0 {
+		t.Errorf("The simulation took %v by its clock, expected some time to pass.", report.Duration)
+	}
+}
+
+// TestRunIsRepeatable checks that a simulation with a fake clock turns out the same way every time it is run with the same seed, even when its workers fail.
+func TestRunIsRepeatable(t *testing.T) {
+	profile := WorkerProfile{Latency: 2 * time.Millisecond, Jitter: time.Millisecond, FailureRate: 0.25}
+	run := func() Report {
+		report, err := Run(Config{
+			Workers: []WorkerProfile{profile, profile, profile},
+			Frames: 8,
+			Seed: 7,
+			Clock: NewFakeClock(time.Unix(0, 0)),
+			Engine: testOptions(),
+		})
+		if err != nil {
+			t.Fatalf("Simulation failed: %v.", err)
+		}
+		return report
+	}
+	
+	first, second := run(), run()
+	if first.Presented != second.Presented {
+		t.Errorf("Drew %d frames, then %d.", first.Presented, second.Presented)
+	}
+	if first.PixelsDrawn != second.PixelsDrawn {
+		t.Errorf("Drew %d pixels, then %d.", first.PixelsDrawn, second.PixelsDrawn)
+	}
+	if first.Duration != second.Duration {
+		t.Errorf("Took %v by the simulation's clock, then %v.", first.Duration, second.Duration)
+	}
+}
+
+// TestFakeClock checks that a fake clock never waits, and moves on by each wait.
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(100, 0)
+	clock := NewFakeClock(start)
+	
+	for _, d := range []time.Duration{time.Second, time.Hour, 0} {
+		select{
+		case <-clock.After(d):
+		default:
+			t.Fatalf("Waiting %v on a fake clock blocked.", d)
+		}
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != time.Hour + time.Second {
+		t.Errorf("The fake clock moved on by %v, expected %v.", elapsed, time.Hour + time.Second)
+	}
+}
+
+// failingWorkers returns the profiles of a worker which fails every work order, and of some reliable workers alongside it.
+func failingWorkers(reliable int) []WorkerProfile {
+	profiles := []WorkerProfile{{Latency: time.Millisecond, FailureRate: 1.0}}
+	for i := 0; i < reliable; i++ {
+		profiles = append(profiles, WorkerProfile{Latency: time.Millisecond, Jitter: time.Millisecond / 2})
+	}
+	return profiles
+}
+
+// checkFailingWorker checks that the failing worker (see failingWorkers) was given work orders, and filled none of them.
+func checkFailingWorker(t *testing.T, report Report) {
+	for _, w := range report.Workers {
+		if w.Address != "sim-0" {
+			continue
+		}
+		if w.Assigned == 0 {
+			t.Errorf("The failing worker was never assigned a work order.")
+		}
+		if w.Succeeded != 0 {
+			t.Errorf("The failing worker filled %d work orders, expected none.", w.Succeeded)
+		}
+		return
+	}
+	t.Errorf("The failing worker left the pool.")
+}
+
+// TestRunRetriesFailedTiles checks that the partitions a failing worker drops are reassigned to other workers, which fill them.
+func TestRunRetriesFailedTiles(t *testing.T) {
+	report, err := Run(Config{
+		Workers: failingWorkers(3),
+		Frames: 4,
+		Seed: 3,
+		Clock: NewFakeClock(time.Unix(0, 0)),
+		Engine: testOptions(),
+	})
+	if err != nil {
+		t.Fatalf("Simulation failed: %v.", err)
+	}
+	
+	checkFailingWorker(t, report)
+	if report.Retries == 0 {
+		t.Errorf("No partitions were reassigned, expected the failing worker's to be.")
+	}
+	if report.Unfilled != 0 {
+		t.Errorf("Left %d partitions unfilled, expected none.", report.Unfilled)
+	}
+	if report.Presented != 4 {
+		t.Errorf("Drew %d frames, expected 4.", report.Presented)
+	}
+}
+
+// TestRunRedundancyCoversFailures checks that when each partition is assigned to several workers, the others fill the partitions a failing worker drops without any being reassigned.
+func TestRunRedundancyCoversFailures(t *testing.T) {
+	opts := testOptions()
+	opts.Redundancy = 2
+	report, err := Run(Config{
+		Workers: failingWorkers(3),
+		Frames: 4,
+		Seed: 5,
+		Clock: NewFakeClock(time.Unix(0, 0)),
+		Engine: opts,
+	})
+	if err != nil {
+		t.Fatalf("Simulation failed: %v.", err)
+	}
+	
+	checkFailingWorker(t, report)
+	if report.Retries != 0 {
+		t.Errorf("Reassigned %d partitions, expected the other worker assigned to each to fill it.", report.Retries)
+	}
+	if report.Unfilled != 0 {
+		t.Errorf("Left %d partitions unfilled, expected none.", report.Unfilled)
+	}
+}
+
+// TestWorkersBehaveIndependently checks that workers with the same profile don't all fail the same work orders, so that reassigning an order can help.
+func TestWorkersBehaveIndependently(t *testing.T) {
+	profile := WorkerProfile{Latency: time.Millisecond, FailureRate: 0.5}
+	first := &fakeWorker{seed: 1, index: 0, profile: profile}
+	second := &fakeWorker{seed: 1, index: 1, profile: profile}
+	
+	for frame := uint64(0); frame < 100; frame++ {
+		order := &comms.WorkOrder{Frame: frame, Width: 16, Height: 16}
+		_, firstFails, _ := first.behaviour(order)
+		_, secondFails, _ := second.behaviour(order)
+		if firstFails != secondFails {
+			return
+		}
+	}
+	t.Errorf("Two workers failed exactly the same 100 work orders.")
+}
\ No newline at end of file
@@ -0,0 +1,270 @@
+// Package app provides the input, update, and frame timing loop shared by the programs which draw a scene in a window.
+package app
+
+import (
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/screen"
+	"github.com/mwindels/distributed-raytracer/shared/input"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"encoding/json"
+	"path/filepath"
+	"time"
+	"math"
+	"fmt"
+	"log"
+)
+
+// Hooks are the callbacks through which a loop produces its frames and carries out the user's actions.
+// Camera and Render must be set, while the actions of any other hooks left unset are ignored.
+type Hooks struct {
+	Camera func() state.Camera					// Returns the camera of the latest frame, which the next frame moves on from.
+	Render func(cam state.Camera) error			// Produces a frame seen through a camera.
+	Refine func() error							// Produces a frame while nothing has changed since the last one (nothing, if nil).
+	SetTimeOfDay func(hour float64) error		// Moves the scene's sun to where it is at some hour.
+	ToggleLight func(index int) (bool, error)	// Switches the light with some index on or off, returning whether it is now on.
+	ToggleFXAA func() bool						// Turns anti-aliasing on or off, returning whether it is now on.
+	CyclePasses func() string					// Shows the next view of the passes, returning a description of it.
+	Screenshot func(path string) error			// Writes the latest frame to the file at path.
+	Clearance func(from, dir geom.Vector, far float64) float64	// Returns how far the camera can move from a position in a (normalized) direction before hitting the scene, up to far (the camera moves through the scene, if nil).
+	SetFocus func(x, y int)						// Moves the point frames are focused on to the mouse cursor, given in the window's pixels (the cursor is ignored, if nil).
+	SceneLoaded func() (Scene, bool)			// Returns the configuration taken from a newly loaded scene, and whether a scene has been loaded since it was last called (the scene never changes, if nil).
+}
+
+// Scene holds the parts of a loop's configuration which are taken from its scene, and so are replaced whenever a new scene is loaded (see Hooks.SceneLoaded).
+type Scene struct {
+	MoveSpeed float64				// See Config.
+	CollisionMargin float64			// See Config.
+	Bookmarks state.Bookmarks		// See Config.
+	Sun state.Sun					// See Config.
+	HasSun bool						// See Config.
+}
+
+// Config controls how a loop handles the user's input and produces its frames.
+type Config struct {
+	Width, Height int				// The size of the window, across which the mouse turns the camera.
+	MoveSpeed float64				// How fast (in the scene's units per second) the camera moves while a movement key is held, before the user speeds it up or slows it down.
+	CollisionMargin float64			// The closest (in the scene's units) the camera comes to the scene's surfaces, if Hooks.Clearance is set.
+	GlideFrames uint				// The number of updates over which the camera glides to a recalled bookmark (it jumps straight there, if zero).
+	Bookmarks state.Bookmarks		// The scene's bookmarks, which can be saved over as the user looks around.
+	Sun state.Sun					// The scene's sun, which follows the time since the loop started if its day length is positive.
+	HasSun bool						// Whether the scene has a sun.
+	ScreenshotDir string			// The directory screenshots are written to.
+	Recorder *input.Recorder		// Records the input stream (nothing is recorded if nil).
+	Player *input.Player			// Replays a recorded input stream instead of using live input (live input if nil).
+	Hooks Hooks
+}
+
+// crossingTime is how long (in seconds) the camera takes to move across a scene at its default speed.
+const crossingTime float64 = 5.0
+
+// maxMoveTime is the longest time (in milliseconds) the camera moves for in a single update, so that a slow frame doesn't throw it across the scene.
+const maxMoveTime uint32 = 250
+
+// DefaultMoveSpeed returns how fast (in an environment's units per second) the camera should move by default, so that it takes the same time to cross any environment, whatever its size.
+// Environments without any objects fall back on input.MoveSpeed.
+func DefaultMoveSpeed(env *state.EnvMutables) float64 {
+	if extent := env.Extent(); extent > 0.0 {
+		return extent / crossingTime
+	}
+	return env.Metres(input.MoveSpeed)
+}
+
+// ease eases a fraction t (from 0 to 1) in and out, so that a glide starts and ends gently.
+func ease(t float64) float64 {
+	return t * t * (3.0 - 2.0 * t)
+}
+
+// Run produces an initial frame, then handles the user's input and produces frames until the user quits.
+// Each update produces at most one frame, which is produced again in full whenever anything has changed (and refined otherwise).
+// Updates happen at most screen.FPS times per second, and the camera moves in proportion to the time between them (so it moves at the same speed, however quickly frames are produced).
+func Run(cfg Config) {
+	hooks := cfg.Hooks
+	bookmarks := cfg.Bookmarks
+	moveSpeed := cfg.MoveSpeed
+	collisionMargin := cfg.CollisionMargin
+	sun, hasSun := cfg.Sun, cfg.HasSun
+	
+	// A glide carries the camera from one view to another over several updates.
+	var glideFrom, glideTo state.Camera
+	gliding, glideFrame := false, uint(0)
+	
+	// Produce the initial frame.
+	if err := hooks.Render(hooks.Camera()); err != nil {
+		log.Printf("%v\n", err)
+	}
+	
+	// Parse user input and produce frames, while the sun (if it's moving) follows the time since the first frame.
+	animating := hasSun && sun.DayLength > 0.0 && hooks.SetTimeOfDay != nil
+	firstUpdate := sdl.GetTicks()
+	prevUpdate := firstUpdate
+	var currentUpdate, elapsed uint32
+	for running, moveDirs, yaw, pitch, actions, number := true, uint8(0), 0.0, 0.0, uint8(0), 0; running; {
+		// Measure the time since the last update, which the camera moves for.
+		currentUpdate = sdl.GetTicks()
+		elapsed, prevUpdate = currentUpdate - prevUpdate, currentUpdate
+		
+		// Collect new inputs.
+		// A replay moves the camera for as long as the recording did, so that it ends up exactly where it did then.
+		running, moveDirs, yaw, pitch, actions, number = input.HandleInputs(moveDirs, cfg.Width, cfg.Height)
+		if cfg.Player != nil {
+			running, moveDirs, yaw, pitch, actions, number, elapsed = cfg.Player.Next(running)
+		}
+		if elapsed > maxMoveTime {
+			elapsed = maxMoveTime
+		}
+		if cfg.Recorder != nil {
+			if err := cfg.Recorder.Record(running, moveDirs, yaw, pitch, actions, number, elapsed); err != nil {
+				log.Printf("Could not record input: %v.\n", err)
+			}
+		}
+		
+		// Follow the cursor (if necessary), unless the input is being replayed.
+		if hooks.SetFocus != nil && cfg.Player == nil {
+			hooks.SetFocus(input.Cursor())
+		}
+		
+		// Start from wherever the last frame (possibly produced at someone else's request) left the camera.
+		cam, changed := hooks.Camera(), false
+		
+		// Take the bookmarks, speed, and sun of a newly loaded scene (if necessary), starting its day from now.
+		if hooks.SceneLoaded != nil {
+			if scene, loaded := hooks.SceneLoaded(); loaded {
+				bookmarks, moveSpeed, collisionMargin = scene.Bookmarks, scene.MoveSpeed, scene.CollisionMargin
+				sun, hasSun = scene.Sun, scene.HasSun
+				animating = hasSun && sun.DayLength > 0.0 && hooks.SetTimeOfDay != nil
+				firstUpdate = currentUpdate
+				gliding = false
+			}
+		}
+		
+		// Take a screenshot (if necessary).
+		if actions & input.ActionScreenshot != 0 && hooks.Screenshot != nil {
+			path := filepath.Join(cfg.ScreenshotDir, fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405.000")))
+			if err := hooks.Screenshot(path); err != nil {
+				log.Printf("Could not take screenshot: %v.\n", err)
+			}else{
+				log.Printf("Screenshot written to \"%s\".\n", path)
+			}
+		}
+		
+		// Show the next view of the passes (if necessary).
+		if actions & input.ActionCyclePasses != 0 && hooks.CyclePasses != nil {
+			log.Printf("Showing passes: %s.\n", hooks.CyclePasses())
+			changed = true
+		}
+		
+		// Save the camera as a bookmark (if necessary), logging it in the form used by environment files.
+		if actions & input.ActionSaveBookmark != 0 {
+			bookmarks = bookmarks.Save(number, cam)
+			saved, _ := bookmarks.Get(number)
+			if stored, err := json.Marshal(saved); err == nil {
+				log.Printf("Saved bookmark %d: %s.\n", number, stored)
+			}
+		}
+		
+		// Jump to a bookmark (if necessary).
+		if actions & input.ActionRecallBookmark != 0 {
+			if recalled, set := bookmarks.Get(number); set {
+				log.Printf("Jumping to bookmark %d (\"%s\").\n", number, recalled.Name)
+				if cfg.GlideFrames > 0 {
+					glideFrom, glideTo, gliding, glideFrame = cam, recalled.Cam, true, 0
+				}else{
+					cam, changed = recalled.Cam, true
+				}
+			}else{
+				log.Printf("Bookmark %d has not been saved.\n", number)
+			}
+		}
+		
+		// Glide towards a recalled bookmark (if necessary), stopping wherever the camera has got to once the user takes over.
+		if gliding && (moveDirs &^ input.MoveSprint != 0 || yaw != 0.0 || pitch != 0.0) {
+			gliding = false
+		}else if gliding {
+			glideFrame += 1
+			if glideFrame < cfg.GlideFrames {
+				cam = glideFrom.Interpolate(glideTo, ease(float64(glideFrame) / float64(cfg.GlideFrames)))
+			}else{
+				cam, gliding = glideTo, false
+			}
+			changed = true
+		}
+		
+		// Switch a light on or off (if necessary).
+		if actions & input.ActionToggleLight != 0 && hooks.ToggleLight != nil {
+			if on, err := hooks.ToggleLight(number - 1); err != nil {
+				log.Printf("Could not switch light %d: %v.\n", number, err)
+			}else{
+				switched := "off"
+				if on {
+					switched = "on"
+				}
+				log.Printf("Switched light %d %s.\n", number, switched)
+				changed = true
+			}
+		}
+		
+		// Move the sun along (if necessary).
+		if animating {
+			hour := sun.Time + 24.0 * float64(sdl.GetTicks() - firstUpdate) / 1000.0 / sun.DayLength
+			if err := hooks.SetTimeOfDay(hour); err != nil {
+				log.Printf("Could not set the time of day: %v.\n", err)
+			}
+			changed = true
+		}
+		
+		// Turn anti-aliasing on or off (if necessary).
+		if actions & input.ActionToggleFXAA != 0 && hooks.ToggleFXAA != nil {
+			if hooks.ToggleFXAA() {
+				log.Printf("Turned FXAA on.\n")
+			}else{
+				log.Printf("Turned FXAA off.\n")
+			}
+			changed = true
+		}
+		
+		// Speed the camera up or slow it down (if necessary).
+		if actions & input.ActionSpeedUp != 0 {
+			moveSpeed *= input.SpeedStep
+			log.Printf("Camera speed: %g per second.\n", moveSpeed)
+		}
+		if actions & input.ActionSlowDown != 0 {
+			moveSpeed /= input.SpeedStep
+			log.Printf("Camera speed: %g per second.\n", moveSpeed)
+		}
+		
+		// Move and rotate the camera (if necessary).
+		if moveDirs &^ input.MoveSprint != 0 || yaw != 0.0 || pitch != 0.0 {
+			distance := moveSpeed * float64(elapsed) / 1000.0
+			if moveDirs & input.MoveSprint != 0 {
+				distance *= input.SprintFactor
+			}
+			dir := cam.MoveDirection(moveDirs & input.MoveForward != 0, moveDirs & input.MoveBackward != 0, moveDirs & input.MoveLeftward != 0, moveDirs & input.MoveRightward != 0, moveDirs & input.MoveUpward != 0, moveDirs & input.MoveDownward != 0)
+			if !dir.Zero() && hooks.Clearance != nil {
+				// Stop short of whatever is in the way.
+				distance = math.Max(0.0, math.Min(distance, hooks.Clearance(cam.Pos, dir, distance + collisionMargin) - collisionMargin))
+			}
+			cam.Pos = cam.Pos.Add(dir.Scale(distance))
+			cam.Yaw(yaw * cam.Fov / 2.0)
+			cam.Pitch(pitch * (float64(cfg.Height) / float64(cfg.Width)) * cam.Fov / 2.0)
+			changed = true
+		}
+		
+		// Produce the next frame if anything has changed, or else refine the last one.
+		if changed {
+			if err := hooks.Render(cam); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}else if hooks.Refine != nil {
+			if err := hooks.Refine(); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}
+		
+		// Wait for the next update.
+		currentUpdate = sdl.GetTicks()
+		if currentUpdate - prevUpdate < screen.MsPerFrame {
+			sdl.Delay(screen.MsPerFrame - (currentUpdate - prevUpdate))
+		}
+	}
+}
\ No newline at end of file
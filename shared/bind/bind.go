@@ -0,0 +1,111 @@
+// Package bind resolves the addresses masters and workers listen on, so that they can be bound to a particular address, network interface, or Unix domain socket.
+package bind
+
+import (
+	"path/filepath"
+	"context"
+	"strconv"
+	"strings"
+	"net"
+	"fmt"
+	"os"
+)
+
+// unixPath returns the path of the Unix domain socket named by an address of the form "unix://path" or "unix:path", or false if the address doesn't name one.
+func unixPath(address string) (string, bool) {
+	if strings.HasPrefix(address, "unix://") {
+		return strings.TrimPrefix(address, "unix://"), true
+	}else if strings.HasPrefix(address, "unix:") {
+		return strings.TrimPrefix(address, "unix:"), true
+	}
+	return "", false
+}
+
+// IsUnix returns whether an address names a Unix domain socket.
+func IsUnix(address string) bool {
+	_, ok := unixPath(address)
+	return ok
+}
+
+// Host resolves a bind setting into the host to listen on.
+// A bind setting may be empty (listening on every interface), an IP address or host name, the name of a network interface, or a Unix domain socket ("unix://path").
+// An interface is bound to its first address, preferring IPv4 addresses over IPv6 addresses.
+// A Unix domain socket is resolved into an address of the form "unix:///absolute/path", so that other processes can find it whatever their working directory.
+func Host(bind string) (string, error) {
+	if bind == "" {
+		return "", nil
+	}
+	
+	// Unix domain sockets are used as they are, apart from making their paths absolute.
+	if path, ok := unixPath(bind); ok {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return "", fmt.Errorf("Could not find the absolute path of socket \"%s\": %v.", bind, err)
+		}
+		return "unix://" + path, nil
+	}
+	
+	// If the setting doesn't name an interface, it must be an address or host name.
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return bind, nil
+	}
+	
+	// Pick one of the interface's addresses.
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("Could not list the addresses of interface \"%s\": %v.", bind, err)
+	}
+	var fallback net.IP
+	for _, a := range addrs {
+		network, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if network.IP.To4() != nil {
+			return network.IP.String(), nil
+		}else if fallback == nil {
+			fallback = network.IP
+		}
+	}
+	if fallback == nil {
+		return "", fmt.Errorf("Interface \"%s\" has no IP addresses.", bind)
+	}
+	return fallback.String(), nil
+}
+
+// Address resolves a bind setting (see Host) and a port into an address to listen on.
+// The port is ignored if the setting names a Unix domain socket.
+func Address(bind string, port uint) (string, error) {
+	host, err := Host(bind)
+	if err != nil {
+		return "", err
+	}
+	if IsUnix(host) {
+		return host, nil
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)), nil
+}
+
+// Listen listens on an address returned by Address.
+// Any socket left behind at a Unix domain socket's path (e.g. by a process which crashed) is removed first.
+func Listen(address string) (net.Listener, error) {
+	path, ok := unixPath(address)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	
+	if info, err := os.Stat(path); err == nil && info.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// Dial connects to an address, which may name a Unix domain socket.
+// This is meant for use as a gRPC context dialer, which is given Unix domain socket addresses with their "unix:" prefix.
+func Dial(ctx context.Context, address string) (net.Conn, error) {
+	if path, ok := unixPath(address); ok {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+}
\ No newline at end of file
@@ -0,0 +1,153 @@
+// Package chaos provides fault injection for the RPCs between the master and its workers, so that failure handling can be exercised reproducibly.
+package chaos
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc"
+	"math/rand"
+	"context"
+	"sync"
+	"time"
+	"flag"
+)
+
+// Options controls which faults are injected, and how often.
+// Rates are probabilities in the range [0, 1].
+type Options struct {
+	DelayRate float64	// The probability that an RPC is delayed.
+	MaxDelay uint		// The longest (in milliseconds) that an RPC can be delayed.
+	DropRate float64	// The probability that an RPC is dropped.
+	CorruptRate float64	// The probability that the results of a trace are corrupted.
+	KillFrequency uint	// How often (in milliseconds) a worker is killed (never if zero).
+	Seed int64			// Seeds the random number generator, so that faults can be reproduced.
+}
+
+// AddFlags defines command line flags for each option on a flag set.
+// The returned options are filled in once the flag set is parsed.
+func AddFlags(flags *flag.FlagSet) *Options {
+	opts := &Options{}
+	flags.Float64Var(&opts.DelayRate, "chaos-delay-rate", 0.0, "the probability that an RPC is delayed")
+	flags.UintVar(&opts.MaxDelay, "chaos-max-delay", 1000, "the longest (in milliseconds) that an RPC can be delayed")
+	flags.Float64Var(&opts.DropRate, "chaos-drop-rate", 0.0, "the probability that an RPC is dropped")
+	flags.Float64Var(&opts.CorruptRate, "chaos-corrupt-rate", 0.0, "the probability that the results of a trace are corrupted")
+	flags.UintVar(&opts.KillFrequency, "chaos-kill-frequency", 0, "how often (in milliseconds) a worker is killed (never if zero)")
+	flags.Int64Var(&opts.Seed, "chaos-seed", 1, "seeds the injected faults")
+	return opts
+}
+
+// Enabled returns whether some options inject any faults at all.
+func (opts Options) Enabled() bool {
+	return opts.DelayRate > 0 || opts.DropRate > 0 || opts.CorruptRate > 0 || opts.KillFrequency > 0
+}
+
+// Monkey injects faults into RPCs.
+type Monkey struct {
+	mu sync.Mutex	// Used to protect the random number generator.
+	random *rand.Rand
+	opts Options
+}
+
+// New creates a monkey which injects faults according to some options.
+func New(opts Options) *Monkey {
+	return &Monkey{
+		random: rand.New(rand.NewSource(opts.Seed)),
+		opts: opts,
+	}
+}
+
+// chance returns true with probability p.
+func (m *Monkey) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	return m.random.Float64() < p
+}
+
+// Intn returns a random number in the range [0, n), using the monkey's random number generator.
+func (m *Monkey) Intn(n int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	return m.random.Intn(n)
+}
+
+// KillFrequency returns how often a worker should be killed (zero if never).
+func (m *Monkey) KillFrequency() time.Duration {
+	return time.Millisecond * time.Duration(m.opts.KillFrequency)
+}
+
+// disrupt delays and/or drops an RPC.
+// A non-nil error is returned if the RPC should not go ahead.
+func (m *Monkey) disrupt(ctx context.Context, method string) error {
+	// Delay the RPC.
+	if m.chance(m.opts.DelayRate) {
+		m.mu.Lock()
+		delay := time.Millisecond * time.Duration(m.random.Int63n(int64(m.opts.MaxDelay) + 1))
+		m.mu.Unlock()
+		
+		select{
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	
+	// Drop the RPC.
+	if m.chance(m.opts.DropRate) {
+		return status.Errorf(codes.Unavailable, "%s dropped by fault injection.", method)
+	}
+	
+	return nil
+}
+
+// corrupt scrambles the colours of some trace results.
+// Messages other than trace results are left alone.
+func (m *Monkey) corrupt(msg interface{}) {
+	results, ok := msg.(*comms.TraceResults)
+	if !ok || !m.chance(m.opts.CorruptRate) {
+		return
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.random.Read(results.GetColours())
+}
+
+// UnaryClientInterceptor returns an interceptor which injects faults into the RPCs a client makes.
+func (m *Monkey) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := m.disrupt(ctx, method); err != nil {
+			return err
+		}
+		
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		
+		m.corrupt(reply)
+		return nil
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor which injects faults into the RPCs a server handles.
+func (m *Monkey) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := m.disrupt(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		
+		resp, err := handler(ctx, req)
+		if err == nil {
+			m.corrupt(resp)
+		}
+		
+		return resp, err
+	}
+}
\ No newline at end of file
@@ -60,6 +60,41 @@ func (rgb RGB) RGB() (uint8, uint8, uint8) {
 	return uint8(255 * rgb.r), uint8(255 * rgb.g), uint8(255 * rgb.b)
 }
 
+// NewRGBFromLevels returns a new RGB object with the specified colours, each out of the levels available at some bit depth (e.g. [0, 1023] at 10 bits).
+func NewRGBFromLevels(r, g, b uint16, depth uint) RGB {
+	max := float64(uint(1) << depth - 1)
+	return RGB{r: math.Min(float64(r) / max, 1.0), g: math.Min(float64(g) / max, 1.0), b: math.Min(float64(b) / max, 1.0)}
+}
+
+// Levels returns the three colour channels of an RGB object, each rounded to the nearest of the levels available at some bit depth (at most 16 bits).
+func (rgb RGB) Levels(depth uint) (uint16, uint16, uint16) {
+	max := float64(uint(1) << depth - 1)
+	return uint16(rgb.r * max + 0.5), uint16(rgb.g * max + 0.5), uint16(rgb.b * max + 0.5)
+}
+
+// bayer is a 4 by 4 ordered dithering matrix, whose entries are spread evenly over [0, 16).
+var bayer = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// Dither returns the three colour channels of an RGB object in the range [0, 255], as drawn at the pixel (x, y).
+// Rather than truncating each channel, neighbouring pixels are rounded up or down in a fixed pattern, so that smooth gradients of colours finer than 8 bits don't band.
+func (rgb RGB) Dither(x, y int) (uint8, uint8, uint8) {
+	threshold := (bayer[y & 3][x & 3] + 0.5) / 16.0
+	channel := func(v float64) uint8 {
+		return uint8(math.Min(math.Floor(v * 255.0 + threshold), 255.0))
+	}
+	return channel(rgb.r), channel(rgb.g), channel(rgb.b)
+}
+
+// Floats returns the three colour channels of an RGB object in the range [0, 1].
+func (rgb RGB) Floats() (float64, float64, float64) {
+	return rgb.r, rgb.g, rgb.b
+}
+
 // MarshalBinary converts an RGB colour into a binary representation.
 func (rgb RGB) MarshalBinary() ([]byte, error) {
 	r, g, b := rgb.RGB()
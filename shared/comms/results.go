@@ -0,0 +1,168 @@
+// Package comms provides the protocol spoken between the master and its workers, with helpers for reading and writing its messages.
+package comms
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"fmt"
+)
+
+// DefaultBitDepth is the number of bits per colour channel in work orders and trace results which leave it unset.
+const DefaultBitDepth uint32 = 8
+
+// ValidBitDepth returns whether colours can be traced with some number of bits per channel (zero meaning DefaultBitDepth).
+// Colours of more than 8 bits are packed into two bytes per channel.
+func ValidBitDepth(depth uint32) bool {
+	return depth == 0 || depth == 8 || depth == 10 || depth == 16
+}
+
+// ChannelBits returns the number of bits per colour channel some trace results were traced with.
+func (r *TraceResults) ChannelBits() uint32 {
+	if r.GetBitDepth() == 0 {
+		return DefaultBitDepth
+	}
+	return r.GetBitDepth()
+}
+
+// ColourSize returns the number of bytes taken up by each pixel's colour in some trace results.
+func (r *TraceResults) ColourSize() int {
+	if r.ChannelBits() > 8 {
+		return 6
+	}
+	return 3
+}
+
+// InterleaveStride returns the number of rows of blocks from one row traced by an interleaved work order (or held by interleaved trace results) to the next.
+// Work orders and results which aren't interleaved (with an interleave of zero or one) hold every row.
+func InterleaveStride(interleave uint32) uint32 {
+	if interleave < 2 {
+		return 1
+	}
+	return interleave
+}
+
+// SetLayout describes how some trace results are laid out, for the blocks of scale by scale pixels in the width by height area (in blocks) with its top left block at (x, y).
+// Blocks are laid out in columns, each column one stride after the one before it.
+// In a checkerboard with some parity (see tracer.Checkered), each column only holds the blocks in the checkerboard, so the stride is halved (rounding up).
+// When interleaved, each column only holds every interleave-th block starting from its first, so the stride is divided by the interleave (rounding up).
+// A checkerboard can't be interleaved (see CheckLayout).
+// This function doesn't allocate the results' buffers; there should be Slots of each (with ColourSize bytes per colour, so the bit depth should be set first).
+func (r *TraceResults) SetLayout(x, y, width, height, scale int, parity, interleave uint) {
+	stride := height
+	if parity != 0 {
+		stride = (height + 1) / 2
+	}else if step := int(InterleaveStride(uint32(interleave))); step > 1 {
+		stride = (height + step - 1) / step
+	}
+	r.X, r.Y, r.Width, r.Height, r.Stride, r.Scale, r.Checkerboard, r.Interleave = uint32(x), uint32(y), uint32(width), uint32(height), uint32(stride), uint32(scale), uint32(parity), uint32(interleave)
+}
+
+// Slots returns the number of pixels (or blocks) some trace results should hold, as laid out.
+// In a checkerboard, this can include a few unused slots at the ends of columns.
+func (r *TraceResults) Slots() int {
+	return int(r.GetWidth()) * int(r.GetStride())
+}
+
+// CheckLayout returns an error if some trace results aren't laid out consistently, or don't hold as many colours as they should.
+func (r *TraceResults) CheckLayout() error {
+	if !ValidBitDepth(r.GetBitDepth()) {
+		return fmt.Errorf("Colours can't be traced with %d bits per channel.", r.GetBitDepth())
+	}
+	
+	step := InterleaveStride(r.GetInterleave())
+	if r.GetCheckerboard() != 0 && step > 1 {
+		return fmt.Errorf("A checkerboard can't be interleaved.")
+	}
+	
+	minStride := (r.GetHeight() + step - 1) / step
+	if r.GetCheckerboard() != 0 {
+		minStride = (r.GetHeight() + 1) / 2
+	}
+	if r.GetStride() < minStride {
+		return fmt.Errorf("A stride of %d is too small for columns of %d blocks.", r.GetStride(), r.GetHeight())
+	}
+	if r.Count() != r.Slots() {
+		return fmt.Errorf("There are %d colours, rather than %d.", r.Count(), r.Slots())
+	}
+	return nil
+}
+
+// Index returns the index within some trace results of the block (i, j) of the screen, or false if the results don't hold it.
+// This is the one place the results' layout is read, so workers and the master always agree on it.
+func (r *TraceResults) Index(i, j int) (int, bool) {
+	x, y := i - int(r.GetX()), j - int(r.GetY())
+	if x < 0 || y < 0 || x >= int(r.GetWidth()) || y >= int(r.GetHeight()) {
+		return 0, false
+	}
+	
+	parity := r.GetCheckerboard()
+	if step := int(InterleaveStride(r.GetInterleave())); step > 1 {
+		if y % step != 0 {
+			return 0, false
+		}
+		return x * int(r.GetStride()) + y / step, true
+	}else if parity == 0 {
+		return x * int(r.GetStride()) + y, true
+	}else if uint32((i + j) % 2) != parity - 1 {
+		return 0, false
+	}
+	return x * int(r.GetStride()) + y / 2, true
+}
+
+// Block returns the block of the screen whose results are at index k of some trace results, or false if the index is an unused slot.
+// This is the inverse of Index.
+func (r *TraceResults) Block(k int) (int, int, bool) {
+	if r.GetStride() == 0 || k < 0 || k >= r.Slots() {
+		return 0, 0, false
+	}
+	x, y := k / int(r.GetStride()), k % int(r.GetStride())
+	
+	// In a checkerboard, the column's blocks alternate with the blocks left out, starting from whichever of its first two rows is in the checkerboard.
+	if parity := r.GetCheckerboard(); parity != 0 {
+		first := 0
+		if uint32((int(r.GetX()) + x + int(r.GetY())) % 2) != parity - 1 {
+			first = 1
+		}
+		y = 2 * y + first
+	}else if step := int(InterleaveStride(r.GetInterleave())); step > 1 {
+		y = step * y
+	}
+	if y >= int(r.GetHeight()) {
+		return 0, 0, false
+	}
+	return int(r.GetX()) + x, int(r.GetY()) + y, true
+}
+
+// Count returns the number of pixels (or blocks) in some trace results, including any unused slots.
+func (r *TraceResults) Count() int {
+	return len(r.GetColours()) / r.ColourSize()
+}
+
+// Colour returns the colour of the pixel at index i of some trace results.
+func (r *TraceResults) Colour(i int) colour.RGB {
+	depth := r.ChannelBits()
+	c := r.GetColours()[r.ColourSize() * i:]
+	if depth <= 8 {
+		return colour.NewRGB(c[0], c[1], c[2])
+	}
+	
+	// Deeper colours are stored as little endian pairs of bytes.
+	level := func(k int) uint16 {
+		return uint16(c[2 * k]) | uint16(c[2 * k + 1]) << 8
+	}
+	return colour.NewRGBFromLevels(level(0), level(1), level(2), uint(depth))
+}
+
+// SetColour sets the colour of the pixel at index i of some trace results.
+func (r *TraceResults) SetColour(i int, col colour.RGB) {
+	depth := r.ChannelBits()
+	c := r.Colours[r.ColourSize() * i:]
+	if depth <= 8 {
+		c[0], c[1], c[2] = col.RGB()
+		return
+	}
+	
+	red, green, blue := col.Levels(uint(depth))
+	for k, level := range []uint16{red, green, blue} {
+		c[2 * k], c[2 * k + 1] = uint8(level), uint8(level >> 8)
+	}
+}
\ No newline at end of file
@@ -1,7 +1,10 @@
 // Package geom provides shared geometry objects for use by workers and the master.
 package geom
 
-import "github.com/mwindels/rtreego"
+import (
+	"github.com/mwindels/rtreego"
+	"math"
+)
 
 // This array contains the normal vectors for the six sides of an axis-aligned 3D box.
 // This should be const, but Go doesn't let us have const structs.  Treat it as read-only.
@@ -27,6 +30,21 @@ func NewBox(bbox *rtreego.Rect) Box {
 
 // Intersect determines whether a ray intersects the box b.
 func (b Box) Intersect(rOrigin, rDir Vector) bool {
+	return b.IntersectWithin(rOrigin, rDir, math.Inf(1))
+}
+
+// Contains determines whether the point p is inside the box b (or on its surface).
+func (b Box) Contains(p Vector) bool {
+	return b.MinCorner.X <= p.X && p.X <= b.MaxCorner.X && b.MinCorner.Y <= p.Y && p.Y <= b.MaxCorner.Y && b.MinCorner.Z <= p.Z && p.Z <= b.MaxCorner.Z
+}
+
+// IntersectWithin determines whether a ray intersects the box b before travelling maxScale times the length of its direction.
+// Rays which start inside the box always intersect it.
+func (b Box) IntersectWithin(rOrigin, rDir Vector, maxScale float64) bool {
+	if b.Contains(rOrigin) {
+		return true
+	}
+	
 	// For each side of the box...
 	for _, sNormal := range boxNormals {
 		// Check to make sure the ray is not perpendicular to the side's normal.
@@ -42,8 +60,8 @@ func (b Box) Intersect(rOrigin, rDir Vector) bool {
 			// Compute the amount by which the ray's direction has to be scaled to hit the side's plane.
 			dirScale := sPoint.Sub(rOrigin).Dot(sNormal) / rDir.Dot(sNormal)
 			
-			// Ensure that the intersection point is in front of the ray.
-			if dirScale >= 0.0 {
+			// Ensure that the intersection point is in front of the ray, and not too far along it.
+			if dirScale >= 0.0 && dirScale <= maxScale {
 				// Compute the point of intersection.
 				intersect := rOrigin.Add(rDir.Scale(dirScale))
 				
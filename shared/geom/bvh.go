@@ -0,0 +1,180 @@
+// Package geom provides shared geometry objects for use by workers and the master.
+package geom
+
+import (
+	"sort"
+	"math"
+)
+
+// bvhLeafSize is the most items a leaf of a bounding volume hierarchy holds.
+const bvhLeafSize int = 4
+
+// bvhStackSize is the most nodes waiting to be visited while traversing a bounding volume hierarchy.
+// Since each split halves a node's items, a hierarchy is never deep enough to fill it.
+const bvhStackSize int = 128
+
+// bvhNode is a node of a bounding volume hierarchy.
+type bvhNode struct {
+	box Box			// The box bounding every item beneath the node.
+	start int		// The index of the node's first child (a leaf's first item, in the hierarchy's items).
+	count int		// The number of items a leaf holds (zero if the node isn't a leaf).
+	axis int		// The axis along which the node's items were split between its children.
+}
+
+// BVH is a bounding volume hierarchy: a binary tree of boxes over a set of items, which rays can be traced through without allocating.
+// The hierarchy is built once, and doesn't change when its items do.
+type BVH struct {
+	nodes []bvhNode
+	items []int		// The items' indices, in the order the leaves hold them.
+}
+
+// component returns a vector's coordinate along an axis (zero for X, one for Y, and two for Z).
+func component(v Vector, axis int) float64 {
+	switch axis {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	default:
+		return v.Z
+	}
+}
+
+// union returns the smallest box holding two boxes.
+func union(a, b Box) Box {
+	return Box{
+		MinCorner: Vector{math.Min(a.MinCorner.X, b.MinCorner.X), math.Min(a.MinCorner.Y, b.MinCorner.Y), math.Min(a.MinCorner.Z, b.MinCorner.Z)},
+		MaxCorner: Vector{math.Max(a.MaxCorner.X, b.MaxCorner.X), math.Max(a.MaxCorner.Y, b.MaxCorner.Y), math.Max(a.MaxCorner.Z, b.MaxCorner.Z)},
+	}
+}
+
+// NewBVH builds a bounding volume hierarchy over items with some boxes, where each item is identified by the index of its box.
+// Each node's items are split in half along the longest axis of their boxes' centres.
+func NewBVH(boxes []Box) BVH {
+	b := BVH{items: make([]int, len(boxes))}
+	for i := range b.items {
+		b.items[i] = i
+	}
+	if len(boxes) > 0 {
+		b.nodes = make([]bvhNode, 1, 2 * (len(boxes) / bvhLeafSize + 1))
+		b.build(boxes, 0, 0, len(boxes))
+	}
+	return b
+}
+
+// build fills in node n of a bounding volume hierarchy with the items from start (inclusive) to end (exclusive), splitting them between new children if there are too many.
+func (b *BVH) build(boxes []Box, n, start, end int) {
+	// Bound the node's items, and their centres.
+	box, centres := boxes[b.items[start]], Box{}
+	for k := start; k < end; k++ {
+		item := boxes[b.items[k]]
+		centre := item.MinCorner.Add(item.MaxCorner).Scale(0.5)
+		box = union(box, item)
+		if k == start {
+			centres = Box{MinCorner: centre, MaxCorner: centre}
+		}else{
+			centres = union(centres, Box{MinCorner: centre, MaxCorner: centre})
+		}
+	}
+	b.nodes[n].box = box
+	
+	// Small nodes are leaves.
+	if end - start <= bvhLeafSize {
+		b.nodes[n].start, b.nodes[n].count = start, end - start
+		return
+	}
+	
+	// Split the items in half along the longest axis of their centres.
+	extent := centres.MaxCorner.Sub(centres.MinCorner)
+	axis := 0
+	if extent.Y > component(extent, axis) {
+		axis = 1
+	}
+	if extent.Z > component(extent, axis) {
+		axis = 2
+	}
+	centre := func(item int) float64 {
+		return component(boxes[item].MinCorner, axis) + component(boxes[item].MaxCorner, axis)
+	}
+	items := b.items[start:end]
+	sort.Slice(items, func(i, j int) bool {return centre(items[i]) < centre(items[j])})
+	
+	// Build the children next to each other, so that a node only needs to know where its first child is.
+	mid := (start + end) / 2
+	left := len(b.nodes)
+	b.nodes = append(b.nodes, bvhNode{}, bvhNode{})
+	b.nodes[n].start, b.nodes[n].axis = left, axis
+	b.build(boxes, left, start, mid)
+	b.build(boxes, left + 1, mid, end)
+}
+
+// hitWithin determines whether a ray, whose direction has the reciprocal invDir, hits a box before travelling maxScale times the length of its direction.
+// Rays which start inside the box always hit it.
+func (b Box) hitWithin(rOrigin, rDir, invDir Vector, maxScale float64) bool {
+	near, far := 0.0, maxScale
+	for axis := 0; axis < 3; axis++ {
+		origin, min, max := component(rOrigin, axis), component(b.MinCorner, axis), component(b.MaxCorner, axis)
+		
+		// A ray parallel to the box's sides along this axis only hits it if it starts between them.
+		if component(rDir, axis) == 0.0 {
+			if origin < min || origin > max {
+				return false
+			}
+			continue
+		}
+		
+		// Narrow the part of the ray within the box to the part between the box's sides along this axis.
+		inv := component(invDir, axis)
+		t1, t2 := (min - origin) * inv, (max - origin) * inv
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+		near, far = math.Max(near, t1), math.Min(far, t2)
+		if near > far {
+			return false
+		}
+	}
+	return true
+}
+
+// Traverse passes each item whose box a ray hits, before travelling maxScale times the length of its direction, to visit.
+// Each node's nearer child is visited first, so that the nearest items tend to be visited before the rest.
+// Visit returns how far along the ray (as a multiple of the length of its direction) the rest of the items need to be looked for, and whether to stop.
+// The return value is whether visit stopped the traversal.
+func (b *BVH) Traverse(rOrigin, rDir Vector, maxScale float64, visit func(item int) (float64, bool)) bool {
+	if len(b.nodes) == 0 {
+		return false
+	}
+	invDir := Vector{1.0 / rDir.X, 1.0 / rDir.Y, 1.0 / rDir.Z}
+	
+	// Visit the nodes depth first, keeping the nodes still to be visited on a stack which never leaves this function.
+	var stack [bvhStackSize]int
+	top := 1
+	for top > 0 {
+		top -= 1
+		n := &b.nodes[stack[top]]
+		if !n.box.hitWithin(rOrigin, rDir, invDir, maxScale) {
+			continue
+		}
+		
+		// Visit a leaf's items.
+		if n.count > 0 {
+			for _, item := range b.items[n.start:n.start + n.count] {
+				var stop bool
+				if maxScale, stop = visit(item); stop {
+					return true
+				}
+			}
+			continue
+		}
+		
+		// Push the farther child first, so that the nearer child is visited first.
+		if component(rDir, n.axis) < 0.0 {
+			stack[top], stack[top + 1] = n.start, n.start + 1
+		}else{
+			stack[top], stack[top + 1] = n.start + 1, n.start
+		}
+		top += 2
+	}
+	return false
+}
\ No newline at end of file
@@ -0,0 +1,69 @@
+// Package geom provides shared geometry objects for use by workers and the master.
+package geom
+
+import "math"
+
+// Quaternion represents a rotation in 3-dimensional space as a unit quaternion.
+type Quaternion struct {
+	W float64	// The real part.
+	X float64
+	Y float64
+	Z float64
+}
+
+// QuaternionFromAxes returns the rotation which turns the x, y, and z axes onto the vectors x, y, and z.
+// The vectors must be normalized, perpendicular to one another, and right-handed (so that x cross y is z).
+func QuaternionFromAxes(x, y, z Vector) Quaternion {
+	// This converts the rotation matrix with columns x, y, and z, working from its largest diagonal element to keep the square root well away from zero.
+	var q Quaternion
+	if trace := x.X + y.Y + z.Z; trace > 0.0 {
+		s := 2.0 * math.Sqrt(trace + 1.0)
+		q = Quaternion{W: s / 4.0, X: (y.Z - z.Y) / s, Y: (z.X - x.Z) / s, Z: (x.Y - y.X) / s}
+	}else if x.X > y.Y && x.X > z.Z {
+		s := 2.0 * math.Sqrt(1.0 + x.X - y.Y - z.Z)
+		q = Quaternion{W: (y.Z - z.Y) / s, X: s / 4.0, Y: (y.X + x.Y) / s, Z: (z.X + x.Z) / s}
+	}else if y.Y > z.Z {
+		s := 2.0 * math.Sqrt(1.0 + y.Y - x.X - z.Z)
+		q = Quaternion{W: (z.X - x.Z) / s, X: (y.X + x.Y) / s, Y: s / 4.0, Z: (z.Y + y.Z) / s}
+	}else{
+		s := 2.0 * math.Sqrt(1.0 + z.Z - x.X - y.Y)
+		q = Quaternion{W: (x.Y - y.X) / s, X: (z.X + x.Z) / s, Y: (z.Y + y.Z) / s, Z: s / 4.0}
+	}
+	return q.Norm()
+}
+
+// Dot returns the dot product of the quaternions p and q.
+func (p Quaternion) Dot(q Quaternion) float64 {
+	return p.W * q.W + p.X * q.X + p.Y * q.Y + p.Z * q.Z
+}
+
+// Norm returns the normalized form of the quaternion q.
+func (q Quaternion) Norm() Quaternion {
+	mag := math.Sqrt(q.Dot(q))
+	return Quaternion{W: q.W / mag, X: q.X / mag, Y: q.Y / mag, Z: q.Z / mag}
+}
+
+// Rotate returns the vector v rotated by the quaternion q.
+func (q Quaternion) Rotate(v Vector) Vector {
+	// This expands q * v * q^-1, which only holds for unit quaternions.
+	u := Vector{X: q.X, Y: q.Y, Z: q.Z}
+	t := u.Cross(v).Scale(2.0)
+	return v.Add(t.Scale(q.W)).Add(u.Cross(t))
+}
+
+// Slerp returns the rotation a fraction t (from 0 to 1) of the way from the rotation p to the rotation q, turning at a constant rate along the shortest arc.
+func Slerp(p, q Quaternion, t float64) Quaternion {
+	// A quaternion and its negation are the same rotation, so take whichever is closer to p.
+	cos := p.Dot(q)
+	if cos < 0.0 {
+		q, cos = Quaternion{W: -q.W, X: -q.X, Y: -q.Y, Z: -q.Z}, -cos
+	}
+	
+	// Nearly equal rotations are interpolated linearly, since the angle between them is too small to divide by.
+	a, b := 1.0 - t, t
+	if cos < 0.9995 {
+		theta := math.Acos(cos)
+		a, b = math.Sin((1.0 - t) * theta) / math.Sin(theta), math.Sin(t * theta) / math.Sin(theta)
+	}
+	return Quaternion{W: a * p.W + b * q.W, X: a * p.X + b * q.X, Y: a * p.Y + b * q.Y, Z: a * p.Z + b * q.Z}.Norm()
+}
\ No newline at end of file
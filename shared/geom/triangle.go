@@ -1,6 +1,8 @@
 // Package geom provides shared geometry objects for use by workers and the master.
 package geom
 
+import "math"
+
 // Triangle represents a triangle in 3-dimensional space.
 // Note that the points are assumed to be stored in counter-clockwise order.
 type Triangle struct {
@@ -20,6 +22,19 @@ type BaryCoords struct {
 	R3 float64	// The ratio between the signed area of triangle (I, P1, P2) and the area of the triangle (P1, P2, P3).
 }
 
+// Edges holds the parts of a triangle which every ray intersecting it needs, so that they can be worked out once rather than for every ray.
+type Edges struct {
+	P1P2 Vector		// The edge from the triangle's first point to its second.
+	P1P3 Vector		// The edge from the triangle's first point to its third.
+	Normal Vector	// The triangle's (unit) normal vector.
+}
+
+// Edges works out the edges and normal of the triangle t.
+func (t Triangle) Edges() Edges {
+	p1p2, p1p3 := t.P2.Sub(t.P1), t.P3.Sub(t.P1)
+	return Edges{P1P2: p1p2, P1P3: p1p3, Normal: p1p2.Cross(p1p3).Norm()}
+}
+
 // Normal computes the normal vector of the triangle t.
 func (t Triangle) Normal() Vector {
 	return t.P2.Sub(t.P1).Cross(t.P3.Sub(t.P1)).Norm()
@@ -35,7 +50,19 @@ func (t Triangle) InterpNormal(p BaryCoords) Vector {
 // If no intersection exists, then the last value returned will be false.
 // Note that this is essentially the Möller-Trumbore algorithm.
 func (t Triangle) Intersection(rOrigin, rDir Vector) (Vector, BaryCoords, bool) {
-	p1p2, p1p3, negativeDir := t.P2.Sub(t.P1), t.P3.Sub(t.P1), rDir.Scale(-1)
+	return t.IntersectionWithin(rOrigin, rDir, math.Inf(1))
+}
+
+// IntersectionWithin returns the point of intersection between a ray and a triangle t, just as Intersection does, but only if the ray hits t before travelling maxScale times the length of its direction.
+// The distance to the triangle's plane is checked first, so triangles beyond a nearer hit are rejected cheaply.
+func (t Triangle) IntersectionWithin(rOrigin, rDir Vector, maxScale float64) (Vector, BaryCoords, bool) {
+	return t.IntersectionWithEdges(t.Edges(), rOrigin, rDir, maxScale)
+}
+
+// IntersectionWithEdges returns the point of intersection between a ray and a triangle t, just as IntersectionWithin does, using edges already worked out for t (see Triangle.Edges).
+// Only the triangle's first point is read; the rest of it is given by its edges.
+func (t Triangle) IntersectionWithEdges(e Edges, rOrigin, rDir Vector, maxScale float64) (Vector, BaryCoords, bool) {
+	p1p2, p1p3, negativeDir := e.P1P2, e.P1P3, rDir.Scale(-1)
 	
 	// Compute the cosine of the angle between t's normal and the direction of the ray using the scalar triple product.
 	// This is equivalent to the determinant of the matrix composed of the three vectors.
@@ -46,6 +73,13 @@ func (t Triangle) Intersection(rOrigin, rDir Vector) (Vector, BaryCoords, bool)
 	if incidence != 0.0 {
 		p1Or := rOrigin.Sub(t.P1)
 		
+		// Compute the amount by which the ray's direction has to be scaled to hit the triangle's plane.
+		// Ensure that the intersection point is in front of the ray, and not too far along it.
+		dirScale := p1p2.Dot(p1p3.Cross(p1Or)) / incidence
+		if dirScale < 0.0 || dirScale > maxScale {
+			return Vector{}, BaryCoords{}, false
+		}
+		
 		// Compute the ratio for the triangle defined by all points except P2.
 		r2 := p1Or.Dot(p1p3.Cross(negativeDir)) / incidence
 		
@@ -61,13 +95,7 @@ func (t Triangle) Intersection(rOrigin, rDir Vector) (Vector, BaryCoords, bool)
 				
 				// If all barycentric coordinates are non-negative, then t has been intersected.
 				if r1 >= 0.0 && r2 >= 0.0 && r3 >= 0.0 {
-					// Compute the amount by which the ray's direction has to be scaled to hit the triangle's plane.
-					dirScale := p1p2.Dot(p1p3.Cross(p1Or)) / incidence
-					
-					// Ensure that the intersection point is in front of the ray.
-					if dirScale >= 0.0 {
-						return rOrigin.Add(rDir.Scale(dirScale)), BaryCoords{R1: r1, R2: r2, R3: r3}, true
-					}
+					return rOrigin.Add(rDir.Scale(dirScale)), BaryCoords{R1: r1, R2: r2, R3: r3}, true
 				}
 			}
 		}
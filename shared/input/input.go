@@ -11,13 +11,43 @@ const (
 	MoveRightward
 	MoveUpward
 	MoveDownward
+	MoveSprint		// Move faster (by SprintFactor) in the other directions held.
+)
+
+// MoveSpeed is how fast (in metres per second) the camera moves while a movement key is held, for environments without any objects to judge its size by.
+const MoveSpeed float64 = 3.0
+
+// CollisionMargin is the closest (in metres) the camera comes to the surfaces of objects, when it is kept from moving through them.
+const CollisionMargin float64 = 0.25
+
+// SprintFactor is how many times faster the camera moves while the sprint key is held.
+const SprintFactor float64 = 4.0
+
+// SpeedStep is how many times faster (or slower) the camera moves each time its speed is turned up (or down).
+const SpeedStep float64 = 1.5
+
+// These constants are one-off action masks that should be applied to the fifth return value of HandleInputs.
+const (
+	ActionScreenshot uint8 = 1 << iota
+	ActionCyclePasses
+	ActionSaveBookmark		// Save the camera as the bookmark numbered by the last return value of HandleInputs.
+	ActionRecallBookmark	// Move the camera to the bookmark numbered by the last return value of HandleInputs.
+	ActionToggleLight		// Switch the light numbered by the last return value of HandleInputs (counting from one) on or off.
+	ActionToggleFXAA		// Turn image-space anti-aliasing on or off.
+	ActionSpeedUp			// Make the camera move faster (by SpeedStep).
+	ActionSlowDown			// Make the camera move slower (by SpeedStep).
 )
 
 // HandleInputs parses all input events waiting in the queue.
-// This function returns: (running, new move directions, yaw, pitch).
-func HandleInputs(moveDirs uint8, width, height int) (bool, uint8, float64, float64) {
+// Bookmarks are recalled with the number keys, and saved by holding control along with a number key.
+// The first nine lights are switched on and off with F2 to F10, and anti-aliasing with F11.
+// The camera moves faster while control is held, and its speed is turned up and down with the plus (or equals) and minus keys.
+// This function returns: (running, new move directions, yaw, pitch, actions, bookmark or light number).
+func HandleInputs(moveDirs uint8, width, height int) (bool, uint8, float64, float64, uint8, int) {
 	running := true	// We assume this to be true.
 	yaw, pitch := 0.0, 0.0	// These are measured in units of (fov / 2) radians.
+	actions := uint8(0)
+	number := 0	// This is only meaningful if a bookmark or light action was taken.
 	
 	// Pull every event out of the queue and evaluate/apply it.
 	for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
@@ -29,6 +59,36 @@ func HandleInputs(moveDirs uint8, width, height int) (bool, uint8, float64, floa
 				case sdl.K_ESCAPE:
 					running = false
 					break
+				case sdl.K_F12:
+					actions |= ActionScreenshot
+					break
+				case sdl.K_F1:
+					actions |= ActionCyclePasses
+					break
+				case sdl.K_F11:
+					actions |= ActionToggleFXAA
+					break
+				case sdl.K_EQUALS, sdl.K_KP_PLUS:
+					actions |= ActionSpeedUp
+					break
+				case sdl.K_MINUS, sdl.K_KP_MINUS:
+					actions |= ActionSlowDown
+					break
+				case sdl.K_LCTRL, sdl.K_RCTRL:
+					moveDirs |= MoveSprint
+					break
+				case sdl.K_1, sdl.K_2, sdl.K_3, sdl.K_4, sdl.K_5, sdl.K_6, sdl.K_7, sdl.K_8, sdl.K_9:
+					number = int(keyEvent.Keysym.Sym - sdl.K_1) + 1
+					if keyEvent.Keysym.Mod & sdl.KMOD_CTRL != 0 {
+						actions |= ActionSaveBookmark
+					}else{
+						actions |= ActionRecallBookmark
+					}
+					break
+				case sdl.K_F2, sdl.K_F3, sdl.K_F4, sdl.K_F5, sdl.K_F6, sdl.K_F7, sdl.K_F8, sdl.K_F9, sdl.K_F10:
+					number = int(keyEvent.Keysym.Sym - sdl.K_F2) + 1
+					actions |= ActionToggleLight
+					break
 				case sdl.K_w:
 					if moveDirs & MoveBackward != 0 {
 						moveDirs &^= MoveForward | MoveBackward
@@ -92,6 +152,9 @@ func HandleInputs(moveDirs uint8, width, height int) (bool, uint8, float64, floa
 				case sdl.K_LSHIFT:
 					moveDirs &^= MoveDownward
 					break
+				case sdl.K_LCTRL, sdl.K_RCTRL:
+					moveDirs &^= MoveSprint
+					break
 				}
 			}
 			break
@@ -102,5 +165,12 @@ func HandleInputs(moveDirs uint8, width, height int) (bool, uint8, float64, floa
 			break
 		}
 	}
-	return running, moveDirs, yaw, pitch
+	return running, moveDirs, yaw, pitch, actions, number
+}
+
+// Cursor returns the position of the mouse cursor within the window.
+// While the mouse turns the camera, the cursor is hidden, but it still moves around (and is kept within) the window.
+func Cursor() (int, int) {
+	x, y, _ := sdl.GetMouseState()
+	return int(x), int(y)
 }
\ No newline at end of file
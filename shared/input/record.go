@@ -0,0 +1,111 @@
+// Package input provides functionality for event parsing.
+package input
+
+import (
+	"github.com/veandco/go-sdl2/sdl"
+	"encoding/json"
+	"bufio"
+	"io"
+	"os"
+)
+
+// Sample records the outcome of a single call to HandleInputs.
+type Sample struct {
+	Time uint32			`json:"time"`	// The number of milliseconds since recording started.
+	Elapsed uint32		`json:"elapsed"`	// The number of milliseconds the camera moved for, since the previous sample.
+	Running bool		`json:"running"`
+	MoveDirs uint8		`json:"moveDirs"`
+	Yaw float64			`json:"yaw"`
+	Pitch float64		`json:"pitch"`
+	Actions uint8		`json:"actions,omitempty"`
+	Number int			`json:"number,omitempty"`
+}
+
+// Recorder writes the outcomes of HandleInputs to a file, one JSON sample per line.
+type Recorder struct {
+	file *os.File
+	writer *bufio.Writer
+	encoder *json.Encoder
+	start uint32
+}
+
+// NewRecorder creates a recorder which writes to the file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	
+	writer := bufio.NewWriter(file)
+	return &Recorder{file: file, writer: writer, encoder: json.NewEncoder(writer), start: sdl.GetTicks()}, nil
+}
+
+// Record records the outcome of a call to HandleInputs, along with how long (in milliseconds) the camera moved for since the previous call.
+func (r *Recorder) Record(running bool, moveDirs uint8, yaw, pitch float64, actions uint8, number int, elapsed uint32) error {
+	return r.encoder.Encode(Sample{Time: sdl.GetTicks() - r.start, Elapsed: elapsed, Running: running, MoveDirs: moveDirs, Yaw: yaw, Pitch: pitch, Actions: actions, Number: number})
+}
+
+// Close finishes writing a recording.
+func (r *Recorder) Close() error {
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	
+	return r.file.Close()
+}
+
+// Player replays a recording made by a recorder.
+type Player struct {
+	samples []Sample
+	next int
+	start uint32
+}
+
+// NewPlayer creates a player which replays the recording in the file at path.
+func NewPlayer(path string) (*Player, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	
+	// Read in every sample.
+	var samples []Sample
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var s Sample
+		if err := decoder.Decode(&s); err == io.EOF {
+			break
+		}else if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	
+	return &Player{samples: samples, next: 0, start: sdl.GetTicks()}, nil
+}
+
+// Next returns the next recorded outcome of HandleInputs, in place of the live one, along with how long (in milliseconds) the camera moved for when it was recorded.
+// If the next sample was recorded later (relative to the start of the recording) than it is being replayed, this function waits until its time comes.
+// Once the recording ends, or if running is false (i.e. the user has asked to quit), the replay stops.
+func (p *Player) Next(running bool) (bool, uint8, float64, float64, uint8, int, uint32) {
+	if !running || p.next >= len(p.samples) {
+		return false, 0, 0.0, 0.0, 0, 0, 0
+	}
+	
+	s := p.samples[p.next]
+	p.next += 1
+	
+	// Recordings made before the camera's movement time was recorded fall back on the time between samples.
+	if s.Elapsed == 0 && p.next > 1 {
+		s.Elapsed = s.Time - p.samples[p.next - 2].Time
+	}
+	
+	// Wait for the sample's time to come.
+	if elapsed := sdl.GetTicks() - p.start; elapsed < s.Time {
+		sdl.Delay(s.Time - elapsed)
+	}
+	
+	return s.Running, s.MoveDirs, s.Yaw, s.Pitch, s.Actions, s.Number, s.Elapsed
+}
\ No newline at end of file
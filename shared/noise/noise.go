@@ -0,0 +1,43 @@
+// Package noise provides seeded procedural noise, for procedural textures, displacement, and volumetrics.
+// Noise is computed without any global state, so every worker finds the same value at the same point for the same seed.
+package noise
+
+import "github.com/mwindels/distributed-raytracer/shared/geom"
+
+// Func is a noise function, which maps each point in space to a value.
+type Func func(p geom.Vector) float64
+
+// hash mixes a 64 bit integer into a well-distributed 64 bit integer (using the SplitMix64 finaliser).
+func hash(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// hashCell mixes a seed and the coordinates of a lattice cell into a well-distributed 64 bit integer.
+func hashCell(seed uint64, x, y, z int64) uint64 {
+	return hash(hash(hash(seed ^ uint64(x)) ^ uint64(y)) ^ uint64(z))
+}
+
+// unit converts a 64 bit integer into a number in the range [0, 1).
+func unit(h uint64) float64 {
+	return float64(h >> 11) / (1 << 53)
+}
+
+// FBM sums several octaves of a noise function (fractional Brownian motion), each octave lacunarity times the frequency of the last and gain times its amplitude.
+// The sum is divided by the total amplitude, so it has the same range as the noise function.
+func FBM(f Func, p geom.Vector, octaves int, lacunarity, gain float64) float64 {
+	sum, amplitude, total := 0.0, 1.0, 0.0
+	for o := 0; o < octaves; o++ {
+		sum += amplitude * f(p)
+		total += amplitude
+		p = p.Scale(lacunarity)
+		amplitude *= gain
+	}
+	
+	if total == 0.0 {
+		return 0.0
+	}
+	return sum / total
+}
\ No newline at end of file
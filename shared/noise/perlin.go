@@ -0,0 +1,94 @@
+// Package noise provides seeded procedural noise, for procedural textures, displacement, and volumetrics.
+// Noise is computed without any global state, so every worker finds the same value at the same point for the same seed.
+package noise
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"math"
+)
+
+// Perlin generates 3D gradient noise, using Ken Perlin's improved noise with a permutation shuffled by a seed.
+type Perlin struct {
+	perm [512]uint8	// A shuffled permutation of [0, 256), repeated twice so that it can be indexed without wrapping.
+}
+
+// NewPerlin creates a Perlin noise generator with some seed.
+func NewPerlin(seed int64) *Perlin {
+	p := &Perlin{}
+	for i := 0; i < 256; i++ {
+		p.perm[i] = uint8(i)
+	}
+	
+	// Shuffle the permutation (Fisher-Yates), drawing each swap from the seed.
+	state := uint64(seed)
+	for i := 255; i > 0; i-- {
+		state = hash(state)
+		j := int(state % uint64(i + 1))
+		p.perm[i], p.perm[j] = p.perm[j], p.perm[i]
+	}
+	copy(p.perm[256:], p.perm[:256])
+	
+	return p
+}
+
+// fade smooths a fraction in the range [0, 1], so that noise is continuous in its first and second derivatives.
+func fade(t float64) float64 {
+	return t * t * t * (t * (t * 6.0 - 15.0) + 10.0)
+}
+
+// lerp interpolates linearly between a and b.
+func lerp(t, a, b float64) float64 {
+	return a + t * (b - a)
+}
+
+// grad returns the dot product of (x, y, z) with one of twelve gradient directions, picked by a hash.
+func grad(h uint8, x, y, z float64) float64 {
+	h &= 15
+	u, v := y, z
+	if h < 8 {
+		u = x
+	}
+	if h < 4 {
+		v = y
+	}else if h == 12 || h == 14 {
+		v = x
+	}
+	
+	if h & 1 != 0 {
+		u = -u
+	}
+	if h & 2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// At returns the noise at a point, which is roughly in the range [-1, 1].
+// The noise is zero at every point with integer coordinates.
+func (n *Perlin) At(p geom.Vector) float64 {
+	// Find the point's cell, and where the point lies within it.
+	fx, fy, fz := math.Floor(p.X), math.Floor(p.Y), math.Floor(p.Z)
+	xi, yi, zi := int(int64(fx) & 255), int(int64(fy) & 255), int(int64(fz) & 255)
+	x, y, z := p.X - fx, p.Y - fy, p.Z - fz
+	u, v, w := fade(x), fade(y), fade(z)
+	
+	// Hash the cell's corners.
+	a := int(n.perm[xi]) + yi
+	aa, ab := int(n.perm[a]) + zi, int(n.perm[a + 1]) + zi
+	b := int(n.perm[xi + 1]) + yi
+	ba, bb := int(n.perm[b]) + zi, int(n.perm[b + 1]) + zi
+	
+	// Blend the gradients of the cell's corners.
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(n.perm[aa], x, y, z), grad(n.perm[ba], x - 1.0, y, z)),
+			lerp(u, grad(n.perm[ab], x, y - 1.0, z), grad(n.perm[bb], x - 1.0, y - 1.0, z))),
+		lerp(v,
+			lerp(u, grad(n.perm[aa + 1], x, y, z - 1.0), grad(n.perm[ba + 1], x - 1.0, y, z - 1.0)),
+			lerp(u, grad(n.perm[ab + 1], x, y - 1.0, z - 1.0), grad(n.perm[bb + 1], x - 1.0, y - 1.0, z - 1.0))))
+}
+
+// FBM returns several octaves of Perlin noise at a point, each double the frequency and half the amplitude of the last.
+func (n *Perlin) FBM(p geom.Vector, octaves int) float64 {
+	return FBM(n.At, p, octaves, 2.0, 0.5)
+}
\ No newline at end of file
@@ -0,0 +1,62 @@
+// Package noise provides seeded procedural noise, for procedural textures, displacement, and volumetrics.
+// Noise is computed without any global state, so every worker finds the same value at the same point for the same seed.
+package noise
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"math"
+)
+
+// Worley generates 3D cellular noise, based on the distances from each point to a set of scattered feature points.
+// Space is split into unit cells, each of which holds one feature point placed by a seed.
+type Worley struct {
+	seed uint64
+}
+
+// NewWorley creates a Worley noise generator with some seed.
+func NewWorley(seed int64) *Worley {
+	return &Worley{seed: uint64(seed)}
+}
+
+// feature returns the feature point of the cell (x, y, z).
+func (n *Worley) feature(x, y, z int64) geom.Vector {
+	h := hashCell(n.seed, x, y, z)
+	return geom.Vector{
+		X: float64(x) + unit(h),
+		Y: float64(y) + unit(hash(h)),
+		Z: float64(z) + unit(hash(hash(h))),
+	}
+}
+
+// Distances returns the distances from a point to its nearest and second nearest feature points.
+func (n *Worley) Distances(p geom.Vector) (float64, float64) {
+	cx, cy, cz := int64(math.Floor(p.X)), int64(math.Floor(p.Y)), int64(math.Floor(p.Z))
+	
+	// The nearest feature point always lies in the point's cell or one of its neighbours (and the second nearest almost always does).
+	f1, f2 := math.Inf(1), math.Inf(1)
+	for dx := int64(-1); dx <= 1; dx++ {
+		for dy := int64(-1); dy <= 1; dy++ {
+			for dz := int64(-1); dz <= 1; dz++ {
+				d := n.feature(cx + dx, cy + dy, cz + dz).Sub(p).Len()
+				if d < f1 {
+					f1, f2 = d, f1
+				}else if d < f2 {
+					f2 = d
+				}
+			}
+		}
+	}
+	
+	return f1, f2
+}
+
+// At returns the distance from a point to its nearest feature point, which is in the range [0, sqrt(3)].
+func (n *Worley) At(p geom.Vector) float64 {
+	f1, _ := n.Distances(p)
+	return f1
+}
+
+// FBM returns several octaves of Worley noise at a point, each double the frequency and half the amplitude of the last.
+func (n *Worley) FBM(p geom.Vector, octaves int) float64 {
+	return FBM(n.At, p, octaves, 2.0, 0.5)
+}
\ No newline at end of file
@@ -0,0 +1,69 @@
+// Package profiling provides an optional HTTP server exposing runtime profiles, so that running masters and workers can be profiled.
+package profiling
+
+import (
+	"net/http/pprof"
+	"net/http"
+	"runtime"
+	"flag"
+	"net"
+	"log"
+)
+
+// Options controls whether profiles are served, and which of the more costly profiles are collected.
+type Options struct {
+	Address string		// The address (including port) on which profiles are served (not served if empty).
+	BlockRate int		// Roughly how many nanoseconds a goroutine must block for to be sampled in the block profile (not collected if zero).
+	MutexFraction int	// Roughly one in this many mutex contention events is sampled in the mutex profile (not collected if zero).
+}
+
+// AddFlags defines command line flags for each option on a flag set.
+// The returned options are filled in once the flag set is parsed.
+func AddFlags(flags *flag.FlagSet) *Options {
+	opts := &Options{}
+	flags.StringVar(&opts.Address, "pprof", "", "serve runtime profiles over HTTP on this address (e.g. \"localhost:6060\", not served if empty)")
+	flags.IntVar(&opts.BlockRate, "pprof-block-rate", 0, "sample goroutines which block for about this many nanoseconds in the block profile (not collected if zero)")
+	flags.IntVar(&opts.MutexFraction, "pprof-mutex-fraction", 0, "sample about one in this many contended mutexes in the mutex profile (not collected if zero)")
+	return opts
+}
+
+// Enabled returns whether some options serve profiles at all.
+func (opts Options) Enabled() bool {
+	return opts.Address != ""
+}
+
+// Start starts serving profiles in the background, under /debug/pprof/ (see net/http/pprof).
+// Profiles are served on their own handler, so nothing registered with the default HTTP handler is exposed.
+func Start(opts Options) error {
+	// Listen before returning, so that a bad address is reported straight away.
+	listener, err := net.Listen("tcp", opts.Address)
+	if err != nil {
+		return err
+	}
+	
+	// Collect the optional profiles (if necessary).
+	if opts.BlockRate > 0 {
+		runtime.SetBlockProfileRate(opts.BlockRate)
+	}
+	if opts.MutexFraction > 0 {
+		runtime.SetMutexProfileFraction(opts.MutexFraction)
+	}
+	
+	// Register the profile handlers.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	
+	// Spin off the profile server.
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Profile server interrupted: %v.\n", err)
+		}
+	}()
+	
+	log.Printf("Serving profiles on \"%s\".\n", listener.Addr())
+	return nil
+}
\ No newline at end of file
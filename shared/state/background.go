@@ -0,0 +1,53 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+)
+
+// Background is the colour seen by rays which don't hit anything.
+// It can be a solid colour, or a vertical gradient blended by how steeply each ray points up or down.
+type Background struct {
+	Top colour.RGB		// The colour seen by rays pointing straight up.
+	Bottom colour.RGB	// The colour seen by rays pointing straight down.
+	Up geom.Vector		// The (normalized) direction which is straight up (GlobalUp if zero).
+}
+
+// StoredBackground is used to (un)marshal background data to/from the JSON format.
+// A solid colour is given by col alone, while a gradient is given by top and bottom (either of which defaults to col).
+type StoredBackground struct {
+	Col *colour.StoredRGB		`json:"col,omitempty"`
+	Top *colour.StoredRGB		`json:"top,omitempty"`
+	Bottom *colour.StoredRGB	`json:"bottom,omitempty"`
+}
+
+// Colour returns the colour seen by a ray travelling in the direction dir, which doesn't hit anything.
+func (b Background) Colour(dir geom.Vector) colour.RGB {
+	if b.Top == b.Bottom {
+		return b.Top
+	}
+	
+	up := b.Up
+	if up.Zero() {
+		up = GlobalUp
+	}
+	t := (dir.Norm().Dot(up) + 1.0) / 2.0
+	return b.Top.Scale(t).Add(b.Bottom.Scale(1.0 - t))
+}
+
+// newBackground creates the background described in an environment file, whose up vector is up.
+func newBackground(stored StoredBackground, up geom.Vector) Background {
+	b := Background{Up: up}
+	if stored.Col != nil {
+		b.Top = colour.NewRGB(stored.Col.R, stored.Col.G, stored.Col.B)
+		b.Bottom = b.Top
+	}
+	if stored.Top != nil {
+		b.Top = colour.NewRGB(stored.Top.R, stored.Top.G, stored.Top.B)
+	}
+	if stored.Bottom != nil {
+		b.Bottom = colour.NewRGB(stored.Bottom.R, stored.Bottom.G, stored.Bottom.B)
+	}
+	return b
+}
\ No newline at end of file
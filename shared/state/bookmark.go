@@ -0,0 +1,83 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"encoding/json"
+	"fmt"
+)
+
+// Bookmark is a named camera position and orientation, which can be jumped back to at any time.
+type Bookmark struct {
+	Name string
+	Cam Camera
+}
+
+// StoredBookmark is used to (un)marshal bookmark data to/from the JSON format.
+type StoredBookmark struct {
+	Name string	`json:"name"`
+	StoredCamera
+}
+
+// Bookmarks holds an environment's bookmarks, numbered from one in the order they were listed in the environment's file.
+// A bookmark with an empty name has not been set.
+type Bookmarks []Bookmark
+
+// defaultBookmarkName returns the name given to the bookmark numbered n when it isn't named.
+func defaultBookmarkName(n int) string {
+	return fmt.Sprintf("bookmark %d", n)
+}
+
+// Get returns the bookmark numbered n.
+// The last return value is false if no such bookmark has been set.
+func (b Bookmarks) Get(n int) (Bookmark, bool) {
+	if n < 1 || n > len(b) || b[n - 1].Name == "" {
+		return Bookmark{}, false
+	}
+	return b[n - 1], true
+}
+
+// Save sets the bookmark numbered n to a camera, keeping the bookmark's name if it already had one.
+// The (possibly grown) bookmarks are returned.
+func (b Bookmarks) Save(n int, cam Camera) Bookmarks {
+	if n < 1 {
+		return b
+	}
+	for len(b) < n {
+		b = append(b, Bookmark{})
+	}
+	
+	if b[n - 1].Name == "" {
+		b[n - 1].Name = defaultBookmarkName(n)
+	}
+	b[n - 1].Cam = cam
+	return b
+}
+
+// Stored converts a camera into the form it is stored in JSON files.
+func (c Camera) Stored() StoredCamera {
+	return StoredCamera{Pos: c.Pos, Dir: c.forward, Fov: c.Fov, Near: c.Near, Far: c.Far}
+}
+
+// MarshalJSON converts a bookmark into the JSON format used by environment files.
+func (b Bookmark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(StoredBookmark{Name: b.Name, StoredCamera: b.Cam.Stored()})
+}
+
+// newBookmarks creates the bookmarks listed in an environment file, whose up vector is up.
+func newBookmarks(stored []StoredBookmark, up geom.Vector) (Bookmarks, error) {
+	bookmarks := make(Bookmarks, len(stored), len(stored))
+	for i, s := range stored {
+		cam, err := s.CameraWithUp(up)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create bookmark %d: %v.", i + 1, err)
+		}
+		
+		// Unnamed bookmarks are named after their number, so that they still count as set.
+		bookmarks[i] = Bookmark{Name: s.Name, Cam: cam}
+		if bookmarks[i].Name == "" {
+			bookmarks[i].Name = defaultBookmarkName(i + 1)
+		}
+	}
+	return bookmarks, nil
+}
\ No newline at end of file
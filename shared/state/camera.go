@@ -21,6 +21,9 @@ type Camera struct {
 	Pos geom.Vector
 	forward, left, up geom.Vector	// Keep these normalized to prevent small errors from building up.
 	Fov float64
+	Near, Far float64	// The distances (along the forward vector) between which objects are seen (with no limit on distance if Far is zero).
+	
+	worldUp geom.Vector	// The (normalized) up vector of the camera's environment, which the camera yaws about (GlobalUp if zero).
 }
 
 // StoredCamera is used to (un)marshal camera data to/from the JSON format.
@@ -28,19 +31,68 @@ type StoredCamera struct {
 	Pos geom.Vector	`json:"pos"`
 	Dir geom.Vector	`json:"dir"`
 	Fov float64		`json:"fov"`
+	Near float64	`json:"near,omitempty"`
+	Far float64		`json:"far,omitempty"`
 }
 
-// NewCamera initializes a new camera with appropriate orientation values.
+// NewCamera initializes a new camera with appropriate orientation values, in an environment whose up vector is the global up vector.
 // If dir is parallel to the global up vector, this function returns an error.
 func NewCamera(pos, dir geom.Vector, fov float64) (Camera, error) {
-	if dir.Cross(GlobalUp).Zero() {
-		return Camera{}, fmt.Errorf("Camera dir is parallel to global up %v.", GlobalUp)
+	return NewCameraWithUp(pos, dir, GlobalUp, fov)
+}
+
+// NewCameraWithUp initializes a new camera with appropriate orientation values, in an environment whose up vector is worldUp.
+// If worldUp is zero, or dir is parallel to it, this function returns an error.
+func NewCameraWithUp(pos, dir, worldUp geom.Vector, fov float64) (Camera, error) {
+	if worldUp.Zero() {
+		return Camera{}, fmt.Errorf("Camera up vector is zero.")
+	}else if dir.Cross(worldUp).Zero() {
+		return Camera{}, fmt.Errorf("Camera dir is parallel to up %v.", worldUp)
 	}else{
 		forward := dir.Norm()
-		left := dir.Cross(GlobalUp).Norm()
+		left := dir.Cross(worldUp).Norm()
 		up := left.Cross(forward)	// This is already normalized.
-		return Camera{Pos: pos, forward: forward, left: left, up: up, Fov: fov}, nil
+		return Camera{Pos: pos, forward: forward, left: left, up: up, Fov: fov, worldUp: worldUp.Norm()}, nil
+	}
+}
+
+// Camera creates the camera described in an environment file, whose up vector is the global up vector.
+func (s StoredCamera) Camera() (Camera, error) {
+	return s.CameraWithUp(GlobalUp)
+}
+
+// CameraWithUp creates the camera described in an environment file, whose up vector is worldUp.
+func (s StoredCamera) CameraWithUp(worldUp geom.Vector) (Camera, error) {
+	if s.Near < 0.0 || s.Far < 0.0 || (s.Far > 0.0 && s.Far <= s.Near) {
+		return Camera{}, fmt.Errorf("Camera clipping distances [%g, %g] are invalid.", s.Near, s.Far)
 	}
+	
+	cam, err := NewCameraWithUp(s.Pos, s.Dir, worldUp, s.Fov)
+	cam.Near, cam.Far = s.Near, s.Far
+	return cam, err
+}
+
+// WorldUp returns the up vector of a camera's environment, which the camera yaws about.
+func (c Camera) WorldUp() geom.Vector {
+	if c.worldUp.Zero() {
+		return GlobalUp
+	}
+	return c.worldUp
+}
+
+// Clip returns the range of distances along a ray from the camera in the direction dir (normalized), between which objects are seen.
+// The clipping distances are measured along the camera's forward vector, so they're stretched for rays pointing off to the side.
+func (c Camera) Clip(dir geom.Vector) (float64, float64) {
+	cos := dir.Dot(c.forward)
+	if cos <= 0.0 {
+		return c.Near, math.Inf(1)
+	}
+	
+	near, far := c.Near / cos, math.Inf(1)
+	if c.Far > 0.0 {
+		far = c.Far / cos
+	}
+	return near, far
 }
 
 // Forward returns the forward vector of a camera.
@@ -58,8 +110,73 @@ func (c Camera) Up() geom.Vector {
 	return c.up
 }
 
+// PixelToPoint translates a pixel value (i, j) to a point on the camera's projection plane in 3D space.
+// The projection plane is exactly one unit in front of the camera.
+// The parameters i and j must be in the range [0, width) and [0, height) respectively.
+func (c Camera) PixelToPoint(i, j, width, height int) geom.Vector {
+	return c.SubpixelToPoint(float64(i) + 0.5, float64(j) + 0.5, width, height)
+}
+
+// SubpixelToPoint translates a position (x, y) on the screen to a point on the camera's projection plane in 3D space.
+// The pixel (i, j) covers the positions [i, i + 1) by [j, j + 1), so its centre is at (i + 0.5, j + 0.5).
+// When translating many positions on the same screen, use a Projection instead.
+func (c Camera) SubpixelToPoint(x, y float64, width, height int) geom.Vector {
+	return c.Projection(width, height).Point(x, y)
+}
+
+// Projection maps positions on a screen to points on a camera's projection plane.
+// It holds everything SubpixelToPoint would otherwise work out for every position.
+type Projection struct {
+	corner geom.Vector			// The point at the screen position (0, 0).
+	stepX, stepY geom.Vector	// How far the point moves for each step along the screen's x and y axes.
+}
+
+// Projection precomputes the mapping from positions on a width by height screen to points on a camera's projection plane.
+func (c Camera) Projection(width, height int) Projection {
+	halfWidth, halfHeight := width / 2, height / 2
+	projHalfWidth := math.Tan(c.Fov / 2.0)
+	projHalfHeight := projHalfWidth * float64(height) / float64(width)
+	return Projection{
+		corner: c.Pos.Add(c.forward).Add(c.left.Scale(projHalfWidth)).Add(c.up.Scale(projHalfHeight)),
+		stepX: c.left.Scale(-projHalfWidth / float64(halfWidth)),
+		stepY: c.up.Scale(-projHalfHeight / float64(halfHeight)),
+	}
+}
+
+// Point translates a position (x, y) on the screen to a point on the projection plane, just as SubpixelToPoint does.
+func (p Projection) Point(x, y float64) geom.Vector {
+	return p.corner.Add(p.stepX.Scale(x)).Add(p.stepY.Scale(y))
+}
+
+// PointToPixel translates a point in 3D space to the (fractional) pixel it appears at on a width by height screen.
+// This is the inverse of PixelToPoint, so pixel centres have integer coordinates.
+// The last return value is false if the point is not in front of the camera.
+func (c Camera) PointToPixel(p geom.Vector, width, height int) (float64, float64, bool) {
+	offset := p.Sub(c.Pos)
+	depth := offset.Dot(c.forward)
+	if depth <= 0.0 {
+		return 0.0, 0.0, false
+	}
+	
+	// Project the point onto the projection plane, then undo PixelToPoint's offsets.
+	halfWidth, halfHeight := width / 2, height / 2
+	projHalfWidth := math.Tan(c.Fov / 2.0)
+	projHalfHeight := projHalfWidth * float64(height) / float64(width)
+	i := float64(halfWidth) - 0.5 - offset.Dot(c.left) / depth * float64(halfWidth) / projHalfWidth
+	j := float64(halfHeight) - 0.5 - offset.Dot(c.up) / depth * float64(halfHeight) / projHalfHeight
+	return i, j, true
+}
+
 // Move moves a camera some distance in some combination of directions.
 func (c *Camera) Move(distance float64, forward, backward, leftward, rightward, upward, downward bool) {
+	if moveDir := c.MoveDirection(forward, backward, leftward, rightward, upward, downward); !moveDir.Zero() {
+		c.Pos = c.Pos.Add(moveDir.Scale(distance))
+	}
+}
+
+// MoveDirection returns the (normalized) direction in which Move moves a camera, given the same combination of directions.
+// Opposing directions cancel out, so the zero vector is returned if the camera wouldn't move at all.
+func (c Camera) MoveDirection(forward, backward, leftward, rightward, upward, downward bool) geom.Vector {
 	moveDir := geom.Vector{0, 0, 0}
 	
 	// Set up the direction vector.
@@ -85,9 +202,28 @@ func (c *Camera) Move(distance float64, forward, backward, leftward, rightward,
 		}
 	}
 	
-	// Move the camera a given distance in the given direction.
-	if !moveDir.Zero() {
-		c.Pos = c.Pos.Add(moveDir.Norm().Scale(distance))
+	if moveDir.Zero() {
+		return moveDir
+	}
+	return moveDir.Norm()
+}
+
+// Interpolate returns the camera a fraction t (from 0 to 1) of the way from the camera c to the camera to.
+// The position, field of view, and clipping distances change linearly, while the camera turns at a constant rate along the shortest arc between the two orientations.
+func (c Camera) Interpolate(to Camera, t float64) Camera {
+	// The camera's left, forward, and up vectors are right-handed (left cross forward is up), so they can be turned into a rotation.
+	from, dest := geom.QuaternionFromAxes(c.left, c.forward, c.up), geom.QuaternionFromAxes(to.left, to.forward, to.up)
+	q := geom.Slerp(from, dest, t)
+	
+	return Camera{
+		Pos: c.Pos.Add(to.Pos.Sub(c.Pos).Scale(t)),
+		forward: q.Rotate(geom.Vector{0, 1, 0}).Norm(),
+		left: q.Rotate(geom.Vector{1, 0, 0}).Norm(),
+		up: q.Rotate(geom.Vector{0, 0, 1}).Norm(),
+		Fov: c.Fov + (to.Fov - c.Fov) * t,
+		Near: c.Near + (to.Near - c.Near) * t,
+		Far: c.Far + (to.Far - c.Far) * t,
+		worldUp: c.worldUp,
 	}
 }
 
@@ -131,15 +267,16 @@ func (c *Camera) Yaw(theta float64) {
 	if math.Mod(theta, 2.0 * math.Pi) != 0.0 {
 		c.forward = c.forward.Rotate(c.up, theta).Norm()
 		
-		// Ensure that the forward vector is not parallel to the global up.
-		if c.forward.Cross(GlobalUp).Zero() {
+		// Ensure that the forward vector is not parallel to the environment's up vector.
+		worldUp := c.WorldUp()
+		if c.forward.Cross(worldUp).Zero() {
 			c.nudgeForward(0.0001)
 		}
 		
-		// Now that we're sure forward and the global up are not parallel, compute left.
-		c.left = c.forward.Cross(GlobalUp).Norm()
+		// Now that we're sure forward and the environment's up vector are not parallel, compute left.
+		c.left = c.forward.Cross(worldUp).Norm()
 		
-		// We'll also recompute up with respect to left (hence with indirect respect to the global up vector).
+		// We'll also recompute up with respect to left (hence with indirect respect to the environment's up vector).
 		// This keeps error from building up in forward on the next yaw.
 		c.up = c.left.Cross(c.forward).Norm()
 	}
@@ -154,21 +291,37 @@ func (c *Camera) Pitch(theta float64) {
 }
 
 // MarshalBinary converts a camera into a binary representation.
+// The camera's whole basis is encoded (rather than just its forward vector), so that it is decoded exactly as it was, even if it is rolled or looking straight up.
 func (c Camera) MarshalBinary() ([]byte, error) {
 	// Set up the binary encoder.
 	writer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&writer)
 	
-	// Encode the camera's position, forward vector, and fov.
+	// Encode the camera's position, basis, environment's up vector, fov, and clipping distances.
 	if err := encoder.Encode(c.Pos); err != nil {
 		return nil, err
 	}
 	if err := encoder.Encode(c.forward); err != nil {
 		return nil, err
 	}
+	if err := encoder.Encode(c.left); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(c.up); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(c.WorldUp()); err != nil {
+		return nil, err
+	}
 	if err := encoder.Encode(c.Fov); err != nil {
 		return nil, err
 	}
+	if err := encoder.Encode(c.Near); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(c.Far); err != nil {
+		return nil, err
+	}
 	
 	return writer.Bytes(), nil
 }
@@ -179,25 +332,38 @@ func (c *Camera) UnmarshalBinary(data []byte) error {
 	reader := bytes.NewBuffer(data)
 	decoder := gob.NewDecoder(reader)
 	
-	// Decode the camera's position, forward vector, and fov.
-	var pos, forward geom.Vector
-	var fov float64
-	if err := decoder.Decode(&pos); err != nil {
+	// Decode the camera's position, basis, environment's up vector, fov, and clipping distances.
+	var decoded Camera
+	if err := decoder.Decode(&decoded.Pos); err != nil {
 		return err
 	}
-	if err := decoder.Decode(&forward); err != nil {
+	if err := decoder.Decode(&decoded.forward); err != nil {
 		return err
 	}
-	if err := decoder.Decode(&fov); err != nil {
+	if err := decoder.Decode(&decoded.left); err != nil {
 		return err
 	}
-	
-	// Reconstruct the camera.
-	if rebuilt, err := NewCamera(pos, forward, fov); err == nil {
-		*c = rebuilt
-	}else{
+	if err := decoder.Decode(&decoded.up); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&decoded.worldUp); err != nil {
 		return err
 	}
+	if err := decoder.Decode(&decoded.Fov); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&decoded.Near); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&decoded.Far); err != nil {
+		return err
+	}
+	
+	// Make sure the basis can be traced through.
+	if decoded.forward.Zero() || decoded.left.Zero() || decoded.up.Zero() || decoded.worldUp.Zero() {
+		return fmt.Errorf("Camera basis (forward %v, left %v, up %v, world up %v) is degenerate.", decoded.forward, decoded.left, decoded.up, decoded.worldUp)
+	}
 	
+	*c = decoded
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,102 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/rtreego"
+	"sort"
+	"math"
+)
+
+// Emitter is a triangle of an object with an emissive material, which lights the environment as an area light.
+// Emitters shine from both of their sides.
+type Emitter struct {
+	Tri geom.Triangle		// The triangle, in world space.
+	Normal geom.Vector		// The (geometric) normal vector of the triangle.
+	Area float64			// The area of the triangle.
+	Emission colour.RGB		// The colour of the light given off by the triangle.
+}
+
+// emitterSet holds every emitter in an environment, so that they can be picked in proportion to their power.
+type emitterSet struct {
+	list []Emitter
+	cdf []float64	// The total power of each emitter and the emitters before it.
+	power float64	// The total power of every emitter.
+}
+
+// Point returns the point on an emitter at (u, v), where u and v are in the range [0, 1).
+// Points are spread uniformly over the emitter's surface.
+func (e Emitter) Point(u, v float64) geom.Vector {
+	su := math.Sqrt(u)
+	return e.Tri.P1.Scale(1.0 - su).Add(e.Tri.P2.Scale(su * (1.0 - v))).Add(e.Tri.P3.Scale(su * v))
+}
+
+// emitterPower returns the power of an emitter, as used to pick emitters.
+func emitterPower(e Emitter) float64 {
+	r, g, b := e.Emission.Floats()
+	return luminance(r, g, b) * e.Area
+}
+
+// findEmitters finds every emitter in an environment.
+// Because emitters are found in world space, they must be found again whenever an object moves.
+func (em *EnvMutables) findEmitters() {
+	em.emitters = emitterSet{}
+	
+	for _, s := range em.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return true}) {
+		o := s.(*Object)
+		if o.mesh == nil || !o.mesh.emissive {
+			continue
+		}
+		if err := o.mesh.acquire(); err != nil {
+			continue
+		}
+		
+		// Add each face with an emissive material, moved to the object's position.
+		for _, f := range o.mesh.faces {
+			mat := o.mesh.materials[f.mat]
+			if mat.Ke == (colour.RGB{}) {
+				continue
+			}
+			
+			tri := geom.Triangle{P1: o.mesh.vertices[f.verts[0]].Add(o.Pos), P2: o.mesh.vertices[f.verts[1]].Add(o.Pos), P3: o.mesh.vertices[f.verts[2]].Add(o.Pos)}
+			e := Emitter{Tri: tri, Normal: tri.Normal(), Area: tri.P2.Sub(tri.P1).Cross(tri.P3.Sub(tri.P1)).Len() / 2.0, Emission: mat.Ke}
+			if power := emitterPower(e); power > 0.0 {
+				em.emitters.power += power
+				em.emitters.list = append(em.emitters.list, e)
+				em.emitters.cdf = append(em.emitters.cdf, em.emitters.power)
+			}
+		}
+		o.mesh.release()
+	}
+}
+
+// Emitters returns every emitter in an environment.
+func (em *EnvMutables) Emitters() []Emitter {
+	return em.emitters.list
+}
+
+// SampleEmitter picks one of an environment's emitters in proportion to its power.
+// The parameter u must be a random number in the range [0, 1).
+// This function returns the emitter and the probability with which it was picked, or false if there are no emitters.
+func (em *EnvMutables) SampleEmitter(u float64) (Emitter, float64, bool) {
+	if len(em.emitters.list) == 0 {
+		return Emitter{}, 0.0, false
+	}
+	
+	i := sort.SearchFloat64s(em.emitters.cdf, u * em.emitters.power)
+	if i >= len(em.emitters.list) {
+		i = len(em.emitters.list) - 1
+	}
+	e := em.emitters.list[i]
+	return e, emitterPower(e) / em.emitters.power, true
+}
+
+// EmitterDensity returns the probability density (per unit of area) with which a point on an emitter with some emission is picked, by picking an emitter with SampleEmitter and then a point on it.
+func (em *EnvMutables) EmitterDensity(emission colour.RGB) float64 {
+	if em.emitters.power <= 0.0 {
+		return 0.0
+	}
+	r, g, b := emission.Floats()
+	return luminance(r, g, b) / em.emitters.power
+}
\ No newline at end of file
@@ -7,8 +7,13 @@ import (
 	"github.com/mwindels/rtreego"
 	"encoding/json"
 	"encoding/gob"
+	"encoding/hex"
+	"crypto/sha256"
 	"io/ioutil"
 	"bytes"
+	"sort"
+	"math"
+	"fmt"
 )
 
 func init() {
@@ -17,14 +22,19 @@ func init() {
 	gob.Register(Environment{})
 }
 
-// This variable represents the global up vector.
+// DefaultAmbient is the global ambient light of environments which don't set their own, which leaves materials' ambient colours as they are.
+var DefaultAmbient colour.RGB = colour.NewRGB(0xFF, 0xFF, 0xFF)
+
+// This variable represents the global up vector, which environments that don't set their own up vector use.
 // Because Go doesn't support constant structures, this has to be a variable.
 var GlobalUp geom.Vector = geom.Vector{0, 1, 0}
 
 // envImmutables represents the immutable parts of an environment.
 type envImmutables struct {
-	meshes map[string]*Mesh	// This maps paths to meshes.
-	paths map[uint]string	// This maps object ids to paths.
+	meshes map[string]*Mesh	// This maps mesh keys (paths, along with any mesh options) to meshes.
+	paths map[uint]string	// This maps object ids to mesh keys.
+	bookmarks Bookmarks		// This holds the environment's bookmarks (which aren't encoded, since only whoever loaded the environment needs them).
+	limits Limits			// This bounds how much work is done to trace the environment (which isn't encoded either, since workers are sent the limits with each work order).
 }
 
 // MarshalBinary converts an envImmutables into a binary representation.
@@ -66,6 +76,72 @@ type EnvMutables struct {
 	Objs *rtreego.Rtree	// This holds all the objects in the environment.
 	Lights []Light		// This holds all the lights in the environment.
 	Cam Camera			// This represents environment's camera.
+	Ambient colour.RGB	// This is the global ambient light, which each material's ambient colour is multiplied by.
+	Background Background	// This is what rays which hit nothing see.
+	MaxRayLength float64	// This is the farthest shading and shadow rays look for objects (with no limit if zero).
+	
+	unitLength float64		// This is the length (in metres) of one of the environment's units (one if zero).
+	sun *Sun				// This moves one of the environment's lights with the time of day (nil if the environment has no sun, or was decoded).
+	lightLinks map[uint]LightLink	// This holds the light link of each object which has one, by the object's id (nil if none do).
+	lightTree *LightTree	// This groups the environment's lights (nil until the environment is loaded or decoded).
+	emitters emitterSet		// This holds the environment's emissive triangles (empty until the environment is loaded or linked).
+	objects []*Object		// This holds the same objects as Objs, indexed by objectBVH.
+	objectBVH geom.BVH		// This is the bounding volume hierarchy over the environment's objects, which rays are traced through (empty until the environment is loaded or linked).
+}
+
+// indexObjects builds a bounding volume hierarchy over the objects in an environment, so that rays can be traced through them without allocating.
+// Like the R-Tree, it must be rebuilt whenever an object moves.
+func (em *EnvMutables) indexObjects() {
+	objs := em.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return true})
+	
+	em.objects = make([]*Object, len(objs), len(objs))
+	boxes := make([]geom.Box, len(objs), len(objs))
+	for i, s := range objs {
+		em.objects[i] = s.(*Object)
+		boxes[i] = em.objects[i].box()
+	}
+	em.objectBVH = geom.NewBVH(boxes)
+}
+
+// TraceObjects passes each object whose bounding box a ray hits, before travelling far from its origin, to visit.
+// Nearer objects tend to be visited first, but not always.
+// Visit returns how far away the rest of the objects need to be looked for, and whether to stop.
+// The return value is whether visit stopped the search.
+func (em *EnvMutables) TraceObjects(rOrigin, rDir geom.Vector, far float64, visit func(*Object) (float64, bool)) bool {
+	dirLen := rDir.Len()
+	return em.objectBVH.Traverse(rOrigin, rDir, far / dirLen, func(k int) (float64, bool) {
+		var stop bool
+		far, stop = visit(em.objects[k])
+		return far / dirLen, stop
+	})
+}
+
+// Clearance returns how far a ray with a position and a (normalized) direction travels before hitting any object, up to far.
+func (em *EnvMutables) Clearance(rOrigin, rDir geom.Vector, far float64) float64 {
+	em.TraceObjects(rOrigin, rDir, far, func(o *Object) (float64, bool) {
+		// Objects beyond the nearest intersection so far needn't be searched.
+		if intersect, _, _, hit := o.IntersectionWithin(rOrigin, rDir, 0.0, far); hit {
+			far = intersect.Sub(rOrigin).Len()
+		}
+		return far, false
+	})
+	return far
+}
+
+// Extent returns the length of the diagonal of the box bounding every object in an environment (zero, if it has no objects).
+func (em *EnvMutables) Extent() float64 {
+	objs := em.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return true})
+	if len(objs) == 0 {
+		return 0.0
+	}
+	
+	min, max := objs[0].(*Object).box().MinCorner, objs[0].(*Object).box().MaxCorner
+	for _, s := range objs[1:] {
+		b := s.(*Object).box()
+		min = geom.Vector{math.Min(min.X, b.MinCorner.X), math.Min(min.Y, b.MinCorner.Y), math.Min(min.Z, b.MinCorner.Z)}
+		max = geom.Vector{math.Max(max.X, b.MaxCorner.X), math.Max(max.Y, b.MaxCorner.Y), math.Max(max.Z, b.MaxCorner.Z)}
+	}
+	return max.Sub(min).Len()
 }
 
 // LinkTo creates a new environment by associating the mutable parts of an environment with the immutable parts of another environment.
@@ -88,8 +164,10 @@ func (em *EnvMutables) LinkTo(e Environment) Environment {
 		}
 	}
 	
-	// Because the mesh informs the object's bounds, we need to rebuild the tree.
+	// Because the mesh informs the object's bounds, we need to rebuild the tree (and the bounding volume hierarchy).
 	em.Objs = rtreego.NewTree(3, 2, 5, objs...)
+	em.indexObjects()
+	em.findEmitters()
 	
 	return Environment{
 		immutable: e.immutable,
@@ -97,13 +175,80 @@ func (em *EnvMutables) LinkTo(e Environment) Environment {
 	}
 }
 
+// MoveObject moves the object with some id to a new position.
+// The return values are the object's bounding boxes before and after the move, and whether the object exists.
+func (em *EnvMutables) MoveObject(id uint, pos geom.Vector) (*rtreego.Rect, *rtreego.Rect, bool) {
+	objs := em.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return true})
+	
+	for _, s := range objs {
+		o := s.(*Object)
+		
+		if o.id == id {
+			before := o.Bounds()
+			o.Pos = pos
+			
+			// Because the object's position informs its bounds, we need to rebuild the tree (and the bounding volume hierarchy).
+			em.Objs = rtreego.NewTree(3, 2, 5, objs...)
+			em.indexObjects()
+			em.findEmitters()
+			
+			return before, o.Bounds(), true
+		}
+	}
+	
+	return nil, nil, false
+}
+
+// MoveLight moves the light with some index to a new position.
+// The return value is false if no light has that index.
+func (em *EnvMutables) MoveLight(index int, pos geom.Vector) bool {
+	if index < 0 || index >= len(em.Lights) {
+		return false
+	}
+	
+	// Because the lights' positions inform the light tree, we need to rebuild it.
+	em.Lights[index].Pos = pos
+	em.lightTree = NewLightTree(em.Lights)
+	return true
+}
+
+// SwitchLight switches the light with some index on or off.
+// The return value is false if no light has that index.
+func (em *EnvMutables) SwitchLight(index int, on bool) bool {
+	if index < 0 || index >= len(em.Lights) {
+		return false
+	}
+	
+	// Because only lights which are on are put in the light tree, we need to rebuild it.
+	em.Lights[index].Off = !on
+	em.lightTree = NewLightTree(em.Lights)
+	return true
+}
+
+// LightsOn returns the number of the environment's lights which are switched on.
+func (em *EnvMutables) LightsOn() int {
+	count := 0
+	for _, l := range em.Lights {
+		if !l.Off {
+			count += 1
+		}
+	}
+	return count
+}
+
+// LightTree returns a light tree over the environment's lights, or nil if none has been built.
+// The tree is only built when the environment is loaded or decoded, so that it can be shared by several goroutines afterwards.
+func (em *EnvMutables) LightTree() *LightTree {
+	return em.lightTree
+}
+
 // MarshalBinary converts an EnvMutables into a binary representation.
 func (em EnvMutables) MarshalBinary() ([]byte, error) {
 	// Set up the binary encoder.
 	writer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&writer)
 	
-	// Encode the EnvMutables' objects, lights, and camera.
+	// Encode the EnvMutables' objects, lights, camera, ambient light, background, ray length, units, and light links.
 	if err := encoder.Encode(em.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return true})); err != nil {
 		return nil, err
 	}
@@ -113,6 +258,21 @@ func (em EnvMutables) MarshalBinary() ([]byte, error) {
 	if err := encoder.Encode(em.Cam); err != nil {
 		return nil, err
 	}
+	if err := encoder.Encode(em.Ambient); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(em.Background); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(em.MaxRayLength); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(em.unitLength); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(em.lightLinks); err != nil {
+		return nil, err
+	}
 	
 	return writer.Bytes(), nil
 }
@@ -123,7 +283,7 @@ func (em *EnvMutables) UnmarshalBinary(data []byte) error {
 	reader := bytes.NewBuffer(data)
 	decoder := gob.NewDecoder(reader)
 	
-	// Decode the EnvMutables' objects, lights, and camera.
+	// Decode the EnvMutables' objects, lights, camera, ambient light, background, ray length, units, and light links.
 	var objects []rtreego.Spatial
 	if err := decoder.Decode(&objects); err != nil {
 		return err
@@ -134,6 +294,23 @@ func (em *EnvMutables) UnmarshalBinary(data []byte) error {
 	if err := decoder.Decode(&em.Cam); err != nil {
 		return err
 	}
+	if err := decoder.Decode(&em.Ambient); err != nil {
+		return err
+	}
+	em.Background = Background{}	// Gob leaves out zero fields, so they mustn't be left over from before.
+	if err := decoder.Decode(&em.Background); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&em.MaxRayLength); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&em.unitLength); err != nil {
+		return err
+	}
+	em.lightLinks = nil	// Gob adds to maps rather than replacing them, so the links mustn't be left over from before.
+	if err := decoder.Decode(&em.lightLinks); err != nil {
+		return err
+	}
 	
 	// Rebuild an R-Tree for the objects.
 	em.Objs = rtreego.NewTree(3, 2, 5)
@@ -141,6 +318,10 @@ func (em *EnvMutables) UnmarshalBinary(data []byte) error {
 		o := s.(Object)
 		em.Objs.Insert(&o)
 	}
+	em.indexObjects()
+	
+	// Group the lights.
+	em.lightTree = NewLightTree(em.Lights)
 	
 	return nil
 }
@@ -156,6 +337,30 @@ type StoredEnvironment struct {
 	Objs []StoredObject		`json:"objs"`
 	Lights []StoredLight	`json:"lights"`
 	Cam StoredCamera		`json:"cam"`
+	Ambient *colour.StoredRGB	`json:"ambient,omitempty"`	// The global ambient light (white if missing, leaving materials' ambient colours as they are).
+	Background StoredBackground	`json:"background"`		// What rays which hit nothing see (black if missing).
+	MaxRayLength float64	`json:"maxRayLength,omitempty"`	// The farthest shading and shadow rays look for objects (with no limit if zero).
+	Sun *StoredSun			`json:"sun,omitempty"`		// A light which moves with the time of day, added after the other lights (no sun if missing).
+	Limits Limits			`json:"limits"`	// How much work is done to trace each pixel (which can be overridden on the command line).
+	Units string			`json:"units,omitempty"`	// The unit of length positions are written in (DefaultUnits if empty).
+	Up *geom.Vector			`json:"up,omitempty"`		// The direction which is up, such as the z axis for scenes exported from CAD programs (GlobalUp if missing).
+	Bookmarks []StoredBookmark	`json:"bookmarks,omitempty"`
+}
+
+// NewEnvironment creates an environment with no objects or lights, seen through a camera.
+func NewEnvironment(cam Camera) Environment {
+	return Environment{
+		immutable: &envImmutables{
+			meshes: make(map[string]*Mesh),
+			paths: make(map[uint]string),
+		},
+		mutable: &EnvMutables{
+			Objs: rtreego.NewTree(3, 2, 5),
+			Lights: nil,
+			Cam: cam,
+			Ambient: DefaultAmbient,
+		},
+	}
 }
 
 // EnvironmentFromFile loads an environment from a JSON file.
@@ -173,6 +378,21 @@ func EnvironmentFromFile(path string) (Environment, error) {
 		return Environment{}, err
 	}
 	
+	// Find the unit of length the environment is written in.
+	sceneLength, err := unitLength(inputEnv.Units)
+	if err != nil {
+		return Environment{}, err
+	}
+	
+	// Find the direction which is up, which the camera, sun, and background are all measured from.
+	up := GlobalUp
+	if inputEnv.Up != nil {
+		if inputEnv.Up.Zero() {
+			return Environment{}, fmt.Errorf("The up vector is zero.")
+		}
+		up = inputEnv.Up.Norm()
+	}
+	
 	// Get the new environment ready.
 	env := Environment{
 		immutable: &envImmutables{
@@ -183,30 +403,44 @@ func EnvironmentFromFile(path string) (Environment, error) {
 			Objs: rtreego.NewTree(3, 2, 5),
 			Lights: make([]Light, len(inputEnv.Lights), len(inputEnv.Lights)),
 			Cam: Camera{},
+			Ambient: DefaultAmbient,
+			unitLength: sceneLength,
 		},
 	}
 	
 	// Add objects to the environment.
 	for i, inObj := range inputEnv.Objs {
-		objMesh, exists := env.immutable.meshes[inObj.Model]
+		// Models written in other units are scaled into the environment's units as they're loaded.
+		meshOpts := MeshOptions{CreaseAngle: inObj.Crease, WeldEpsilon: inObj.Weld}
+		modelLength := sceneLength
+		if inObj.Units != "" {
+			if modelLength, err = unitLength(inObj.Units); err != nil {
+				return Environment{}, err
+			}
+		}
+		if modelLength != sceneLength {
+			meshOpts.Scale = modelLength / sceneLength
+		}
+		meshKey := meshOpts.key(inObj.Model)
+		objMesh, exists := env.immutable.meshes[meshKey]
 		
 		if !exists {
 			// If the new object's mesh has not already been loaded, load it.
-			objMesh, err = MeshFromFile(relativePath(path, inObj.Model))
+			objMesh, err = MeshFromFile(relativePath(path, inObj.Model), meshOpts)
 			if err != nil {
 				// If we didn't find the mesh at the relative path, try the absolute path.
-				objMesh, err = MeshFromFile(inObj.Model)
+				objMesh, err = MeshFromFile(inObj.Model, meshOpts)
 				if err != nil {
 					return Environment{}, err
 				}
 			}
 			
 			// Add the mesh to the mesh map.
-			env.immutable.meshes[inObj.Model] = objMesh
+			env.immutable.meshes[meshKey] = objMesh
 		}
 		
-		// Map the new object's id to the object's model path.
-		env.immutable.paths[uint(i + 1)] = inObj.Model
+		// Map the new object's id to the object's mesh key.
+		env.immutable.paths[uint(i + 1)] = meshKey
 		
 		// Add the new object to the objects tree.
 		env.mutable.Objs.Insert(&Object{
@@ -218,14 +452,63 @@ func EnvironmentFromFile(path string) (Environment, error) {
 	
 	// Add lights to the environment.
 	for i, inLight := range inputEnv.Lights {
+		if inLight.Intensity < 0.0 {
+			return Environment{}, fmt.Errorf("Light %d has a negative intensity %g.", i + 1, inLight.Intensity)
+		}
+		if inLight.Radius < 0.0 {
+			return Environment{}, fmt.Errorf("Light %d has a negative radius %g.", i + 1, inLight.Radius)
+		}
 		env.mutable.Lights[i] = Light{
 			Pos: inLight.Pos,
 			Col: colour.NewRGB(inLight.Col.R, inLight.Col.G, inLight.Col.B),
+			Intensity: inLight.Intensity,
+			Radius: inLight.Radius,
+			Off: inLight.Off,
 		}
 	}
 	
+	// Add the sun (if there is one) after the other lights, where it is at its starting time.
+	if inputEnv.Sun != nil {
+		sun := newSun(*inputEnv.Sun, len(env.mutable.Lights), up)
+		env.mutable.Lights = append(env.mutable.Lights, sun.Light(sun.Time))
+		env.mutable.sun = &sun
+	}
+	env.mutable.lightTree = NewLightTree(env.mutable.Lights)
+	
+	// Link objects to the lights which shine on them (if necessary), now that every light is in place.
+	for i, inObj := range inputEnv.Objs {
+		if inObj.Lights == nil {
+			continue
+		}
+		if err := inObj.Lights.validate(len(env.mutable.Lights)); err != nil {
+			return Environment{}, fmt.Errorf("Object %d has an invalid light link: %v.", i + 1, err)
+		}
+		if env.mutable.lightLinks == nil {
+			env.mutable.lightLinks = make(map[uint]LightLink)
+		}
+		env.mutable.lightLinks[uint(i + 1)] = *inObj.Lights
+	}
+	
+	env.mutable.indexObjects()
+	env.mutable.findEmitters()
+	if inputEnv.Ambient != nil {
+		env.mutable.Ambient = colour.NewRGB(inputEnv.Ambient.R, inputEnv.Ambient.G, inputEnv.Ambient.B)
+	}
+	env.mutable.Background = newBackground(inputEnv.Background, up)
+	if inputEnv.MaxRayLength < 0.0 {
+		return Environment{}, fmt.Errorf("The maximum ray length %g is negative.", inputEnv.MaxRayLength)
+	}
+	env.mutable.MaxRayLength = inputEnv.MaxRayLength
+	
 	// Add the camera to the environment.
-	env.mutable.Cam, err = NewCamera(inputEnv.Cam.Pos, inputEnv.Cam.Dir, inputEnv.Cam.Fov)
+	env.mutable.Cam, err = inputEnv.Cam.CameraWithUp(up)
+	if err != nil {
+		return Environment{}, err
+	}
+	
+	// Add the limits and bookmarked cameras to the environment.
+	env.immutable.limits = inputEnv.Limits
+	env.immutable.bookmarks, err = newBookmarks(inputEnv.Bookmarks, up)
 	if err != nil {
 		return Environment{}, err
 	}
@@ -267,7 +550,93 @@ func (e *Environment) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// UseCache makes a mesh cache hold an environment's meshes, so that they're kept within the cache's memory budget.
+// Meshes are evicted straight away if they don't fit.
+func (e Environment) UseCache(c *MeshCache) {
+	for key, mesh := range e.immutable.meshes {
+		c.hold(key, mesh)
+	}
+}
+
+// EncodeMesh encodes the mesh with some key (as used by a mesh cache), so that it can be sent to a worker which evicted it.
+func (e Environment) EncodeMesh(key string) ([]byte, error) {
+	mesh, exists := e.immutable.meshes[key]
+	if !exists {
+		return nil, fmt.Errorf("No mesh with key \"%s\".", key)
+	}
+	
+	if err := mesh.acquire(); err != nil {
+		return nil, err
+	}
+	defer mesh.release()
+	
+	writer := bytes.Buffer{}
+	if err := gob.NewEncoder(&writer).Encode(*mesh); err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
+}
+
+// Hash returns a hash (as a hexadecimal string) of the immutable parts of an environment.
+// Unlike the environment's binary representation, the hash doesn't depend on the order of any maps, so the same scene always has the same hash.
+func (e Environment) Hash() (string, error) {
+	hash := sha256.New()
+	
+	// Hash each mesh in order of its key.
+	keys := make([]string, 0, len(e.immutable.meshes))
+	for key := range e.immutable.meshes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data, err := e.EncodeMesh(key)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%q %d\n", key, len(data))
+		hash.Write(data)
+	}
+	
+	// Hash each object's mesh key in order of the object's id.
+	ids := make([]uint, 0, len(e.immutable.paths))
+	for id := range e.immutable.paths {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {return ids[i] < ids[j]})
+	for _, id := range ids {
+		fmt.Fprintf(hash, "%d %q\n", id, e.immutable.paths[id])
+	}
+	
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // Mutable returns a pointer to the mutable elements of an environment.
 func (e Environment) Mutable() *EnvMutables {
 	return e.mutable
+}
+
+// Copy creates an environment which shares the immutable elements of an environment, but has its own copy of the mutable elements, so that either can be changed without affecting the other.
+func (e Environment) Copy() (Environment, error) {
+	data, err := e.mutable.MarshalBinary()
+	if err != nil {
+		return Environment{}, err
+	}
+	mutable := &EnvMutables{}
+	if err := mutable.UnmarshalBinary(data); err != nil {
+		return Environment{}, err
+	}
+	
+	// The sun itself never changes (only the light it moves does), so it can be shared.
+	mutable.sun = e.mutable.sun
+	return mutable.LinkTo(e), nil
+}
+
+// Bookmarks returns a copy of an environment's bookmarks, which can be changed without affecting the environment.
+func (e Environment) Bookmarks() Bookmarks {
+	return append(Bookmarks(nil), e.immutable.bookmarks...)
+}
+
+// Limits returns the limits on how much work is done to trace an environment, as given in its file.
+func (e Environment) Limits() Limits {
+	return e.immutable.limits
 }
\ No newline at end of file
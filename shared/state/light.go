@@ -4,16 +4,82 @@ package state
 import (
 	"github.com/mwindels/distributed-raytracer/shared/geom"
 	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"fmt"
 )
 
-// Light represents a point of light in 3-dimensional space.
+// Light represents a point (or small sphere) of light in 3-dimensional space.
 type Light struct {
 	Pos geom.Vector
 	Col colour.RGB
+	Intensity float64	// How many times brighter than its colour the light is (once, if zero), so that lights needn't be limited to white.
+	Radius float64		// The radius of the sphere the light shines from (a point, if zero), which softens its shadows and widens its highlights.
+	Off bool			// Whether the light has been switched off (it keeps its place among the lights, so that it can be switched back on).
 }
 
 // StoredLight is used to (un)marshal light data to/from the JSON format.
 type StoredLight struct {
 	Pos geom.Vector			`json:"pos"`
 	Col colour.StoredRGB	`json:"col"`
+	Intensity float64		`json:"intensity,omitempty"`	// One if zero.
+	Radius float64			`json:"radius,omitempty"`		// In the environment's units.
+	Off bool				`json:"off,omitempty"`
+}
+
+// Power returns the (unclamped) colour a light shines with, which is its colour scaled by its intensity.
+func (l Light) Power() (float64, float64, float64) {
+	r, g, b := l.Col.Floats()
+	if l.Intensity > 0.0 {
+		r, g, b = r * l.Intensity, g * l.Intensity, b * l.Intensity
+	}
+	return r, g, b
+}
+
+// LightLink restricts which of an environment's lights shine on an object, by the lights' indices (where the sun, if any, comes after the other lights).
+type LightLink struct {
+	Include []int	`json:"include,omitempty"`	// The only lights which shine on the object (every light, if empty).
+	Exclude []int	`json:"exclude,omitempty"`	// Lights which never shine on the object.
+}
+
+// shines returns whether the light with some index shines on an object with a light link.
+func (ll LightLink) shines(index int) bool {
+	for _, i := range ll.Exclude {
+		if i == index {
+			return false
+		}
+	}
+	if len(ll.Include) == 0 {
+		return true
+	}
+	for _, i := range ll.Include {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// validate makes sure a light link only refers to lights among some number of lights.
+func (ll LightLink) validate(lights int) error {
+	for _, list := range [][]int{ll.Include, ll.Exclude} {
+		for _, i := range list {
+			if i < 0 || i >= lights {
+				return fmt.Errorf("No light with index %d.", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Linked returns whether the object with some id has a light link, so that only some of the environment's lights shine on it.
+func (em *EnvMutables) Linked(id uint) bool {
+	_, linked := em.lightLinks[id]
+	return linked
+}
+
+// Shines returns whether the light with some index shines on the object with some id (which every light does, unless the object has a light link).
+func (em *EnvMutables) Shines(index int, id uint) bool {
+	if link, linked := em.lightLinks[id]; linked {
+		return link.shines(index)
+	}
+	return true
 }
\ No newline at end of file
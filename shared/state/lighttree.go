@@ -0,0 +1,193 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"sort"
+	"math"
+)
+
+// LightTree is a bounding volume hierarchy over a scene's lights.
+// It lets a point treat distant groups of lights as one, and pick a light without looking at every light in the scene.
+type LightTree struct {
+	root *lightNode	// Nil if there are no lights.
+	all []ClusterLight	// Every light on its own, built along with the tree so that it needn't be built while tracing.
+}
+
+// lightNode is a node of a light tree, bounding one or more lights.
+type lightNode struct {
+	centre geom.Vector		// The centre of a sphere bounding every light under this node.
+	radius float64			// The radius of the bounding sphere.
+	pos geom.Vector			// The brightness-weighted centre of the lights under this node.
+	r, g, b float64			// The total (unclamped) colour of the lights under this node.
+	count int				// The number of lights under this node.
+	light int				// The index of this node's light (leaves only).
+	size float64			// The radius of this node's light (leaves only).
+	left, right *lightNode	// This node's children (nil for leaves).
+}
+
+// ClusterLight represents a single light, or a group of lights treated as a single light.
+type ClusterLight struct {
+	Pos geom.Vector
+	R, G, B float64	// The total (unclamped) colour of the lights.
+	Count int		// The number of lights.
+	Radius float64	// The radius of the sphere the light shines from (zero for points, and for groups of lights).
+}
+
+// luminance returns the perceived brightness of a colour.
+func luminance(r, g, b float64) float64 {
+	return 0.2126 * r + 0.7152 * g + 0.0722 * b
+}
+
+// NewLightTree builds a light tree over the lights which are switched on.
+func NewLightTree(lights []Light) *LightTree {
+	var indices []int
+	var all []ClusterLight
+	for i, l := range lights {
+		if l.Off {
+			continue
+		}
+		
+		r, g, b := l.Power()
+		indices = append(indices, i)
+		all = append(all, ClusterLight{Pos: l.Pos, R: r, G: g, B: b, Count: 1, Radius: l.Radius})
+	}
+	
+	if len(indices) == 0 {
+		return &LightTree{all: all}
+	}
+	return &LightTree{root: buildLightNode(lights, indices), all: all}
+}
+
+// All returns every light in a light tree on its own, in the order they were given to NewLightTree (leaving out lights which are off).
+// The returned slice is shared, so it must not be modified.
+func (t *LightTree) All() []ClusterLight {
+	return t.all
+}
+
+// buildLightNode builds the light tree node bounding some of the given lights, by splitting them in half along their longest axis.
+func buildLightNode(lights []Light, indices []int) *lightNode {
+	// Find the lights' bounding box, total colour, and brightness-weighted centre.
+	node := &lightNode{count: len(indices), light: indices[0]}
+	min := geom.Vector{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := geom.Vector{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	weightedPos, totalWeight := geom.Vector{}, 0.0
+	for _, i := range indices {
+		p := lights[i].Pos
+		min = geom.Vector{math.Min(min.X, p.X), math.Min(min.Y, p.Y), math.Min(min.Z, p.Z)}
+		max = geom.Vector{math.Max(max.X, p.X), math.Max(max.Y, p.Y), math.Max(max.Z, p.Z)}
+		
+		r, g, b := lights[i].Power()
+		node.r, node.g, node.b = node.r + r, node.g + g, node.b + b
+		weight := luminance(r, g, b)
+		weightedPos = weightedPos.Add(p.Scale(weight))
+		totalWeight += weight
+	}
+	node.centre = min.Add(max).Scale(0.5)
+	node.radius = max.Sub(min).Len() / 2.0
+	if totalWeight > 0.0 {
+		node.pos = weightedPos.Scale(1.0 / totalWeight)
+	}else{
+		node.pos = node.centre
+	}
+	if len(indices) == 1 {
+		node.size = lights[node.light].Radius
+		return node
+	}
+	
+	// Split the lights at the median of their longest axis.
+	extent := max.Sub(min)
+	axis := func(v geom.Vector) float64 {return v.X}
+	if extent.Y >= extent.X && extent.Y >= extent.Z {
+		axis = func(v geom.Vector) float64 {return v.Y}
+	}else if extent.Z >= extent.X && extent.Z >= extent.Y {
+		axis = func(v geom.Vector) float64 {return v.Z}
+	}
+	sort.Slice(indices, func(a, b int) bool {return axis(lights[indices[a]].Pos) < axis(lights[indices[b]].Pos)})
+	
+	half := len(indices) / 2
+	node.left = buildLightNode(lights, indices[:half])
+	node.right = buildLightNode(lights, indices[half:])
+	return node
+}
+
+// behind returns whether every light under a node is behind the plane through p with normal n.
+func (node *lightNode) behind(p, n geom.Vector) bool {
+	return node.centre.Sub(p).Dot(n) < -node.radius
+}
+
+// cluster returns the lights under a node as a single light.
+func (node *lightNode) cluster() ClusterLight {
+	return ClusterLight{Pos: node.pos, R: node.r, G: node.g, B: node.b, Count: node.count, Radius: node.size}
+}
+
+// Cut finds the lights which can shine on the point p (on a surface with normal n), grouping together any lights which look smaller than maxAngle radians from p.
+// Lights behind the surface are left out.
+func (t *LightTree) Cut(p, n geom.Vector, maxAngle float64) []ClusterLight {
+	var cut []ClusterLight
+	if t.root == nil {
+		return cut
+	}
+	
+	// Walk down the tree, stopping at leaves and at groups which are small enough to treat as one light.
+	stack := []*lightNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack) - 1]
+		stack = stack[:len(stack) - 1]
+		if node.behind(p, n) {
+			continue
+		}
+		
+		if node.left == nil {
+			cut = append(cut, node.cluster())
+		}else if distance := node.centre.Sub(p).Len(); distance > node.radius && node.radius / distance < maxAngle {
+			cut = append(cut, node.cluster())
+		}else{
+			stack = append(stack, node.left, node.right)
+		}
+	}
+	
+	return cut
+}
+
+// importance returns how much light a node's lights could shine on the point p (on a surface with normal n), relative to other nodes.
+func (node *lightNode) importance(p, n geom.Vector) float64 {
+	if node.behind(p, n) {
+		return 0.0
+	}
+	
+	// A single light is weighted by the angle it shines on the surface at, but a group of lights could shine from any angle.
+	facing := 1.0
+	if node.left == nil {
+		facing = math.Max(node.pos.Sub(p).Norm().Dot(n), 0.0)
+	}
+	return luminance(node.r, node.g, node.b) * facing
+}
+
+// Sample picks a light which can shine on the point p (on a surface with normal n), walking down the tree and picking each child in proportion to its importance.
+// The parameter u must be a random number in the range [0, 1).
+// This function returns the index of the light and the probability with which it was picked, or false if no light can shine on the point.
+func (t *LightTree) Sample(p, n geom.Vector, u float64) (int, float64, bool) {
+	if t.root == nil || t.root.importance(p, n) <= 0.0 {
+		return 0, 0.0, false
+	}
+	
+	node, chance := t.root, 1.0
+	for node.left != nil {
+		left, right := node.left.importance(p, n), node.right.importance(p, n)
+		if left + right <= 0.0 {
+			return 0, 0.0, false
+		}
+		
+		// Pick a child, then reuse u for the next choice by stretching the part of [0, 1) that picked the child.
+		leftChance := left / (left + right)
+		if u < leftChance {
+			node, chance, u = node.left, chance * leftChance, u / leftChance
+		}else{
+			node, chance, u = node.right, chance * (1.0 - leftChance), (u - leftChance) / (1.0 - leftChance)
+		}
+		u = math.Min(u, math.Nextafter(1.0, 0.0))
+	}
+	
+	return node.light, chance, true
+}
\ No newline at end of file
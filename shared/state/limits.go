@@ -0,0 +1,28 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+// Limits bounds how much work is done to trace each pixel of an environment, trading quality for speed.
+// Each zero field is left to whoever traces the environment (which may override the others too).
+type Limits struct {
+	Samples uint			`json:"samples,omitempty"`			// The number of rays traced through each pixel.
+	MirrorDepth uint		`json:"mirrorDepth,omitempty"`		// The most reflections and refractions a ray goes through when using Phong shading.
+	PathDepth uint			`json:"pathDepth,omitempty"`		// The most surfaces a path bounces off of when path tracing.
+	AreaLightSamples uint	`json:"areaLightSamples,omitempty"`	// The number of points on the environment's emitters which light each point when using Phong shading.
+}
+
+// Or returns a copy of some limits, with each zero field taken from other.
+func (l Limits) Or(other Limits) Limits {
+	if l.Samples == 0 {
+		l.Samples = other.Samples
+	}
+	if l.MirrorDepth == 0 {
+		l.MirrorDepth = other.MirrorDepth
+	}
+	if l.PathDepth == 0 {
+		l.PathDepth = other.PathDepth
+	}
+	if l.AreaLightSamples == 0 {
+		l.AreaLightSamples = other.AreaLightSamples
+	}
+	return l
+}
\ No newline at end of file
@@ -4,16 +4,19 @@ package state
 import (
 	"github.com/mwindels/distributed-raytracer/shared/geom"
 	"github.com/mwindels/distributed-raytracer/shared/colour"
-	"github.com/mwindels/rtreego"
 	"github.com/mwindels/gwob"
 	"encoding/gob"
+	"strconv"
+	"strings"
+	"bufio"
 	"bytes"
 	"math"
 	"log"
+	"fmt"
+	"os"
 )
 
 func init() {
-	gob.Register(face{})
 	gob.Register(Mesh{})
 }
 
@@ -23,30 +26,7 @@ type face struct {
 	vertNorms [3]uint	// The indices of each vertex normal of the face.
 	mat uint			// The index of the material used by the face.
 	
-	mesh *Mesh			// A pointer to the mesh this face resides within.
-}
-
-// Bounds gets the rectangular bounding box containing the face f.
-func (f face) Bounds() *rtreego.Rect {
-	// Find the smallest and largest X coordinates.
-	xMin := math.Min(f.mesh.vertices[f.verts[0]].X, math.Min(f.mesh.vertices[f.verts[1]].X, f.mesh.vertices[f.verts[2]].X))
-	xMax := math.Max(f.mesh.vertices[f.verts[0]].X, math.Max(f.mesh.vertices[f.verts[1]].X, f.mesh.vertices[f.verts[2]].X))
-	
-	// Find the smallest and largest Y coordinates.
-	yMin := math.Min(f.mesh.vertices[f.verts[0]].Y, math.Min(f.mesh.vertices[f.verts[1]].Y, f.mesh.vertices[f.verts[2]].Y))
-	yMax := math.Max(f.mesh.vertices[f.verts[0]].Y, math.Max(f.mesh.vertices[f.verts[1]].Y, f.mesh.vertices[f.verts[2]].Y))
-	
-	// Find the smallest and largest Z coordinates.
-	zMin := math.Min(f.mesh.vertices[f.verts[0]].Z, math.Min(f.mesh.vertices[f.verts[1]].Z, f.mesh.vertices[f.verts[2]].Z))
-	zMax := math.Max(f.mesh.vertices[f.verts[0]].Z, math.Max(f.mesh.vertices[f.verts[1]].Z, f.mesh.vertices[f.verts[2]].Z))
-	
-	// Create the bounding box.
-	bbox, err := rtreego.NewRect(rtreego.Point{xMin, yMin, zMin}, []float64{math.Max(xMax - xMin, boundEpsilon), math.Max(yMax - yMin, boundEpsilon), math.Max(zMax - zMin, boundEpsilon)})
-	if err != nil {
-		panic(err)
-	}
-	
-	return bbox
+	edges geom.Edges	// The face's edges and normal, worked out when the face is added to its mesh (see Mesh.setFaces).
 }
 
 // MarshalBinary converts a face into a binary representation.
@@ -56,7 +36,7 @@ func (f face) MarshalBinary() ([]byte, error) {
 	encoder := gob.NewEncoder(&writer)
 	
 	// Encode the face's vertex, vertex normal, and material indices.
-	// We don't store the mesh pointer, because it means nothing without the mesh.
+	// We don't store the face's edges, because they're worked out again from the mesh.
 	if err := encoder.Encode(f.verts); err != nil {
 		return nil, err
 	}
@@ -94,19 +74,232 @@ func (f *face) UnmarshalBinary(data []byte) error {
 type Material struct {
 	Ka, Kd, Ks colour.RGB	// The ambient, diffuse, and specular intensities respectively.
 	Ns float64				// The specular exponent.
+	Ke colour.RGB			// The emissive intensity (black unless the material gives off light).
+	Transmission colour.RGB	// The fraction of each colour of light which passes through the material (black if the material is opaque).
+	Illum uint8				// The MTL illumination model, which controls which effects the material shows.
+	Ni float64				// The index of refraction, used by illumination models with refraction or Fresnel reflection.
+	TwoSided bool			// Whether both sides of the material are shaded alike (otherwise, the backs of opaque faces are culled).
+}
+
+// These constants are the MTL illumination models with special meaning to the renderer.
+// Every other model is treated as IllumHighlight, with whichever extra effects its number implies.
+const (
+	IllumColour uint8 = 0		// The material is drawn in its diffuse colour, regardless of lighting.
+	IllumAmbient uint8 = 1		// The material is lit, but has no specular highlights.
+	IllumHighlight uint8 = 2	// The material is lit with Phong shading (the default).
+)
+
+// Culled returns whether rays pass through the backs of a material's faces.
+// Only opaque single-sided materials are culled, because transparent materials must be hit from behind for light to leave them.
+func (m Material) Culled() bool {
+	return !m.TwoSided && m.Transmission == (colour.RGB{})
+}
+
+// Lit returns whether a material is affected by lights.
+func (m Material) Lit() bool {
+	return m.Illum != IllumColour
+}
+
+// Highlight returns the specular intensity of a material, or black if its illumination model has no specular highlights.
+func (m Material) Highlight() colour.RGB {
+	if m.Illum == IllumColour || m.Illum == IllumAmbient {
+		return colour.RGB{}
+	}
+	return m.Ks
+}
+
+// Reflective returns whether a material mirrors its surroundings (illumination models 3 to 9), in proportion to its specular intensity.
+func (m Material) Reflective() bool {
+	return m.Illum >= 3 && m.Illum <= 9
+}
+
+// Fresnel returns whether a material's reflections grow stronger at grazing angles (illumination models 5 and 7).
+func (m Material) Fresnel() bool {
+	return m.Illum == 5 || m.Illum == 7
+}
+
+// Refractive returns whether light passing through a material is bent by its index of refraction (illumination models 6 and 7).
+// Light passes straight through other transparent materials.
+func (m Material) Refractive() bool {
+	return m.Illum == 6 || m.Illum == 7
+}
+
+// mtlExtras holds the properties of a material which gwob doesn't parse.
+type mtlExtras struct {
+	emission colour.RGB	// The emissive intensity (Ke).
+	filter colour.RGB	// The transmission filter (Tf), which tints light passing through the material.
+	hasFilter bool		// Whether the material has a transmission filter.
+	dissolve float64	// How opaque the material is (d, or one minus Tr), where one is fully opaque.
+	hasDissolve bool	// Whether the material has a d line (which takes precedence over Tr).
+	illum uint8			// The illumination model (illum).
+	twoSided bool		// Whether both sides of the material are shaded alike (twosided, which isn't part of the MTL format).
+}
+
+// parseMTLColour parses the colour on a line of a Wavefront MTL file, split into fields, where the first field is the colour's keyword.
+func parseMTLColour(fields []string, name string) (colour.RGB, error) {
+	if len(fields) < 4 {
+		return colour.RGB{}, fmt.Errorf("Material \"%s\" has a malformed %s line.", name, fields[0])
+	}
+	var c [3]float64
+	for i := range c {
+		var err error
+		if c[i], err = strconv.ParseFloat(fields[i + 1], 32); err != nil {
+			return colour.RGB{}, fmt.Errorf("Could not parse the %s of material \"%s\": %v.", fields[0], name, err)
+		}
+	}
+	return colour.NewRGBFromFloats(float32(c[0]), float32(c[1]), float32(c[2])), nil
+}
+
+// readMTLExtras reads the properties gwob doesn't parse (Ke and Tf) of each material in a Wavefront MTL file.
+// gwob does parse d, Tr, and illum, but can't tell a zero from a missing value, so they are read here as well.
+// Materials are two-sided unless they have the (non-standard) line "twosided 0", which lets closed meshes cull their back faces.
+// This function returns a map from material names to their extra properties.
+func readMTLExtras(path string) (map[string]*mtlExtras, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	
+	extras := make(map[string]*mtlExtras)
+	scanner := bufio.NewScanner(file)
+	name, current := "", &mtlExtras{dissolve: 1.0, illum: IllumHighlight, twoSided: true}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		
+		switch fields[0] {
+		case "newmtl":
+			name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "newmtl"))
+			current = &mtlExtras{dissolve: 1.0, illum: IllumHighlight, twoSided: true}
+			extras[name] = current
+		case "Ke":
+			if current.emission, err = parseMTLColour(fields, name); err != nil {
+				return nil, err
+			}
+		case "Tf":
+			if current.filter, err = parseMTLColour(fields, name); err != nil {
+				return nil, err
+			}
+			current.hasFilter = true
+		case "d":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("Material \"%s\" has a malformed d line.", name)
+			}
+			if current.dissolve, err = strconv.ParseFloat(fields[len(fields) - 1], 64); err != nil {
+				return nil, fmt.Errorf("Could not parse the d of material \"%s\": %v.", name, err)
+			}
+			current.hasDissolve = true
+		case "Tr":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("Material \"%s\" has a malformed Tr line.", name)
+			}
+			tr, err := strconv.ParseFloat(fields[len(fields) - 1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse the Tr of material \"%s\": %v.", name, err)
+			}
+			if !current.hasDissolve {
+				current.dissolve = 1.0 - tr
+			}
+		case "illum":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("Material \"%s\" has a malformed illum line.", name)
+			}
+			illum, err := strconv.ParseUint(fields[1], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse the illum of material \"%s\": %v.", name, err)
+			}
+			current.illum = uint8(illum)
+		case "twosided":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("Material \"%s\" has a malformed twosided line.", name)
+			}
+			if current.twoSided, err = strconv.ParseBool(fields[1]); err != nil {
+				return nil, fmt.Errorf("Could not parse the twosided of material \"%s\": %v.", name, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	
+	return extras, nil
+}
+
+// transmission finds how much light passes through a material with some extra properties and diffuse colour.
+// Light passing through is tinted by the material's transmission filter, or by its diffuse colour if it has no filter.
+// Refractive materials which aren't dissolved let through the light their transmission filter allows.
+func (e *mtlExtras) transmission(kd colour.RGB) colour.RGB {
+	if e.dissolve >= 1.0 {
+		if (e.illum == 6 || e.illum == 7) && e.hasFilter {
+			return e.filter
+		}
+		return colour.RGB{}
+	}
+	
+	tint := kd
+	if e.hasFilter {
+		tint = e.filter
+	}
+	return tint.Scale(1.0 - math.Max(e.dissolve, 0.0))
 }
 
 // Mesh represents a triangulated (3D) polygonal mesh with various material properties.
 type Mesh struct {
 	vertices []geom.Vector		// The vertices of this mesh.
 	vertexNormals []geom.Vector	// The vertex normals of this mesh.
-	faces *rtreego.Rtree		// Stores each of this mesh's triangular faces.
+	faces []face				// Stores each of this mesh's triangular faces.
+	bvh geom.BVH				// The bounding volume hierarchy over this mesh's faces, which rays are traced through.
 	
 	materials []Material		// The materials of this mesh.
+	
+	min, max geom.Vector		// The corners of the box bounding this mesh's vertices (kept when the mesh is evicted).
+	emissive bool				// Whether any of this mesh's materials give off light (kept when the mesh is evicted).
+	residency *meshResidency	// Tracks whether this mesh is loaded, if it's held by a mesh cache (nil otherwise).
+}
+
+// summarise finds the parts of a mesh which are kept when it is evicted from a mesh cache.
+func (m *Mesh) summarise() {
+	m.min, m.max = geom.Vector{}, geom.Vector{}
+	for i, v := range m.vertices {
+		if i == 0 {
+			m.min, m.max = v, v
+		}
+		m.min = geom.Vector{math.Min(m.min.X, v.X), math.Min(m.min.Y, v.Y), math.Min(m.min.Z, v.Z)}
+		m.max = geom.Vector{math.Max(m.max.X, v.X), math.Max(m.max.Y, v.Y), math.Max(m.max.Z, v.Z)}
+	}
+	
+	m.emissive = false
+	for _, mat := range m.materials {
+		if mat.Ke != (colour.RGB{}) {
+			m.emissive = true
+		}
+	}
+}
+
+// MeshOptions controls how a mesh is built from a Wavefront OBJ file.
+type MeshOptions struct {
+	CreaseAngle float64	// The largest angle (in degrees) between faces which share smoothed normals (zero to smooth by smoothing groups alone).
+	WeldEpsilon float64	// The largest distance between vertices (after scaling) which are merged into one (zero to merge identical vertices only).
+	Scale float64		// The factor the model's vertices are scaled by, to convert them into an environment's units (one if zero).
+}
+
+// key returns a string which identifies a mesh loaded from a model with some options, so that each model is only loaded once per set of options.
+func (opts MeshOptions) key(model string) string {
+	if opts == (MeshOptions{}) {
+		return model
+	}
+	if opts.Scale == 0.0 {
+		return fmt.Sprintf("%s#crease=%g,weld=%g", model, opts.CreaseAngle, opts.WeldEpsilon)
+	}
+	return fmt.Sprintf("%s#crease=%g,weld=%g,scale=%g", model, opts.CreaseAngle, opts.WeldEpsilon, opts.Scale)
 }
 
 // MeshFromFile returns a new mesh based on a provided Wavefront OBJ file.
-func MeshFromFile(path string) (*Mesh, error) {
+// If the file has no vertex normals, they are generated from its smoothing groups and the options' crease angle.
+func MeshFromFile(path string, opts MeshOptions) (*Mesh, error) {
 	options := gwob.ObjParserOptions{LogStats: true, Logger: func(s string) {log.Println(s)}, IgnoreNormals: false}
 	
 	// Read in the mesh from the file.
@@ -117,15 +310,23 @@ func MeshFromFile(path string) (*Mesh, error) {
 	
 	// Read in the material library associated with the mesh.
 	inputMatlib := gwob.NewMaterialLib()
+	extras := make(map[string]*mtlExtras)
 	if len(inputMesh.Mtllib) > 0 {
-		inputMatlib, err = gwob.ReadMaterialLibFromFile(relativePath(path, inputMesh.Mtllib), &options)
+		matlibPath := relativePath(path, inputMesh.Mtllib)
+		inputMatlib, err = gwob.ReadMaterialLibFromFile(matlibPath, &options)
 		if err != nil {
 			// If the material can't be found at the relative path, try the absolute path.
-			inputMatlib, err = gwob.ReadMaterialLibFromFile(inputMesh.Mtllib, &options)
+			matlibPath = inputMesh.Mtllib
+			inputMatlib, err = gwob.ReadMaterialLibFromFile(matlibPath, &options)
 			if err != nil {
 				return nil, err
 			}
 		}
+		
+		// Read in the properties gwob doesn't parse separately.
+		if extras, err = readMTLExtras(matlibPath); err != nil {
+			return nil, err
+		}
 	}
 	
 	vertexStride := inputMesh.StrideSize / 4
@@ -136,22 +337,33 @@ func MeshFromFile(path string) (*Mesh, error) {
 	mesh := &Mesh{
 		vertices: make([]geom.Vector, 0, len(inputMesh.Coord) / vertexStride),
 		materials: make([]Material, 0, len(inputMesh.Groups)),
-		faces: rtreego.NewTree(3, 2, 5),
 	}
 	if inputMesh.NormCoordFound {
 		mesh.vertexNormals = make([]geom.Vector, 0, len(inputMesh.Coord) / vertexStride)
 	}
 	
 	// Assemble the mesh.
-	vertexMap := make(map[geom.Vector]uint)
+	scale := opts.Scale
+	if scale == 0.0 {
+		scale = 1.0
+	}
+	welder := newVertexWelder(opts.WeldEpsilon)
 	vertexNormalMap := make(map[geom.Vector]uint)
 	materialMap := make(map[Material]uint)
+	var faces []face
+	var smoothing []int
 	for _, g := range inputMesh.Groups {
 		// Assign a default material.
-		mat := Material{Ka: colour.NewRGB(0x10, 0x10, 0x10), Kd: colour.NewRGB(0xFF, 0xFF, 0xFF), Ks: colour.NewRGB(0x00, 0x00, 0x00), Ns: 0.0}
+		mat := Material{Ka: colour.NewRGB(0x10, 0x10, 0x10), Kd: colour.NewRGB(0xFF, 0xFF, 0xFF), Ks: colour.NewRGB(0x00, 0x00, 0x00), Ns: 0.0, Illum: IllumHighlight, Ni: 1.0, TwoSided: true}
 		if gMat, exists := inputMatlib.Lib[g.Usemtl]; exists {
 			// If a material exists for this group, use it instead.
-			mat = Material{Ka: colour.NewRGBFromFloats(gMat.Ka[0], gMat.Ka[1], gMat.Ka[2]), Kd: colour.NewRGBFromFloats(gMat.Kd[0], gMat.Kd[1], gMat.Kd[2]), Ks: colour.NewRGBFromFloats(gMat.Ks[0], gMat.Ks[1], gMat.Ks[2]), Ns: float64(gMat.Ns)}
+			mat = Material{Ka: colour.NewRGBFromFloats(gMat.Ka[0], gMat.Ka[1], gMat.Ka[2]), Kd: colour.NewRGBFromFloats(gMat.Kd[0], gMat.Kd[1], gMat.Kd[2]), Ks: colour.NewRGBFromFloats(gMat.Ks[0], gMat.Ks[1], gMat.Ks[2]), Ns: float64(gMat.Ns), Illum: IllumHighlight, Ni: float64(gMat.Ni), TwoSided: true}
+			if extra, exists := extras[g.Usemtl]; exists {
+				mat.Ke = extra.emission
+				mat.Transmission = extra.transmission(mat.Kd)
+				mat.Illum = extra.illum
+				mat.TwoSided = extra.twoSided
+			}
 		}
 		
 		// If the material is new, add it.
@@ -166,7 +378,6 @@ func MeshFromFile(path string) (*Mesh, error) {
 		for f := 0; f < g.IndexCount / 3; f++ {
 			fFace := face{
 				mat: matIndex,
-				mesh: mesh,
 			}
 			
 			// Add the vertex and vertex normal indices (if they exist).
@@ -178,14 +389,8 @@ func MeshFromFile(path string) (*Mesh, error) {
 					inputMesh.Coord64(vertexStride * inputMesh.Indices[vIndex] + vertexOffset + 2),
 				}
 				
-				// Add the new vertex.
-				if vVertexIndex, exists := vertexMap[vVertex]; exists {
-					fFace.verts[v] = vVertexIndex
-				}else{
-					fFace.verts[v] = uint(len(mesh.vertices))
-					vertexMap[vVertex] = uint(len(mesh.vertices))
-					mesh.vertices = append(mesh.vertices, vVertex)
-				}
+				// Add the new vertex (or find the vertex it's welded to).
+				fFace.verts[v] = welder.add(mesh, vVertex.Scale(scale))
 				
 				// Add the new vertex normal (if it exists).
 				if inputMesh.NormCoordFound {
@@ -204,14 +409,126 @@ func MeshFromFile(path string) (*Mesh, error) {
 				}
 			}
 			
-			// Insert the new face into the R-Tree.
-			mesh.faces.Insert(fFace)
+			// Skip faces which welding collapsed, since they can't be hit.
+			if fFace.verts[0] == fFace.verts[1] || fFace.verts[1] == fFace.verts[2] || fFace.verts[2] == fFace.verts[0] {
+				continue
+			}
+			
+			// With a crease angle, faces outside of any smoothing group are smoothed together (as group -1), by angle alone.
+			faces = append(faces, fFace)
+			if g.Smooth == 0 && opts.CreaseAngle > 0.0 {
+				smoothing = append(smoothing, -1)
+			}else{
+				smoothing = append(smoothing, g.Smooth)
+			}
 		}
 	}
 	
+	// If the mesh has no vertex normals of its own, generate them from its smoothing groups (unless every face is flat).
+	if !inputMesh.NormCoordFound {
+		for _, group := range smoothing {
+			if group != 0 {
+				mesh.smoothNormals(faces, smoothing, opts.CreaseAngle * math.Pi / 180.0)
+				break
+			}
+		}
+	}
+	
+	// Build a bounding volume hierarchy over the faces.
+	mesh.setFaces(faces)
+	mesh.summarise()
+	
 	return mesh, nil
 }
 
+// setFaces sets a mesh's faces, working out their edges for intersecting rays with them, and builds a bounding volume hierarchy over them.
+func (m *Mesh) setFaces(faces []face) {
+	boxes := make([]geom.Box, len(faces), len(faces))
+	for i := range faces {
+		faces[i].edges = m.triangle(faces[i]).Edges()
+		boxes[i] = m.faceBox(faces[i])
+	}
+	m.faces = faces
+	m.bvh = geom.NewBVH(boxes)
+}
+
+// faceBox returns the box bounding a face of a mesh.
+func (m *Mesh) faceBox(f face) geom.Box {
+	p1, p2, p3 := m.vertices[f.verts[0]], m.vertices[f.verts[1]], m.vertices[f.verts[2]]
+	return geom.Box{
+		MinCorner: geom.Vector{math.Min(p1.X, math.Min(p2.X, p3.X)), math.Min(p1.Y, math.Min(p2.Y, p3.Y)), math.Min(p1.Z, math.Min(p2.Z, p3.Z))},
+		MaxCorner: geom.Vector{math.Max(p1.X, math.Max(p2.X, p3.X)), math.Max(p1.Y, math.Max(p2.Y, p3.Y)), math.Max(p1.Z, math.Max(p2.Z, p3.Z))},
+	}
+}
+
+// triangle returns the triangle (without vertex normals) a face of a mesh covers.
+func (m *Mesh) triangle(f face) geom.Triangle {
+	return geom.Triangle{P1: m.vertices[f.verts[0]], P2: m.vertices[f.verts[1]], P3: m.vertices[f.verts[2]]}
+}
+
+// faceNormal returns the (unnormalised) normal vector of a face of a mesh, whose length is twice the face's area.
+func (m *Mesh) faceNormal(f face) geom.Vector {
+	p1, p2, p3 := m.vertices[f.verts[0]], m.vertices[f.verts[1]], m.vertices[f.verts[2]]
+	return p2.Sub(p1).Cross(p3.Sub(p1))
+}
+
+// smoothNormals generates a mesh's vertex normals, so that faces in the same smoothing group (as given by each face's smoothing group in groups) share averaged normals at the vertices they share.
+// If crease (in radians) is positive, faces only share normals with faces at most crease away from them, which keeps sharp edges within a smoothing group sharp.
+// Each average is weighted by the faces' areas, and faces outside of any smoothing group (group zero) keep their own flat normal.
+func (m *Mesh) smoothNormals(faces []face, groups []int, crease float64) {
+	// A vertex can have a different normal in each smoothing group it's part of.
+	type corner struct {
+		vertex uint
+		group int
+	}
+	
+	// Find the faces around each corner.
+	around := make(map[corner][]int)
+	for i, f := range faces {
+		if groups[i] != 0 {
+			for _, v := range f.verts {
+				around[corner{v, groups[i]}] = append(around[corner{v, groups[i]}], i)
+			}
+		}
+	}
+	flats := make([]geom.Vector, len(faces), len(faces))
+	for i, f := range faces {
+		flats[i] = m.faceNormal(f).Norm()
+	}
+	
+	// Give each corner of each face the sum of the normals of the faces around it (within the crease angle), or the face's own flat normal.
+	m.vertexNormals = nil
+	normalMap := make(map[geom.Vector]uint)
+	minCos := math.Cos(crease)
+	for i := range faces {
+		for v, vertex := range faces[i].verts {
+			n := flats[i]
+			if groups[i] != 0 {
+				sum := geom.Vector{}
+				for _, j := range around[corner{vertex, groups[i]}] {
+					if crease <= 0.0 || flats[i].Dot(flats[j]) >= minCos {
+						sum = sum.Add(m.faceNormal(faces[j]))
+					}
+				}
+				
+				// Faces around a corner can cancel out, in which case the face's own normal is used.
+				if !sum.Zero() {
+					n = sum.Norm()
+				}
+			}
+			
+			// Share identical normals.
+			index, exists := normalMap[n]
+			if !exists {
+				index = uint(len(m.vertexNormals))
+				normalMap[n] = index
+				m.vertexNormals = append(m.vertexNormals, n)
+			}
+			faces[i].vertNorms[v] = index
+		}
+	}
+}
+
 // MarshalBinary converts a mesh into a binary representation.
 func (m Mesh) MarshalBinary() ([]byte, error) {
 	// Set up the binary encoder.
@@ -225,7 +542,7 @@ func (m Mesh) MarshalBinary() ([]byte, error) {
 	if err := encoder.Encode(m.vertexNormals); err != nil {
 		return nil, err
 	}
-	if err := encoder.Encode(m.faces.SearchCondition(func(nbb *rtreego.Rect) bool {return true})); err != nil {
+	if err := encoder.Encode(m.faces); err != nil {
 		return nil, err
 	}
 	if err := encoder.Encode(m.materials); err != nil {
@@ -242,7 +559,7 @@ func (m *Mesh) UnmarshalBinary(data []byte) error {
 	decoder := gob.NewDecoder(reader)
 	
 	// Decode the mesh's vertices, vertex normals, faces, and materials.
-	var faces []rtreego.Spatial
+	var faces []face
 	if err := decoder.Decode(&m.vertices); err != nil {
 		return err
 	}
@@ -256,17 +573,9 @@ func (m *Mesh) UnmarshalBinary(data []byte) error {
 		return err
 	}
 	
-	// Rebuild an R-Tree for the faces.
-	m.faces = rtreego.NewTree(3, 2, 5)
-	
-	// Because our faces have a mesh associated with them, we need to add a pointer to that mesh.
-	// Then, add the face value to the faces R-Tree.
-	for _, s := range faces {
-		f := s.(face)
-		f.mesh = m
-		
-		m.faces.Insert(f)
-	}
+	// Work out the faces' edges again, and rebuild a bounding volume hierarchy over them.
+	m.setFaces(faces)
+	m.summarise()
 	
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,171 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"container/list"
+	"encoding/gob"
+	"bytes"
+	"sync"
+	"time"
+	"log"
+)
+
+// These constants are used to estimate how much memory a mesh takes up.
+const (
+	vectorBytes uint64 = 24		// The size of a vertex or vertex normal.
+	faceBytes uint64 = 176		// The size of a face (with its edges), including its share of the bounding volume hierarchy over it.
+	materialBytes uint64 = 64	// The size of a material.
+)
+
+// meshRetryDelay is how long a mesh cache waits after failing to load a mesh before trying to load it again.
+const meshRetryDelay time.Duration = time.Second
+
+// MeshLoader fetches a mesh (encoded as by Environment.EncodeMesh) by its key, so that a mesh cache can reload meshes it has evicted.
+type MeshLoader func(key string) ([]byte, error)
+
+// MeshCache keeps the meshes of an environment within a memory budget.
+// When the budget is exceeded, the least recently used meshes are evicted, then reloaded when they're needed again.
+// Meshes keep their bounds when evicted, so evicting a mesh doesn't change how its objects are arranged.
+type MeshCache struct {
+	mu sync.Mutex
+	budget uint64			// The most bytes of meshes kept loaded (though meshes in use are never evicted).
+	used uint64				// The estimated bytes of meshes currently loaded.
+	load MeshLoader
+	recent *list.List		// The loaded meshes, most recently used first.
+}
+
+// meshResidency tracks whether a mesh held by a mesh cache is loaded.
+// Every field is guarded by the cache's lock.
+type meshResidency struct {
+	key string					// Identifies the mesh to the cache's loader.
+	cache *MeshCache
+	size uint64					// The estimated bytes the mesh takes up when loaded.
+	users int					// The number of callers using the mesh (which can't be evicted while in use).
+	element *list.Element		// The mesh's place in the cache's list of loaded meshes (nil if the mesh is evicted).
+	loading chan struct{}		// Closed when the load in progress finishes (nil if the mesh isn't being loaded).
+	failed time.Time			// When the mesh last failed to load.
+	err error					// Why the mesh last failed to load.
+}
+
+// NewMeshCache creates a mesh cache which keeps up to budget bytes of meshes loaded, reloading evicted meshes with load.
+func NewMeshCache(budget uint64, load MeshLoader) *MeshCache {
+	return &MeshCache{budget: budget, load: load, recent: list.New()}
+}
+
+// size estimates how much memory a loaded mesh takes up.
+func (m *Mesh) size() uint64 {
+	return vectorBytes * uint64(len(m.vertices) + len(m.vertexNormals)) + faceBytes * uint64(len(m.faces)) + materialBytes * uint64(len(m.materials))
+}
+
+// hold starts tracking a loaded mesh with some key, then evicts meshes until the cache is within its budget.
+func (c *MeshCache) hold(key string, m *Mesh) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	m.residency = &meshResidency{key: key, cache: c, size: m.size()}
+	m.residency.element = c.recent.PushFront(m)
+	c.used += m.residency.size
+	c.evict()
+}
+
+// evict evicts the least recently used meshes which aren't in use, until the cache is within its budget.
+// This function assumes the caller holds the cache's lock.
+func (c *MeshCache) evict() {
+	for e := c.recent.Back(); e != nil && c.used > c.budget; {
+		prev := e.Prev()
+		if m := e.Value.(*Mesh); m.residency.users == 0 {
+			m.vertices, m.vertexNormals, m.faces, m.bvh, m.materials = nil, nil, nil, geom.BVH{}, nil
+			c.recent.Remove(e)
+			m.residency.element = nil
+			c.used -= m.residency.size
+		}
+		e = prev
+	}
+}
+
+// fetch loads an evicted mesh with the cache's loader.
+func (c *MeshCache) fetch(key string) (*Mesh, error) {
+	data, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	
+	var m Mesh
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// acquire makes sure a mesh is loaded, and keeps it from being evicted until release is called.
+// Meshes which aren't held by a mesh cache are always loaded.
+func (m *Mesh) acquire() error {
+	r := m.residency
+	if r == nil {
+		return nil
+	}
+	c := r.cache
+	
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	loaded := false
+	for r.element == nil {
+		// Wait for any load in progress, then check again.
+		if r.loading != nil {
+			wait := r.loading
+			c.mu.Unlock()
+			<-wait
+			c.mu.Lock()
+			continue
+		}
+		
+		// Don't retry a failed load too soon, so that every ray doesn't wait on a missing master.
+		if r.err != nil && time.Since(r.failed) < meshRetryDelay {
+			return r.err
+		}
+		
+		// Load the mesh without holding the lock, so other meshes can be used in the meantime.
+		r.loading = make(chan struct{})
+		c.mu.Unlock()
+		fetched, err := c.fetch(r.key)
+		c.mu.Lock()
+		close(r.loading)
+		r.loading = nil
+		if err != nil {
+			log.Printf("Could not load mesh \"%s\": %v.\n", r.key, err)
+			r.failed, r.err = time.Now(), err
+			return err
+		}
+		
+		m.vertices, m.vertexNormals, m.faces, m.bvh, m.materials = fetched.vertices, fetched.vertexNormals, fetched.faces, fetched.bvh, fetched.materials
+		r.element = c.recent.PushFront(m)
+		r.err = nil
+		c.used += r.size
+		loaded = true
+	}
+	
+	r.users += 1
+	c.recent.MoveToFront(r.element)
+	if loaded {
+		c.evict()
+	}
+	return nil
+}
+
+// release lets a mesh be evicted again, once every caller of acquire has released it.
+func (m *Mesh) release() {
+	r := m.residency
+	if r == nil {
+		return
+	}
+	
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	
+	r.users -= 1
+	if r.users == 0 && r.cache.used > r.cache.budget {
+		r.cache.evict()
+	}
+}
\ No newline at end of file
@@ -25,32 +25,40 @@ type Object struct {
 type StoredObject struct {
 	Model string	`json:"model"`
 	Pos geom.Vector	`json:"pos"`
+	Crease float64	`json:"crease,omitempty"`	// The largest angle (in degrees) between faces which share smoothed normals, if the model has no normals of its own.
+	Weld float64	`json:"weld,omitempty"`		// The largest distance between the model's vertices which are merged into one (in the environment's units).
+	Units string	`json:"units,omitempty"`		// The unit of length the model is written in (the environment's units if empty).
+	Lights *LightLink	`json:"lights,omitempty"`	// Which lights shine on the object (every light, if missing).
 }
 
-// Bounds gets the rectangular bounding box containing the object o.
-func (o Object) Bounds() *rtreego.Rect {
+// ID returns the unsigned integer that uniquely identifies an object within its environment.
+func (o Object) ID() uint {
+	return o.id
+}
+
+// box gets the box bounding the object o.
+// Note: because we use o.Pos, we must rebuild the environment's R-Tree (and bounding volume hierarchy) every time an object moves!
+func (o Object) box() geom.Box {
 	// Set up a minimal bounding box.
-	// Note: because we use o.Pos, we must rebuild the environment's R-Tree every time an object moves!
-	xMin, xMax := o.Pos.X, o.Pos.X
-	yMin, yMax := o.Pos.Y, o.Pos.Y
-	zMin, zMax := o.Pos.Z, o.Pos.Z
+	b := geom.Box{MinCorner: o.Pos, MaxCorner: o.Pos}
 	
-	// For each vertex in the object's mesh, expand the box if necessary.
+	// Expand the box to hold the object's mesh, if necessary.
 	if o.mesh != nil {
-		for _, v := range o.mesh.vertices {
-			xMin = math.Min(xMin, o.Pos.X + v.X)
-			xMax = math.Max(xMax, o.Pos.X + v.X)
-			
-			yMin = math.Min(yMin, o.Pos.Y + v.Y)
-			yMax = math.Max(yMax, o.Pos.Y + v.Y)
-			
-			zMin = math.Min(zMin, o.Pos.Z + v.Z)
-			zMax = math.Max(zMax, o.Pos.Z + v.Z)
-		}
+		min, max := o.Pos.Add(o.mesh.min), o.Pos.Add(o.mesh.max)
+		b.MinCorner = geom.Vector{math.Min(b.MinCorner.X, min.X), math.Min(b.MinCorner.Y, min.Y), math.Min(b.MinCorner.Z, min.Z)}
+		b.MaxCorner = geom.Vector{math.Max(b.MaxCorner.X, max.X), math.Max(b.MaxCorner.Y, max.Y), math.Max(b.MaxCorner.Z, max.Z)}
 	}
 	
+	return b
+}
+
+// Bounds gets the rectangular bounding box containing the object o.
+func (o Object) Bounds() *rtreego.Rect {
+	b := o.box()
+	size := b.MaxCorner.Sub(b.MinCorner)
+	
 	// Create the bounding box.
-	bbox, err := rtreego.NewRect(rtreego.Point{xMin, yMin, zMin}, []float64{math.Max(xMax - xMin, boundEpsilon), math.Max(yMax - yMin, boundEpsilon), math.Max(zMax - zMin, boundEpsilon)})
+	bbox, err := rtreego.NewRect(rtreego.Point{b.MinCorner.X, b.MinCorner.Y, b.MinCorner.Z}, []float64{math.Max(size.X, boundEpsilon), math.Max(size.Y, boundEpsilon), math.Max(size.Z, boundEpsilon)})
 	if err != nil {
 		panic(err)
 	}
@@ -61,52 +69,110 @@ func (o Object) Bounds() *rtreego.Rect {
 // Intersection computes the intersection between a ray and an object.
 // This function's return values are: (1) the point of intersection, (2) the normal vector at that point, (3) the material at that point, and (4) whether or not the ray intersected the object.
 func (o Object) Intersection(rOrigin, rDir geom.Vector) (geom.Vector, geom.Vector, Material, bool) {
+	return o.IntersectionWithin(rOrigin, rDir, 0.0, math.Inf(1))
+}
+
+// IntersectionWithin computes the nearest intersection between a ray and an object, which is between near and far away from the ray's origin.
+// Nearer intersections are skipped (so the ray can pass through them), and farther ones are not looked for at all.
+// This function's return values are the same as Intersection's.
+func (o Object) IntersectionWithin(rOrigin, rDir geom.Vector, near, far float64) (geom.Vector, geom.Vector, Material, bool) {
 	hasNearest := false
 	var nearestDistance float64
 	var nearestIntersect geom.Vector
 	var nearestVertexNormal geom.Vector
 	var nearestMaterial Material
 	
+	// Keep the nearest of every intersection, only looking for intersections nearer than the nearest so far.
+	o.eachIntersection(rOrigin, rDir, near, far, func(intersect, normal geom.Vector, mat Material, intersectDistance float64) (float64, bool) {
+		if !hasNearest || intersectDistance < nearestDistance {
+			hasNearest = true
+			nearestDistance = intersectDistance
+			nearestIntersect = intersect
+			nearestVertexNormal = normal
+			nearestMaterial = mat
+		}
+		return nearestDistance, false
+	})
+	
+	return nearestIntersect, nearestVertexNormal, nearestMaterial, hasNearest
+}
+
+// AnyIntersectionWithin looks for intersections between a ray and an object which are between near and far away from the ray's origin, in no particular order.
+// The material at each intersection is passed to hit, and the search stops as soon as hit returns true.
+// This is cheaper than finding the nearest intersection when any intersection will do (such as for shadow rays).
+// The return value is whether hit returned true.
+func (o Object) AnyIntersectionWithin(rOrigin, rDir geom.Vector, near, far float64, hit func(Material) bool) bool {
+	return o.eachIntersection(rOrigin, rDir, near, far, func(intersect, normal geom.Vector, mat Material, intersectDistance float64) (float64, bool) {
+		return far, hit(mat)
+	})
+}
+
+// eachIntersection passes every intersection between a ray and an object which is between near and far away from the ray's origin to visit, along with its normal, material, and distance, in no particular order.
+// Visit returns how far away the rest of the intersections can be, so that faces beyond a nearer intersection are skipped, and whether to stop searching.
+// The return value is whether the search was stopped.
+func (o Object) eachIntersection(rOrigin, rDir geom.Vector, near, far float64, visit func(geom.Vector, geom.Vector, Material, float64) (float64, bool)) bool {
 	// Offset the ray to compensate for the object's position.
 	rOrigin = rOrigin.Sub(o.Pos)
 	
 	m := o.mesh
 	if m != nil {
+		// Make sure the mesh is loaded, and stays loaded until we're done with it.
+		// If it can't be loaded, the object can't be hit.
+		if err := m.acquire(); err != nil {
+			return false
+		}
+		defer m.release()
+		
 		// Compute the points of intersection with respect to the object's unit mesh.
-		for _, s := range m.faces.SearchCondition(func(nbb *rtreego.Rect) bool {return geom.NewBox(nbb).Intersect(rOrigin, rDir)}) {
-			// Convert the rtreego.Spatial s to a face.
-			f := s.(face)
+		// The faces are found by traversing the mesh's bounding volume hierarchy, which doesn't allocate.
+		dirLen := rDir.Len()
+		return m.bvh.Traverse(rOrigin, rDir, far / dirLen, func(k int) (float64, bool) {
+			f := &m.faces[k]
+			maxScale := far / dirLen
 			
 			// Build a triangle.
-			tri := geom.Triangle{P1: m.vertices[f.verts[0]], P2: m.vertices[f.verts[1]], P3: m.vertices[f.verts[2]]}
+			tri := m.triangle(*f)
 			if len(m.vertexNormals) > 0 {
 				tri.N1 = m.vertexNormals[f.vertNorms[0]]
 				tri.N2 = m.vertexNormals[f.vertNorms[1]]
 				tri.N3 = m.vertexNormals[f.vertNorms[2]]
 			}
 			
-			// Find the intersection of the ray and the triangle.
-			if intersect, bcoords, hit := tri.Intersection(rOrigin, rDir); hit {
+			// Find the intersection of the ray and the triangle (if it isn't too far away).
+			// The face's edges and normal were worked out when it was added to the mesh.
+			if intersect, bcoords, hit := tri.IntersectionWithEdges(f.edges, rOrigin, rDir, maxScale); hit {
+				// Skip the triangle if its back faces the ray and its material culls back faces.
+				mat := m.materials[f.mat]
+				backface := rDir.Dot(f.edges.Normal) > 0.0
+				if backface && mat.Culled() {
+					return maxScale, false
+				}
+				
 				var normal geom.Vector
 				if len(m.vertexNormals) > 0 {
 					normal = tri.InterpNormal(bcoords)
 				}else{
-					normal = tri.Normal()
+					normal = f.edges.Normal
+				}
+				
+				// Two-sided materials are shaded as if the ray hit their front, unless they refract (which needs to know which side the ray is on).
+				if backface && mat.TwoSided && !mat.Refractive() {
+					normal = normal.Scale(-1.0)
 				}
 				
 				intersectDistance := rOrigin.Sub(intersect).Len()
-				if !hasNearest || intersectDistance < nearestDistance {
-					hasNearest = true
-					nearestDistance = intersectDistance
-					nearestIntersect = intersect
-					nearestVertexNormal = normal
-					nearestMaterial = m.materials[f.mat]
+				if intersectDistance < near || intersectDistance > far {
+					return maxScale, false
 				}
+				var stop bool
+				far, stop = visit(intersect.Add(o.Pos), normal, mat, intersectDistance)
+				return far / dirLen, stop
 			}
-		}
+			return maxScale, false
+		})
 	}
 	
-	return nearestIntersect.Add(o.Pos), nearestVertexNormal, nearestMaterial, hasNearest
+	return false
 }
 
 // MarshalBinary converts an object into a binary representation.
@@ -0,0 +1,101 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"math"
+)
+
+// DefaultSunDistance is how far (in the environment's units) the sun is from the origin, for environments which don't say.
+// The sun is a point light, so it must be far enough away that its light falls in nearly parallel rays over the whole environment.
+const DefaultSunDistance float64 = 10000.0
+
+// sunrise is the colour the sun is tinted towards as it nears the horizon.
+var sunrise colour.RGB = colour.NewRGB(0xFF, 0x80, 0x40)
+
+// Sun is a light which moves across the sky (and changes colour) with the time of day.
+// It rises in the direction east at six o'clock, is highest at noon, sets at eighteen o'clock, and is switched off through the night.
+type Sun struct {
+	Col colour.RGB		// The colour of the sun at noon.
+	East geom.Vector	// The (normalized) direction the sun rises in, which must be perpendicular to the environment's up vector.
+	Tilt float64		// How far (in radians) the sun's path leans away from passing straight overhead, towards the direction east × up.
+	Distance float64	// How far the sun is from the origin.
+	Time float64		// The hour (in the range [0, 24)) the sun starts at.
+	DayLength float64	// How long (in seconds) a whole day takes to pass (the sun stands still if zero).
+	
+	index int			// The index of the sun among the environment's lights.
+	up geom.Vector		// The environment's (normalized) up vector, which the sun is overhead along at noon (if it isn't tilted).
+}
+
+// StoredSun is used to (un)marshal sun data to/from the JSON format.
+type StoredSun struct {
+	Col *colour.StoredRGB	`json:"col,omitempty"`			// White if missing.
+	East *geom.Vector		`json:"east,omitempty"`			// The x axis if missing (or the z axis, if the x axis is up).
+	Tilt float64			`json:"tilt,omitempty"`
+	Distance float64		`json:"distance,omitempty"`		// DefaultSunDistance if zero.
+	Time float64			`json:"time"`
+	DayLength float64		`json:"dayLength,omitempty"`
+}
+
+// newSun creates the sun described in an environment file whose up vector is up, as the light with some index.
+func newSun(stored StoredSun, index int, up geom.Vector) Sun {
+	sun := Sun{Col: colour.NewRGB(0xFF, 0xFF, 0xFF), East: geom.Vector{1, 0, 0}, Tilt: stored.Tilt, Distance: stored.Distance, Time: stored.Time, DayLength: stored.DayLength, index: index, up: up}
+	if stored.Col != nil {
+		sun.Col = colour.NewRGB(stored.Col.R, stored.Col.G, stored.Col.B)
+	}
+	if stored.East != nil && !stored.East.Cross(up).Zero() {
+		sun.East = *stored.East
+	}else if sun.East.Cross(up).Zero() {
+		sun.East = geom.Vector{0, 0, 1}
+	}
+	
+	// Flatten the direction onto the horizon.
+	sun.East = sun.East.Sub(up.Scale(sun.East.Dot(up))).Norm()
+	if sun.Distance <= 0.0 {
+		sun.Distance = DefaultSunDistance
+	}
+	return sun
+}
+
+// Light returns the sun's light at some hour (in the range [0, 24)).
+func (s Sun) Light(hour float64) Light {
+	// Turn the sun about the axis through its path, tilted away from straight overhead.
+	angle := (hour - 6.0) / 24.0 * 2.0 * math.Pi
+	up := s.up
+	if up.Zero() {
+		up = GlobalUp
+	}
+	overhead := up.Scale(math.Cos(s.Tilt)).Add(s.East.Cross(up).Scale(math.Sin(s.Tilt)))
+	dir := s.East.Scale(math.Cos(angle)).Add(overhead.Scale(math.Sin(angle)))
+	
+	// The sun is redder and dimmer the nearer it is to the horizon, and off below it.
+	height := dir.Dot(up)
+	if height <= 0.0 {
+		return Light{Pos: dir.Scale(s.Distance), Col: colour.RGB{}, Off: true}
+	}
+	tint := sunrise.Scale(1.0 - math.Sqrt(height)).Add(colour.NewRGB(0xFF, 0xFF, 0xFF).Scale(math.Sqrt(height)))
+	return Light{Pos: dir.Scale(s.Distance), Col: s.Col.Multiply(tint).Scale(math.Min(4.0 * height, 1.0))}
+}
+
+// Sun returns an environment's sun.
+// The last return value is false if the environment has no sun (which is always the case for environments decoded by workers, since they're only sent the sun's light).
+func (em *EnvMutables) Sun() (Sun, bool) {
+	if em.sun == nil {
+		return Sun{}, false
+	}
+	return *em.sun, true
+}
+
+// SetTimeOfDay moves an environment's sun to where it is at some hour, wrapping the hour into the range [0, 24).
+// The return value is false if the environment has no sun.
+func (em *EnvMutables) SetTimeOfDay(hour float64) bool {
+	if em.sun == nil || em.sun.index >= len(em.Lights) {
+		return false
+	}
+	
+	// Because the sun's position informs the light tree, we need to rebuild it.
+	em.Lights[em.sun.index] = em.sun.Light(math.Mod(math.Mod(hour, 24.0) + 24.0, 24.0))
+	em.lightTree = NewLightTree(em.Lights)
+	return true
+}
\ No newline at end of file
@@ -0,0 +1,46 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"strings"
+	"fmt"
+)
+
+// DefaultUnits is the unit of length environments and models are assumed to be written in, if they don't say otherwise.
+const DefaultUnits string = "m"
+
+// unitLengths holds the length (in metres) of each unit environments and models can be written in.
+var unitLengths = map[string]float64{
+	"mm": 0.001,
+	"cm": 0.01,
+	"m": 1.0,
+	"km": 1000.0,
+	"in": 0.0254,
+	"ft": 0.3048,
+}
+
+// unitLength returns the length (in metres) of the unit with some name (ignoring case).
+// An empty name stands for the default units.
+func unitLength(units string) (float64, error) {
+	if units == "" {
+		units = DefaultUnits
+	}
+	if length, exists := unitLengths[strings.ToLower(units)]; exists {
+		return length, nil
+	}
+	return 0.0, fmt.Errorf("Unknown units \"%s\".", units)
+}
+
+// UnitLength returns the length (in metres) of one unit of an environment.
+func (em *EnvMutables) UnitLength() float64 {
+	if em.unitLength <= 0.0 {
+		return 1.0
+	}
+	return em.unitLength
+}
+
+// Metres converts a length in metres into an environment's units.
+// Distances which are meant to be physically small (or large), like the offsets which stop rays from hitting the surfaces they leave, should be converted with this function so they keep their size whatever units the environment is written in.
+func (em *EnvMutables) Metres(length float64) float64 {
+	return length / em.UnitLength()
+}
\ No newline at end of file
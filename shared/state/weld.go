@@ -0,0 +1,60 @@
+// Package state provides shared state information for use by workers and the master.
+package state
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"math"
+)
+
+// vertexWelder assigns indices to the vertices of a mesh as they're added, so that vertices within some distance of one another share an index.
+// Vertices are hashed into a grid of cells as wide as that distance, so only the neighbouring cells need to be searched for a match.
+type vertexWelder struct {
+	epsilon float64				// The largest distance between vertices which are welded together (zero to weld identical vertices only).
+	exact map[geom.Vector]uint	// The index of each vertex (when welding identical vertices only).
+	cells map[[3]int64][]uint	// The indices of the vertices in each cell of the grid.
+}
+
+// newVertexWelder creates a vertex welder which welds vertices within epsilon of one another.
+func newVertexWelder(epsilon float64) *vertexWelder {
+	if epsilon <= 0.0 {
+		return &vertexWelder{exact: make(map[geom.Vector]uint)}
+	}
+	return &vertexWelder{epsilon: epsilon, cells: make(map[[3]int64][]uint)}
+}
+
+// cell returns the cell of the grid which holds a vertex.
+func (w *vertexWelder) cell(v geom.Vector) [3]int64 {
+	return [3]int64{int64(math.Floor(v.X / w.epsilon)), int64(math.Floor(v.Y / w.epsilon)), int64(math.Floor(v.Z / w.epsilon))}
+}
+
+// add returns the index of a vertex among a mesh's vertices, adding the vertex to the mesh if no vertex near enough to it has been added yet.
+func (w *vertexWelder) add(m *Mesh, v geom.Vector) uint {
+	if w.exact != nil {
+		index, exists := w.exact[v]
+		if !exists {
+			index = uint(len(m.vertices))
+			w.exact[v] = index
+			m.vertices = append(m.vertices, v)
+		}
+		return index
+	}
+	
+	// Look for a vertex near enough in the vertex's cell and its neighbours.
+	c := w.cell(v)
+	for dx := int64(-1); dx <= 1; dx++ {
+		for dy := int64(-1); dy <= 1; dy++ {
+			for dz := int64(-1); dz <= 1; dz++ {
+				for _, index := range w.cells[[3]int64{c[0] + dx, c[1] + dy, c[2] + dz}] {
+					if m.vertices[index].Sub(v).Len() <= w.epsilon {
+						return index
+					}
+				}
+			}
+		}
+	}
+	
+	index := uint(len(m.vertices))
+	w.cells[c] = append(w.cells[c], index)
+	m.vertices = append(m.vertices, v)
+	return index
+}
\ No newline at end of file
@@ -0,0 +1,146 @@
+// Package throttle provides bandwidth limits for network connections, so that rendering can share a constrained network.
+package throttle
+
+import (
+	"sync"
+	"time"
+	"net"
+)
+
+// chunkFraction controls how much of a second's worth of bytes a throttled connection transfers at once.
+// Smaller chunks give a smoother transfer rate, at the cost of more system calls.
+const chunkFraction float64 = 0.1
+
+// minChunk is the smallest number of bytes a throttled connection transfers at once.
+const minChunk int = 512
+
+// Limiter is a token bucket which limits the average rate at which bytes are transferred.
+type Limiter struct {
+	mu sync.Mutex
+	rate float64	// The number of bytes allowed per second.
+	tokens float64	// The number of bytes which can be transferred right now (negative if transfers are owed).
+	last time.Time	// When the tokens were last topped up.
+}
+
+// NewLimiter creates a limiter which allows rate bytes per second, with bursts of up to one second's worth.
+func NewLimiter(rate uint) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// chunk returns how many bytes should be transferred at once under a limiter.
+func (l *Limiter) chunk() int {
+	if c := int(l.rate * chunkFraction); c > minChunk {
+		return c
+	}
+	return minChunk
+}
+
+// Wait blocks until n bytes can be transferred.
+func (l *Limiter) Wait(n int) {
+	l.mu.Lock()
+	
+	// Top up the tokens, then take what we need (going into debt if necessary).
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	
+	// If we're in debt, wait for it to be paid off.
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	
+	time.Sleep(wait)
+}
+
+// conn is a network connection with limited read and/or write rates.
+type conn struct {
+	net.Conn
+	reads, writes *Limiter	// Nil if the respective direction is unlimited.
+}
+
+// NewConn limits the rates (in bytes per second) at which a connection reads and writes.
+// A rate of zero leaves that direction unlimited.
+// Limiting reads slows the sender down through the network's flow control.
+func NewConn(c net.Conn, readRate, writeRate uint) net.Conn {
+	if readRate == 0 && writeRate == 0 {
+		return c
+	}
+	
+	tc := &conn{Conn: c}
+	if readRate > 0 {
+		tc.reads = NewLimiter(readRate)
+	}
+	if writeRate > 0 {
+		tc.writes = NewLimiter(writeRate)
+	}
+	return tc
+}
+
+// Read reads at most one chunk of data from the connection, then waits until the limit allows it.
+func (c *conn) Read(b []byte) (int, error) {
+	if c.reads == nil {
+		return c.Conn.Read(b)
+	}
+	
+	if chunk := c.reads.chunk(); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.reads.Wait(n)
+	return n, err
+}
+
+// Write writes data to the connection one chunk at a time, waiting until the limit allows each chunk.
+func (c *conn) Write(b []byte) (int, error) {
+	if c.writes == nil {
+		return c.Conn.Write(b)
+	}
+	
+	written := 0
+	for written < len(b) {
+		end := written + c.writes.chunk()
+		if end > len(b) {
+			end = len(b)
+		}
+		
+		c.writes.Wait(end - written)
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// listener is a network listener whose connections have limited read and/or write rates.
+type listener struct {
+	net.Listener
+	readRate, writeRate uint
+}
+
+// NewListener limits the rates (in bytes per second) at which each connection accepted by a listener reads and writes.
+// A rate of zero leaves that direction unlimited.
+func NewListener(l net.Listener, readRate, writeRate uint) net.Listener {
+	if readRate == 0 && writeRate == 0 {
+		return l
+	}
+	
+	return &listener{Listener: l, readRate: readRate, writeRate: writeRate}
+}
+
+// Accept waits for the next connection, and limits its rates.
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	
+	return NewConn(c, l.readRate, l.writeRate), nil
+}
\ No newline at end of file
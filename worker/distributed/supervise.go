@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/bind"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"io/ioutil"
+	"os/exec"
+	"bufio"
+	"time"
+	"flag"
+	"sync"
+	"fmt"
+	"log"
+	"io"
+	"os"
+)
+
+// restartDelay is how long the supervisor waits before restarting a replica which exited.
+const restartDelay time.Duration = time.Second
+
+// replicaFlags are the flags which aren't passed on to replicas as they are.
+var replicaFlags = map[string]bool{"replicas": true, "pprof": true, "bind": true, "chaos-seed": true}
+
+// coreGroup returns the cores (as a range of CPU numbers, e.g. "4-7") replica i is pinned to, when each replica is given procs cores.
+// Neighbouring CPU numbers usually share a NUMA node, so each replica's group is kept together.
+func coreGroup(i uint, procs int) string {
+	first := int(i) * procs % runtime.NumCPU()
+	return fmt.Sprintf("%d-%d", first, first + procs - 1)
+}
+
+// supervise launches replicas copies of this worker, each serving work orders on its own port (orderPort, orderPort + 1, and so on), and restarts any which exit.
+// Replicas are given this worker's flags, except that they don't serve profiles, each binds its own Unix domain socket (the socket's path suffixed with ".i") if one is set, and each injects its own faults (seeded by chaosSeed + i).
+// Replicas share the scene cache (if there is one), whose scenes are written atomically.
+// The machine's cores are split evenly between the replicas: each replica is limited to its share of cores (unless GOMAXPROCS is set), and on Linux (where taskset is installed), it is also pinned to its own group of cores.
+// This function only returns once it is interrupted, after stopping the replicas.
+func supervise(replicas uint, masterAddr string, orderPort uint64, bindAddr string, chaosSeed int64) {
+	// Find this program, so that it can be launched again.
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Could not find the worker's executable: %v.\n", err)
+	}
+	
+	// Pass on every flag which was set, besides the supervisor's own.
+	var shared []string
+	flag.Visit(func(f *flag.Flag) {
+		if !replicaFlags[f.Name] {
+			shared = append(shared, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	
+	// Split the cores between the replicas.
+	procs := runtime.NumCPU() / int(replicas)
+	if procs < 1 {
+		procs = 1
+	}
+	env := os.Environ()
+	if os.Getenv("GOMAXPROCS") == "" {
+		env = append(env, fmt.Sprintf("GOMAXPROCS=%d", procs))
+	}
+	taskset := ""
+	if runtime.GOOS == "linux" {
+		if taskset, err = exec.LookPath("taskset"); err != nil {
+			log.Printf("Could not find taskset, so replicas won't be pinned to their cores: %v.\n", err)
+		}
+	}
+	
+	// Spin off a goroutine to run each replica.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := uint(0); i < replicas; i++ {
+		args := append([]string(nil), shared...)
+		if bind.IsUnix(bindAddr) {
+			args = append(args, fmt.Sprintf("-bind=%s.%d", bindAddr, i))
+		}else if bindAddr != "" {
+			args = append(args, "-bind=" + bindAddr)
+		}
+		args = append(args, fmt.Sprintf("-chaos-seed=%d", chaosSeed + int64(i)))
+		args = append(args, masterAddr, strconv.FormatUint(orderPort + uint64(i), 10))
+		
+		// Launch the replica through taskset (if possible), pinning it to its group of cores.
+		replicaExe := exe
+		if taskset != "" {
+			replicaExe, args = taskset, append([]string{"-c", coreGroup(i, procs), exe}, args...)
+		}
+		
+		wg.Add(1)
+		go func(i uint, exe string, args []string) {
+			defer wg.Done()
+			runReplica(i, exe, args, env, stop)
+		}(i, replicaExe, args)
+	}
+	
+	// Wait until the supervisor is interrupted, then stop the replicas.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Stopping replicas after recieving %v.\n", <-signals)
+	close(stop)
+	wg.Wait()
+}
+
+// runReplica repeatedly launches a replica of this worker, restarting it whenever it exits, until stop is closed.
+// The replica's output is copied to the supervisor's, with each line prefixed by the replica's number.
+func runReplica(i uint, exe string, args, env []string, stop <-chan struct{}) {
+	for {
+		// Launch the replica, capturing its output along with its errors.
+		cmd := exec.Command(exe, args...)
+		cmd.Env = env
+		output, err := cmd.StderrPipe()
+		if err == nil {
+			cmd.Stdout = cmd.Stderr
+			err = cmd.Start()
+		}
+		
+		if err != nil {
+			log.Printf("Could not launch replica %d: %v.\n", i, err)
+		}else{
+			// Copy the replica's output until it exits.
+			copied := make(chan struct{})
+			go func() {
+				defer close(copied)
+				lines := bufio.NewScanner(output)
+				for lines.Scan() {
+					fmt.Fprintf(os.Stderr, "[replica %d] %s\n", i, lines.Text())
+				}
+				
+				// Don't leave the replica blocked on a line too long to scan.
+				io.Copy(ioutil.Discard, output)
+			}()
+			
+			// Wait for the replica to exit, stopping it if the supervisor is interrupted.
+			exited := make(chan error, 1)
+			go func() {
+				<-copied
+				exited <- cmd.Wait()
+			}()
+			select{
+			case err = <-exited:
+			case <-stop:
+				cmd.Process.Signal(syscall.SIGTERM)
+				<-exited
+				return
+			}
+			log.Printf("Replica %d exited: %v.\n", i, err)
+		}
+		
+		// Wait before restarting the replica.
+		select{
+		case <-time.After(restartDelay):
+		case <-stop:
+			return
+		}
+	}
+}
\ No newline at end of file
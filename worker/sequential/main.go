@@ -5,25 +5,27 @@ import (
 	"github.com/mwindels/distributed-raytracer/shared/state"
 	"github.com/mwindels/distributed-raytracer/shared/screen"
 	"github.com/mwindels/distributed-raytracer/shared/input"
+	"github.com/mwindels/distributed-raytracer/shared/app"
 	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
 	"strconv"
+	"runtime"
+	"flag"
+	"fmt"
 	"log"
-	"os"
 )
 
-// draw draws an environment to the screen.
-func draw(window *sdl.Window, surface *sdl.Surface, env *state.EnvMutables) {
-	// Clear the screen.
-	surface.FillRect(nil, 0)
-	
-	// For every pixel on screen...
+// draw draws an environment to the screen, sampling each pixel as set out by opts.
+// The screen is traced by up to threads goroutines at once (see render).
+func draw(window *sdl.Window, surface *sdl.Surface, env *state.EnvMutables, threads uint, opts tracer.SampleOptions) {
+	// Trace every pixel on screen.
 	width, height := int(surface.W), int(surface.H)
+	colours := render(env, width, height, threads, opts)
+	
+	// Clear the screen, then colour every pixel.
+	surface.FillRect(nil, 0)
 	for i := 0; i < width; i++ {
 		for j := 0; j < height; j++ {
-			// If an object was hit, colour a pixel.
-			if colour, valid := tracer.Trace(i, j, width, height, env); valid {
-				surface.Set(i, j, colour)
-			}
+			surface.Set(i, j, colours[i * height + j])
 		}
 	}
 	
@@ -32,8 +34,29 @@ func draw(window *sdl.Window, surface *sdl.Surface, env *state.EnvMutables) {
 }
 
 func main() {
+	// Parse the command line options.
+	glideFrames := flag.Uint("glide-frames", 0, "the number of frames over which the camera glides to a recalled bookmark, rather than jumping straight there (no glide if zero)")
+	collide := flag.Bool("collide", false, "keep the camera from moving through the scene's objects, stopping it just short of them")
+	moveSpeed := flag.Float64("move-speed", 0.0, "how fast (in metres per second) the camera moves while a movement key is held, which can be turned up and down with the plus and minus keys (scaled to the size of the scene if zero)")
+	recordPath := flag.String("record", "", "record the input stream to this file")
+	replayPath := flag.String("replay", "", "replay the input stream recorded in this file instead of using live input")
+	samples := flag.Uint("samples", 0, "the number of rays traced through each pixel (the scene's, or else one, if zero)")
+	mirrorDepth := flag.Uint("mirror-depth", 0, fmt.Sprintf("the most reflections and refractions a ray goes through when using Phong shading (the scene's, or else %d, if zero)", tracer.DefaultMirrorDepth))
+	pathDepth := flag.Uint("path-depth", 0, fmt.Sprintf("the most surfaces a path bounces off of when path tracing (the scene's, or else %d, if zero)", tracer.DefaultPathDepth))
+	areaLightSamples := flag.Uint("area-light-samples", 0, fmt.Sprintf("the number of points on the scene's emitters which light each point when using Phong shading (the scene's, or else %d, if zero)", tracer.DefaultAreaLightSamples))
+	timeOfDay := flag.Float64("time-of-day", -1.0, "the hour (from 0 to 24) the scene's sun starts at (the scene's time if negative)")
+	dayLength := flag.Float64("day-length", -1.0, "how long (in seconds) a whole day takes to pass for the scene's sun, which stands still if zero (the scene's day length if negative)")
+	patternName := flag.String("pattern", "grid", "where within each pixel rays are traced (grid, jittered, halton, sobol, or blue-noise)")
+	integratorName := flag.String("integrator", "phong", "how the colour of each ray is found (phong, or path for path tracing)")
+	threads := flag.Uint("threads", uint(runtime.NumCPU()), "the number of goroutines tracing each frame's tiles at once")
+	outPath := flag.String("out", "", "render without a window, writing each frame to this PNG file (with the frame's number before the extension, if there are several frames), then exit")
+	cameraSpec := flag.String("camera", "", "the camera rendered without a window, either the number of one of the scene's bookmarks or a camera in the JSON form bookmarks are logged in when saved (the scene's camera if empty)")
+	frames := flag.Uint("frames", 1, "the number of frames rendered without a window, over which the camera turns one full circle")
+	flag.Parse()
+	args := flag.Args()
+	
 	// Make sure we have enough parameters.
-	if len(os.Args) != 4 {
+	if len(args) != 3 {
 		log.Fatalln("Improper parameters.  This program requires the parameters:"+
 			"\n\t(1) environment file path"+
 			"\n\t(2) window width"+
@@ -41,19 +64,60 @@ func main() {
 	}
 	
 	// Load in the environment.
-	env, err := state.EnvironmentFromFile(os.Args[1])
+	env, err := state.EnvironmentFromFile(args[0])
 	if err != nil {
-		log.Fatalf("Could not read in environment \"%s\": %v.\n", os.Args[1], err)
+		log.Fatalf("Could not read in environment \"%s\": %v.\n", args[0], err)
 	}
 	
 	// Get the width and height of the screen.
-	width, err := strconv.ParseUint(os.Args[2], 10, 64)
+	width, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		log.Fatalf("Could not parse window width \"%s\": %v.\n", args[1], err)
+	}
+	height, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		log.Fatalf("Could not parse window height \"%s\": %v.\n", args[2], err)
+	}
+	
+	// Move the scene's sun (if necessary).
+	sun, hasSun := env.Mutable().Sun()
+	if *timeOfDay >= 0.0 {
+		if !env.Mutable().SetTimeOfDay(*timeOfDay) {
+			log.Fatalf("Could not set the time of day: the scene has no sun.\n")
+		}
+		sun.Time = *timeOfDay
+	}
+	if *dayLength >= 0.0 {
+		if !hasSun {
+			log.Fatalf("Could not set the length of the day: the scene has no sun.\n")
+		}
+		sun.DayLength = *dayLength
+	}
+	
+	// Choose how to sample each pixel, taking the scene's limits wherever none were given.
+	pattern, err := tracer.ParsePattern(*patternName)
 	if err != nil {
-		log.Fatalf("Could not parse window width \"%s\": %v.\n", os.Args[2], err)
+		log.Fatalf("Could not parse sampling pattern: %v.\n", err)
 	}
-	height, err := strconv.ParseUint(os.Args[3], 10, 64)
+	integrator, err := tracer.ParseIntegrator(*integratorName)
 	if err != nil {
-		log.Fatalf("Could not parse window height \"%s\": %v.\n", os.Args[3], err)
+		log.Fatalf("Could not parse integrator: %v.\n", err)
+	}
+	limits := state.Limits{Samples: *samples, MirrorDepth: *mirrorDepth, PathDepth: *pathDepth, AreaLightSamples: *areaLightSamples}.Or(env.Limits())
+	sampleOpts := tracer.SampleOptions{Samples: limits.Samples, MirrorDepth: limits.MirrorDepth, PathDepth: limits.PathDepth, AreaLightSamples: limits.AreaLightSamples, Pattern: pattern, Integrator: integrator}
+	
+	// Render without a window (if necessary), starting from the given camera.
+	if *outPath != "" {
+		scene := env.Mutable()
+		if *cameraSpec != "" {
+			if scene.Cam, err = parseCamera(*cameraSpec, env.Bookmarks(), scene.Cam.WorldUp()); err != nil {
+				log.Fatalf("Could not parse camera \"%s\": %v.\n", *cameraSpec, err)
+			}
+		}
+		if err := renderOffline(scene, sun, hasSun, int(width), int(height), *frames, *threads, sampleOpts, *outPath); err != nil {
+			log.Fatalf("Could not render without a window: %v.\n", err)
+		}
+		return
 	}
 	
 	// Start the screen.
@@ -63,31 +127,68 @@ func main() {
 	}
 	defer screen.StopScreen(window)
 	
-	// Run the input/update/render loop.
-	scene := env.Mutable()
-	/*firstUpdate := sdl.GetTicks()*/
-	var prevUpdate, currentUpdate uint32
-	for running, /*frame,*/ moveDirs, yaw, pitch := true, /*uint(0),*/ uint8(0), 0.0, 0.0; running; /*frame++*/ {
-		prevUpdate = sdl.GetTicks()
-		
-		// Handle new inputs.
-		running, moveDirs, yaw, pitch = input.HandleInputs(moveDirs, int(surface.W), int(surface.H))
-		
-		// If the camera needs to move, move it.
-		scene.Cam.Move(0.1, moveDirs & input.MoveForward != 0, moveDirs & input.MoveBackward != 0, moveDirs & input.MoveLeftward != 0, moveDirs & input.MoveRightward != 0, moveDirs & input.MoveUpward != 0, moveDirs & input.MoveDownward != 0)
-		
-		// If the camera needs to rotate, rotate it.
-		scene.Cam.Yaw(yaw * scene.Cam.Fov / 2.0)
-		scene.Cam.Pitch(pitch * (float64(surface.H) / float64(surface.W)) * scene.Cam.Fov / 2.0)
-		
-		// Draw the screen.
-		draw(window, surface, scene)
-		
-		// If there's still time before the next frame needs to be drawn, wait.
-		currentUpdate = sdl.GetTicks()
-		/*log.Printf("\t%f\n", float64(frame) / (float64(currentUpdate - firstUpdate) / 1000.0))*/
-		if currentUpdate - prevUpdate < screen.MsPerFrame {
-			sdl.Delay(screen.MsPerFrame - (currentUpdate - prevUpdate))
+	// Set up input recording and replay (if necessary).
+	var recorder *input.Recorder
+	if *recordPath != "" {
+		if recorder, err = input.NewRecorder(*recordPath); err != nil {
+			log.Fatalf("Could not record input to \"%s\": %v.\n", *recordPath, err)
+		}
+		defer recorder.Close()
+	}
+	var player *input.Player
+	if *replayPath != "" {
+		if player, err = input.NewPlayer(*replayPath); err != nil {
+			log.Fatalf("Could not replay input from \"%s\": %v.\n", *replayPath, err)
 		}
 	}
+	
+	// Run the input/update/render loop, starting with the environment's bookmarks.
+	// The camera moves at the same physical speed (if set), whatever units the environment is written in, or else crosses the scene in the same time whatever its size.
+	scene := env.Mutable()
+	speed := app.DefaultMoveSpeed(scene)
+	if *moveSpeed > 0.0 {
+		speed = scene.Metres(*moveSpeed)
+	}
+	hooks := app.Hooks{
+		Camera: func() state.Camera {
+			return scene.Cam
+		},
+		Render: func(cam state.Camera) error {
+			scene.Cam = cam
+			draw(window, surface, scene, *threads, sampleOpts)
+			return nil
+		},
+		SetTimeOfDay: func(hour float64) error {
+			if !scene.SetTimeOfDay(hour) {
+				return fmt.Errorf("The scene has no sun.")
+			}
+			return nil
+		},
+		ToggleLight: func(index int) (bool, error) {
+			if index < 0 || index >= len(scene.Lights) {
+				return false, fmt.Errorf("No light with index %d.", index)
+			}
+			on := scene.Lights[index].Off
+			scene.SwitchLight(index, on)
+			return on, nil
+		},
+	}
+	
+	// Keep the camera from moving through the scene (if necessary).
+	if *collide {
+		hooks.Clearance = scene.Clearance
+	}
+	app.Run(app.Config{
+		Width: int(surface.W),
+		Height: int(surface.H),
+		MoveSpeed: speed,
+		GlideFrames: *glideFrames,
+		CollisionMargin: scene.Metres(input.CollisionMargin),
+		Bookmarks: env.Bookmarks(),
+		Sun: sun,
+		HasSun: hasSun,
+		Recorder: recorder,
+		Player: player,
+		Hooks: hooks,
+	})
 }
\ No newline at end of file
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/screen"
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"encoding/json"
+	"path/filepath"
+	"image/png"
+	"strconv"
+	"strings"
+	"image"
+	"math"
+	"fmt"
+	"log"
+	"os"
+)
+
+// parseCamera parses a camera given on the command line, which is either the number of one of a scene's bookmarks, or a camera in the JSON form bookmarks are stored (and logged when saved) in.
+// The camera is set in a scene whose up vector is up.
+func parseCamera(s string, bookmarks state.Bookmarks, up geom.Vector) (state.Camera, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		bookmark, set := bookmarks.Get(n)
+		if !set {
+			return state.Camera{}, fmt.Errorf("Bookmark %d has not been saved.", n)
+		}
+		return bookmark.Cam, nil
+	}
+	
+	var stored state.StoredCamera
+	if err := json.Unmarshal([]byte(s), &stored); err != nil {
+		return state.Camera{}, err
+	}
+	return stored.CameraWithUp(up)
+}
+
+// framePath returns the path frame f of some number of frames is written to.
+// A single frame is written to out itself, while each of several frames has its number inserted before out's extension.
+func framePath(out string, f, frames uint) string {
+	if frames <= 1 {
+		return out
+	}
+	ext := filepath.Ext(out)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(out, ext), f, ext)
+}
+
+// writePNG writes a width by height frame of colours (laid out as by render) to the PNG file at path.
+func writePNG(path string, colours []colour.RGB, width, height int) error {
+	frame := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			frame.Set(i, j, colours[i * height + j])
+		}
+	}
+	
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, frame); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// renderOffline renders frames of a scene on a width by height screen without a window, writing each to a PNG file (see framePath).
+// The camera turns one full circle over the frames, and a moving sun moves as though the frames were drawn at the window's frame rate.
+// Each frame is traced by up to threads goroutines at once, sampling each pixel as set out by opts.
+func renderOffline(scene *state.EnvMutables, sun state.Sun, hasSun bool, width, height int, frames, threads uint, opts tracer.SampleOptions, out string) error {
+	if frames == 0 {
+		frames = 1
+	}
+	
+	for f := uint(0); f < frames; f++ {
+		// Move the sun along with the time since the first frame (if necessary).
+		if hasSun && sun.DayLength > 0.0 {
+			scene.SetTimeOfDay(sun.Time + 24.0 * float64(f * uint(screen.MsPerFrame)) / 1000.0 / sun.DayLength)
+		}
+		
+		// Trace the frame, then write it out.
+		path := framePath(out, f, frames)
+		if err := writePNG(path, render(scene, width, height, threads, opts), width, height); err != nil {
+			return fmt.Errorf("Could not write frame %d to \"%s\": %v.", f, path, err)
+		}
+		log.Printf("Frame %d written to \"%s\".\n", f, path)
+		
+		// Turn the camera towards the next frame.
+		scene.Cam.Yaw(2.0 * math.Pi / float64(frames))
+	}
+	return nil
+}
\ No newline at end of file
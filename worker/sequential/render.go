@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"image"
+	"sync"
+)
+
+// tileSize is the width and height (in pixels) of the tiles each frame is split into, so that each thread traces a tile at a time.
+// Tiles are kept small, so that threads which finish their tiles early can take on the rest of the frame's tiles.
+const tileSize int = 32
+
+// render traces every pixel of a width by height screen, sampling each pixel as set out by opts.
+// The screen is split into tiles, which are traced by up to threads goroutines at once (one, if zero).
+// The colour of pixel (i, j) is returned at index i * height + j.
+func render(env *state.EnvMutables, width, height int, threads uint, opts tracer.SampleOptions) []colour.RGB {
+	colours := make([]colour.RGB, width * height, width * height)
+	if threads == 0 {
+		threads = 1
+	}
+	
+	// The camera math is worked out once for the whole screen.
+	opts.Frame = tracer.NewFrame(env, width, height)
+	
+	// Queue up every tile.
+	tiles := make(chan image.Rectangle, ((width + tileSize - 1) / tileSize) * ((height + tileSize - 1) / tileSize))
+	for x := 0; x < width; x += tileSize {
+		for y := 0; y < height; y += tileSize {
+			tiles <- image.Rect(x, y, x + tileSize, y + tileSize).Intersect(image.Rect(0, 0, width, height))
+		}
+	}
+	close(tiles)
+	
+	// Spin off the threads, each of which traces tiles until there are none left.
+	// Every pixel belongs to exactly one tile, so the threads never write the same colour.
+	var wg sync.WaitGroup
+	for t := uint(0); t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			
+			for tile := range tiles {
+				for i := tile.Min.X; i < tile.Max.X; i++ {
+					for j := tile.Min.Y; j < tile.Max.Y; j++ {
+						// Colour a pixel (with the background, if nothing was hit).
+						colours[i * height + j] = tracer.TraceSample(i, j, width, height, env, opts).Colour
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	
+	return colours
+}
\ No newline at end of file
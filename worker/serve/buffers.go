@@ -0,0 +1,81 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"google.golang.org/grpc/stats"
+	"context"
+	"sync"
+)
+
+// colourBuffers holds byte buffers for the colours of trace results, so that a busy worker needn't allocate a new buffer for every work order.
+var colourBuffers = sync.Pool{New: func() interface{} {return new([]byte)}}
+
+// releaseKey is the context key under which each call to a trace server keeps its releaser.
+type releaseKey struct{}
+
+// releaser collects the buffers used by a single call to a trace server, so that they can be reused once the call's results have been sent.
+type releaser struct {
+	mu sync.Mutex
+	buffers []*[]byte
+}
+
+// colourBuffer returns a zeroed buffer of n bytes for the colours of some trace results.
+// If ctx belongs to a call to a trace server, the buffer comes from the pool and goes back to it once the call ends.
+// Otherwise the results might be kept, so the buffer is allocated and left to the garbage collector.
+func colourBuffer(ctx context.Context, n int) []byte {
+	r, ok := ctx.Value(releaseKey{}).(*releaser)
+	if !ok {
+		return make([]byte, n, n)
+	}
+	
+	buffer := colourBuffers.Get().(*[]byte)
+	if cap(*buffer) < n {
+		*buffer = make([]byte, n, n)
+	}else{
+		for i := range (*buffer)[:n] {
+			(*buffer)[i] = 0
+		}
+	}
+	
+	r.mu.Lock()
+	r.buffers = append(r.buffers, buffer)
+	r.mu.Unlock()
+	
+	return (*buffer)[:n]
+}
+
+// releaseHandler implements the stats.Handler interface, giving each call to a trace server a releaser, and handing its buffers back to the pool once the call has ended.
+// Calls end after their results have been sent, so the buffers are no longer in use by then.
+type releaseHandler struct{}
+
+// TagRPC gives a call its own releaser.
+func (h releaseHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, releaseKey{}, &releaser{})
+}
+
+// HandleRPC hands a call's buffers back to the pool once it ends.
+func (h releaseHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if _, ended := s.(*stats.End); !ended {
+		return
+	}
+	r, ok := ctx.Value(releaseKey{}).(*releaser)
+	if !ok {
+		return
+	}
+	
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	for _, buffer := range r.buffers {
+		colourBuffers.Put(buffer)
+	}
+	r.buffers = nil
+}
+
+// TagConn does nothing.
+func (h releaseHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn does nothing.
+func (h releaseHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
\ No newline at end of file
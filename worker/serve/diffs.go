@@ -0,0 +1,138 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"bytes"
+	"sync"
+	"fmt"
+)
+
+// diffCacheSize is the number of decoded diffs (and of prepared frames) a tracer keeps, which should cover every frame in flight at once.
+const diffCacheSize int = 8
+
+// decodedDiff is a diff (the mutable state of a frame) which has been decoded and linked to a tracer's scene.
+type decodedDiff struct {
+	hash [sha256.Size]byte
+	env *state.EnvMutables
+	err error
+	ready chan struct{}		// Closed once the diff has been decoded (or failed to decode).
+}
+
+// decodeDiff decodes a diff and links it to scene, then lets any work orders waiting on it know.
+// If decoding panics (such as on a malformed diff), the diff fails to decode rather than leaving the work orders waiting on it forever.
+func decodeDiff(d *decodedDiff, diff []byte, scene state.Environment) {
+	defer close(d.ready)
+	defer func() {
+		if r := recover(); r != nil {
+			d.env, d.err = nil, fmt.Errorf("Decoding the diff panicked: %v.", r)
+		}
+	}()
+	
+	env := &state.EnvMutables{}
+	if err := gob.NewDecoder(bytes.NewBuffer(diff)).Decode(env); err != nil {
+		d.err = err
+		return
+	}
+	env.LinkTo(scene)
+	d.env = env
+}
+
+// diffCache keeps the diffs of recent frames decoded, so that each of a frame's work orders needn't decode its diff (and rebuild its objects' R-Tree) again.
+// Diffs are identified by their hash, so a diff is only ever reused for work orders which carry exactly the same diff.
+type diffCache struct {
+	mu sync.Mutex
+	recent *list.List	// The decoded diffs, most recently used first.
+	
+	frames map[uint64]*state.EnvMutables	// The decoded diffs of the frames prepared by the master, by frame.
+	prepared []uint64						// The prepared frames, oldest first.
+}
+
+// newDiffCache creates an empty diff cache.
+func newDiffCache() *diffCache {
+	return &diffCache{recent: list.New(), frames: make(map[uint64]*state.EnvMutables)}
+}
+
+// prepare decodes the diff of a frame and links it to scene, so that the frame's work orders can refer to the frame rather than carry its diff.
+// Only the most recently prepared frames are kept.
+func (c *diffCache) prepare(frame uint64, diff []byte, scene state.Environment) error {
+	env, err := c.get(diff, scene)
+	if err != nil {
+		return err
+	}
+	
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	if _, exists := c.frames[frame]; !exists {
+		c.prepared = append(c.prepared, frame)
+	}
+	c.frames[frame] = env
+	for len(c.prepared) > diffCacheSize {
+		delete(c.frames, c.prepared[0])
+		c.prepared = c.prepared[1:]
+	}
+	return nil
+}
+
+// frame returns the decoded diff of a prepared frame, or false if the frame hasn't been prepared (or has since been dropped).
+// The returned mutable state is shared, so it mustn't be modified.
+func (c *diffCache) frame(frame uint64) (*state.EnvMutables, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	env, exists := c.frames[frame]
+	return env, exists
+}
+
+// get returns a diff, decoded and linked to scene.
+// If the diff is already being decoded by another work order, this waits for that decode rather than decoding it again.
+// The returned mutable state is shared, so it mustn't be modified.
+func (c *diffCache) get(diff []byte, scene state.Environment) (*state.EnvMutables, error) {
+	hash := sha256.Sum256(diff)
+	
+	// Find the diff, or start decoding it if it isn't cached.
+	c.mu.Lock()
+	var d *decodedDiff
+	for e := c.recent.Front(); e != nil; e = e.Next() {
+		if e.Value.(*decodedDiff).hash == hash {
+			d = e.Value.(*decodedDiff)
+			c.recent.MoveToFront(e)
+			break
+		}
+	}
+	decode := d == nil
+	if decode {
+		d = &decodedDiff{hash: hash, ready: make(chan struct{})}
+		c.recent.PushFront(d)
+		if c.recent.Len() > diffCacheSize {
+			c.recent.Remove(c.recent.Back())
+		}
+	}
+	c.mu.Unlock()
+	
+	if !decode {
+		<-d.ready
+		return d.env, d.err
+	}
+	
+	// Decode the diff, without holding the lock (so that other diffs can be found meanwhile).
+	decodeDiff(d, diff, scene)
+	
+	// Don't keep diffs which couldn't be decoded, so that they're tried again.
+	if d.err != nil {
+		c.mu.Lock()
+		for e := c.recent.Front(); e != nil; e = e.Next() {
+			if e.Value.(*decodedDiff) == d {
+				c.recent.Remove(e)
+				break
+			}
+		}
+		c.mu.Unlock()
+	}
+	
+	return d.env, d.err
+}
\ No newline at end of file
@@ -0,0 +1,76 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"strings"
+	"time"
+	"net"
+	"fmt"
+	"log"
+)
+
+// IdleMode controls what a worker does when no work orders or heartbeats come in from its master within its idle timeout.
+type IdleMode uint8
+
+// These constants are the possible idle modes.
+const (
+	IdleStop IdleMode = iota	// The trace server is closed, and the worker registers with its master again before serving again.
+	IdleStandby					// The trace server keeps serving, and the worker registers with its master again in the background, picking up its new scene.
+	IdleNever					// The trace server keeps serving, and the worker never registers again (unless the server is interrupted).
+	numIdleModes
+)
+
+// idleModeNames holds the name of each idle mode.
+var idleModeNames = [numIdleModes]string{"stop", "standby", "never"}
+
+// String returns the name of an idle mode.
+func (m IdleMode) String() string {
+	if m < numIdleModes {
+		return idleModeNames[m]
+	}
+	return fmt.Sprintf("IdleMode(%d)", uint8(m))
+}
+
+// ParseIdleMode finds the idle mode with some name (ignoring case).
+func ParseIdleMode(name string) (IdleMode, error) {
+	for m := IdleMode(0); m < numIdleModes; m++ {
+		if strings.EqualFold(name, idleModeNames[m]) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown idle mode \"%s\".", name)
+}
+
+// standBy serves work orders on listener like Serve, but rather than closing the server when its idle timeout lapses, registers with the master at registerAddr again.
+// Failed registrations are retried until one succeeds, and the scene the master sends replaces the one being traced.
+// Since the server is never closed, the error which interrupted it is always returned.
+func (t *Tracer) standBy(registerAddr string, listenPort uint32, listener net.Listener) error {
+	// Spin off the trace server.
+	served := make(chan error, 1)
+	go func() {
+		served <- t.Serve(listener)
+	}()
+	
+	var retry <-chan time.Time
+	for {
+		// Wait until the master has gone quiet (or the last registration needs retrying).
+		select{
+		case err := <-served:
+			return err
+		case <-t.lapsed:
+			log.Printf("Standing by after recieving no orders or heartbeats.\n")
+		case <-retry:
+		}
+		retry = nil
+		
+		// Register again under a new session, and trace the master's scene from now on.
+		session := newSession()
+		scene, screenWidth, screenHeight, err := register(registerAddr, listenPort, session, t.opts)
+		if err != nil {
+			log.Printf("Failed to register: %v.\n", err)
+			retry = time.After(time.Millisecond * time.Duration(t.opts.RegisterFrequency))
+			continue
+		}
+		t.replaceScene(scene, screenWidth, screenHeight, session)
+	}
+}
\ No newline at end of file
@@ -0,0 +1,87 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"path/filepath"
+	"io/ioutil"
+	"strings"
+	"fmt"
+	"os"
+)
+
+// sceneExtension is the extension of each scene file in a scene cache directory.
+const sceneExtension string = ".scene"
+
+// validSceneHash returns whether a scene hash (as sent by the master) is safe to use as a file name.
+func validSceneHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, ch := range hash {
+		if !strings.ContainsRune("0123456789abcdef", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedScenes lists the hashes of the scenes cached in a directory.
+// Directories which don't exist (yet) hold no scenes.
+func cachedScenes(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	
+	var hashes []string
+	for _, f := range files {
+		if hash := strings.TrimSuffix(f.Name(), sceneExtension); !f.IsDir() && hash != f.Name() && validSceneHash(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// loadScene reads the scene (encoded as in comms.MasterState) with some hash from a cache directory.
+func loadScene(dir, hash string) ([]byte, error) {
+	if !validSceneHash(hash) {
+		return nil, fmt.Errorf("Invalid scene hash \"%s\".", hash)
+	}
+	return ioutil.ReadFile(filepath.Join(dir, hash + sceneExtension))
+}
+
+// saveScene writes a scene (encoded as in comms.MasterState) with some hash to a cache directory, creating the directory if necessary.
+// The scene is written to a temporary file first, so a worker which crashes part way through never leaves a broken scene in the cache.
+func saveScene(dir, hash string, data []byte) error {
+	if !validSceneHash(hash) {
+		return fmt.Errorf("Invalid scene hash \"%s\".", hash)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	
+	temp, err := ioutil.TempFile(dir, hash + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(dir, hash + sceneExtension))
+}
+
+// dropScene removes the scene with some hash from a cache directory.
+func dropScene(dir, hash string) {
+	if validSceneHash(hash) {
+		os.Remove(filepath.Join(dir, hash + sceneExtension))
+	}
+}
\ No newline at end of file
@@ -0,0 +1,234 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/chaos"
+	"github.com/mwindels/distributed-raytracer/shared/bind"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"google.golang.org/grpc"
+	"encoding/binary"
+	"encoding/gob"
+	"crypto/rand"
+	"context"
+	"bytes"
+	"time"
+	"math"
+	"net"
+	"fmt"
+	"log"
+)
+
+// These constants are the values used by workers whose options leave them unset.
+const (
+	DefaultRegisterFrequency uint = 500	// The minimum amount of time a worker will wait before trying to re-register itself after a failure.
+	DefaultIdleTimeout uint = 2000		// How long a worker will wait for trace requests and heartbeats before acting on its idle mode.
+)
+
+// TraceFunc traces a single ray through the pixel (i, j) of a width by height screen and into a scene.
+// It returns the colour of the pixel, and whether anything was hit.
+type TraceFunc func(i, j, width, height int, env *state.EnvMutables) (colour.RGB, bool)
+
+// SampleFunc traces a single ray through the pixel (i, j) of a width by height screen and into a scene.
+// It returns everything found along the way, which is used to fill any AOVs requested by the master.
+// The pixel is sampled as requested by the master, which may ask for blocks of pixels to be traced instead (see tracer.TraceSample).
+type SampleFunc func(i, j, width, height int, env *state.EnvMutables, opts tracer.SampleOptions) tracer.Sample
+
+// Options controls how a worker registers with a master and serves its work orders.
+// All times are measured in milliseconds.
+type Options struct {
+	RegisterFrequency uint	// The minimum amount of time to wait before trying to re-register after a failure.
+	IdleTimeout uint		// How long to wait for trace requests and heartbeats before acting on the idle mode.
+	Idle IdleMode			// What to do when no trace requests or heartbeats come in within the idle timeout (IdleStop by default).
+	Trace TraceFunc			// The function used to trace each pixel (tracer.Trace if nil).
+	Sample SampleFunc		// The function used to trace each pixel with its AOVs (tracer.TraceSample if nil, or Trace without AOVs if Trace is set).
+	Chaos *chaos.Monkey		// Injects faults into the trace server's RPCs and kills it on a schedule (no faults if nil).
+	ResultRate uint			// The most bytes per second of results sent to the master (unlimited if zero).
+	MemoryBudget uint		// The most megabytes of meshes kept in memory, with the least recently used meshes evicted and fetched again when needed (unlimited if zero).
+	SceneCache string		// A directory in which scenes are cached, so that they needn't be sent again when re-registering (no cache if empty).
+	Host string				// The host name or IP address the master reaches the worker at (the bound address, or else the address the worker registers from, if empty).
+	Bind string				// The address, network interface, or Unix domain socket on which work orders are served (every interface if empty, see bind.Host).
+}
+
+// withDefaults returns a copy of some options with every unset value replaced by its default.
+func (opts Options) withDefaults() Options {
+	if opts.RegisterFrequency == 0 {
+		opts.RegisterFrequency = DefaultRegisterFrequency
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.Sample == nil {
+		if opts.Trace == nil {
+			opts.Sample = tracer.TraceSample
+		}else{
+			// Custom trace functions don't produce AOVs, so fill them with the values for a miss.
+			// They also only trace pixels, so blocks of pixels are traced through their centres.
+			trace := opts.Trace
+			opts.Sample = func(i, j, width, height int, env *state.EnvMutables, opts tracer.SampleOptions) tracer.Sample {
+				if s := int(opts.Scale); s > 1 {
+					i, j = i * s + s / 2, j * s + s / 2
+				}
+				c, hit := trace(i, j, width, height, env)
+				return tracer.Sample{Colour: c, Depth: math.Inf(1), Hit: hit}
+			}
+		}
+	}
+	if opts.Trace == nil {
+		opts.Trace = tracer.Trace
+	}
+	
+	return opts
+}
+
+// Register registers a worker with the master at registerAddr for later communication on listenPort using the tracer it returns.
+func Register(registerAddr string, listenPort uint32, opts Options) (*Tracer, error) {
+	opts = opts.withDefaults()
+	
+	session := newSession()
+	scene, screenWidth, screenHeight, err := register(registerAddr, listenPort, session, opts)
+	if err != nil {
+		return nil, err
+	}
+	t := NewTracer(scene, screenWidth, screenHeight, opts)
+	t.scene.session = session
+	return t, nil
+}
+
+// newSession picks a random (non-zero) session for a registration, so that each registration of a worker can be told apart from the rest.
+func newSession() uint64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return uint64(time.Now().UnixNano()) | 1
+		}
+		if session := binary.LittleEndian.Uint64(b[:]); session != 0 {
+			return session
+		}
+	}
+}
+
+// register registers a worker with the master at registerAddr for later communication on listenPort, under some session.
+// It returns the master's scene, and the size of the screen the scene is drawn on.
+func register(registerAddr string, listenPort uint32, session uint64, opts Options) (state.Environment, uint, uint, error) {
+	// Connect to the master.
+	conn, err := grpc.Dial(registerAddr, grpc.WithInsecure())
+	if err != nil {
+		return state.Environment{}, 0, 0, err
+	}
+	defer conn.Close()
+	
+	// Create a registration client.
+	client := comms.NewRegistrationClient(conn)
+	
+	// Attempt to register, listing the scenes we've cached.
+	stateMsg, err := client.Register(context.Background(), &comms.WorkerLink{Port: listenPort, CachedScenes: cachedScenes(opts.SceneCache), Host: opts.Host, Session: session, NeverIdle: opts.Idle == IdleNever})
+	if err != nil {
+		return state.Environment{}, 0, 0, err
+	}
+	
+	// Find the scene's state, either in the response or in our cache.
+	data := stateMsg.GetState()
+	if data != nil {
+		if opts.SceneCache != "" {
+			if err := saveScene(opts.SceneCache, stateMsg.GetSceneHash(), data); err != nil {
+				log.Printf("Could not cache the scene: %v.\n", err)
+			}
+		}
+	}else if opts.SceneCache != "" {
+		if data, err = loadScene(opts.SceneCache, stateMsg.GetSceneHash()); err != nil {
+			return state.Environment{}, 0, 0, fmt.Errorf("Could not load the cached scene: %v.", err)
+		}
+	}else{
+		return state.Environment{}, 0, 0, fmt.Errorf("No scene data recieved.")
+	}
+	
+	// Decode the scene's state.
+	// If a cached scene can't be decoded, drop it so that the master sends it again next time.
+	var newScene state.Environment
+	if err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&newScene); err != nil {
+		if stateMsg.GetState() == nil {
+			dropScene(opts.SceneCache, stateMsg.GetSceneHash())
+		}
+		return state.Environment{}, 0, 0, err
+	}
+	
+	// Keep the scene's meshes within the memory budget (if necessary).
+	if opts.MemoryBudget > 0 {
+		newScene.UseCache(state.NewMeshCache(uint64(opts.MemoryBudget) << 20, func(key string) ([]byte, error) {
+			return fetchMesh(registerAddr, key)
+		}))
+	}
+	
+	return newScene, uint(stateMsg.GetScreenWidth()), uint(stateMsg.GetScreenHeight()), nil
+}
+
+// fetchMesh fetches the mesh with some key from the master at registerAddr, encoded as by state.Environment.EncodeMesh.
+func fetchMesh(registerAddr, key string) ([]byte, error) {
+	// Connect to the master.
+	conn, err := grpc.Dial(registerAddr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	
+	// Fetch the mesh.
+	meshMsg, err := comms.NewRegistrationClient(conn).FetchMesh(context.Background(), &comms.MeshKey{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return meshMsg.GetMesh(), nil
+}
+
+// Run repeatedly registers a worker with the master at masterAddr, then serves the master's work orders on orderPort.
+// Whenever the trace server closes, the worker waits and tries to register again, so this function never returns.
+// Workers on standby keep their trace server open while they register again, only closing it if it is interrupted (see IdleMode).
+func Run(masterAddr string, orderPort uint, opts Options) {
+	opts = opts.withDefaults()
+	
+	// Work out where to listen for work orders.
+	listenAddr, err := bind.Address(opts.Bind, orderPort)
+	if err != nil {
+		log.Fatalf("Could not resolve bind address: %v.\n", err)
+	}
+	
+	// Have the master send work orders to the socket we're bound to, or (unless told otherwise) the address we're bound to if it's a particular address.
+	if bind.IsUnix(listenAddr) {
+		opts.Host = listenAddr
+	}else if host, _, _ := net.SplitHostPort(listenAddr); opts.Host == "" && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			opts.Host = host
+		}
+	}
+	
+	for {
+		// Try to register.
+		t, err := Register(masterAddr, uint32(orderPort), opts)
+		if err == nil {
+			// Create a listener for the master.
+			listener, err := bind.Listen(listenAddr)
+			if err != nil {
+				log.Fatalf("Failed to listen on \"%s\": %v.\n", listenAddr, err)
+			}
+			
+			// Serve incoming work orders, standing by when idle (if necessary).
+			if opts.Idle == IdleStandby {
+				err = t.standBy(masterAddr, uint32(orderPort), listener)
+			}else{
+				err = t.Serve(listener)
+			}
+			if err != nil {
+				log.Printf("Tracer interrupted: %v.\n", err)
+			}else{
+				log.Printf("Tracer timed out after recieving no orders or heartbeats.\n")
+			}
+		}else{
+			log.Printf("Failed to register: %v.\n", err)
+		}
+		
+		// Wait before trying to register again.
+		time.Sleep(time.Millisecond * time.Duration(opts.RegisterFrequency))
+	}
+}
\ No newline at end of file
@@ -0,0 +1,360 @@
+// Package serve provides the registration loop and trace server lifecycle of a distributed worker, so that custom workers can reuse them.
+package serve
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/comms"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"github.com/mwindels/distributed-raytracer/shared/throttle"
+	"github.com/mwindels/distributed-raytracer/worker/shared/tracer"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc"
+	"crypto/sha256"
+	"runtime/debug"
+	"context"
+	"time"
+	"sync"
+	"net"
+	"fmt"
+	"log"
+)
+
+// Tracer implements the comms.TraceServer interface.
+type Tracer struct {
+	mu sync.RWMutex
+	scene *tracedScene				// The scene being traced, which is replaced whenever a worker on standby registers again.
+	resetTraceTimeout chan struct{}
+	lapsed chan struct{}			// Is sent a value whenever the idle timeout of a tracer on standby lapses.
+	opts Options
+}
+
+// tracedScene is a scene being traced, along with the screen it is drawn on and the diffs decoded for it.
+type tracedScene struct {
+	// No lock here because we never mutate this data.
+	env state.Environment
+	screenWidth, screenHeight uint
+	session uint64		// The registration the scene was received under (zero if the tracer never registered).
+	
+	diffs *diffCache	// The recently decoded diffs, shared by the work orders of each frame (threadsafe).
+}
+
+// NewTracer creates a tracer for a scene drawn on a screenWidth by screenHeight screen, without registering it with a master.
+// This is useful for workers which run in the same process as their master.
+func NewTracer(scene state.Environment, screenWidth, screenHeight uint, opts Options) *Tracer {
+	return &Tracer{
+		scene: &tracedScene{env: scene, screenWidth: screenWidth, screenHeight: screenHeight, diffs: newDiffCache()},
+		resetTraceTimeout: make(chan struct{}),
+		lapsed: make(chan struct{}, 1),
+		opts: opts.withDefaults(),
+	}
+}
+
+// current returns the scene a tracer is tracing right now.
+func (t *Tracer) current() *tracedScene {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	
+	return t.scene
+}
+
+// replaceScene has a tracer trace a new scene, drawn on a screenWidth by screenHeight screen and received under some registration session.
+// Work orders already being traced finish tracing the old scene, but the diffs decoded for it are dropped, since they're linked to the old scene.
+func (t *Tracer) replaceScene(scene state.Environment, screenWidth, screenHeight uint, session uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	
+	t.scene = &tracedScene{env: scene, screenWidth: screenWidth, screenHeight: screenHeight, session: session, diffs: newDiffCache()}
+}
+
+// timeoutReset resets a tracer's trace timeout.
+func (t *Tracer) timeoutReset() {
+	defer func() {
+		recover()
+	}()
+	
+	// Try to reset the trace timeout.
+	// If the channel is closed, this will panic and return immediately.
+	t.resetTraceTimeout <- struct{}{}
+}
+
+// putColour writes a colour into a buffer of AOV values, which has three values per pixel, at pixel idx.
+func putColour(buffer []float32, idx int, c colour.RGB) {
+	r, g, b := c.Floats()
+	buffer[3 * idx], buffer[3 * idx + 1], buffer[3 * idx + 2] = float32(r), float32(g), float32(b)
+}
+
+// BulkTrace traces a batch of rays.
+// Tracing is abandoned if the call is cancelled, or if its timeout or the work order's deadline passes, since the results would be of no use.
+func (t *Tracer) BulkTrace(ctx context.Context, req *comms.WorkOrder) (*comms.TraceResults, error) {
+	return t.TraceOrder(ctx, req)
+}
+
+// TraceOrder traces a work order exactly as BulkTrace does, without counting as a call to the tracer's server.
+// This lets a tracer which isn't serving (such as one the master uses to check its workers) trace work orders directly.
+// If tracing the work order panics, the panic is returned as an error naming the work order, rather than taking the whole worker down with it.
+func (t *Tracer) TraceOrder(ctx context.Context, req *comms.WorkOrder) (results *comms.TraceResults, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from a panic while tracing %s: %v.\n%s", describeOrder(req), r, debug.Stack())
+			results, err = nil, status.Errorf(codes.Internal, "Panicked while tracing %s: %v.", describeOrder(req), r)
+		}
+	}()
+	
+	return t.traceOrder(ctx, req)
+}
+
+// describeOrder describes which part of which frame a work order covers, for reporting problems with it.
+// The frame's diff is identified by its hash (if the order carries it), since frames are only numbered if they were prepared.
+func describeOrder(req *comms.WorkOrder) string {
+	description := fmt.Sprintf("the %dx%d area at (%d, %d)", req.GetWidth(), req.GetHeight(), req.GetX(), req.GetY())
+	if req.GetFrame() != 0 {
+		description += fmt.Sprintf(" of frame %d", req.GetFrame())
+	}
+	if req.GetDiff() != nil {
+		hash := sha256.Sum256(req.GetDiff())
+		description += fmt.Sprintf(" (diff %x)", hash[:8])
+	}
+	return description
+}
+
+// traceOrder traces a work order (see TraceOrder).
+func (t *Tracer) traceOrder(ctx context.Context, req *comms.WorkOrder) (*comms.TraceResults, error) {
+	start := time.Now()
+	
+	// Stop at the work order's deadline, as well as the call's own.
+	// The call's own timeout is relative, so it still applies if the worker's clock disagrees with the master's.
+	if d := req.GetDeadline(); d != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, d))
+		defer cancel()
+	}
+	
+	// Set up this call's results, including any requested AOVs.
+	// If the frame is traced at a reduced resolution, there is one result for each block of pixels rather than each pixel.
+	// If the frame is traced in a checkerboard, there are only results for the pixels (or blocks) in the checkerboard.
+	// Likewise, if the order is interleaved, there are only results for the rows it covers.
+	// The results are laid out as described by their layout (see comms.TraceResults.Index).
+	// If the order came through the tracer's server, the colours' buffer is reused once the results have been sent.
+	scale := int(req.GetScale())
+	if scale < 1 {
+		scale = 1
+	}
+	xInit, yInit, width, height := tracer.Blocks(int(req.GetX()), int(req.GetY()), int(req.GetWidth()), int(req.GetHeight()), scale)
+	if !comms.ValidBitDepth(req.GetBitDepth()) {
+		return nil, fmt.Errorf("Colours can't be traced with %d bits per channel.", req.GetBitDepth())
+	}
+	scene := t.current()
+	results := &comms.TraceResults{BitDepth: req.GetBitDepth(), Session: scene.session}
+	results.SetLayout(xInit, yInit, width, height, scale, uint(req.GetCheckerboard()), uint(req.GetInterleave()))
+	count := results.Slots()
+	aovs := req.GetAovs()
+	results.Colours = colourBuffer(ctx, results.ColourSize() * count)
+	if aovs & uint32(comms.AOV_DEPTH) != 0 {
+		results.Depth = make([]float32, count, count)
+	}
+	if aovs & uint32(comms.AOV_NORMAL) != 0 {
+		results.Normal = make([]float32, 3 * count, 3 * count)
+	}
+	if aovs & uint32(comms.AOV_ALBEDO) != 0 {
+		results.Albedo = make([]float32, 3 * count, 3 * count)
+	}
+	if aovs & uint32(comms.AOV_OBJECT_ID) != 0 {
+		results.ObjectId = make([]uint32, count, count)
+	}
+	if aovs & uint32(comms.AOV_AMBIENT) != 0 {
+		results.Ambient = make([]float32, 3 * count, 3 * count)
+	}
+	if aovs & uint32(comms.AOV_DIFFUSE) != 0 {
+		results.Diffuse = make([]float32, 3 * count, 3 * count)
+	}
+	if aovs & uint32(comms.AOV_SPECULAR) != 0 {
+		results.Specular = make([]float32, 3 * count, 3 * count)
+	}
+	if aovs & uint32(comms.AOV_SHADOW) != 0 {
+		results.Shadow = make([]float32, count, count)
+	}
+	sampleOpts := tracer.SampleOptions{
+		Samples: uint(req.GetSamples()),
+		MirrorDepth: uint(req.GetMirrorDepth()),
+		PathDepth: uint(req.GetPathDepth()),
+		AreaLightSamples: uint(req.GetAreaLightSamples()),
+		Pattern: tracer.Pattern(req.GetPattern()),
+		Integrator: tracer.Integrator(req.GetIntegrator()),
+		Components: aovs & uint32(comms.AOV_AMBIENT | comms.AOV_DIFFUSE | comms.AOV_SPECULAR | comms.AOV_SHADOW) != 0,
+		Occlusion: aovs & uint32(comms.AOV_OCCLUSION) != 0,
+		Scale: uint(req.GetScale()),
+	}
+	if sampleOpts.Occlusion {
+		results.Occlusion = make([]float32, count, count)
+	}
+	
+	// Decode the mutable state for this frame, unless another of the frame's work orders already has.
+	// If the order doesn't carry the frame's diff, the frame should have been prepared already.
+	diff := &state.EnvMutables{}
+	if req.GetDiff() != nil {
+		var err error
+		if diff, err = scene.diffs.get(req.GetDiff(), scene.env); err != nil {
+			return nil, err
+		}
+	}else if req.GetFrame() != 0 {
+		var prepared bool
+		if diff, prepared = scene.diffs.frame(req.GetFrame()); !prepared {
+			return nil, status.Errorf(codes.FailedPrecondition, "Frame %d hasn't been prepared.", req.GetFrame())
+		}
+	}
+	
+	// Work out the camera math once for the whole order, on whichever screen the order's frame is drawn on.
+	screenWidth, screenHeight := int(scene.screenWidth), int(scene.screenHeight)
+	if req.GetScreenWidth() != 0 && req.GetScreenHeight() != 0 {
+		screenWidth, screenHeight = int(req.GetScreenWidth()), int(req.GetScreenHeight())
+	}
+	sampleOpts.Frame = tracer.NewFrame(diff, screenWidth, screenHeight)
+	
+	// For every pixel (or block) specified...
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			idx, traced := results.Index(xInit + i, yInit + j)
+			if !traced {
+				continue
+			}
+			
+			// Make sure the RPC hasn't been cancelled, and that its results can still make it into the frame.
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			
+			// Trace the pixel (showing the background if nothing was hit).
+			sample := t.opts.Sample(xInit + i, yInit + j, screenWidth, screenHeight, diff, sampleOpts)
+			results.SetColour(idx, sample.Colour)
+			
+			// Fill in the requested AOVs.
+			if results.Depth != nil {
+				results.Depth[idx] = float32(sample.Depth)
+			}
+			if results.Normal != nil {
+				results.Normal[3 * idx], results.Normal[3 * idx + 1], results.Normal[3 * idx + 2] = float32(sample.Normal.X), float32(sample.Normal.Y), float32(sample.Normal.Z)
+			}
+			if results.Albedo != nil {
+				putColour(results.Albedo, idx, sample.Albedo)
+			}
+			if results.ObjectId != nil {
+				results.ObjectId[idx] = uint32(sample.ObjectID)
+			}
+			if results.Ambient != nil {
+				putColour(results.Ambient, idx, sample.Ambient)
+			}
+			if results.Diffuse != nil {
+				putColour(results.Diffuse, idx, sample.Diffuse)
+			}
+			if results.Specular != nil {
+				putColour(results.Specular, idx, sample.Specular)
+			}
+			if results.Shadow != nil {
+				results.Shadow[idx] = float32(sample.Shadow)
+			}
+			if results.Occlusion != nil {
+				results.Occlusion[idx] = float32(sample.Occlusion)
+			}
+		}
+	}
+	
+	results.TraceTime = int64(time.Since(start))
+	return results, nil
+}
+
+// PrepareFrame decodes the diff of a frame ahead of its work orders, which can then refer to the frame rather than carry its diff.
+func (t *Tracer) PrepareFrame(ctx context.Context, req *comms.FrameState) (*empty.Empty, error) {
+	if req.GetFrame() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Frame zero can't be prepared.")
+	}
+	scene := t.current()
+	if err := scene.diffs.prepare(req.GetFrame(), req.GetDiff(), scene.env); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// Heartbeat keeps the worker from disconnecting from the master while it has no other requests to serve.
+// Like every other request, a heartbeat resets the tracer's idle timeout (see Serve).
+// The reply gives the session the tracer registered under, so that the master can tell whether it's still the worker it registered.
+func (t *Tracer) Heartbeat(ctx context.Context, req *empty.Empty) (*comms.HeartbeatReply, error) {
+	return &comms.HeartbeatReply{Session: t.current().session}, nil
+}
+
+// Serve serves work orders on listener until no requests come in within the tracer's idle timeout (see IdleMode).
+// If the server times out, nil is returned; otherwise the error which interrupted the server is returned.
+// Tracers on standby (or which never idle) never time out.
+// A tracer can only be served once.
+func (t *Tracer) Serve(listener net.Listener) error {
+	// Set up the worker, reusing its results' buffers and injecting faults if necessary.
+	// Every request resets the idle timeout, both when it comes in and once it has been answered, so a busy worker needn't also be sent heartbeats.
+	var faults grpc.UnaryServerInterceptor
+	if t.opts.Chaos != nil {
+		faults = t.opts.Chaos.UnaryServerInterceptor()
+	}
+	server := grpc.NewServer(grpc.StatsHandler(releaseHandler{}), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		t.timeoutReset()
+		defer t.timeoutReset()
+		
+		if faults != nil {
+			return faults(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}))
+	comms.RegisterTraceServer(server, t)
+	
+	// Spin off a goroutine which kills the trace server on the schedule set by the fault injection (if necessary).
+	killed, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	if t.opts.Chaos != nil && t.opts.Chaos.KillFrequency() > 0 {
+		go func() {
+			select{
+			case <-time.After(t.opts.Chaos.KillFrequency()):
+				log.Printf("Killing tracer by fault injection.\n")
+				close(killed)
+				server.Stop()
+			case <-done:
+			}
+		}()
+	}
+	
+	// Spin off a goroutine which acts on the tracer's idle behaviour whenever no requests come in within a timeout.
+	// Once the server stops, requests stop resetting the timeout, so that they don't wait on this goroutine.
+	go func() {
+		for {
+			var timeout <-chan time.Time
+			if t.opts.Idle != IdleNever {
+				timeout = time.After(time.Millisecond * time.Duration(t.opts.IdleTimeout))
+			}
+			
+			select{
+			case <-t.resetTraceTimeout:
+			case <-timeout:
+				// Tracers on standby keep serving, and let the worker know to register again.
+				if t.opts.Idle == IdleStandby {
+					select{
+					case t.lapsed <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				close(t.resetTraceTimeout)
+				server.GracefulStop()
+				return
+			case <-done:
+				close(t.resetTraceTimeout)
+				return
+			}
+		}
+	}()
+	
+	err := server.Serve(throttle.NewListener(listener, 0, t.opts.ResultRate))
+	select{
+	case <-killed:
+		return fmt.Errorf("Killed by fault injection.")
+	default:
+		return err
+	}
+}
\ No newline at end of file
@@ -0,0 +1,380 @@
+// Package tracer provides ray-tracing functionality shared by the distributed and sequential workers.
+package tracer
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"github.com/mwindels/distributed-raytracer/shared/colour"
+	"github.com/mwindels/distributed-raytracer/shared/state"
+	"strings"
+	"math"
+	"fmt"
+)
+
+// DefaultPathDepth is the most surfaces a path bounces off of before it is cut short, for options which don't specify it.
+const DefaultPathDepth uint = 4
+
+// emitterOffset is the distance (in metres) points picked on emitters are moved towards the points they light, so that the emitters don't block their own light.
+const emitterOffset float64 = 0.001
+
+// rouletteDepth is the number of bounces after which paths are randomly cut short (with Russian roulette) once they carry little light.
+const rouletteDepth int = 2
+
+// Integrator controls how the colour of each ray is found.
+type Integrator uint8
+
+// These constants are the possible integrators (numbered as in comms.Integrator).
+const (
+	IntegratorPhong Integrator = iota	// Each ray's nearest hit is lit directly by every light, using Phong shading.
+	IntegratorPath						// Each ray is followed as it bounces around the scene, sampling one light at each bounce.
+)
+
+// integratorNames holds the name of each integrator.
+var integratorNames = []string{"phong", "path"}
+
+// String returns the name of an integrator.
+func (i Integrator) String() string {
+	if int(i) < len(integratorNames) {
+		return integratorNames[i]
+	}
+	return fmt.Sprintf("Integrator(%d)", uint8(i))
+}
+
+// ParseIntegrator finds the integrator with some name (ignoring case).
+func ParseIntegrator(name string) (Integrator, error) {
+	for i, integratorName := range integratorNames {
+		if strings.EqualFold(name, integratorName) {
+			return Integrator(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown integrator \"%s\".", name)
+}
+
+// spectrum is an unclamped colour, used to carry light along paths.
+type spectrum struct {
+	r, g, b float64
+}
+
+// spectrumOf converts a colour into a spectrum.
+func spectrumOf(c colour.RGB) spectrum {
+	r, g, b := c.Floats()
+	return spectrum{r, g, b}
+}
+
+// add returns the sum of two spectra.
+func (s spectrum) add(t spectrum) spectrum {
+	return spectrum{s.r + t.r, s.g + t.g, s.b + t.b}
+}
+
+// mul returns the product of two spectra.
+func (s spectrum) mul(t spectrum) spectrum {
+	return spectrum{s.r * t.r, s.g * t.g, s.b * t.b}
+}
+
+// scale returns a spectrum scaled by a scalar.
+func (s spectrum) scale(f float64) spectrum {
+	return spectrum{s.r * f, s.g * f, s.b * f}
+}
+
+// luminance returns the perceived brightness of a spectrum.
+func (s spectrum) luminance() float64 {
+	return 0.2126 * s.r + 0.7152 * s.g + 0.0722 * s.b
+}
+
+// colour clamps a spectrum into a colour.
+func (s spectrum) colour() colour.RGB {
+	return colour.NewRGBFromFloats(float32(s.r), float32(s.g), float32(s.b))
+}
+
+// basis returns two directions which, along with n, form an orthonormal basis.
+func basis(n geom.Vector) (geom.Vector, geom.Vector) {
+	helper := geom.Vector{1.0, 0.0, 0.0}
+	if math.Abs(n.X) > 0.9 {
+		helper = geom.Vector{0.0, 1.0, 0.0}
+	}
+	tangent := n.Cross(helper).Norm()
+	return tangent, n.Cross(tangent)
+}
+
+// reflect reflects a direction d (pointing away from a surface) about a normal n.
+func reflect(d, n geom.Vector) geom.Vector {
+	return n.Scale(2 * d.Dot(n)).Sub(d)
+}
+
+// brdf evaluates a material's (normalised Phong) reflectance for light arriving from wi and leaving towards wo.
+func brdf(material state.Material, normal, wo, wi geom.Vector) spectrum {
+	diffuse := spectrumOf(material.Kd).scale(1.0 / math.Pi)
+	lobe := math.Pow(math.Max(reflect(wo, normal).Dot(wi), 0.0), material.Ns)
+	specular := spectrumOf(material.Highlight()).scale((material.Ns + 2.0) / (2.0 * math.Pi) * lobe)
+	return diffuse.add(specular)
+}
+
+// diffuseChance returns the probability with which a material's diffuse lobe is sampled (rather than its specular lobe).
+// The second return value is false if the material reflects no light at all.
+func diffuseChance(material state.Material) (float64, bool) {
+	kd, ks := spectrumOf(material.Kd).luminance(), spectrumOf(material.Highlight()).luminance()
+	if kd + ks <= 0.0 {
+		return 0.0, false
+	}
+	return kd / (kd + ks), true
+}
+
+// brdfPdf returns the probability density with which sampleBRDF picks the direction wi.
+func brdfPdf(material state.Material, normal, wo, wi geom.Vector) float64 {
+	chance, reflects := diffuseChance(material)
+	if !reflects {
+		return 0.0
+	}
+	
+	diffusePdf := math.Max(wi.Dot(normal), 0.0) / math.Pi
+	specularPdf := (material.Ns + 1.0) / (2.0 * math.Pi) * math.Pow(math.Max(reflect(wo, normal).Dot(wi), 0.0), material.Ns)
+	return chance * diffusePdf + (1.0 - chance) * specularPdf
+}
+
+// sampleBRDF picks a direction for light to arrive from, in proportion to (one lobe of) a material's reflectance.
+// The last return value is false if no direction could be picked.
+func sampleBRDF(material state.Material, normal, wo geom.Vector, rand *pixelRand) (geom.Vector, bool) {
+	chance, reflects := diffuseChance(material)
+	if !reflects {
+		return geom.Vector{}, false
+	}
+	
+	// Pick a lobe, then a direction around its axis.
+	axis, cosTheta := normal, 0.0
+	if u := rand.float(); u < chance {
+		cosTheta = math.Sqrt(1.0 - rand.float())
+	}else{
+		axis = reflect(wo, normal)
+		cosTheta = math.Pow(1.0 - rand.float(), 1.0 / (material.Ns + 1.0))
+	}
+	sinTheta, phi := math.Sqrt(math.Max(0.0, 1.0 - cosTheta * cosTheta)), 2.0 * math.Pi * rand.float()
+	tangent, bitangent := basis(axis)
+	wi := tangent.Scale(sinTheta * math.Cos(phi)).Add(bitangent.Scale(sinTheta * math.Sin(phi))).Add(axis.Scale(cosTheta))
+	
+	if wi.Dot(normal) <= 0.0 {
+		return geom.Vector{}, false
+	}
+	return wi, true
+}
+
+// sampleLight picks one of the scene's lights in proportion to how much light it could shine on a point with some normal, on the object with some id.
+// Lights are picked by their brightness, and lights behind the point (or switched off, or not linked to the object) are never picked.
+// In scenes with many lights, the light is picked by walking down the scene's light tree instead, which weighs whole groups of lights at once.
+// This function returns the light and the probability with which it was picked, or false if no light can shine on the point.
+func sampleLight(intersect, normal geom.Vector, id uint, env *state.EnvMutables, rand *pixelRand) (state.Light, float64, bool) {
+	if tree := env.LightTree(); tree != nil && !env.Linked(id) && len(env.Lights) > manyLights {
+		i, chance, lit := tree.Sample(intersect, normal, rand.float())
+		if !lit || chance <= 0.0 {
+			return state.Light{}, 0.0, false
+		}
+		return env.Lights[i], chance, true
+	}
+	
+	weights := make([]float64, len(env.Lights), len(env.Lights))
+	total := 0.0
+	for i, l := range env.Lights {
+		if l.Off || !env.Shines(i, id) {
+			continue
+		}
+		r, g, b := l.Power()
+		weights[i] = spectrum{r, g, b}.luminance() * math.Max(l.Pos.Sub(intersect).Norm().Dot(normal), 0.0)
+		total += weights[i]
+	}
+	if total <= 0.0 {
+		return state.Light{}, 0.0, false
+	}
+	
+	// Walk the lights until the running weight passes a random target.
+	target := rand.float() * total
+	last := 0
+	for i, w := range weights {
+		if w > 0.0 {
+			last = i
+		}
+		if target < w {
+			return env.Lights[i], w / total, true
+		}
+		target -= w
+	}
+	
+	// Rounding can carry the target just past the last light, so fall back to the last light with any weight.
+	return env.Lights[last], weights[last] / total, true
+}
+
+// emitterLight picks a point on one of the scene's emitters, in proportion to the emitters' power.
+// The point is returned as a point light which, on average, lights the point intersect as much as every emitter together does.
+// The light is moved slightly towards intersect, so that the emitter itself doesn't block it.
+// This function also returns the probability density (per unit of solid angle, as seen from intersect) with which the direction to the light was picked.
+// The last return value is false if no light could be picked.
+func emitterLight(intersect geom.Vector, env *state.EnvMutables, rand *pixelRand) (state.ClusterLight, float64, bool) {
+	e, chance, exists := env.SampleEmitter(rand.float())
+	if !exists {
+		return state.ClusterLight{}, 0.0, false
+	}
+	
+	// Pick a point on the emitter, and find how much of the emitter faces intersect.
+	u, v := rand.float(), rand.float()
+	toLight := e.Point(u, v).Sub(intersect)
+	distSquared := toLight.Dot(toLight)
+	if distSquared <= 0.0 {
+		return state.ClusterLight{}, 0.0, false
+	}
+	lightDir := toLight.Norm()
+	cosLight := math.Abs(e.Normal.Dot(lightDir))
+	if cosLight <= 0.0 {
+		return state.ClusterLight{}, 0.0, false
+	}
+	
+	// Convert the density from per unit of area to per unit of solid angle.
+	pdf := chance / e.Area * distSquared / cosLight
+	
+	// Lights' colours are scaled by pi when they reach a surface, so undo that here.
+	col := spectrumOf(e.Emission).scale(1.0 / (math.Pi * pdf))
+	return state.ClusterLight{Pos: intersect.Add(toLight).Sub(lightDir.Scale(env.Metres(emitterOffset))), R: col.r, G: col.g, B: col.b, Count: 1}, pdf, true
+}
+
+// emissionPdf returns the probability density (per unit of solid angle, as seen from the point from) with which emitterLight picks the point hit on an emitter with some emission and normal.
+func emissionPdf(from, hit, hitNormal geom.Vector, emission colour.RGB, env *state.EnvMutables) float64 {
+	toHit := hit.Sub(from)
+	cosLight := math.Abs(hitNormal.Norm().Dot(toHit.Norm()))
+	if cosLight <= 0.0 {
+		return 0.0
+	}
+	return env.EmitterDensity(emission) * toHit.Dot(toHit) / cosLight
+}
+
+// powerHeuristic weighs a sample picked with the probability density pdf, against another way of picking it with the density otherPdf (multiple importance sampling).
+func powerHeuristic(pdf, otherPdf float64) float64 {
+	if pdf <= 0.0 {
+		return 0.0
+	}
+	return pdf * pdf / (pdf * pdf + otherPdf * otherPdf)
+}
+
+// transmittance finds the fraction of each colour of light which reaches a point from a light at some position.
+// Light passes through transparent objects (tinted by their transmission), but is blocked by any opaque object, or once it has passed through maxShadowHits objects.
+// Since tinting doesn't depend on the order the light passes through objects, the shadow ray's hits are taken in any order, stopping at the first which blocks the light.
+// Objects farther from the point than the environment's maximum ray length don't block the light.
+func transmittance(intersect, lightPos geom.Vector, env *state.EnvMutables) spectrum {
+	lightDir := lightPos.Sub(intersect).Norm()
+	lightDist := math.Min(lightPos.Sub(intersect).Len(), rayLength(env))
+	
+	// Tint the light by each object between the point and the light, until one blocks it.
+	through, hits := spectrum{1.0, 1.0, 1.0}, 0
+	blocked := occluded(intersect.Add(lightDir.Scale(env.Metres(rayOffset))), lightDir, 0.0, lightDist, env, func(material state.Material) bool {
+		hits += 1
+		if material.Transmission == (colour.RGB{}) || hits >= maxShadowHits {
+			return true
+		}
+		through = through.mul(spectrumOf(material.Transmission))
+		return false
+	})
+	
+	if blocked {
+		return spectrum{}
+	}
+	return through
+}
+
+// lightPoint picks a random point on the disc a spherical light with some centre and radius looks like from a point, so that its shadows are soft.
+// Lights without a radius (or which surround the point) are always seen from their centre.
+func lightPoint(intersect, centre geom.Vector, radius float64, rand *pixelRand) geom.Vector {
+	toLight := centre.Sub(intersect)
+	if radius <= 0.0 || toLight.Len() <= radius {
+		return centre
+	}
+	
+	// Spread the points evenly over the disc's area.
+	tangent, bitangent := basis(toLight.Norm())
+	r, phi := radius * math.Sqrt(rand.float()), 2.0 * math.Pi * rand.float()
+	return centre.Add(tangent.Scale(r * math.Cos(phi))).Add(bitangent.Scale(r * math.Sin(phi)))
+}
+
+// softTransmittance finds the fraction of each colour of a (possibly spherical) light which reaches a point, averaged over samples points picked across the light by lightPoint.
+// Lights without a radius are only traced once, from their centre.
+func softTransmittance(intersect geom.Vector, l state.ClusterLight, env *state.EnvMutables, samples int, rand *pixelRand) spectrum {
+	if l.Radius <= 0.0 || samples <= 1 {
+		return transmittance(intersect, lightPoint(intersect, l.Pos, l.Radius, rand), env)
+	}
+	
+	through := spectrum{}
+	for k := 0; k < samples; k++ {
+		through = through.add(transmittance(intersect, lightPoint(intersect, l.Pos, l.Radius, rand), env))
+	}
+	return through.scale(1.0 / float64(samples))
+}
+
+// pathRadiance finds the light arriving at the camera from the first hit of a path, by following the path as it bounces around the scene.
+// At each bounce, one light and one point on an emitter are sampled explicitly (next-event estimation), and the path continues in a direction picked by the surface's reflectance.
+// Point lights can't be hit by chance, so every light they contribute arrives through the explicitly sampled lights.
+// Emitters can be hit by chance though, so their light is weighed between the two ways of finding it with multiple importance sampling.
+// Lights' colours are scaled by pi, so that directly lit diffuse surfaces are as bright as with Phong shading.
+// Each surface the path bounces off of is only lit by the lights linked to its object (see state.LightLink), whose id is passed in for the first hit.
+func pathRadiance(intersect, normal geom.Vector, material state.Material, id uint, wo geom.Vector, env *state.EnvMutables, opts SampleOptions, rand *pixelRand) spectrum {
+	radiance, throughput := spectrumOf(material.Ke), spectrum{1.0, 1.0, 1.0}
+	maxDepth := opts.pathDepth()
+	for depth := 0; depth < maxDepth; depth++ {
+		// Light both sides of each surface.
+		if normal.Dot(wo) < 0.0 {
+			normal = normal.Scale(-1.0)
+		}
+		
+		// Sample a light directly, from a random point across it (if it has a radius).
+		if l, chance, lit := sampleLight(intersect, normal, id, env, rand); lit {
+			pos := lightPoint(intersect, l.Pos, l.Radius, rand)
+			if wi := pos.Sub(intersect).Norm(); wi.Dot(normal) > 0.0 {
+				if through := transmittance(intersect, pos, env); through != (spectrum{}) {
+					r, g, b := l.Power()
+					contribution := brdf(material, normal, wo, wi).mul(spectrum{r, g, b}).mul(through).scale(math.Pi * wi.Dot(normal) / chance)
+					radiance = radiance.add(throughput.mul(contribution))
+				}
+			}
+		}
+		
+		// Sample a point on an emitter directly.
+		if l, pdf, lit := emitterLight(intersect, env, rand); lit {
+			if wi := l.Pos.Sub(intersect).Norm(); wi.Dot(normal) > 0.0 {
+				weight := powerHeuristic(pdf, brdfPdf(material, normal, wo, wi))
+				through := transmittance(intersect, l.Pos, env)
+				contribution := brdf(material, normal, wo, wi).mul(spectrum{l.R, l.G, l.B}).mul(through).scale(math.Pi * wi.Dot(normal) * weight)
+				radiance = radiance.add(throughput.mul(contribution))
+			}
+		}
+		
+		// Pick the direction the path continues in.
+		wi, reflects := sampleBRDF(material, normal, wo, rand)
+		if !reflects {
+			break
+		}
+		pdf := brdfPdf(material, normal, wo, wi)
+		if pdf <= 0.0 {
+			break
+		}
+		throughput = throughput.mul(brdf(material, normal, wo, wi).scale(wi.Dot(normal) / pdf))
+		
+		// Randomly cut short long paths which carry little light, weighting the survivors to make up for it.
+		if depth >= rouletteDepth {
+			survival := math.Min(math.Max(throughput.r, math.Max(throughput.g, throughput.b)), 0.95)
+			if rand.float() >= survival {
+				break
+			}
+			throughput = throughput.scale(1.0 / survival)
+		}
+		
+		// Follow the path to its next surface, or out to the background.
+		from := intersect
+		var hit bool
+		if intersect, normal, material, id, hit = trace(intersect.Add(wi.Scale(env.Metres(rayOffset))), wi, env); !hit {
+			radiance = radiance.add(throughput.mul(spectrumOf(env.Background.Colour(wi))))
+			break
+		}
+		wo = wi.Scale(-1.0)
+		
+		// Add the light of any emitter the path hit by chance.
+		if material.Ke != (colour.RGB{}) {
+			weight := powerHeuristic(pdf, emissionPdf(from, intersect, normal, material.Ke, env))
+			radiance = radiance.add(throughput.mul(spectrumOf(material.Ke)).scale(weight))
+		}
+	}
+	
+	return radiance
+}
\ No newline at end of file
@@ -0,0 +1,167 @@
+// Package tracer provides ray-tracing functionality shared by the distributed and sequential workers.
+package tracer
+
+import (
+	"github.com/mwindels/distributed-raytracer/shared/geom"
+	"strings"
+	"math"
+	"fmt"
+)
+
+// blueNoiseCandidates is the number of candidates considered (per point already placed) when placing each point of a blue noise pattern.
+const blueNoiseCandidates int = 8
+
+// Pattern controls where within each pixel rays are traced when supersampling.
+// Patterns which use randomness are seeded by the pixel's position, so that every worker samples a pixel in the same way.
+type Pattern uint8
+
+// These constants are the possible sampling patterns (numbered as in comms.SamplingPattern).
+const (
+	PatternGrid Pattern = iota	// Samples are placed at the centres of a regular grid of cells.
+	PatternJittered				// Samples are placed randomly within a regular grid of cells.
+	PatternHalton				// Samples follow the Halton sequence in bases 2 and 3, randomly shifted per pixel.
+	PatternSobol				// Samples follow the first two dimensions of the Sobol sequence, randomly scrambled per pixel.
+	PatternBlueNoise			// Samples are placed randomly, but as far from one another as possible.
+)
+
+// patternNames holds the name of each pattern.
+var patternNames = []string{"grid", "jittered", "halton", "sobol", "blue-noise"}
+
+// String returns the name of a pattern.
+func (p Pattern) String() string {
+	if int(p) < len(patternNames) {
+		return patternNames[p]
+	}
+	return fmt.Sprintf("Pattern(%d)", uint8(p))
+}
+
+// ParsePattern finds the pattern with some name (ignoring case).
+func ParsePattern(name string) (Pattern, error) {
+	for p, patternName := range patternNames {
+		if strings.EqualFold(name, patternName) {
+			return Pattern(p), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown sampling pattern \"%s\".", name)
+}
+
+// pixelRand is a small, fast random number generator for placing the samples of a single pixel.
+type pixelRand uint32
+
+// newPixelRand creates a random number generator seeded by the pixel (i, j).
+func newPixelRand(i, j int) pixelRand {
+	h := uint32(i) * 73856093 ^ uint32(j) * 19349663
+	h ^= h >> 16
+	h *= 0x7feb352d
+	h ^= h >> 15
+	h *= 0x846ca68b
+	h ^= h >> 16
+	return pixelRand(h | 1)
+}
+
+// newPointRand creates a random number generator seeded by a point in the scene, so that every worker which shades the point samples it in the same way.
+func newPointRand(p geom.Vector) pixelRand {
+	h := math.Float64bits(p.X) ^ math.Float64bits(p.Y) * 0x9e3779b97f4a7c15 ^ math.Float64bits(p.Z) * 0xc2b2ae3d27d4eb4f
+	return newPixelRand(int(uint32(h)), int(uint32(h >> 32)))
+}
+
+// next returns the next random 32 bit integer.
+func (r *pixelRand) next() uint32 {
+	x := uint32(*r)
+	x ^= x << 13
+	x ^= x >> 17
+	x ^= x << 5
+	*r = pixelRand(x)
+	return x
+}
+
+// float returns the next random number in the range [0, 1).
+func (r *pixelRand) float() float64 {
+	return float64(r.next()) / (1 << 32)
+}
+
+// radicalInverse mirrors the digits of n (in some base) around the decimal point, giving a number in the range [0, 1).
+func radicalInverse(n uint32, base uint32) float64 {
+	inverse, scale := 0.0, 1.0 / float64(base)
+	for f := scale; n > 0; n, f = n / base, f * scale {
+		inverse += float64(n % base) * f
+	}
+	return inverse
+}
+
+// sobol returns the nth point of the first two dimensions of the Sobol sequence, with each dimension's bits scrambled by XORing them with a mask.
+func sobol(n uint32, scrambleX, scrambleY uint32) (float64, float64) {
+	x, y := scrambleX, scrambleY
+	for v, w := uint32(1 << 31), uint32(1 << 31); n != 0; n, v, w = n >> 1, v >> 1, w ^ (w >> 1) {
+		if n & 1 != 0 {
+			x ^= v
+			y ^= w
+		}
+	}
+	return float64(x) / (1 << 32), float64(y) / (1 << 32)
+}
+
+// wrappedDistance returns the squared distance between two points in the unit square, as if its opposite edges were joined.
+// This keeps neighbouring pixels' blue noise patterns from crowding at their shared edges.
+func wrappedDistance(a, b [2]float64) float64 {
+	d := 0.0
+	for axis := 0; axis < 2; axis++ {
+		delta := math.Abs(a[axis] - b[axis])
+		delta = math.Min(delta, 1.0 - delta)
+		d += delta * delta
+	}
+	return d
+}
+
+// Offsets returns the positions (in the range [0, 1) along each axis) within the pixel (i, j) at which to trace n rays.
+func (p Pattern) Offsets(n, i, j int) [][2]float64 {
+	offsets := make([][2]float64, n, n)
+	rand := newPixelRand(i, j)
+	
+	switch p {
+	case PatternJittered, PatternGrid:
+		// Split the pixel into a grid with at least n cells, then place one sample in each of the first n cells.
+		columns := int(math.Ceil(math.Sqrt(float64(n))))
+		rows := (n + columns - 1) / columns
+		for k := 0; k < n; k++ {
+			u, v := 0.5, 0.5
+			if p == PatternJittered {
+				u, v = rand.float(), rand.float()
+			}
+			offsets[k] = [2]float64{(float64(k % columns) + u) / float64(columns), (float64(k / columns) + v) / float64(rows)}
+		}
+	case PatternHalton:
+		shiftX, shiftY := rand.float(), rand.float()
+		for k := 0; k < n; k++ {
+			x, y := radicalInverse(uint32(k), 2) + shiftX, radicalInverse(uint32(k), 3) + shiftY
+			offsets[k] = [2]float64{x - math.Floor(x), y - math.Floor(y)}
+		}
+	case PatternSobol:
+		scrambleX, scrambleY := rand.next(), rand.next()
+		for k := 0; k < n; k++ {
+			offsets[k][0], offsets[k][1] = sobol(uint32(k), scrambleX, scrambleY)
+		}
+	case PatternBlueNoise:
+		// Place each sample at the best of several random candidates, i.e. the one furthest from every sample placed so far.
+		for k := 0; k < n; k++ {
+			best, bestDistance := [2]float64{rand.float(), rand.float()}, -1.0
+			for c := 0; k > 0 && c < k * blueNoiseCandidates; c++ {
+				candidate := [2]float64{rand.float(), rand.float()}
+				nearest := math.Inf(1)
+				for _, placed := range offsets[:k] {
+					nearest = math.Min(nearest, wrappedDistance(candidate, placed))
+				}
+				if nearest > bestDistance {
+					best, bestDistance = candidate, nearest
+				}
+			}
+			offsets[k] = best
+		}
+	default:
+		for k := 0; k < n; k++ {
+			offsets[k] = [2]float64{0.5, 0.5}
+		}
+	}
+	
+	return offsets
+}
\ No newline at end of file
@@ -5,87 +5,487 @@ import (
 	"github.com/mwindels/distributed-raytracer/shared/geom"
 	"github.com/mwindels/distributed-raytracer/shared/colour"
 	"github.com/mwindels/distributed-raytracer/shared/state"
-	"github.com/mwindels/rtreego"
 	"math"
 )
 
-// pixelToPoint translates a pixel value (i, j) to a point on a projection plane in 3D space.
-// This function assumes that the projection plane is exactly one unit away from the camera.
-// The parameters i and j must be in the range [0, width) and [0, height) respectively.
-func pixelToPoint(i, j, width, height int, cam state.Camera) geom.Vector {
-	halfWidth, halfHeight := width / 2, height / 2
-	projHalfWidth := math.Tan(cam.Fov / 2.0)
-	projHalfHeight := projHalfWidth * float64(height) / float64(width)
-	iOffset := cam.Left().Scale(projHalfWidth * (float64(halfWidth - i) - 0.5) / float64(halfWidth))
-	jOffset := cam.Up().Scale(projHalfHeight * (float64(halfHeight - j) - 0.5) / float64(halfHeight))
-	return cam.Pos.Add(cam.Forward()).Add(iOffset).Add(jOffset)
+// occlusionSamples is the number of rays cast to find the ambient occlusion of a point.
+const occlusionSamples int = 16
+
+// occlusionRadius is the distance (in metres) within which objects occlude a point.
+const occlusionRadius float64 = 1.0
+
+// rayOffset is the distance (in metres) a ray starts away from the surface it leaves, so that it doesn't hit that surface again.
+const rayOffset float64 = 0.0001
+
+// manyLights is the number of lights above which points are shaded by a cut through the scene's light tree, rather than by every light.
+const manyLights int = 16
+
+// lightCutAngle is the largest angle (in radians) a group of lights may cover, as seen from a point, to be shaded as a single light.
+const lightCutAngle float64 = 0.1
+
+// maxShadowHits is the most transparent objects a shadow ray passes through before the light is considered blocked.
+const maxShadowHits int = 8
+
+// DefaultMirrorDepth is the most reflections and refractions a ray goes through when using Phong shading, for options which don't specify it.
+const DefaultMirrorDepth uint = 4
+
+// DefaultAreaLightSamples is the number of points on the scene's emitters which light each point when using Phong shading, for options which don't specify it.
+const DefaultAreaLightSamples uint = 16
+
+// goldenAngle is the angle (in radians) between consecutive ambient occlusion rays around the spiral.
+var goldenAngle float64 = math.Pi * (3.0 - math.Sqrt(5.0))
+
+// rayLength returns the farthest a shading or shadow ray looks for objects in an environment.
+func rayLength(env *state.EnvMutables) float64 {
+	if env.MaxRayLength > 0.0 {
+		return env.MaxRayLength
+	}
+	return math.Inf(1)
 }
 
-// trace traces a single ray with a position and a direction.
-// This function returns the nearest intersection point, and an associated normal vector and material.
+// trace traces a single shading or shadow ray with a position and a (normalized) direction, looking no farther than the environment's maximum ray length.
+// This function returns the nearest intersection point, and an associated normal vector, material, and object id.
 // The last return value is whether an intersection exists.
-func trace(rOrigin, rDir geom.Vector, env *state.EnvMutables) (geom.Vector, geom.Vector, state.Material, bool) {
+func trace(rOrigin, rDir geom.Vector, env *state.EnvMutables) (geom.Vector, geom.Vector, state.Material, uint, bool) {
+	return traceWithin(rOrigin, rDir, 0.0, rayLength(env), env)
+}
+
+// traceWithin traces a single ray with a position and a (normalized) direction, just as trace does, but only finds intersections between near and far away from the ray's origin.
+// Once an intersection has been found, the rest of the objects are only searched up to it, so that faces behind it aren't tested.
+func traceWithin(rOrigin, rDir geom.Vector, near, far float64, env *state.EnvMutables) (geom.Vector, geom.Vector, state.Material, uint, bool) {
 	nearestExists := false
 	var nearestDistance float64
 	var nearestIntersect, nearestNormal geom.Vector
 	var nearestMaterial state.Material
-	for _, s := range env.Objs.SearchCondition(func(nbb *rtreego.Rect) bool {return geom.NewBox(nbb).Intersect(rOrigin, rDir)}) {
-		// Convert the rtreego.Spatial s to an object.
-		o := s.(*state.Object)
-		
-		// Check if the ray intersects this object.
-		if intersect, normal, material, hit := o.Intersection(rOrigin, rDir); hit {
-			intersectDistance := intersect.Sub(env.Cam.Pos).Len()
+	var nearestID uint
+	env.TraceObjects(rOrigin, rDir, far, func(o *state.Object) (float64, bool) {
+		// Check if the ray intersects this object before the nearest intersection so far.
+		limit := far
+		if nearestExists {
+			limit = nearestDistance
+		}
+		if intersect, normal, material, hit := o.IntersectionWithin(rOrigin, rDir, near, limit); hit {
+			intersectDistance := intersect.Sub(rOrigin).Len()
 			if !nearestExists || intersectDistance < nearestDistance {
 				nearestExists = true
 				nearestDistance = intersectDistance
 				nearestIntersect = intersect
 				nearestNormal = normal
 				nearestMaterial = material
+				nearestID = o.ID()
 			}
 		}
+		
+		// Objects beyond the nearest intersection so far needn't be searched.
+		if nearestExists {
+			return nearestDistance, false
+		}
+		return far, false
+	})
+	
+	return nearestIntersect, nearestNormal, nearestMaterial, nearestID, nearestExists
+}
+
+// occluded looks for objects a single ray with a position and a (normalized) direction hits between near and far away from its origin, in no particular order.
+// The material at each hit is passed to hit, and the search stops at the first hit for which hit returns true, so that shadow rays needn't find the nearest hit.
+// The return value is whether hit returned true.
+func occluded(rOrigin, rDir geom.Vector, near, far float64, env *state.EnvMutables, hit func(state.Material) bool) bool {
+	return env.TraceObjects(rOrigin, rDir, far, func(o *state.Object) (float64, bool) {
+		return far, o.AnyIntersectionWithin(rOrigin, rDir, near, far, hit)
+	})
+}
+
+// blocks is a hit function for occluded which stops at any object.
+func blocks(material state.Material) bool {
+	return true
+}
+
+// lighting holds the components of the light reflected from a point, as found by Phong shading.
+type lighting struct {
+	ambient, diffuse, specular colour.RGB
+	shadow float64	// The fraction of lights which were blocked from the point (lights behind transparent objects count as partly blocked).
+}
+
+// lightsAt returns the lights which shade a point with some normal, on the object with some id.
+// In scenes with many lights, the lights are taken from a cut through the scene's light tree, so distant groups of lights are shaded as one and lights behind the point are skipped.
+// Objects with light links are shaded by each of their lights on its own instead, since a group of lights may hold some which don't shine on them.
+func lightsAt(intersect, normal geom.Vector, id uint, env *state.EnvMutables) []state.ClusterLight {
+	linked := env.Linked(id)
+	if tree := env.LightTree(); tree != nil && !linked && len(env.Lights) > manyLights {
+		return tree.Cut(intersect, normal, lightCutAngle)
+	}else if tree != nil && !linked {
+		return tree.All()
 	}
 	
-	return nearestIntersect, nearestNormal, nearestMaterial, nearestExists
+	lights := make([]state.ClusterLight, 0, len(env.Lights))
+	for i, l := range env.Lights {
+		if l.Off || !env.Shines(i, id) {
+			continue
+		}
+		r, g, b := l.Power()
+		lights = append(lights, state.ClusterLight{Pos: l.Pos, R: r, G: g, B: b, Count: 1, Radius: l.Radius})
+	}
+	return lights
 }
 
-// phong calculates the colour of a point using Phong shading.
-func phong(intersect, normal geom.Vector, material state.Material, env *state.EnvMutables) colour.RGB {
-	// Start by adding the ambient lighting.
-	// Note: this should be multiplied by some global ambient intensity.
-	colour := material.Ka
+// addLight adds the diffuse and specular lighting from a single light to the light reflected from a point, tinted by whatever the light passes through to reach the point.
+// The return value is the fraction of the light which reaches the point (averaged over its colours).
+// The direction from the point back to the camera is passed in as camDir, since it's the same for every light.
+// Lights with a radius are traced from samples points across them (see softTransmittance), picked with rand.
+func (lit *lighting) addLight(intersect, normal, camDir geom.Vector, material state.Material, l state.ClusterLight, env *state.EnvMutables, samples int, rand *pixelRand) float64 {
+	// Make sure the object is not in shadow.
+	through := softTransmittance(intersect, l, env, samples, rand)
+	if through == (spectrum{}) {
+		return 0.0
+	}
+	
+	// The highlight of a light with a radius comes from the point on it closest to the camera's reflection, so bigger lights leave wider highlights.
+	lightDir := l.Pos.Sub(intersect).Norm()
+	specDir := lightDir
+	if l.Radius > 0.0 {
+		toLight, viewDir := l.Pos.Sub(intersect), reflect(camDir, normal)
+		toView := viewDir.Scale(toLight.Dot(viewDir)).Sub(toLight)
+		if dist := toView.Len(); dist > 0.0 {
+			specDir = toLight.Add(toView.Scale(math.Min(l.Radius / dist, 1.0))).Norm()
+		}
+	}
+	reflectDir := normal.Scale(2 * specDir.Dot(normal)).Sub(specDir)
+	col := spectrum{l.R, l.G, l.B}.mul(through)
+	
+	// Add diffuse lighting for light l.
+	lit.diffuse = lit.diffuse.Add(spectrumOf(material.Kd).scale(math.Max(lightDir.Dot(normal), 0.0)).mul(col).colour())
+	
+	// Add specular lighting for light l.
+	lit.specular = lit.specular.Add(spectrumOf(material.Highlight()).scale(math.Pow(math.Max(reflectDir.Dot(camDir), 0.0), material.Ns)).mul(col).colour())
+	return (through.r + through.g + through.b) / 3.0
+}
+
+// shade calculates the components of the light reflected from a point on the object with some id using Phong shading.
+func shade(intersect, normal geom.Vector, material state.Material, id uint, env *state.EnvMutables, opts SampleOptions) lighting {
+	// Start with the ambient lighting, scaled by the environment's global ambient light.
+	// Emissive surfaces glow regardless of the lights around them, so their emission is counted as ambient light.
+	lit := lighting{ambient: material.Ka.Multiply(env.Ambient).Add(material.Ke)}
+	
+	// Materials which aren't lit are drawn in their diffuse colour.
+	if !material.Lit() {
+		lit.diffuse = material.Kd
+		return lit
+	}
 	
 	// For every light, add the diffuse and specular lighting.
 	// Note: the diffuse and specular intensities of a light are considered the same.
-	for _, l := range env.Lights {
-		lightDir := l.Pos.Sub(intersect).Norm()
+	lights := lightsAt(intersect, normal, id, env)
+	shaded, total := 0.0, float64(env.LightsOn())
+	if env.Linked(id) {
+		// Only the lights which shine on the object count towards its shadow.
+		total = float64(len(lights))
+	}
+	camDir := env.Cam.Pos.Sub(intersect).Norm()
+	rand := newPointRand(intersect)
+	samples := opts.areaLightSamples()
+	for _, l := range lights {
+		shaded += float64(l.Count) * (1.0 - lit.addLight(intersect, normal, camDir, material, l, env, samples, &rand))
+	}
+	
+	// Treat every emitter together as one more light, lit by a fixed number of points spread over the emitters.
+	if len(env.Emitters()) > 0 {
+		for k := 0; k < samples; k++ {
+			if l, _, lights := emitterLight(intersect, env, &rand); lights {
+				l.R, l.G, l.B = l.R / float64(samples), l.G / float64(samples), l.B / float64(samples)
+				shaded += (1.0 - lit.addLight(intersect, normal, camDir, material, l, env, 1, &rand)) / float64(samples)
+			}
+		}
+		total += 1.0
+	}
+	
+	if total > 0.0 {
+		lit.shadow = shaded / total
+	}
+	
+	return lit
+}
+
+// occlusion calculates the fraction of the hemisphere above a point which is not blocked by any object within occlusionRadius.
+// The hemisphere is sampled along a fixed spiral of directions, so that every worker finds the same occlusion for the same point.
+func occlusion(intersect, normal geom.Vector, env *state.EnvMutables) float64 {
+	// Find two directions perpendicular to the normal.
+	tangent, bitangent := basis(normal)
+	
+	// Cast rays along a cosine-weighted spiral over the hemisphere.
+	open := 0
+	for k := 0; k < occlusionSamples; k++ {
+		r := math.Sqrt((float64(k) + 0.5) / float64(occlusionSamples))
+		phi := float64(k) * goldenAngle
+		dir := tangent.Scale(r * math.Cos(phi)).Add(bitangent.Scale(r * math.Sin(phi))).Add(normal.Scale(math.Sqrt(1.0 - r * r)))
+		
+		if !occluded(intersect.Add(dir.Scale(env.Metres(rayOffset))), dir, 0.0, math.Min(env.Metres(occlusionRadius), rayLength(env)), env, blocks) {
+			open += 1
+		}
+	}
+	
+	return float64(open) / float64(occlusionSamples)
+}
+
+// refract bends a direction d (pointing towards a surface) as it passes through a surface with normal n (pointing against d), from a medium with index of refraction n1 into one with index n2.
+// The second return value is false if the direction is totally internally reflected instead.
+func refract(d, n geom.Vector, n1, n2 float64) (geom.Vector, bool) {
+	ratio := n1 / n2
+	cosI := -d.Dot(n)
+	sinT2 := ratio * ratio * (1.0 - cosI * cosI)
+	if sinT2 > 1.0 {
+		return geom.Vector{}, false
+	}
+	return d.Scale(ratio).Add(n.Scale(ratio * cosI - math.Sqrt(1.0 - sinT2))).Norm(), true
+}
+
+// schlick approximates the fraction of light reflected by a surface (the Fresnel factor) for light arriving at some angle, from a medium with index of refraction n1 to one with index n2.
+func schlick(cosI, n1, n2 float64) float64 {
+	r0 := (n1 - n2) / (n1 + n2)
+	r0 *= r0
+	return r0 + (1.0 - r0) * math.Pow(1.0 - cosI, 5.0)
+}
+
+// phongRadiance traces a ray, finding the light arriving along it with Phong shading.
+// The parameter depth is the number of reflections and refractions the ray has already gone through.
+func phongRadiance(rOrigin, rDir geom.Vector, env *state.EnvMutables, opts SampleOptions, depth int) spectrum {
+	intersect, normal, material, id, hit := trace(rOrigin, rDir, env)
+	if !hit {
+		return spectrumOf(env.Background.Colour(rDir))
+	}
+	return surfaceRadiance(shade(intersect, normal, material, id, env, opts), intersect, normal, material, rDir, env, opts, depth)
+}
+
+// surfaceRadiance finds the light leaving a point towards a ray travelling in direction rDir, given the point's Phong shading.
+// Reflective materials add what they mirror to their shading, and transparent materials blend their shading with what shows through them, following at most the options' mirror depth of reflections and refractions.
+func surfaceRadiance(lit lighting, intersect, normal geom.Vector, material state.Material, rDir geom.Vector, env *state.EnvMutables, opts SampleOptions, depth int) spectrum {
+	radiance := spectrumOf(lit.ambient).add(spectrumOf(lit.diffuse)).add(spectrumOf(lit.specular))
+	if depth >= opts.mirrorDepth() || !material.Lit() {
+		return radiance
+	}
+	
+	// Find which way the surface faces the ray, and the indices of refraction on either side of it.
+	facing, n1, n2 := normal, 1.0, material.Ni
+	if n2 <= 0.0 {
+		n2 = 1.0
+	}
+	if rDir.Dot(normal) > 0.0 {
+		facing, n1, n2 = normal.Scale(-1.0), n2, n1
+	}
+	cosI := math.Min(-rDir.Dot(facing), 1.0)
+	
+	// Find how much light is reflected and transmitted.
+	reflectance := spectrum{}
+	if material.Reflective() {
+		reflectance = spectrumOf(material.Highlight())
+		if material.Fresnel() {
+			reflectance = reflectance.scale(schlick(cosI, n1, n2))
+		}
+	}
+	through := spectrumOf(material.Transmission)
+	
+	// Blend in the light passing through the surface, which is bent if the material is refractive.
+	// Light which can't leave the surface (total internal reflection) is reflected instead.
+	if through != (spectrum{}) {
+		tDir, transmits := rDir, true
+		if material.Refractive() {
+			tDir, transmits = refract(rDir, facing, n1, n2)
+		}
+		if transmits {
+			behind := phongRadiance(intersect.Add(tDir.Scale(env.Metres(rayOffset))), tDir, env, opts, depth + 1)
+			radiance = radiance.mul(spectrum{1.0 - through.r, 1.0 - through.g, 1.0 - through.b}).add(behind.mul(through))
+		}else{
+			reflectance = reflectance.add(through)
+		}
+	}
+	
+	// Add the light mirrored by the surface.
+	if reflectance != (spectrum{}) {
+		mDir := reflect(rDir.Scale(-1.0), facing)
+		radiance = radiance.add(phongRadiance(intersect.Add(mDir.Scale(env.Metres(rayOffset))), mDir, env, opts, depth + 1).mul(reflectance))
+	}
+	
+	return radiance
+}
+
+// Sample holds everything found by tracing a single ray through a pixel.
+type Sample struct {
+	Colour colour.RGB	// The shaded colour of the nearest object hit (or the background, if nothing was hit).
+	Depth float64		// The distance along the ray to the nearest object hit (infinite if nothing was hit).
+	Normal geom.Vector	// The normal vector at the point hit.
+	Albedo colour.RGB	// The diffuse colour of the material at the point hit.
+	ObjectID uint		// The id of the object hit (zero if nothing was hit).
+	Ambient colour.RGB	// The ambient component of the shaded colour.
+	Diffuse colour.RGB	// The diffuse component of the shaded colour.
+	Specular colour.RGB	// The specular component of the shaded colour.
+	Shadow float64		// The fraction of lights blocked from the point hit.
+	Occlusion float64	// The fraction of the hemisphere above the point hit which is open (only found if asked for).
+	Hit bool			// Whether anything was hit.
+}
+
+// SampleOptions controls how each pixel is sampled.
+type SampleOptions struct {
+	Samples uint			// The number of rays traced through each pixel (one if zero).
+	MirrorDepth uint		// The most reflections and refractions a ray goes through when using Phong shading (DefaultMirrorDepth if zero).
+	PathDepth uint			// The most surfaces a path bounces off of when path tracing (DefaultPathDepth if zero).
+	AreaLightSamples uint	// The number of points on the scene's emitters which light each point when using Phong shading (DefaultAreaLightSamples if zero).
+	Pattern Pattern			// Where within each pixel the rays are traced.
+	Integrator Integrator	// How the colour of each ray is found.
+	Components bool			// Whether to find the components of each ray's Phong shading, even when using another integrator.
+	Occlusion bool			// Whether to find ambient occlusion, which is costly.
+	Scale uint				// The width and height (in pixels) of the blocks traced in place of pixels (one if zero).
+	Frame *Frame			// The camera math shared by every pixel, which must have been made for the same scene and screen (worked out for each pixel if nil).
+}
+
+// mirrorDepth returns the most reflections and refractions a ray goes through when using Phong shading.
+func (opts SampleOptions) mirrorDepth() int {
+	if opts.MirrorDepth == 0 {
+		return int(DefaultMirrorDepth)
+	}
+	return int(opts.MirrorDepth)
+}
+
+// pathDepth returns the most surfaces a path bounces off of when path tracing.
+func (opts SampleOptions) pathDepth() int {
+	if opts.PathDepth == 0 {
+		return int(DefaultPathDepth)
+	}
+	return int(opts.PathDepth)
+}
+
+// areaLightSamples returns the number of points on the scene's emitters which light each point when using Phong shading.
+func (opts SampleOptions) areaLightSamples() int {
+	if opts.AreaLightSamples == 0 {
+		return int(DefaultAreaLightSamples)
+	}
+	return int(opts.AreaLightSamples)
+}
+
+// Frame holds the camera math shared by every pixel traced on the same screen with the same camera, so that it needn't be worked out again for each pixel.
+// Callers tracing many pixels (such as a work order's worth) should make a frame once, and pass it to TraceSample through its options.
+type Frame struct {
+	eye geom.Vector					// The camera's position, from which every ray is traced.
+	projection state.Projection		// Maps positions on the screen to points on the camera's projection plane.
+}
+
+// NewFrame works out the camera math for tracing a scene on a width by height screen.
+func NewFrame(env *state.EnvMutables, width, height int) *Frame {
+	return &Frame{eye: env.Cam.Pos, projection: env.Cam.Projection(width, height)}
+}
+
+// Blocks finds the blocks of scale by scale pixels which cover an area of a screen, with its top left corner at the pixel (x, y).
+// Blocks are aligned to the screen rather than the area, so that neighbouring areas trace the same blocks along their shared edges.
+// This function returns the column and row of the area's top left block, and the number of columns and rows of blocks covering the area.
+func Blocks(x, y, width, height, scale int) (int, int, int, int) {
+	if scale < 1 {
+		scale = 1
+	}
+	if width <= 0 || height <= 0 {
+		return x / scale, y / scale, 0, 0
+	}
+	
+	left, top := x / scale, y / scale
+	return left, top, (x + width - 1) / scale - left + 1, (y + height - 1) / scale - top + 1
+}
+
+// Checkered returns whether the pixel (or block) (i, j) is traced in a checkerboard with some parity.
+// A parity of one traces the pixels whose column and row add up to an even number, a parity of two traces the rest, and a parity of zero traces every pixel.
+func Checkered(i, j int, parity uint) bool {
+	return parity == 0 || uint((i + j) % 2) == parity - 1
+}
+
+// CheckeredCount returns the number of pixels (or blocks) traced in a checkerboard with some parity, within the area with its top left corner at (x, y).
+func CheckeredCount(x, y, width, height int, parity uint) int {
+	count := 0
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			if Checkered(x + i, y + j, parity) {
+				count += 1
+			}
+		}
+	}
+	return count
+}
+
+// traceRay traces a single ray from the camera (at eye) through a point on its projection plane, returning everything found along the way.
+// Random numbers (used by some integrators) are drawn from rand.
+func traceRay(eye, screenIntersect geom.Vector, env *state.EnvMutables, opts SampleOptions, rand *pixelRand) Sample {
+	// Only objects between the camera's clipping distances are seen.
+	rDir := screenIntersect.Sub(eye).Norm()
+	near, far := env.Cam.Clip(rDir)
+	intersect, normal, material, id, valid := traceWithin(eye, rDir, near, far, env)
+	if !valid {
+		return Sample{Colour: env.Background.Colour(rDir), Depth: math.Inf(1)}
+	}
+	
+	// Fill in the sample.
+	s := Sample{
+		Depth: intersect.Sub(eye).Len(),
+		Normal: normal,
+		Albedo: material.Kd,
+		ObjectID: id,
+		Hit: true,
+	}
+	if opts.Integrator == IntegratorPhong || opts.Components {
+		lit := shade(intersect, normal, material, id, env, opts)
+		s.Colour = surfaceRadiance(lit, intersect, normal, material, rDir, env, opts, 0).colour()
+		s.Ambient, s.Diffuse, s.Specular, s.Shadow = lit.ambient, lit.diffuse, lit.specular, lit.shadow
+	}
+	if opts.Integrator == IntegratorPath {
+		s.Colour = pathRadiance(intersect, normal, material, id, rDir.Scale(-1.0), env, opts, rand).colour()
+	}
+	if opts.Occlusion {
+		s.Occlusion = occlusion(intersect, normal, env)
+	}
+	return s
+}
+
+// TraceSample traces rays through the pixel (i, j) and into a scene, returning everything found along the way.
+// When several rays are traced, the colours, shadows, and occlusions are averaged, while the depth, normal, albedo, and object id come from the first ray which hit anything.
+// If the options' scale is more than one, (i, j) is a block of pixels (see Blocks) instead, and the rays are spread over the whole block.
+// The parameters i and j must be in the ranges [0, width) and [0, height) respectively (once scaled).
+func TraceSample(i, j, width, height int, env *state.EnvMutables, opts SampleOptions) Sample {
+	n := int(opts.Samples)
+	if n < 1 {
+		n = 1
+	}
+	frame := opts.Frame
+	if frame == nil {
+		frame = NewFrame(env, width, height)
+	}
+	scale := math.Max(float64(opts.Scale), 1.0)
+	offsets := opts.Pattern.Offsets(n, i, j)
+	rand := newPixelRand(i, j)
+	if n == 1 {
+		return traceRay(frame.eye, frame.projection.Point((float64(i) + offsets[0][0]) * scale, (float64(j) + offsets[0][1]) * scale), env, opts, &rand)
+	}
+	
+	// Trace a ray through each offset within the pixel, and combine the results.
+	result := Sample{Depth: math.Inf(1)}
+	var colours, ambients, diffuses, speculars spectrum
+	for _, offset := range offsets {
+		s := traceRay(frame.eye, frame.projection.Point((float64(i) + offset[0]) * scale, (float64(j) + offset[1]) * scale), env, opts, &rand)
+		colours = colours.add(spectrumOf(s.Colour))
+		ambients = ambients.add(spectrumOf(s.Ambient))
+		diffuses = diffuses.add(spectrumOf(s.Diffuse))
+		speculars = speculars.add(spectrumOf(s.Specular))
+		result.Shadow += s.Shadow / float64(n)
+		result.Occlusion += s.Occlusion / float64(n)
 		
-		// Make sure the object is not in shadow.
-		if shadeIntersect, _, _, shaded := trace(intersect.Add(lightDir.Scale(0.0001)), lightDir, env); !shaded || l.Pos.Sub(intersect).Len() < shadeIntersect.Sub(intersect).Len() {
-			reflectDir := normal.Scale(2 * lightDir.Dot(normal)).Sub(lightDir)
-			camDir := env.Cam.Pos.Sub(intersect).Norm()
-			
-			// Add diffuse lighting for light l.
-			colour = colour.Add(material.Kd.Scale(math.Max(lightDir.Dot(normal), 0.0)).Multiply(l.Col))
-			
-			// Add specular lighting for light l.
-			colour = colour.Add(material.Ks.Scale(math.Pow(math.Max(reflectDir.Dot(camDir), 0.0), material.Ns)).Multiply(l.Col))
+		if s.Hit && !result.Hit {
+			result.Depth, result.Normal, result.Albedo, result.ObjectID, result.Hit = s.Depth, s.Normal, s.Albedo, s.ObjectID, true
 		}
 	}
+	result.Colour = colours.scale(1.0 / float64(n)).colour()
+	result.Ambient = ambients.scale(1.0 / float64(n)).colour()
+	result.Diffuse = diffuses.scale(1.0 / float64(n)).colour()
+	result.Specular = speculars.scale(1.0 / float64(n)).colour()
 	
-	return colour
+	return result
 }
 
 // Trace traces a single ray through the pixel (i, j) and into a scene.
 // The parameters i and j must be in the ranges [0, width) and [0, height) respectively.
 func Trace(i, j, width, height int, env *state.EnvMutables) (colour.RGB, bool) {
-	// Find the centre of the pixel (i, j) on the projection plane.
-	screenIntersect := pixelToPoint(i, j, width, height, env.Cam)
-	
-	// If an object was hit, return a colour.
-	if intersect, normal, material, valid := trace(env.Cam.Pos, screenIntersect.Sub(env.Cam.Pos).Norm(), env); valid {
-		return phong(intersect, normal, material, env), true
-	}else{
-		return colour.RGB{}, false
-	}
+	s := TraceSample(i, j, width, height, env, SampleOptions{})
+	return s.Colour, s.Hit
 }
\ No newline at end of file